@@ -108,6 +108,12 @@ def ensure_vector_index() -> None:
             "CREATE INDEX IF NOT EXISTS idx_textbook_exercises_concept_tags "
             "ON textbook_exercises USING gin (concept_tags)"
         )
+        # 教材新版本先解析进 staging 表，web 服务在解析完成后一次性切换到正式表。
+        # LIKE ... INCLUDING DEFAULTS 沿用正式表的 id 序列，切换时题目 id 可原样保留
+        for table in ("textbook_chunks", "textbook_exercises"):
+            cur.execute(f"CREATE TABLE IF NOT EXISTS {table}_staging (LIKE {table} INCLUDING DEFAULTS)")
+            cur.execute(f"ALTER TABLE {table}_staging ADD COLUMN IF NOT EXISTS version_id INTEGER")
+            cur.execute(f"CREATE INDEX IF NOT EXISTS idx_{table}_staging_version ON {table}_staging (version_id)")
         cur.execute(
             """
             CREATE TABLE IF NOT EXISTS model_usage_daily (
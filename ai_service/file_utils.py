@@ -54,6 +54,89 @@ def _ocr_pdf_with_vision(doc) -> str:
     return "\n\n".join(pages_out)
 
 
+class UnsupportedFileError(ValueError):
+    """上传文件无法按页识别（类型不支持或 PDF 损坏）。"""
+
+
+def estimate_ocr_confidence(text: str) -> float:
+    """估计一页识别结果的可信度（0-1）。
+
+    视觉模型不返回置信度，这里按启发式规则估计：空结果为 0，乱码字符、
+    公式定界符不成对、文字过短都会扣分。前端据此提示学生重点核对哪几页。
+    """
+    stripped = (text or "").strip()
+    if not stripped or stripped == "[空白]":
+        return 0.0
+    score = 1.0
+    garbled = stripped.count("\ufffd") + stripped.count("□")
+    score -= min(0.5, garbled / max(len(stripped), 1) * 10)
+    if stripped.count("$") % 2 == 1:
+        score -= 0.2
+    if stripped.count("\\(") != stripped.count("\\)") or stripped.count("\\[") != stripped.count("\\]"):
+        score -= 0.1
+    if len(stripped) < 10:
+        score -= 0.3
+    return round(max(score, 0.05), 2)
+
+
+def _vision_page(data_url: str) -> dict:
+    try:
+        text = _ocr_image_data_url(data_url)
+    except APIError as exc:
+        return {"text": "", "confidence": 0.0, "method": "vision", "error": f"Error from AI service: {exc.message}"}
+    except Exception as exc:
+        return {"text": "", "confidence": 0.0, "method": "vision", "error": str(exc)}
+    return {"text": text, "confidence": estimate_ocr_confidence(text), "method": "vision"}
+
+
+def extract_pages_from_file(file: UploadFile, use_vision: bool = False) -> list[dict]:
+    """按页识别一个上传文件，返回 [{page, text, confidence, method, error?}]。
+
+    图片算一页；PDF 逐页处理：use_vision=True 时渲染成图片走视觉 OCR（最多
+    _VISION_PDF_MAX_PAGES 页），否则抽取文字层（文字层为空的页置信度为 0，提示改用视觉识别）。
+    单页失败只标记该页，不影响其它页。
+    """
+    mime_type = file.content_type if file.content_type else ""
+    content = file.file.read()
+    file.file.seek(0)
+
+    if "pdf" in mime_type:
+        try:
+            doc = pymupdf.open(stream=content, filetype="pdf")
+        except Exception as exc:
+            raise UnsupportedFileError(f"Error extracting PDF text: {exc}") from exc
+        pages = []
+        for idx in range(len(doc)):
+            if not use_vision:
+                text = doc[idx].get_text().strip()
+                pages.append({"page": idx + 1, "text": text, "confidence": 1.0 if text else 0.0, "method": "text_layer"})
+                continue
+            if idx >= _VISION_PDF_MAX_PAGES:
+                pages.append({
+                    "page": idx + 1, "text": "", "confidence": 0.0, "method": "vision",
+                    "error": f"超过 {_VISION_PDF_MAX_PAGES} 页，未识别",
+                })
+                continue
+            try:
+                pix = doc[idx].get_pixmap(dpi=_VISION_PDF_DPI)
+            except Exception as exc:
+                logger.error("Rendering PDF page %d failed: %s", idx + 1, exc)
+                pages.append({"page": idx + 1, "text": "", "confidence": 0.0, "method": "vision", "error": str(exc)})
+                continue
+            data_url = "data:image/png;base64," + base64.b64encode(pix.tobytes("png")).decode("utf-8")
+            pages.append({"page": idx + 1, **_vision_page(data_url)})
+        return pages
+
+    if "text" in mime_type:
+        text = content.decode("utf-8", errors="replace")
+        return [{"page": 1, "text": text, "confidence": 1.0, "method": "plain"}]
+
+    if "image" in mime_type:
+        return [{"page": 1, **_vision_page(file_to_base64(file))}]
+
+    raise UnsupportedFileError(f"Unsupported file type: {mime_type or 'unknown'}")
+
+
 def extract_text_from_file(file: UploadFile, use_vision: bool = False) -> str:
     """从上传文件提取文本。
 
@@ -91,3 +174,32 @@ def extract_text_from_file(file: UploadFile, use_vision: bool = False) -> str:
             return f"An unexpected error occurred: {exc}"
 
     return "Unsupported file type."
+
+
+_PAGE_RENDER_DPI = 150
+
+
+def render_pdf_page(path: str, page_num: int, fmt: str = "png") -> bytes:
+    """把本地 PDF 的第 page_num 页（从 1 开始）渲染成 PNG，或抽成只含该页的 PDF。
+
+    文件无法打开、页码越界或格式不支持时抛 UnsupportedFileError。
+    """
+    if fmt not in ("png", "pdf"):
+        raise UnsupportedFileError(f"Unsupported page format: {fmt}")
+    try:
+        doc = pymupdf.open(path)
+    except Exception as exc:
+        raise UnsupportedFileError(f"Error opening PDF: {exc}") from exc
+    try:
+        if page_num < 1 or page_num > len(doc):
+            raise UnsupportedFileError(f"Page {page_num} out of range (1-{len(doc)})")
+        if fmt == "png":
+            return doc[page_num - 1].get_pixmap(dpi=_PAGE_RENDER_DPI).tobytes("png")
+        single = pymupdf.open()
+        try:
+            single.insert_pdf(doc, from_page=page_num - 1, to_page=page_num - 1)
+            return single.tobytes()
+        finally:
+            single.close()
+    finally:
+        doc.close()
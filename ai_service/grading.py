@@ -0,0 +1,197 @@
+"""Structured AI grading: versioned JSON schema, validation and retry.
+
+/api/v1/grade asks the model for the structured JSON directly. The streaming
+endpoint streams the Markdown first and then extracts the structure from it.
+Either way the result is validated here, and if the model keeps producing
+malformed JSON we degrade to text-only (structured=None).
+"""
+import json
+import logging
+from typing import Any, List, Optional, Tuple
+
+from clients import client
+from llm import chat_completion
+from prompts import GRADING_STRUCTURE_EXTRACT_PROMPT, GRADING_STRUCTURED_OUTPUT_SPEC, GRADING_SYSTEM_PROMPT
+from response_utils import parse_model_json
+
+
+logger = logging.getLogger(__name__)
+
+SCHEMA_VERSION = "grading.v1"
+VERDICTS = {"correct", "minor_error", "major_error"}
+MAX_STRUCTURE_ATTEMPTS = 2
+
+
+def _number(value: Any, field: str) -> Optional[float]:
+    if value is None or value == "":
+        return None
+    if isinstance(value, bool):
+        raise ValueError(f"{field} 必须是数字")
+    try:
+        return float(value)
+    except (TypeError, ValueError):
+        raise ValueError(f"{field} 必须是数字")
+
+
+def _tags(value: Any) -> List[str]:
+    if value is None:
+        return []
+    if not isinstance(value, list):
+        raise ValueError("concept_tags 必须是字符串数组")
+    seen: List[str] = []
+    for item in value:
+        tag = str(item).strip()
+        if tag and tag not in seen:
+            seen.append(tag)
+    return seen[:10]
+
+
+def validate_structured_grade(data: Any) -> dict:
+    """Validate and normalise a grading.v1 object. Raises ValueError describing the first problem."""
+    if not isinstance(data, dict):
+        raise ValueError("顶层必须是 JSON 对象")
+    version = data.get("schema_version", SCHEMA_VERSION)
+    if version != SCHEMA_VERSION:
+        raise ValueError(f"schema_version 必须是 {SCHEMA_VERSION}")
+    exercises = data.get("exercises")
+    if not isinstance(exercises, list) or not exercises:
+        raise ValueError("exercises 必须是非空数组")
+
+    normalised_exercises = []
+    for i, exercise in enumerate(exercises, start=1):
+        if not isinstance(exercise, dict):
+            raise ValueError(f"exercises[{i}] 必须是对象")
+        max_score = _number(exercise.get("max_score"), f"exercises[{i}].max_score")
+        if max_score is None:
+            max_score = 10.0
+        if max_score <= 0:
+            raise ValueError(f"exercises[{i}].max_score 必须为正数")
+        score = _number(exercise.get("suggested_score"), f"exercises[{i}].suggested_score")
+        if score is not None and not 0 <= score <= max_score:
+            raise ValueError(f"exercises[{i}].suggested_score 超出 0-{max_score:g}")
+
+        steps = exercise.get("steps") or []
+        if not isinstance(steps, list):
+            raise ValueError(f"exercises[{i}].steps 必须是数组")
+        normalised_steps = []
+        for j, step in enumerate(steps, start=1):
+            if not isinstance(step, dict):
+                raise ValueError(f"exercises[{i}].steps[{j}] 必须是对象")
+            verdict = str(step.get("verdict", "")).strip()
+            if verdict not in VERDICTS:
+                raise ValueError(f"exercises[{i}].steps[{j}].verdict 必须是 {'/'.join(sorted(VERDICTS))}")
+            normalised_steps.append({
+                "index": j,
+                "summary": str(step.get("summary") or "").strip(),
+                "verdict": verdict,
+                "comment": str(step.get("comment") or "").strip(),
+            })
+
+        error_step = exercise.get("error_step")
+        if error_step is not None:
+            try:
+                error_step = int(error_step)
+            except (TypeError, ValueError):
+                raise ValueError(f"exercises[{i}].error_step 必须是整数或 null")
+            if not 1 <= error_step <= len(normalised_steps):
+                raise ValueError(f"exercises[{i}].error_step 不对应任何步骤")
+        elif any(step["verdict"] != "correct" for step in normalised_steps):
+            # 模型漏填时按第一个非 correct 步骤补齐
+            error_step = next(step["index"] for step in normalised_steps if step["verdict"] != "correct")
+
+        normalised_exercises.append({
+            "label": str(exercise.get("label") or f"第{i}题").strip(),
+            "max_score": max_score,
+            "suggested_score": score,
+            "steps": normalised_steps,
+            "error_step": error_step,
+            "concept_tags": _tags(exercise.get("concept_tags")),
+        })
+
+    overall = _number(data.get("overall_score"), "overall_score")
+    if overall is not None and not 0 <= overall <= 100:
+        raise ValueError("overall_score 超出 0-100")
+
+    tags = _tags(data.get("concept_tags"))
+    for exercise in normalised_exercises:
+        for tag in exercise["concept_tags"]:
+            if tag not in tags:
+                tags.append(tag)
+
+    return {
+        "schema_version": SCHEMA_VERSION,
+        "exercises": normalised_exercises,
+        "overall_score": overall,
+        "concept_tags": tags[:20],
+        "explanation_markdown": str(data.get("explanation_markdown") or "").strip(),
+    }
+
+
+def _request_structure(model: str, messages: List[dict]) -> Tuple[Optional[dict], str]:
+    """Call the model, retrying once with the validation error fed back. Returns (structured, raw_text)."""
+    raw = ""
+    for attempt in range(1, MAX_STRUCTURE_ATTEMPTS + 1):
+        response = chat_completion(client, model=model, messages=messages, max_tokens=4096, temperature=0.2)
+        raw = response.choices[0].message.content or ""
+        try:
+            return validate_structured_grade(parse_model_json(raw)), raw
+        except ValueError as exc:
+            logger.warning("Structured grading attempt %d invalid: %s", attempt, exc)
+            messages = messages + [
+                {"role": "assistant", "content": raw},
+                {"role": "user", "content": f"你的输出不符合要求：{exc}。请只输出修正后的完整 JSON 对象。"},
+            ]
+    return None, raw
+
+
+def grading_user_prompt(problem_text: str, solution_text: str) -> str:
+    return f"请批改以下作业：\n--- 题目 ---\n{problem_text}\n--- 学生解答 ---\n{solution_text}"
+
+
+def grade_structured(problem_text: str, solution_text: str, model: str) -> Tuple[str, Optional[dict]]:
+    """One-shot structured grading. Returns (markdown correction, structured or None)."""
+    messages = [
+        {"role": "system", "content": GRADING_SYSTEM_PROMPT + "\n" + GRADING_STRUCTURED_OUTPUT_SPEC},
+        {"role": "user", "content": grading_user_prompt(problem_text, solution_text)},
+    ]
+    structured, raw = _request_structure(model, messages)
+    if structured and structured["explanation_markdown"]:
+        return structured["explanation_markdown"], structured
+
+    # 降级：结构化失败时把模型原文当作 Markdown 批改；原文是 JSON 则尽量取出其中的说明
+    parsed = parse_model_json(raw)
+    if isinstance(parsed, dict) and parsed.get("explanation_markdown"):
+        return str(parsed["explanation_markdown"]), structured
+    if structured is None and parsed is None and raw.strip():
+        return raw, None
+    # 结构化成功但缺 Markdown、或原文无法使用：退回普通批改
+    response = chat_completion(
+        client,
+        model=model,
+        messages=[
+            {"role": "system", "content": GRADING_SYSTEM_PROMPT},
+            {"role": "user", "content": grading_user_prompt(problem_text, solution_text)},
+        ],
+        max_tokens=4096,
+        temperature=0.3,
+    )
+    return response.choices[0].message.content or "", structured
+
+
+def extract_structure(problem_text: str, solution_text: str, correction: str, model: str) -> Optional[dict]:
+    """Turn an already written Markdown correction into grading.v1. Never raises; None means text-only."""
+    messages = [
+        {"role": "system", "content": GRADING_STRUCTURE_EXTRACT_PROMPT},
+        {
+            "role": "user",
+            "content": f"{grading_user_prompt(problem_text, solution_text)}\n--- 批改意见 ---\n{correction}",
+        },
+    ]
+    try:
+        structured, _ = _request_structure(model, messages)
+    except Exception as exc:
+        logger.error("Structure extraction failed: %s", exc)
+        return None
+    if structured is not None:
+        structured["explanation_markdown"] = correction
+    return structured
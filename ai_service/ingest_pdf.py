@@ -5,6 +5,7 @@ import json
 import pymupdf
 import psycopg2
 import base64
+import hashlib
 import shutil
 import subprocess
 import tempfile
@@ -36,6 +37,15 @@ vl_model = resolve_model("ocr")
 ocr_llm_semaphore = BoundedSemaphore(settings.ocr_max_concurrency)
 
 
+class IngestCanceled(Exception):
+    """解析过程中收到取消信号（cancel_event 被置位或 web 服务回报 canceled）。"""
+
+
+def _check_canceled(cancel_event):
+    if cancel_event is not None and cancel_event.is_set():
+        raise IngestCanceled("Task canceled by user")
+
+
 # ---------------------------------------------------------------------------
 # Office 文档（PPT/Word）转 PDF
 # ---------------------------------------------------------------------------
@@ -491,8 +501,17 @@ def _dedup_key(ex):
     return (num, stem)
 
 
-def _exercise_progress_path(textbook_name):
+def _target_tables(version_id):
+    """(正文表, 题目表)：教材新版本写 staging 表，由 web 服务在解析完成后整体切换。"""
+    if version_id is None:
+        return "textbook_chunks", "textbook_exercises"
+    return "textbook_chunks_staging", "textbook_exercises_staging"
+
+
+def _exercise_progress_path(textbook_name, version_id=None):
     safe = re.sub(r"[^\w一-鿿]+", "_", textbook_name or "textbook").strip("_") or "textbook"
+    if version_id is not None:
+        safe = f"{safe}_v{version_id}"
     return os.path.join(tempfile.gettempdir(), f"exercise_progress_{safe}.json")
 
 
@@ -526,7 +545,7 @@ def _new_db_conn():
     return conn
 
 
-def _ingest_exercise_batch(textbook_id, textbook_name, exercises):
+def _ingest_exercise_batch(textbook_id, textbook_name, exercises, version_id=None):
     """对一批题目做 embedding 并 INSERT（追加，不清空），返回写入条数。线程安全：自建连接。"""
     searchable = []
     texts = []
@@ -544,16 +563,19 @@ def _ingest_exercise_batch(textbook_id, textbook_name, exercises):
     for i in range(0, len(texts), batch_size):
         embeddings.extend(get_embeddings(texts[i:i + batch_size]))
 
+    _, exercise_table = _target_tables(version_id)
     conn = _new_db_conn()
     cur = conn.cursor()
     try:
         for ex, emb in zip(searchable, embeddings):
             cur.execute(
-                """
-                INSERT INTO textbook_exercises
+                f"""
+                INSERT INTO {exercise_table}
                     (textbook_id, textbook_name, page_num, exercise_number, stem, answer, solution,
-                     concepts, concept_tags, exercise_type, question_type, has_answer, source_excerpt, embedding)
-                VALUES (%s, %s, %s, %s, %s, %s, %s, %s, %s, %s, %s, %s, %s, %s)
+                     concepts, concept_tags, exercise_type, question_type, has_answer, source_excerpt, embedding
+                     {", version_id" if version_id is not None else ""})
+                VALUES (%s, %s, %s, %s, %s, %s, %s, %s, %s, %s, %s, %s, %s, %s
+                        {", %s" if version_id is not None else ""})
                 """,
                 (
                     textbook_id,
@@ -570,6 +592,7 @@ def _ingest_exercise_batch(textbook_id, textbook_name, exercises):
                     bool(ex.get("has_answer")),
                     ex.get("source_excerpt", ""),
                     emb,
+                    *((version_id,) if version_id is not None else ()),
                 ),
             )
         conn.commit()
@@ -579,32 +602,37 @@ def _ingest_exercise_batch(textbook_id, textbook_name, exercises):
     return len(searchable)
 
 
-def _delete_exercises(textbook_id, textbook_name):
+def _delete_exercises(textbook_id, textbook_name, version_id=None):
     conn = _new_db_conn()
     cur = conn.cursor()
-    cur.execute(
-        "DELETE FROM textbook_exercises WHERE textbook_name = %s OR textbook_id = %s",
-        (textbook_name, textbook_id),
-    )
+    if version_id is not None:
+        cur.execute("DELETE FROM textbook_exercises_staging WHERE version_id = %s", (version_id,))
+    else:
+        cur.execute(
+            "DELETE FROM textbook_exercises WHERE textbook_name = %s OR textbook_id = %s",
+            (textbook_name, textbook_id),
+        )
     conn.commit()
     cur.close()
     conn.close()
 
 
-def _dedup_exercises_in_db(textbook_name):
-    """入库后去重：同书内 (题号, 题干前40字) 相同的只保留最小 id。"""
+def _dedup_exercises_in_db(textbook_name, version_id=None):
+    """入库后去重：同书（或同一新版本）内 (题号, 题干前40字) 相同的只保留最小 id。"""
+    _, exercise_table = _target_tables(version_id)
+    scope_column, scope_value = ("version_id", version_id) if version_id is not None else ("textbook_name", textbook_name)
     conn = _new_db_conn()
     cur = conn.cursor()
     cur.execute(
-        """
-        DELETE FROM textbook_exercises a
-        USING textbook_exercises b
+        f"""
+        DELETE FROM {exercise_table} a
+        USING {exercise_table} b
         WHERE a.id > b.id
-          AND a.textbook_name = %s AND b.textbook_name = %s
+          AND a.{scope_column} = %s AND b.{scope_column} = %s
           AND COALESCE(a.exercise_number, '') = COALESCE(b.exercise_number, '')
           AND LEFT(a.stem, 40) = LEFT(b.stem, 40)
         """,
-        (textbook_name, textbook_name),
+        (scope_value, scope_value),
     )
     removed = cur.rowcount
     conn.commit()
@@ -615,7 +643,7 @@ def _dedup_exercises_in_db(textbook_name):
 
 def extract_and_ingest_exercises(
     full_text, textbook_id, textbook_name,
-    window=3, stride=2, max_workers=5, resume=True,
+    window=3, stride=2, max_workers=5, resume=True, on_progress=None, cancel_event=None, version_id=None,
 ):
     """并发滑动窗口抽题 + 每窗口增量入库 + 断点续传。
 
@@ -623,6 +651,9 @@ def extract_and_ingest_exercises(
     - 增量入库：每个窗口抽完立即写库，进程被中断也不丢已入库的题。
     - 断点续传：进度文件记录已完成窗口，重跑跳过它们；首次运行才清空该书旧题。
     - 去重：入库时允许少量跨窗口重复，全部完成后用 SQL 去重。
+    - on_progress(done_windows, total_windows)：每个窗口结束后调用，供上报进度。
+    - cancel_event：置位后不再开新窗口，已完成窗口的进度保留，最后抛 IngestCanceled。
+    - version_id：教材新版本，题目写入 staging 表，不动正在使用的旧版本题目。
     """
     pages = split_pages(full_text)
     if not pages:
@@ -630,12 +661,12 @@ def extract_and_ingest_exercises(
         return 0
 
     window_starts = list(range(0, len(pages), max(1, stride)))
-    progress_path = _exercise_progress_path(textbook_name)
+    progress_path = _exercise_progress_path(textbook_name, version_id)
     done = _load_exercise_progress(progress_path) if resume else set()
 
     if not done:
         # 首次运行：清空旧题并重置进度
-        _delete_exercises(textbook_id, textbook_name)
+        _delete_exercises(textbook_id, textbook_name, version_id)
         if os.path.exists(progress_path):
             try:
                 os.remove(progress_path)
@@ -653,11 +684,13 @@ def extract_and_ingest_exercises(
     total = [0]
 
     def process_window(i):
+        if cancel_event is not None and cancel_event.is_set():
+            return 0
         window_pages = pages[i:i + window]
         start_page = window_pages[0][0]
         block = "\n\n".join(f"【第{pn}页】\n{txt}" for pn, txt in window_pages if txt.strip())
         exs = _extract_exercises_llm(block, start_page)
-        n = _ingest_exercise_batch(textbook_id, textbook_name, exs)
+        n = _ingest_exercise_batch(textbook_id, textbook_name, exs, version_id)
         with lock:
             done.add(i)
             _save_exercise_progress(progress_path, done)
@@ -673,8 +706,16 @@ def extract_and_ingest_exercises(
                 except Exception as exc:
                     print(f"\n[警告] 窗口抽题失败: {exc}")
                 pbar.update(1)
-
-    removed = _dedup_exercises_in_db(textbook_name)
+                if on_progress is not None:
+                    try:
+                        on_progress(pbar.n, len(window_starts))
+                    except IngestCanceled:
+                        pass  # 调用方已置位 cancel_event，剩余窗口会直接跳过
+                    except Exception as exc:
+                        print(f"\n上报抽题进度失败: {exc}")
+
+    _check_canceled(cancel_event)
+    removed = _dedup_exercises_in_db(textbook_name, version_id)
     print(f"题库入库完成：写入 {total[0]} 题，去重移除 {removed} 题。")
     # 成功完成，清理进度文件
     if os.path.exists(progress_path):
@@ -684,30 +725,78 @@ def extract_and_ingest_exercises(
             pass
     return total[0]
 
-def extract_text_via_ocr(pdf_path, textbook_id=None, max_workers=5, return_metadata=False):
+def clear_exercise_progress(textbook_name, version_id=None):
+    """删除抽题断点文件；取消后题目已清空，下次需从头抽取。"""
+    path = _exercise_progress_path(textbook_name, version_id)
+    if os.path.exists(path):
+        try:
+            os.remove(path)
+        except Exception:
+            pass
+
+
+def _ocr_cache_path(pdf_path):
+    """按文件内容哈希存一份 OCR 结果，重新上传同一文件（文件名带时间戳）时复用已识别的页。"""
+    digest = hashlib.sha256()
+    with open(pdf_path, "rb") as f:
+        for block in iter(lambda: f.read(1 << 20), b""):
+            digest.update(block)
+    cache_dir = os.path.join(os.path.dirname(os.path.abspath(pdf_path)), ".ocr_cache")
+    return os.path.join(cache_dir, f"{digest.hexdigest()}.ocr.txt")
+
+
+def _stash_ocr_cache(output_txt_path, cache_path):
+    if not cache_path or not os.path.exists(output_txt_path):
+        return
+    try:
+        os.makedirs(os.path.dirname(cache_path), exist_ok=True)
+        shutil.copyfile(output_txt_path, cache_path)
+    except Exception as exc:
+        print(f"[警告] 保存 OCR 缓存失败: {exc}")
+
+
+def db_progress(textbook_id):
+    """没有回调时（如命令行直接解析）的进度上报：写 textbooks 表，返回教材当前状态。"""
+    def report(processed_pages, total_pages):
+        conn = _new_db_conn()
+        cur = conn.cursor()
+        cur.execute(
+            "UPDATE textbooks SET processed_pages = %s, total_pages = %s WHERE id = %s RETURNING status",
+            (processed_pages, total_pages, textbook_id),
+        )
+        row = cur.fetchone()
+        conn.commit()
+        cur.close()
+        conn.close()
+        return row[0] if row else ""
+    return report
+
+
+def extract_text_via_ocr(pdf_path, textbook_id=None, max_workers=5, return_metadata=False, on_progress=None, cancel_event=None):
+    """逐页视觉 OCR。on_progress(processed_pages, total_pages) 每完成一页调用一次，返回教材当前状态；
+    不传时若有 textbook_id 则直接写库。每页开始前和完成后检查 cancel_event，取消时已识别的页留在缓存里供续传。"""
     print(f"正在读取 PDF: {pdf_path} (启用大模型 OCR 提取模式, 并发线程: {max_workers}) ...")
     try:
         doc = pymupdf.open(pdf_path)
     except Exception as e:
-        print(f"读取 PDF 失败: {e}")
-        exit(1)
+        # 后台任务里 exit() 会绕过异常处理、让教材一直停在 processing，这里改为抛异常
+        raise RuntimeError(f"读取 PDF 失败: {e}") from e
         
     output_txt_path = pdf_path + ".ocr.txt"
     print(f"OCR 提取结果将实时保存在: {output_txt_path}")
+    try:
+        cache_path = _ocr_cache_path(pdf_path)
+    except Exception as exc:
+        print(f"[警告] 计算 OCR 缓存路径失败: {exc}")
+        cache_path = None
+    if cache_path and not os.path.exists(output_txt_path) and os.path.exists(cache_path):
+        shutil.copyfile(cache_path, output_txt_path)
+        print(f"复用同一文件此前的 OCR 结果: {cache_path}")
     
     total_pages = len(doc)
-    # 如果传了 textbook_id，先更新数据库的 total_pages
-    if textbook_id is not None:
-        try:
-            conn = _new_db_conn()
-            cur = conn.cursor()
-            cur.execute("UPDATE textbooks SET total_pages = %s WHERE id = %s", (total_pages, textbook_id))
-            conn.commit()
-            cur.close()
-            conn.close()
-        except Exception as e:
-            print(f"更新 total_pages 失败: {e}")
-    
+    if on_progress is None and textbook_id is not None:
+        on_progress = db_progress(textbook_id)
+
     # 尝试读取已有的进度
     completed_pages = set()
     if os.path.exists(output_txt_path):
@@ -720,16 +809,12 @@ def extract_text_via_ocr(pdf_path, textbook_id=None, max_workers=5, return_metad
                     except:
                         pass
         print(f"检测到已有解析记录，已完成 {len(completed_pages)} 页，将跳过这些页面...")
-        if textbook_id is not None:
-             try:
-                 conn = _new_db_conn()
-                 cur = conn.cursor()
-                 cur.execute("UPDATE textbooks SET processed_pages = %s WHERE id = %s", (len(completed_pages), textbook_id))
-                 conn.commit()
-                 cur.close()
-                 conn.close()
-             except Exception as e:
-                 pass
+    # 上报总页数与已完成页数
+    if on_progress is not None:
+        try:
+            on_progress(len(completed_pages), total_pages)
+        except Exception as e:
+            print(f"上报解析进度失败: {e}")
 
     pages_to_process = [i for i in range(total_pages) if i not in completed_pages]
     
@@ -749,6 +834,8 @@ def extract_text_via_ocr(pdf_path, textbook_id=None, max_workers=5, return_metad
             return ""
 
     def process_page(i):
+        if cancel_event is not None and cancel_event.is_set():
+            return i, None
         page = doc[i]
         pix = page.get_pixmap(matrix=pymupdf.Matrix(2, 2))
         img_bytes = pix.tobytes("png")
@@ -799,32 +886,28 @@ def extract_text_via_ocr(pdf_path, textbook_id=None, max_workers=5, return_metad
             # 获取结果
             for future in as_completed(future_to_page):
                 page_index, text_result = future.result()
+                if text_result is None:
+                    continue
                 results[page_index] = text_result
                 pbar.update(1)
                 
-                # 实时更新数据库进度
-                if textbook_id is not None:
+                # 实时上报进度（回调 web 服务或写库），顺带得知是否已被取消
+                updated_status = ""
+                if on_progress is not None:
                     with file_lock:
                         current_processed_pages += 1
                         try:
-                            conn = _new_db_conn()
-                            cur = conn.cursor()
-                            cur.execute("UPDATE textbooks SET processed_pages = %s WHERE id = %s RETURNING status", (current_processed_pages, textbook_id))
-                            updated_status = cur.fetchone()[0]
-                            conn.commit()
-                            cur.close()
-                            conn.close()
-                            
-                            # 检查是否被取消
-                            if updated_status == 'canceled':
-                                print("检测到取消信号，终止解析...")
-                                executor.shutdown(wait=False, cancel_futures=True)
-                                raise Exception("Task canceled by user")
-                                
+                            updated_status = on_progress(current_processed_pages, total_pages)
                         except Exception as e:
-                            if str(e) == "Task canceled by user":
-                                raise e
-                            pass
+                            print(f"上报解析进度失败: {e}")
+                if updated_status == 'canceled' or (cancel_event is not None and cancel_event.is_set()):
+                    print("检测到取消信号，终止解析...")
+                    # 等在途的页写完缓存再退出，续传时不必重做
+                    executor.shutdown(wait=True, cancel_futures=True)
+                    _stash_ocr_cache(output_txt_path, cache_path)
+                    raise IngestCanceled("Task canceled by user")
+    _stash_ocr_cache(output_txt_path, cache_path)
+    _check_canceled(cancel_event)
 
     # 重新读取完整文件，以保证最终 text 变量中的页面顺序是正确的（因为并发写入会导致 txt 文件里顺序错乱）
     # 在实际 RAG 场景中，只要打好了 page chunk，顺序错乱一点点影响不大，但为了安全起见我们这里统一合并
@@ -930,7 +1013,7 @@ def ingest_exercises_to_db(textbook_id, textbook_name, exercises):
     print(f"题目入库完成：{n} 题。")
 
 
-def ingest_to_db(textbook_name, week_num, chunks, textbook_id=None):
+def ingest_to_db(textbook_name, week_num, chunks, textbook_id=None, cancel_event=None, version_id=None):
     print("正在连接数据库并写入数据...")
     try:
         conn = psycopg2.connect(
@@ -943,20 +1026,26 @@ def ingest_to_db(textbook_name, week_num, chunks, textbook_id=None):
         register_vector(conn)
         cur = conn.cursor()
     except Exception as e:
-        print(f"连接数据库失败，请检查 Docker 是否运行: {e}")
-        exit(1)
+        raise RuntimeError(f"连接数据库失败，请检查 Docker 是否运行: {e}") from e
 
     # 每次处理 50 个 chunk，防止 API 超时或 payload 过大
     batch_size = 50
     total_batches = (len(chunks) - 1) // batch_size + 1
 
-    if textbook_id is not None:
+    chunk_table, _ = _target_tables(version_id)
+    if version_id is not None:
+        cur.execute("DELETE FROM textbook_chunks_staging WHERE version_id = %s", (version_id,))
+    elif textbook_id is not None:
         cur.execute("DELETE FROM textbook_chunks WHERE textbook_id = %s OR textbook_name = %s", (textbook_id, textbook_name))
     else:
         cur.execute("DELETE FROM textbook_chunks WHERE textbook_name = %s", (textbook_name,))
     conn.commit()
     
     for i in tqdm(range(0, len(chunks), batch_size), total=total_batches, desc="Embedding & 入库"):
+        if cancel_event is not None and cancel_event.is_set():
+            cur.close()
+            conn.close()
+            raise IngestCanceled("Task canceled by user")
         batch_chunks_raw = chunks[i:i+batch_size]
         # 入库前再清洗一次，避免旧缓存里的脏行流入向量库
         batch_chunks = [sanitize_ocr_text(ch) for ch in batch_chunks_raw]
@@ -973,10 +1062,16 @@ def ingest_to_db(textbook_name, week_num, chunks, textbook_id=None):
             raise
         
         for chunk, emb in zip(batch_chunks, embeddings):
-            cur.execute(
-                "INSERT INTO textbook_chunks (textbook_id, textbook_name, content, embedding, week_num) VALUES (%s, %s, %s, %s, %s)",
-                (textbook_id, textbook_name, chunk, emb, week_num)
-            )
+            if version_id is not None:
+                cur.execute(
+                    f"INSERT INTO {chunk_table} (textbook_id, textbook_name, content, embedding, week_num, version_id) VALUES (%s, %s, %s, %s, %s, %s)",
+                    (textbook_id, textbook_name, chunk, emb, week_num, version_id)
+                )
+            else:
+                cur.execute(
+                    "INSERT INTO textbook_chunks (textbook_id, textbook_name, content, embedding, week_num) VALUES (%s, %s, %s, %s, %s)",
+                    (textbook_id, textbook_name, chunk, emb, week_num)
+                )
         conn.commit()
         
     cur.close()
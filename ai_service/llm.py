@@ -1,6 +1,6 @@
 import logging
 import re
-from typing import Any
+from typing import Any, Iterator
 
 from openai import OpenAI
 
@@ -42,3 +42,16 @@ def chat_completion(client: OpenAI, *, model: str, **kwargs: Any):
             ", ".join(sorted(retry_without)),
         )
         return client.chat.completions.create(model=model, **retry_kwargs)
+
+
+def chat_completion_stream(client: OpenAI, *, model: str, **kwargs: Any) -> Iterator[str]:
+    """Stream a chat completion, yielding text deltas. Unsupported params are retried like chat_completion."""
+    kwargs["stream"] = True
+    stream = chat_completion(client, model=model, **kwargs)
+    for chunk in stream:
+        if not chunk.choices:
+            continue
+        delta = chunk.choices[0].delta
+        text = getattr(delta, "content", None) if delta is not None else None
+        if text:
+            yield text
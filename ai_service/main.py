@@ -1,23 +1,33 @@
 import json
 import logging
 import os
+from dataclasses import dataclass
 from typing import List, Optional
 
 from fastapi import BackgroundTasks, FastAPI, File, Form, HTTPException, Query, UploadFile
 from fastapi.middleware.cors import CORSMiddleware
+from fastapi.responses import Response, StreamingResponse
 from pydantic import BaseModel
 
 from clients import client
 from config import resolve_model, resolve_model_id, settings
 from database import ensure_vector_index, get_db_conn
-from file_utils import extract_text_from_file, file_to_base64
-from llm import chat_completion
-from memory import build_memory_state, build_rag_query
-from prompts import GRADING_FOLLOW_UP_PROMPT, GRADING_SYSTEM_PROMPT, PPT_SUMMARY_PROMPT, SYSTEM_PROMPT
+from file_utils import (
+    UnsupportedFileError,
+    extract_pages_from_file,
+    extract_text_from_file,
+    file_to_base64,
+    render_pdf_page,
+)
+from grading import SCHEMA_VERSION as GRADING_SCHEMA_VERSION
+from grading import extract_structure, grade_structured, grading_user_prompt
+from llm import chat_completion, chat_completion_stream
+from memory import build_memory_state, build_rag_query, parse_history, summarize_messages
+from prompts import GRADING_FOLLOW_UP_PROMPT, GRADING_SYSTEM_PROMPT, HINT_ONLY_PROMPT, PPT_SUMMARY_PROMPT, SYSTEM_PROMPT
 from question_bank import list_chapters, search_questions
 from rag import retrieve_textbook_context
 from response_utils import extract_model_title, parse_model_json
-from textbook_tasks import process_textbook_task
+from textbook_tasks import cleanup_partial_ingest, claim_textbook, process_textbook_task, request_cancel
 
 
 logging.basicConfig(level=logging.INFO)
@@ -42,12 +52,16 @@ def format_chat_system_prompt(
     memory_context: str,
     learned_summaries: str,
     retrieved_context: str,
+    hint_only: bool = False,
 ) -> str:
-    return (
+    prompt = (
         SYSTEM_PROMPT.replace("{memory_context}", memory_context or "无。")
         .replace("{learned_summaries}", learned_summaries or "无。")
         .replace("{retrieved_context}", retrieved_context or "（未检索到相关教材片段。）")
     )
+    if hint_only:
+        prompt += HINT_ONLY_PROMPT
+    return prompt
 
 
 def generate_title(prompt: str) -> str:
@@ -153,9 +167,59 @@ async def ingest_textbook_api(
     file_path: str = Form(...),
     textbook_name: str = Form(...),
     textbook_id: int = Form(...),
+    job_id: Optional[int] = Form(None),
+    callback_url: Optional[str] = Form(None),
+    callback_token: Optional[str] = Form(None),
+    version_id: Optional[int] = Form(None),
+):
+    """后台解析教材；进度与结果通过 callback_url 回调 web 服务。同一本书已在解析时直接确认，不重复开跑。
+    带 version_id 时解析的是已有教材的新版本，结果写入 staging 表。"""
+    if not claim_textbook(textbook_id):
+        return {"message": "Textbook is already being processed", "status": "already_running"}
+    background_tasks.add_task(
+        process_textbook_task,
+        file_path,
+        textbook_name,
+        textbook_id,
+        job_id=job_id,
+        callback_url=callback_url,
+        callback_token=callback_token,
+        version_id=version_id,
+    )
+    return {"message": "Started processing textbook asynchronously", "status": "started"}
+
+
+@app.post("/api/v1/textbook/cancel")
+def cancel_textbook_api(
+    textbook_id: int = Form(...),
+    textbook_name: str = Form(...),
+    version_id: Optional[int] = Form(None),
+):
+    """取消教材解析。正在解析时置位取消信号并返回 canceling，解析线程停下、清理完后通过回调确认；
+    本进程没有在解析（已结束或服务重启过）时直接清理残留数据并返回 canceled。"""
+    if request_cancel(textbook_id):
+        return {"status": "canceling"}
+    try:
+        deleted_chunks, deleted_exercises = cleanup_partial_ingest(textbook_id, textbook_name, version_id)
+    except Exception as exc:
+        logger.error("Cleanup canceled textbook error: %s", exc)
+        raise HTTPException(status_code=500, detail=str(exc))
+    return {"status": "canceled", "deleted_chunks": deleted_chunks, "deleted_exercises": deleted_exercises}
+
+
+@app.post("/api/v1/textbook/page")
+def textbook_page_api(
+    file_path: str = Form(...),
+    page_num: int = Form(...),
+    format: str = Form("png"),
 ):
-    background_tasks.add_task(process_textbook_task, file_path, textbook_name, textbook_id)
-    return {"message": "Started processing textbook asynchronously"}
+    """引用溯源：渲染教材 PDF 的单页（png）或抽出单页 PDF。权限由 web 服务校验。"""
+    try:
+        content = render_pdf_page(file_path, page_num, format)
+    except UnsupportedFileError as exc:
+        raise HTTPException(status_code=400, detail=str(exc))
+    media_type = "application/pdf" if format == "pdf" else "image/png"
+    return Response(content=content, media_type=media_type)
 
 
 @app.get("/api/v1/models")
@@ -210,16 +274,20 @@ async def delete_textbook_api(
     try:
         conn = get_db_conn()
         cur = conn.cursor()
+        # 按 id 删除；只有缺少 textbook_id 的旧数据才按名称匹配，避免误删同名教材
         cur.execute(
-            "DELETE FROM textbook_chunks WHERE textbook_name = %s OR textbook_id = %s",
-            (textbook_name, textbook_id),
+            "DELETE FROM textbook_chunks WHERE textbook_id = %s OR (textbook_id IS NULL AND textbook_name = %s)",
+            (textbook_id, textbook_name),
         )
         deleted = cur.rowcount
         cur.execute(
-            "DELETE FROM textbook_exercises WHERE textbook_name = %s OR textbook_id = %s",
-            (textbook_name, textbook_id),
+            "DELETE FROM textbook_exercises WHERE textbook_id = %s OR (textbook_id IS NULL AND textbook_name = %s)",
+            (textbook_id, textbook_name),
         )
         deleted_exercises = cur.rowcount
+        # 尚未切换的新版本数据
+        cur.execute("DELETE FROM textbook_chunks_staging WHERE textbook_id = %s", (textbook_id,))
+        cur.execute("DELETE FROM textbook_exercises_staging WHERE textbook_id = %s", (textbook_id,))
         conn.commit()
         cur.close()
         conn.close()
@@ -285,6 +353,21 @@ async def ocr_endpoint(file: UploadFile = File(...), use_vision: bool = Form(Fal
     return {"text": text}
 
 
+@app.post("/api/v1/ocr/pages")
+async def ocr_pages_endpoint(files: List[UploadFile] = File(...), use_vision: bool = Form(False)):
+    """多文件按页 OCR：files 的顺序即页序，返回逐页文本与置信度，以及按页合并后的全文。"""
+    pages = []
+    for file_index, file in enumerate(files):
+        try:
+            file_pages = extract_pages_from_file(file, use_vision=use_vision)
+        except UnsupportedFileError as exc:
+            raise HTTPException(status_code=400, detail=f"{file.filename}: {exc}")
+        for page in file_pages:
+            pages.append({"file_index": file_index, "filename": file.filename, **page})
+    merged = "\n\n".join(page["text"] for page in pages if page["text"])
+    return {"pages": pages, "text": merged}
+
+
 @app.post("/api/v1/summarize_ppt")
 async def summarize_ppt(file: UploadFile = File(...)):
     text = extract_text_from_file(file)
@@ -309,18 +392,48 @@ async def summarize_ppt(file: UploadFile = File(...)):
         raise HTTPException(status_code=500, detail=str(exc))
 
 
-@app.post("/api/v1/chat")
-async def multimodal_chat(
-    prompt: Optional[str] = Form(None),
-    files: Optional[List[UploadFile]] = File(None),
-    is_first_message: bool = Form(False),
-    learned_summaries: str = Form(""),
-    current_week: int = Form(0),
-    history: Optional[str] = Form(None),
-    model_id: Optional[str] = Form(None),
-    user_id: int = Form(0),
-    textbook_ids: Optional[str] = Form(None),
-):
+def sse_event(event: str, data: dict) -> str:
+    """Format one Server-Sent Event frame; data is always a single-line JSON object."""
+    return f"event: {event}\ndata: {json.dumps(data, ensure_ascii=False)}\n\n"
+
+
+def sse_response(events) -> StreamingResponse:
+    return StreamingResponse(
+        events,
+        media_type="text/event-stream",
+        headers={"Cache-Control": "no-cache", "X-Accel-Buffering": "no"},
+    )
+
+
+@dataclass
+class ChatContext:
+    messages: List[dict]
+    current_prompt: str
+    selected_model: str
+    selected_model_id: str
+    premium_usage_count: int
+    citations: list
+
+
+def prepare_chat_context(
+    *,
+    prompt: Optional[str],
+    files: Optional[List[UploadFile]],
+    learned_summaries: str,
+    current_week: int,
+    history: Optional[str],
+    history_summary: Optional[str],
+    model_id: Optional[str],
+    user_id: int,
+    textbook_ids: Optional[str],
+    hint_only: bool = False,
+) -> ChatContext:
+    """Shared by /chat and /chat/stream: attachments, premium quota, memory, RAG and the final message list.
+
+    history_summary is sent by the web service, which already trimmed history to the model's budget and keeps a
+    rolling summary of older turns; when present the history is used as-is instead of being summarized here.
+    hint_only is set by the web service when the question matches an open assignment under integrity mode.
+    """
     if not prompt and not files:
         raise HTTPException(status_code=400, detail="Prompt or files must be provided.")
 
@@ -343,7 +456,7 @@ async def multimodal_chat(
     selected_model_id = resolve_model_id("chat", model_id)
     selected_model = resolve_model("chat", selected_model_id)
     premium_usage_count = enforce_premium_chat_limit(user_id, selected_model_id)
-    memory_state = build_memory_state(client, resolve_model("memory"), history)
+    memory_state = build_memory_state(client, resolve_model("memory"), history, summary=history_summary)
     rag_query = build_rag_query(current_prompt, memory_state)
     scoped_textbook_ids = None
     if textbook_ids is not None:
@@ -362,36 +475,77 @@ async def multimodal_chat(
         memory_context=memory_state.prompt_context,
         learned_summaries=learned_summaries,
         retrieved_context=retrieved_context,
+        hint_only=hint_only,
     )
 
     messages: List[dict] = [{"role": "system", "content": system_prompt}]
     messages.extend(memory_state.recent_messages)
     messages.append({"role": "user", "content": user_content_list})
+    return ChatContext(
+        messages=messages,
+        current_prompt=current_prompt,
+        selected_model=selected_model,
+        selected_model_id=selected_model_id,
+        premium_usage_count=premium_usage_count,
+        citations=citations,
+    )
+
+
+def premium_usage_payload(count: int) -> Optional[dict]:
+    if count < 0:
+        return None
+    return {"count": count, "limit": settings.premium_chat_daily_limit}
+
+
+@app.post("/api/v1/chat")
+async def multimodal_chat(
+    prompt: Optional[str] = Form(None),
+    files: Optional[List[UploadFile]] = File(None),
+    is_first_message: bool = Form(False),
+    learned_summaries: str = Form(""),
+    current_week: int = Form(0),
+    history: Optional[str] = Form(None),
+    history_summary: Optional[str] = Form(None),
+    model_id: Optional[str] = Form(None),
+    user_id: int = Form(0),
+    textbook_ids: Optional[str] = Form(None),
+    hint_only: bool = Form(False),
+):
+    ctx = prepare_chat_context(
+        prompt=prompt,
+        files=files,
+        learned_summaries=learned_summaries,
+        current_week=current_week,
+        history=history,
+        history_summary=history_summary,
+        model_id=model_id,
+        user_id=user_id,
+        textbook_ids=textbook_ids,
+        hint_only=hint_only,
+    )
 
     try:
         response = chat_completion(
             client,
-            model=selected_model,
-            messages=messages,
+            model=ctx.selected_model,
+            messages=ctx.messages,
             max_tokens=4096,
             temperature=0.55,
         )
         ai_response = response.choices[0].message.content or ""
         parsed = parse_model_json(ai_response)
-        title = generate_title(prompt or current_prompt) if is_first_message else None
+        title = generate_title(prompt or ctx.current_prompt) if is_first_message else None
 
         if isinstance(parsed, dict):
             text = parsed.get("response") or parsed.get("text_explanation") or ai_response
             parsed["response"] = text
             parsed.setdefault("text_explanation", text)
-            parsed.setdefault("citations", citations)
-            parsed.setdefault("model", selected_model)
-            parsed.setdefault("model_id", selected_model_id)
-            if premium_usage_count >= 0:
-                parsed.setdefault("premium_usage", {
-                    "count": premium_usage_count,
-                    "limit": settings.premium_chat_daily_limit,
-                })
+            parsed.setdefault("citations", ctx.citations)
+            parsed.setdefault("model", ctx.selected_model)
+            parsed.setdefault("model_id", ctx.selected_model_id)
+            parsed["hint_only"] = hint_only
+            if ctx.premium_usage_count >= 0:
+                parsed.setdefault("premium_usage", premium_usage_payload(ctx.premium_usage_count))
             if title:
                 parsed["title"] = title
             return parsed
@@ -400,51 +554,170 @@ async def multimodal_chat(
             "response": ai_response,
             "text_explanation": ai_response,
             "title": title,
-            "citations": citations,
-            "model": selected_model,
-            "model_id": selected_model_id,
-            "premium_usage": (
-                {"count": premium_usage_count, "limit": settings.premium_chat_daily_limit}
-                if premium_usage_count >= 0 else None
-            ),
+            "citations": ctx.citations,
+            "model": ctx.selected_model,
+            "model_id": ctx.selected_model_id,
+            "premium_usage": premium_usage_payload(ctx.premium_usage_count),
+            "hint_only": hint_only,
         }
     except Exception as exc:
         logger.error("Chat API error: %s", exc)
         raise HTTPException(status_code=500, detail=str(exc))
 
 
+@app.post("/api/v1/chat/stream")
+def multimodal_chat_stream(
+    prompt: Optional[str] = Form(None),
+    files: Optional[List[UploadFile]] = File(None),
+    is_first_message: bool = Form(False),
+    learned_summaries: str = Form(""),
+    current_week: int = Form(0),
+    history: Optional[str] = Form(None),
+    history_summary: Optional[str] = Form(None),
+    model_id: Optional[str] = Form(None),
+    user_id: int = Form(0),
+    textbook_ids: Optional[str] = Form(None),
+    hint_only: bool = Form(False),
+):
+    """SSE variant of /chat: meta -> delta* -> done | error. Validation and quota errors are still plain HTTP errors."""
+    ctx = prepare_chat_context(
+        prompt=prompt,
+        files=files,
+        learned_summaries=learned_summaries,
+        current_week=current_week,
+        history=history,
+        history_summary=history_summary,
+        model_id=model_id,
+        user_id=user_id,
+        textbook_ids=textbook_ids,
+        hint_only=hint_only,
+    )
+
+    def events():
+        yield sse_event("meta", {
+            "citations": ctx.citations,
+            "model": ctx.selected_model,
+            "model_id": ctx.selected_model_id,
+            "hint_only": hint_only,
+        })
+        parts: List[str] = []
+        try:
+            for delta in chat_completion_stream(
+                client,
+                model=ctx.selected_model,
+                messages=ctx.messages,
+                max_tokens=4096,
+                temperature=0.55,
+            ):
+                parts.append(delta)
+                yield sse_event("delta", {"text": delta})
+        except Exception as exc:
+            logger.error("Chat stream error: %s", exc)
+            yield sse_event("error", {"error": str(exc)})
+            return
+
+        text = "".join(parts)
+        title = generate_title(prompt or ctx.current_prompt) if is_first_message else None
+        yield sse_event("done", {
+            "response": text,
+            "text_explanation": text,
+            "title": title,
+            "citations": ctx.citations,
+            "model": ctx.selected_model,
+            "model_id": ctx.selected_model_id,
+            "premium_usage": premium_usage_payload(ctx.premium_usage_count),
+            "hint_only": hint_only,
+        })
+
+    return sse_response(events())
+
+
+@app.post("/api/v1/chat/summarize")
+def chat_summarize(previous_summary: str = Form(""), history: str = Form("[]")):
+    """Rolling summary for long chats: merge older turns into the previous summary. Called asynchronously by the web service."""
+    messages = parse_history(history)
+    if not messages and not previous_summary.strip():
+        raise HTTPException(status_code=400, detail="history must not be empty")
+    summary = summarize_messages(client, resolve_model("memory"), messages, previous_summary=previous_summary)
+    return {"summary": summary}
+
+
+def grading_messages(problem_text: str, solution_text: str) -> List[dict]:
+    return [
+        {"role": "system", "content": GRADING_SYSTEM_PROMPT},
+        {"role": "user", "content": grading_user_prompt(problem_text, solution_text)},
+    ]
+
+
 @app.post("/api/v1/grade")
 async def grade_homework(problem_text: str = Form(...), solution_text: str = Form(...)):
+    """correction 仍是 Markdown（兼容旧调用方）；structured 为 grading.v1 结构化结果，校验失败时为 null。"""
     if not solution_text or not problem_text:
         raise HTTPException(status_code=400, detail="Problem and solution text must be provided.")
     try:
-        user_prompt = f"请批改以下作业：\n--- 题目 ---\n{problem_text}\n--- 学生解答 ---\n{solution_text}"
-        messages = [
-            {"role": "system", "content": GRADING_SYSTEM_PROMPT},
-            {"role": "user", "content": user_prompt},
-        ]
-        response = chat_completion(
-            client,
-            model=resolve_model("grading"),
-            messages=messages,
-            max_tokens=4096,
-            temperature=0.3,
-        )
-        return {"correction": response.choices[0].message.content or ""}
+        grading_model = resolve_model("grading")
+        correction, structured = grade_structured(problem_text, solution_text, grading_model)
+        return {
+            "correction": correction,
+            "model": grading_model,
+            "structured": structured,
+            "schema_version": GRADING_SCHEMA_VERSION,
+        }
     except Exception as exc:
         logger.error("Grading error: %s", exc)
         raise HTTPException(status_code=500, detail=str(exc))
 
 
-@app.post("/api/v1/grading/chat")
-async def grading_chat(
-    problem_text: str = Form(...),
-    solution_text: str = Form(...),
-    correction_text: str = Form(...),
-    new_question: str = Form(...),
-    chat_history: str = Form("[]"),
-):
-    final_prompt = f"""{GRADING_FOLLOW_UP_PROMPT}
+@app.post("/api/v1/grade/stream")
+def grade_homework_stream(problem_text: str = Form(...), solution_text: str = Form(...)):
+    """SSE variant of /grade: meta -> delta* -> done({correction, model, structured}) | error.
+    The Markdown is streamed as it is written; the structure is extracted afterwards."""
+    if not solution_text or not problem_text:
+        raise HTTPException(status_code=400, detail="Problem and solution text must be provided.")
+    grading_model = resolve_model("grading")
+
+    def events():
+        yield sse_event("meta", {"model": grading_model})
+        parts: List[str] = []
+        try:
+            for delta in chat_completion_stream(
+                client,
+                model=grading_model,
+                messages=grading_messages(problem_text, solution_text),
+                max_tokens=4096,
+                temperature=0.3,
+            ):
+                parts.append(delta)
+                yield sse_event("delta", {"text": delta})
+        except Exception as exc:
+            logger.error("Grading stream error: %s", exc)
+            yield sse_event("error", {"error": str(exc)})
+            return
+        correction = "".join(parts)
+        structured = extract_structure(problem_text, solution_text, correction, grading_model)
+        yield sse_event("done", {
+            "correction": correction,
+            "model": grading_model,
+            "structured": structured,
+            "schema_version": GRADING_SCHEMA_VERSION,
+        })
+
+    return sse_response(events())
+
+
+def grading_chat_messages(
+    problem_text: str,
+    solution_text: str,
+    correction_text: str,
+    new_question: str,
+    chat_history: str,
+    hint_only: bool = False,
+) -> List[dict]:
+    """Grading context goes into the system prompt; earlier follow-up turns are replayed as user/assistant messages.
+
+    hint_only is set by the web service when the graded problem belongs to an open assignment under integrity mode.
+    """
+    system_prompt = f"""{GRADING_FOLLOW_UP_PROMPT}
 
 作业上下文：
 ---
@@ -457,16 +730,43 @@ async def grading_chat(
 ### 已给出的批改意见
 {correction_text}
 ---
-
-学生接着问：
-{new_question}
 """
+    if hint_only:
+        system_prompt += HINT_ONLY_PROMPT
+    messages: List[dict] = [{"role": "system", "content": system_prompt}]
+    try:
+        history = json.loads(chat_history or "[]")
+    except json.JSONDecodeError:
+        history = []
+    if isinstance(history, list):
+        for item in history[-20:]:
+            if not isinstance(item, dict):
+                continue
+            role = item.get("role")
+            content = str(item.get("content") or "")
+            if role == "ai":
+                role = "assistant"
+            if role in ("user", "assistant") and content.strip():
+                messages.append({"role": role, "content": content})
+    messages.append({"role": "user", "content": new_question})
+    return messages
+
 
-    messages = [{"role": "user", "content": final_prompt}]
+@app.post("/api/v1/grading/chat")
+async def grading_chat(
+    problem_text: str = Form(...),
+    solution_text: str = Form(...),
+    correction_text: str = Form(...),
+    new_question: str = Form(...),
+    chat_history: str = Form("[]"),
+    hint_only: bool = Form(False),
+):
+    messages = grading_chat_messages(problem_text, solution_text, correction_text, new_question, chat_history, hint_only)
+    grading_chat_model = resolve_model("grading_chat")
     try:
         response = chat_completion(
             client,
-            model=resolve_model("grading_chat"),
+            model=grading_chat_model,
             messages=messages,
             max_tokens=4096,
             temperature=0.45,
@@ -477,12 +777,48 @@ async def grading_chat(
             text = parsed.get("response") or parsed.get("text_explanation") or json.dumps(parsed, ensure_ascii=False)
         else:
             text = ai_response
-        return {"response": text, "text_explanation": text}
+        return {"response": text, "text_explanation": text, "model": grading_chat_model, "hint_only": hint_only}
     except Exception as exc:
         logger.error("Grading chat API error: %s", exc)
         raise HTTPException(status_code=500, detail=str(exc))
 
 
+@app.post("/api/v1/grading/chat/stream")
+def grading_chat_stream(
+    problem_text: str = Form(...),
+    solution_text: str = Form(...),
+    correction_text: str = Form(...),
+    new_question: str = Form(...),
+    chat_history: str = Form("[]"),
+    hint_only: bool = Form(False),
+):
+    """SSE variant of /grading/chat: meta -> delta* -> done({response, text_explanation, model, hint_only}) | error."""
+    messages = grading_chat_messages(problem_text, solution_text, correction_text, new_question, chat_history, hint_only)
+    grading_chat_model = resolve_model("grading_chat")
+
+    def events():
+        yield sse_event("meta", {"model": grading_chat_model})
+        parts: List[str] = []
+        try:
+            for delta in chat_completion_stream(
+                client,
+                model=grading_chat_model,
+                messages=messages,
+                max_tokens=4096,
+                temperature=0.45,
+            ):
+                parts.append(delta)
+                yield sse_event("delta", {"text": delta})
+        except Exception as exc:
+            logger.error("Grading chat stream error: %s", exc)
+            yield sse_event("error", {"error": str(exc)})
+            return
+        text = "".join(parts)
+        yield sse_event("done", {"response": text, "text_explanation": text, "model": grading_chat_model, "hint_only": hint_only})
+
+    return sse_response(events())
+
+
 if __name__ == "__main__":
     import uvicorn
 
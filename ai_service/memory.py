@@ -106,15 +106,24 @@ def split_history(
     return "\n\n".join(pinned), older, recent
 
 
-def summarize_messages(client: OpenAI, model: str, messages: List[Dict[str, str]]) -> str:
+def summarize_messages(
+    client: OpenAI,
+    model: str,
+    messages: List[Dict[str, str]],
+    previous_summary: str = "",
+) -> str:
+    previous_summary = (previous_summary or "").strip()
     if not messages:
-        return ""
+        return previous_summary
     text = "\n".join(f"{msg['role']}: {msg['content']}" for msg in messages)
+    previous_part = ""
+    if previous_summary:
+        previous_part = f"此前的摘要（请与新对话合并成一份新的摘要）：\n{previous_summary}\n\n新的对话：\n"
     prompt = (
         "请把下面这段线性代数学习对话压缩成给后续助教使用的记忆摘要。"
         "只保留：学生正在学的主题、已经问过的关键点、已确认的结论、仍困惑的地方。"
         "不要加入新知识，不要评价学生。控制在 300 字以内。\n\n"
-        f"{text}"
+        f"{previous_part}{text}"
     )
     try:
         response = chat_completion(
@@ -128,16 +137,28 @@ def summarize_messages(client: OpenAI, model: str, messages: List[Dict[str, str]
     except Exception as exc:
         logger.warning("Conversation summary failed, using deterministic fallback: %s", exc)
         fallback = "\n".join(f"{msg['role']}: {msg['content']}" for msg in messages[-8:])
+        if previous_summary:
+            fallback = previous_summary + "\n" + fallback
         return truncate_middle(fallback, 1200)
 
 
-def build_memory_state(client: OpenAI, model: str, history_raw: Optional[str]) -> MemoryState:
+def build_memory_state(
+    client: OpenAI,
+    model: str,
+    history_raw: Optional[str],
+    summary: Optional[str] = None,
+) -> MemoryState:
+    """summary is None: summarize older turns here (legacy callers).
+    summary given: the caller already trimmed history and keeps its own rolling summary, so use history verbatim."""
     messages = parse_history(history_raw)
-    pinned_context, older_messages, recent_messages = split_history(messages)
-
-    summary = ""
-    if _count_user_turns(messages) >= settings.memory_summary_trigger_turns:
-        summary = summarize_messages(client, model, older_messages)
+    if summary is not None:
+        pinned_context, older_messages, recent_messages = split_history(messages, recent_turns=len(messages) + 1)
+        summary = summary.strip()
+    else:
+        pinned_context, older_messages, recent_messages = split_history(messages)
+        summary = ""
+        if _count_user_turns(messages) >= settings.memory_summary_trigger_turns:
+            summary = summarize_messages(client, model, older_messages)
 
     recent_user_questions: List[str] = []
     for msg in reversed(recent_messages):
@@ -33,6 +33,15 @@ SYSTEM_PROMPT = """
 ---END RETRIEVED CONTEXT---
 """
 
+HINT_ONLY_PROMPT = """
+【作业诚信模式】
+学生本轮的问题与一份正在进行中的作业题目高度相关，老师开启了“只给提示”模式。你必须：
+- 不给出最终答案、完整解题过程或可以直接抄写的推导；不要替学生完成计算。
+- 用提问、指出相关概念/定理、给出思路方向或类似但不同的例子来引导学生自己完成。
+- 可以检查学生已经写出的步骤并指出哪里有问题，但不要顺势把后续步骤写完。
+- 在回答开头用一句话温和说明：这道题属于进行中的作业，这里只提供思路提示。
+"""
+
 GRADING_SYSTEM_PROMPT = """
 你是一位严格而富有洞察力的线性代数老师。你的任务是批改学生提交的作业。
 作业内容会以文本形式提供，这些文本是从图片或PDF中通过OCR提取的。
@@ -81,3 +90,40 @@ GRADING_FOLLOW_UP_PROMPT = """
 3. 直接输出纯文本或 Markdown，不要输出 JSON。
 4. 数学公式一律用 KaTeX 兼容语法：行内公式用 $...$，独立公式用 $$...$$；禁止使用 \\( \\) 或 \\[ \\] 作为定界符，也不要在一段公式内部再嵌套 $。
 """
+
+GRADING_STRUCTURED_OUTPUT_SPEC = """
+输出要求（必须严格遵守）：只输出一个 JSON 对象，不要输出任何 JSON 以外的文字，也不要用代码块包裹。结构如下：
+{
+  "schema_version": "grading.v1",
+  "exercises": [
+    {
+      "label": "第一题",
+      "max_score": 10,
+      "suggested_score": 7,
+      "steps": [
+        {"index": 1, "summary": "该步骤学生做了什么（一句话）", "verdict": "correct", "comment": "点评，可为空"},
+        {"index": 2, "summary": "……", "verdict": "major_error", "comment": "错误原因"}
+      ],
+      "error_step": 2,
+      "concept_tags": ["矩阵的逆", "行列式"]
+    }
+  ],
+  "overall_score": 70,
+  "concept_tags": ["矩阵的逆"],
+  "explanation_markdown": "完整的 Markdown 批改（格式同上：逐题状态、错误分析、正确解法、总结）"
+}
+字段约定：
+- verdict 只能是 correct / minor_error / major_error 三者之一。
+- error_step 是该题第一个出错步骤的 index，全对时为 null。
+- max_score 默认 10；suggested_score 取 0 到 max_score 之间；overall_score 为 0-100 的整体得分。
+- concept_tags 用简短的中文线性代数知识点名称。
+- explanation_markdown 中的数学公式同样使用 KaTeX 语法，注意 JSON 字符串中的反斜杠与换行需要正确转义。
+"""
+
+GRADING_STRUCTURE_EXTRACT_PROMPT = """
+你会收到一道线性代数作业的题目、学生解答以及老师已经写好的 Markdown 批改意见。
+请不要重新批改，只需把批改意见中的结论整理成结构化结果，逐题拆分学生解答的步骤并给出判定。
+""" + GRADING_STRUCTURED_OUTPUT_SPEC.replace(
+    '"explanation_markdown": "完整的 Markdown 批改（格式同上：逐题状态、错误分析、正确解法、总结）"',
+    '"explanation_markdown": ""',
+)
@@ -70,7 +70,7 @@ def retrieve_textbook_context(
             chunk_params.append(textbook_ids)
         cur.execute(
             f"""
-            SELECT textbook_name, content, week_num, embedding <=> %s::vector AS distance
+            SELECT id, textbook_id, textbook_name, content, week_num, embedding <=> %s::vector AS distance
             FROM textbook_chunks
             WHERE {" AND ".join(chunk_filters)}
             ORDER BY embedding <=> %s::vector
@@ -92,7 +92,7 @@ def retrieve_textbook_context(
                 exercise_params.append(textbook_ids)
             cur.execute(
                 f"""
-                SELECT textbook_name, page_num, exercise_number, stem, answer, solution,
+                SELECT id, textbook_id, textbook_name, page_num, exercise_number, stem, answer, solution,
                        concepts, source_excerpt, embedding <=> %s::vector AS distance
                 FROM textbook_exercises
                 WHERE {" AND ".join(exercise_filters)}
@@ -109,10 +109,12 @@ def retrieve_textbook_context(
         return "", []
 
     candidates = []
-    for tb_name, content, week_num, distance in chunk_rows:
+    for chunk_id, tb_id, tb_name, content, week_num, distance in chunk_rows:
         candidates.append(
             {
                 "source_type": "textbook",
+                "chunk_id": chunk_id,
+                "textbook_id": tb_id,
                 "textbook_name": tb_name,
                 "content": content or "",
                 "week_num": week_num,
@@ -120,7 +122,7 @@ def retrieve_textbook_context(
                 "distance": distance,
             }
         )
-    for tb_name, page_num, exercise_number, stem, answer, solution, concepts, source_excerpt, distance in exercise_rows:
+    for ex_id, tb_id, tb_name, page_num, exercise_number, stem, answer, solution, concepts, source_excerpt, distance in exercise_rows:
         parts = []
         if exercise_number:
             parts.append(f"题号：{exercise_number}")
@@ -136,6 +138,8 @@ def retrieve_textbook_context(
         candidates.append(
             {
                 "source_type": "exercise",
+                "exercise_id": ex_id,
+                "textbook_id": tb_id,
                 "textbook_name": tb_name,
                 "content": "\n".join(parts),
                 "week_num": None,
@@ -177,7 +181,10 @@ def retrieve_textbook_context(
             {
                 "index": idx,
                 "source_type": candidate["source_type"],
+                "textbook_id": candidate["textbook_id"],
                 "textbook_name": tb_name,
+                "chunk_id": candidate.get("chunk_id"),
+                "exercise_id": candidate.get("exercise_id"),
                 "week_num": int(week_num) if week_num is not None else None,
                 "page_num": page_num,
                 "distance": float(distance) if distance is not None else None,
@@ -1,4 +1,8 @@
 import logging
+import threading
+from typing import Dict, Optional, Tuple
+
+import httpx
 
 import ingest_pdf
 from database import get_db_conn
@@ -6,11 +10,66 @@ from database import get_db_conn
 
 logger = logging.getLogger(__name__)
 
+# 本进程正在解析的教材及其取消信号：web 服务重试投递时同一本书不重复开跑
+_running_lock = threading.Lock()
+_running_textbooks: Dict[int, threading.Event] = {}
+
+
+def claim_textbook(textbook_id: int) -> bool:
+    with _running_lock:
+        if textbook_id in _running_textbooks:
+            return False
+        _running_textbooks[textbook_id] = threading.Event()
+        return True
+
+
+def release_textbook(textbook_id: int) -> None:
+    with _running_lock:
+        _running_textbooks.pop(textbook_id, None)
+
+
+def cancel_event_for(textbook_id: int) -> Optional[threading.Event]:
+    with _running_lock:
+        return _running_textbooks.get(textbook_id)
+
+
+def request_cancel(textbook_id: int) -> bool:
+    """置位取消信号，返回该书是否正在本进程解析。解析线程会在下一页 / 下一批次前停下并清理。"""
+    with _running_lock:
+        event = _running_textbooks.get(textbook_id)
+    if event is None:
+        return False
+    event.set()
+    return True
+
+
+def cleanup_partial_ingest(textbook_id: int, textbook_name: str, version_id: Optional[int] = None) -> Tuple[int, int]:
+    """删除取消前已写入的分块与题目（OCR 缓存保留，续传时复用），返回删除的 (chunks, exercises) 数。
+    新版本只清它自己的 staging 数据，正在使用的旧版本不受影响。"""
+    conn = get_db_conn()
+    cur = conn.cursor()
+    if version_id is not None:
+        cur.execute("DELETE FROM textbook_chunks_staging WHERE version_id = %s", (version_id,))
+        deleted_chunks = cur.rowcount
+        cur.execute("DELETE FROM textbook_exercises_staging WHERE version_id = %s", (version_id,))
+        deleted_exercises = cur.rowcount
+    else:
+        cur.execute("DELETE FROM textbook_chunks WHERE textbook_id = %s", (textbook_id,))
+        deleted_chunks = cur.rowcount
+        cur.execute("DELETE FROM textbook_exercises WHERE textbook_id = %s", (textbook_id,))
+        deleted_exercises = cur.rowcount
+    conn.commit()
+    cur.close()
+    conn.close()
+    ingest_pdf.clear_exercise_progress(textbook_name, version_id)
+    return deleted_chunks, deleted_exercises
+
 
 def update_textbook_status(textbook_id: int, status: str) -> None:
     conn = get_db_conn()
     cur = conn.cursor()
-    cur.execute("UPDATE textbooks SET status = %s WHERE id = %s", (status, textbook_id))
+    # 只改仍在解析中的教材，避免覆盖 web 服务侧的取消
+    cur.execute("UPDATE textbooks SET status = %s WHERE id = %s AND status = 'processing'", (status, textbook_id))
     conn.commit()
     cur.close()
     conn.close()
@@ -26,29 +85,124 @@ def get_textbook_status(textbook_id: int) -> str:
     return row[0] if row else ""
 
 
-def process_textbook_task(file_path: str, textbook_name: str, textbook_id: int) -> None:
+class IngestReporter:
+    """向 web 服务回调上报解析进度与结果，返回教材当前状态（canceled 时调用方应停止）。
+
+    没有 callback_url 时（旧版 web 服务）退回直接写 textbooks 表。回调失败只记日志，不中断解析。
+    """
+
+    def __init__(self, textbook_id: int, job_id: Optional[int], callback_url: Optional[str], callback_token: Optional[str]):
+        self.textbook_id = textbook_id
+        self.job_id = job_id
+        self.callback_url = callback_url
+        self.callback_token = callback_token
+
+    def _post(self, payload: dict) -> str:
+        body = {"job_id": self.job_id, "token": self.callback_token, **payload}
+        try:
+            resp = httpx.post(self.callback_url, json=body, timeout=10.0)
+            resp.raise_for_status()
+            return resp.json().get("status", "")
+        except Exception as exc:
+            logger.warning("Ingest callback for textbook %s failed: %s", self.textbook_id, exc)
+            return ""
+
+    def progress(self, processed_pages: Optional[int] = None, total_pages: Optional[int] = None, stage: str = "") -> str:
+        if not self.callback_url:
+            if processed_pages is None:
+                return get_textbook_status(self.textbook_id)
+            return ingest_pdf.db_progress(self.textbook_id)(processed_pages, total_pages)
+        return self._post({
+            "event": "progress",
+            "stage": stage,
+            "processed_pages": processed_pages,
+            "total_pages": total_pages,
+        })
+
+    def completed(self) -> None:
+        if not self.callback_url:
+            update_textbook_status(self.textbook_id, "completed")
+            return
+        self._post({"event": "completed"})
+
+    def failed(self, error: str) -> None:
+        if not self.callback_url:
+            update_textbook_status(self.textbook_id, "failed")
+            return
+        self._post({"event": "failed", "error": error})
+
+    def canceled(self, deleted_chunks: int, deleted_exercises: int) -> None:
+        """确认已停止并清理完毕。"""
+        if not self.callback_url:
+            return
+        self._post({
+            "event": "canceled",
+            "deleted_chunks": deleted_chunks,
+            "deleted_exercises": deleted_exercises,
+        })
+
+    def check(self, status: str, cancel_event: Optional[threading.Event]) -> None:
+        """阶段之间检查取消：本进程收到取消请求，或回调得知教材已被取消。"""
+        if status == "canceled" and cancel_event is not None:
+            cancel_event.set()
+        if status == "canceled" or (cancel_event is not None and cancel_event.is_set()):
+            raise ingest_pdf.IngestCanceled("Task canceled by user")
+
+
+def process_textbook_task(
+    file_path: str,
+    textbook_name: str,
+    textbook_id: int,
+    job_id: Optional[int] = None,
+    callback_url: Optional[str] = None,
+    callback_token: Optional[str] = None,
+    version_id: Optional[int] = None,
+) -> None:
+    """解析教材。带 version_id 时是已有教材的新版本：结果写 staging 表，完成后由 web 服务切换。"""
+    reporter = IngestReporter(textbook_id, job_id, callback_url, callback_token)
+    cancel_event = cancel_event_for(textbook_id)
     try:
         logger.info("Background task: processing textbook %s", textbook_name)
+        reporter.check(reporter.progress(stage="ocr"), cancel_event)
         # PPT/Word 课件先转成 PDF，再走统一的 OCR/抽题流程
         file_path = ingest_pdf.ensure_pdf(file_path)
         text = ingest_pdf.extract_text_via_ocr(
             file_path,
             textbook_id=textbook_id,
             max_workers=5,
+            on_progress=lambda processed, total: reporter.progress(processed, total, stage="ocr"),
+            cancel_event=cancel_event,
         )
+        reporter.check(reporter.progress(stage="chunks"), cancel_event)
         chunks = ingest_pdf.chunk_text(text)
-        ingest_pdf.ingest_to_db(textbook_name, 1, chunks, textbook_id=textbook_id)
+        ingest_pdf.ingest_to_db(
+            textbook_name, 1, chunks, textbook_id=textbook_id, cancel_event=cancel_event, version_id=version_id
+        )
+        reporter.check(reporter.progress(stage="exercises"), cancel_event)
         # 题库抽取：按页排序全文做并发滑动窗口抽取 + 增量入库 + 断点续传（解决跨页截断 & 长任务中断丢失）
-        ingest_pdf.extract_and_ingest_exercises(text, textbook_id, textbook_name)
-        update_textbook_status(textbook_id, "completed")
+        ingest_pdf.extract_and_ingest_exercises(
+            text,
+            textbook_id,
+            textbook_name,
+            on_progress=lambda done, total: reporter.check(reporter.progress(stage="exercises"), cancel_event),
+            cancel_event=cancel_event,
+            version_id=version_id,
+        )
+        reporter.check("", cancel_event)
+        reporter.completed()
         logger.info("Background task: %s completed", textbook_name)
+    except ingest_pdf.IngestCanceled:
+        logger.info("Background task: %s canceled, cleaning up partial data", textbook_name)
+        try:
+            deleted_chunks, deleted_exercises = cleanup_partial_ingest(textbook_id, textbook_name, version_id)
+            reporter.canceled(deleted_chunks, deleted_exercises)
+        except Exception:
+            logger.exception("Could not clean up canceled textbook %s", textbook_id)
     except Exception as exc:
-        if str(exc) == "Task canceled by user":
-            logger.info("Background task: %s canceled by user", textbook_name)
-            return
         logger.error("Background task failed for %s: %s", textbook_name, exc)
         try:
-            if get_textbook_status(textbook_id) != "canceled":
-                update_textbook_status(textbook_id, "failed")
+            reporter.failed(str(exc))
         except Exception:
             logger.exception("Could not mark textbook %s as failed", textbook_id)
+    finally:
+        release_textbook(textbook_id)
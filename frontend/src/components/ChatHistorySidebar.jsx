@@ -1,5 +1,6 @@
 import React from 'react';
-import { MessageSquare, PanelLeftClose, Plus } from 'lucide-react';
+import { MessageSquare, PanelLeftClose, Pin, Plus } from 'lucide-react';
+import Button from './ui/Button';
 import IconButton from './ui/IconButton';
 
 const ChatHistorySidebar = ({
@@ -9,9 +10,17 @@ const ChatHistorySidebar = ({
   onSelectChat,
   isCollapsed,
   onToggle,
+  hasMore = false,
+  isLoadingMore = false,
+  onLoadMore,
   mobile = false,
 }) => {
-  const historyItems = chats ? Object.values(chats).sort((a, b) => new Date(b.createdAt) - new Date(a.createdAt)) : [];
+  // 置顶会话排在最前（按置顶时间），其余按创建时间倒序
+  const historyItems = chats ? Object.values(chats).sort((a, b) => {
+    if (Boolean(a.pinnedAt) !== Boolean(b.pinnedAt)) return a.pinnedAt ? -1 : 1;
+    if (a.pinnedAt && b.pinnedAt) return new Date(b.pinnedAt) - new Date(a.pinnedAt);
+    return new Date(b.createdAt) - new Date(a.createdAt);
+  }) : [];
 
   return (
     <div className={`chat-history ${isCollapsed ? 'is-collapsed' : ''} ${mobile ? 'is-mobile' : ''}`}>
@@ -31,12 +40,17 @@ const ChatHistorySidebar = ({
                 onClick={() => onSelectChat(item.id)}
                 title={item.title}
               >
-                <MessageSquare size={17} aria-hidden="true" />
+                {item.pinnedAt ? <Pin size={17} aria-hidden="true" /> : <MessageSquare size={17} aria-hidden="true" />}
                 {!isCollapsed && <span>{item.title || '未命名对话'}</span>}
               </button>
             </li>
           ))}
         </ul>
+        {hasMore && !isCollapsed && (
+          <div className="chat-history__more">
+            <Button variant="ghost" size="sm" loading={isLoadingMore} onClick={onLoadMore}>加载更早的对话</Button>
+          </div>
+        )}
         {historyItems.length === 0 && !isCollapsed && (
           <p className="chat-history__empty">还没有历史对话</p>
         )}
@@ -1,7 +1,7 @@
 import React, { useEffect, useRef, useState } from 'react';
 import axios from 'axios';
 import AiResponse from './AiResponse';
-import { ThumbsUp, ThumbsDown, FileText, BookOpen, ChevronDown, ChevronUp } from 'lucide-react';
+import { ThumbsUp, ThumbsDown, FileText, BookOpen, ChevronDown, ChevronUp, GraduationCap } from 'lucide-react';
 import autoWrapMath from '../utils/autoWrapMath';
 import { getAvatarInitial } from '../utils/avatarInitial';
 
@@ -61,6 +61,21 @@ const CitationItem = ({ c, index }) => {
     const full = c?.content || preview;
     const hasMore = full.length > preview.length + 4;
     const shown = expanded ? full : preview;
+    const canOpenPage = Boolean(c?.textbook_id) && c?.page_num != null;
+
+    // 打开引用所在的教材原页（需带 Authorization，取回图片后用 blob URL 打开）
+    const openPage = async () => {
+        const preview = window.open('', '_blank');
+        try {
+            const res = await axios.get(`/api/textbooks/${c.textbook_id}/pages/${c.page_num}`, { responseType: 'blob' });
+            const url = URL.createObjectURL(res.data);
+            if (preview) preview.location.href = url;
+            setTimeout(() => URL.revokeObjectURL(url), 60000);
+        } catch (err) {
+            preview?.close();
+            console.error("Failed to open textbook page:", err);
+        }
+    };
 
     return (
         <li className="px-3 py-2.5 text-xs">
@@ -75,7 +90,20 @@ const CitationItem = ({ c, index }) => {
                     </span>
                 )}
             </div>
-            {loc && <div className="text-[#868E96] mt-0.5">{loc}</div>}
+            {loc && (
+                <div className="text-[#868E96] mt-0.5">
+                    {loc}
+                    {canOpenPage && (
+                        <button
+                            type="button"
+                            onClick={openPage}
+                            className="ml-2 text-[11px] text-[#212529] hover:underline"
+                        >
+                            查看原页
+                        </button>
+                    )}
+                </div>
+            )}
             {shown && (
                 <div className="mt-1.5 text-[#495057] leading-relaxed text-xs">
                     <AiResponse content={shown} />
@@ -134,8 +162,61 @@ const CitationCard = ({ citations }) => {
     );
 };
 
+// 老师对这条 AI 回答的更正
+const CorrectionCard = ({ correction }) => {
+    if (!correction?.content) return null;
+    return (
+        <div className="mt-2 border border-amber-200 bg-amber-50 rounded-lg px-3 py-2 text-sm text-[#495057]">
+            <div className="flex items-center gap-1.5 text-xs font-medium text-amber-700 mb-1">
+                <GraduationCap size={14} />
+                老师更正
+            </div>
+            <AiResponse content={autoWrapMath(correction.content)} />
+        </div>
+    );
+};
+
+const FEEDBACK_REASONS = [
+    { value: 'wrong_math', label: '数学有误' },
+    { value: 'unclear', label: '讲得不清楚' },
+    { value: 'off_topic', label: '答非所问' },
+    { value: 'gives_away', label: '直接给了答案' },
+];
+
+// 点踩后的详细反馈：原因、补充说明与（可选）更好的回答
+const FeedbackPanel = ({ onSubmit, onClose }) => {
+    const [reasons, setReasons] = useState([]);
+    const [comment, setComment] = useState('');
+    const [betterAnswer, setBetterAnswer] = useState('');
+    const toggle = (value) => setReasons(prev => prev.includes(value) ? prev.filter(r => r !== value) : [...prev, value]);
+
+    return (
+        <div className="mt-2 w-full max-w-md border border-[#DEE2E6] bg-white rounded-lg p-3 text-xs text-[#495057] space-y-2">
+            <div className="flex flex-wrap gap-1.5">
+                {FEEDBACK_REASONS.map(r => (
+                    <button
+                        key={r.value}
+                        type="button"
+                        onClick={() => toggle(r.value)}
+                        className={`px-2 py-1 rounded-full border transition-colors ${reasons.includes(r.value) ? 'bg-black text-white border-black' : 'border-[#DEE2E6] hover:bg-[#F8F9FA]'}`}
+                    >
+                        {r.label}
+                    </button>
+                ))}
+            </div>
+            <textarea value={comment} onChange={e => setComment(e.target.value)} rows={2} placeholder="补充说明（可选）" className="w-full border border-[#DEE2E6] rounded p-2 resize-none" />
+            <textarea value={betterAnswer} onChange={e => setBetterAnswer(e.target.value)} rows={3} placeholder="你认为更好的回答（可选）" className="w-full border border-[#DEE2E6] rounded p-2 resize-y" />
+            <div className="flex justify-end gap-2">
+                <button type="button" onClick={onClose} className="px-2 py-1 rounded hover:bg-[#F8F9FA]">跳过</button>
+                <button type="button" onClick={() => onSubmit({ reasons, comment, betterAnswer })} className="px-2 py-1 rounded bg-black text-white">提交</button>
+            </div>
+        </div>
+    );
+};
+
 const MessageList = ({ messages, isLoading, user }) => {
   const messagesEndRef = useRef(null);
+  const [feedbackFor, setFeedbackFor] = useState(null);
 
   const scrollToBottom = () => {
     messagesEndRef.current?.scrollIntoView({ behavior: 'smooth' });
@@ -147,16 +228,32 @@ const MessageList = ({ messages, isLoading, user }) => {
 
   const visibleMessages = messages.filter(msg => msg.sender !== 'system');
 
-  const handleFeedback = async (messageId, score) => {
+  const handleFeedback = async (messageId, score, details = {}) => {
       try {
-          await axios.post(`/api/chat/messages/${messageId}/feedback`, { score });
-          // In a real app, you would update the local state to show it was submitted
-          // For now, we just rely on visual feedback or state management in parent if needed
+          await axios.post(`/api/chat/messages/${messageId}/feedback`, { score, ...details });
+          // 点踩先记录分数，再展开详细反馈面板
+          setFeedbackFor(score < 0 && !details.reasons ? messageId : null);
       } catch (err) {
           console.error("Failed to submit feedback:", err);
       }
   };
 
+  // 已保存的附件需要带 Authorization 请求，取回后用 blob URL 在新标签页打开
+  const openAttachment = async (event, file) => {
+      if (!file.attachmentId) return;
+      event.preventDefault();
+      const preview = window.open('', '_blank');
+      try {
+          const res = await axios.get(`/api/chat/attachments/${file.attachmentId}`, { responseType: 'blob' });
+          const url = URL.createObjectURL(res.data);
+          if (preview) preview.location.href = url;
+          setTimeout(() => URL.revokeObjectURL(url), 60000);
+      } catch (err) {
+          preview?.close();
+          console.error("Failed to open attachment:", err);
+      }
+  };
+
   return (
     <div className="flex-1 overflow-y-auto p-4 space-y-6 bg-[#FFFFFF]">
       {visibleMessages.map((msg, index) => (
@@ -181,7 +278,8 @@ const MessageList = ({ messages, isLoading, user }) => {
                         {msg.files.map((file, fileIndex) => (
                             <a 
                                 key={fileIndex} 
-                                href={file.url} 
+                                href={file.url || '#'} 
+                                onClick={(event) => openAttachment(event, file)}
                                 target="_blank" 
                                 rel="noopener noreferrer" 
                                 className={`flex items-center gap-2 p-2 rounded border text-sm transition-colors ${
@@ -201,6 +299,13 @@ const MessageList = ({ messages, isLoading, user }) => {
 
                 {/* AI 消息的教材引用卡片 */}
                 {msg.sender === 'ai' && <CitationCard citations={msg.citations} />}
+                {msg.sender === 'ai' && <CorrectionCard correction={msg.correction} />}
+                {msg.sender === 'ai' && feedbackFor === msg.id && (
+                    <FeedbackPanel
+                        onSubmit={(details) => handleFeedback(msg.id, -1, details)}
+                        onClose={() => setFeedbackFor(null)}
+                    />
+                )}
 
                 {msg.sender === 'ai' && (
                     <div className="flex items-center gap-2 mt-1.5 ml-2 text-gray-400 text-xs">
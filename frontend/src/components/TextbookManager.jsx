@@ -27,10 +27,17 @@ const statusMeta = {
   processing: { label: '解析中', icon: Clock3, tone: 'warning' },
   failed: { label: '解析失败', icon: AlertCircle, tone: 'danger' },
   canceled: { label: '已取消', icon: XCircle, tone: 'neutral' },
+  deleting: { label: '删除中', icon: Trash2, tone: 'neutral' },
 };
 
+const visibilityOptions = [
+  { value: 'private', label: '仅自己可见' },
+  { value: 'shared', label: '共享给指定老师' },
+  { value: 'institution', label: '全校老师可见' },
+];
+
 const TextbookManager = () => {
-  const { token } = useAuth();
+  const { token, user } = useAuth();
   const { confirm } = useConfirm();
   const { showToast } = useToast();
   const [textbooks, setTextbooks] = useState([]);
@@ -38,9 +45,12 @@ const TextbookManager = () => {
   const [uploading, setUploading] = useState(false);
   const [file, setFile] = useState(null);
   const [name, setName] = useState('');
+  const [visibility, setVisibility] = useState('private');
   const [error, setError] = useState('');
   const pollTimerRef = useRef(null);
   const fileInputRef = useRef(null);
+  const versionInputRef = useRef(null);
+  const [versionTarget, setVersionTarget] = useState(null);
 
   const fetchTextbooks = useCallback(async ({ silent = false } = {}) => {
     if (!silent) setIsLoading(true);
@@ -62,7 +72,12 @@ const TextbookManager = () => {
   }, [fetchTextbooks]);
 
   useEffect(() => {
-    const hasProcessing = textbooks.some((textbook) => textbook.status === 'processing');
+    const hasProcessing = textbooks.some((textbook) => (
+      textbook.status === 'processing'
+      || textbook.status === 'deleting'
+      || textbook.ingest_job?.status === 'canceling'
+      || textbook.pending_version
+    ));
     if (hasProcessing) {
       if (pollTimerRef.current) window.clearInterval(pollTimerRef.current);
       pollTimerRef.current = window.setInterval(() => fetchTextbooks({ silent: true }), POLL_INTERVAL_MS);
@@ -97,6 +112,7 @@ const TextbookManager = () => {
     const formData = new FormData();
     formData.append('file', file);
     formData.append('name', name.trim());
+    formData.append('visibility', visibility);
 
     try {
       await axios.post(`${API_BASE_URL}/api/teacher/textbooks`, formData, {
@@ -120,23 +136,81 @@ const TextbookManager = () => {
   const handleCancel = async (textbook) => {
     const approved = await confirm({
       title: '取消教材解析？',
-      description: `将停止《${textbook.name}》当前的 OCR 与入库任务，已生成的数据会由后续删除操作清理。`,
+      description: `将停止《${textbook.name}》当前的 OCR 与入库任务并清理已写入的切片和题目；已识别的页会保留，之后可继续解析。`,
       confirmLabel: '取消解析',
       tone: 'danger',
     });
     if (!approved) return;
 
     try {
-      await axios.post(`${API_BASE_URL}/api/teacher/textbooks/${textbook.id}/cancel`, {}, {
+      const res = await axios.post(`${API_BASE_URL}/api/teacher/textbooks/${textbook.id}/cancel`, {}, {
         headers: { Authorization: `Bearer ${token}` },
       });
-      showToast('已发送取消指令', 'info');
+      showToast(res.data?.message || '已发送取消指令', 'info');
       fetchTextbooks();
     } catch (requestError) {
       showToast(requestError.response?.data?.error || '取消失败', 'error');
     }
   };
 
+  const handleRetry = async (textbook) => {
+    try {
+      await axios.post(`${API_BASE_URL}/api/teacher/textbooks/${textbook.id}/retry`, {}, {
+        headers: { Authorization: `Bearer ${token}` },
+      });
+      showToast(textbook.status === 'canceled' ? '已继续解析，已识别的页将直接复用' : '已重新提交解析任务', 'success');
+      fetchTextbooks();
+    } catch (requestError) {
+      showToast(requestError.response?.data?.error || '重试失败', 'error');
+    }
+  };
+
+  const handleVisibilityChange = async (textbook, nextVisibility) => {
+    try {
+      await axios.put(`${API_BASE_URL}/api/teacher/textbooks/${textbook.id}/visibility`, { visibility: nextVisibility }, {
+        headers: { Authorization: `Bearer ${token}` },
+      });
+      showToast('可见范围已更新', 'success');
+      fetchTextbooks({ silent: true });
+    } catch (requestError) {
+      showToast(requestError.response?.data?.error || '更新可见范围失败', 'error');
+    }
+  };
+
+  const handlePickVersion = (textbook) => {
+    setVersionTarget(textbook);
+    versionInputRef.current?.click();
+  };
+
+  const handleVersionUpload = async (event) => {
+    const picked = event.target.files?.[0];
+    event.target.value = '';
+    if (!picked || !versionTarget) return;
+    const approved = await confirm({
+      title: '上传新版本？',
+      description: `《${versionTarget.name}》的新版本解析完成后会自动替换当前版本，作业和收藏中的题目会按题号与题干迁移到新版本。解析期间学生仍使用当前版本。`,
+      confirmLabel: '上传',
+    });
+    if (!approved) return;
+
+    const formData = new FormData();
+    formData.append('file', picked);
+    try {
+      const res = await axios.post(`${API_BASE_URL}/api/teacher/textbooks/${versionTarget.id}/versions`, formData, {
+        headers: {
+          Authorization: `Bearer ${token}`,
+          'Content-Type': 'multipart/form-data',
+        },
+      });
+      showToast(res.data?.message || '新版本已上传', 'success');
+      fetchTextbooks();
+    } catch (requestError) {
+      showToast(requestError.response?.data?.error || '上传新版本失败', 'error');
+    } finally {
+      setVersionTarget(null);
+    }
+  };
+
   const handleDelete = async (textbook) => {
     const description = textbook.status === 'completed'
       ? `这会永久删除《${textbook.name}》的上传文件、教材切片、题目和向量库数据。`
@@ -149,15 +223,36 @@ const TextbookManager = () => {
     });
     if (!approved) return;
 
+    const requestDelete = (cascade) => axios.delete(`${API_BASE_URL}/api/teacher/textbooks/${textbook.id}`, {
+      headers: { Authorization: `Bearer ${token}` },
+      params: cascade ? { cascade: 1 } : undefined,
+    });
     try {
-      await axios.delete(`${API_BASE_URL}/api/teacher/textbooks/${textbook.id}`, {
-        headers: { Authorization: `Bearer ${token}` },
-      });
-      showToast('教材及关联数据已删除', 'success');
-      fetchTextbooks();
+      await requestDelete(false);
     } catch (requestError) {
-      showToast(requestError.response?.data?.error || '删除失败', 'error');
+      const dependencies = requestError.response?.status === 409 && requestError.response.data?.dependencies;
+      if (!dependencies) {
+        showToast(requestError.response?.data?.error || '删除失败', 'error');
+        return;
+      }
+      const parts = dependencies.assignments.map((assignment) => `《${assignment.title}》${assignment.exercise_count} 题`);
+      if (dependencies.favorite_count > 0) parts.push(`${dependencies.favorite_count} 条学生收藏`);
+      const cascadeApproved = await confirm({
+        title: '教材题目仍被引用',
+        description: `以下内容引用了《${textbook.name}》的题目：${parts.join('、')}。继续删除会把这些题目从作业和收藏中移除，已提交的作答记录保留。`,
+        confirmLabel: '连同引用一起删除',
+        tone: 'danger',
+      });
+      if (!cascadeApproved) return;
+      try {
+        await requestDelete(true);
+      } catch (cascadeError) {
+        showToast(cascadeError.response?.data?.error || '删除失败', 'error');
+        return;
+      }
     }
+    showToast('教材已移除，后台正在清理关联数据', 'success');
+    fetchTextbooks();
   };
 
   return (
@@ -193,6 +288,14 @@ const TextbookManager = () => {
               required
             />
           </label>
+          <label>
+            <span>可见范围</span>
+            <select className="ui-field" value={visibility} onChange={(event) => setVisibility(event.target.value)}>
+              {visibilityOptions.map((option) => (
+                <option key={option.value} value={option.value}>{option.label}</option>
+              ))}
+            </select>
+          </label>
           <div className="textbook-upload__footer">
             <p>大体积教材可能需要较长时间，离开页面不会中断后台任务。</p>
             <Button
@@ -228,11 +331,19 @@ const TextbookManager = () => {
           />
         ) : (
           <div className="textbook-task-list">
+            <input
+              ref={versionInputRef}
+              type="file"
+              accept=".pdf,.ppt,.pptx,.doc,.docx"
+              hidden
+              onChange={handleVersionUpload}
+            />
             {textbooks.map((textbook) => {
               const meta = statusMeta[textbook.status] || statusMeta.canceled;
               const StatusIcon = meta.icon;
               const totalPages = Number(textbook.total_pages) || 0;
               const processedPages = Number(textbook.processed_pages) || 0;
+              const isOwner = !textbook.teacher_id || textbook.teacher_id === Number(user?.sub);
               const progress = totalPages > 0
                 ? Math.min(100, Math.max(0, Math.floor((processedPages / totalPages) * 100)))
                 : null;
@@ -242,7 +353,10 @@ const TextbookManager = () => {
                   <div className="textbook-task__file">
                     <div className="textbook-task__file-icon"><FileText size={18} aria-hidden="true" /></div>
                     <div>
-                      <h3>{textbook.name}</h3>
+                      <h3>
+                        {textbook.name}
+                        {textbook.current_version > 1 ? ` · 第 ${textbook.current_version} 版` : ''}
+                      </h3>
                       <p>{new Date(textbook.created_at).toLocaleString('zh-CN', { hour12: false })}</p>
                     </div>
                   </div>
@@ -264,16 +378,61 @@ const TextbookManager = () => {
                     {textbook.status === 'processing' && (
                       <p>{totalPages > 0 ? `${processedPages} / ${totalPages} 页` : '正在读取教材页数'}</p>
                     )}
+                    {textbook.pending_version && (
+                      <p>
+                        第 {textbook.pending_version.version} 版解析中
+                        {textbook.pending_version.total_pages > 0
+                          ? `（${textbook.pending_version.processed_pages} / ${textbook.pending_version.total_pages} 页）`
+                          : ''}
+                      </p>
+                    )}
+                    {textbook.status === 'deleting' && <p>正在清理向量库数据与文件…</p>}
+                    {textbook.status === 'canceled' && textbook.ingest_job?.status === 'canceling' && (
+                      <p>正在停止解析并清理数据…</p>
+                    )}
+                    {textbook.status === 'failed' && textbook.ingest_job?.last_error && (
+                      <p title={textbook.ingest_job.last_error}>
+                        第 {textbook.ingest_job.attempts} 次尝试失败：{textbook.ingest_job.last_error}
+                      </p>
+                    )}
                   </div>
 
                   <div className="textbook-task__actions">
+                    {isOwner ? (
+                      <select
+                        className="ui-field"
+                        aria-label={`${textbook.name} 的可见范围`}
+                        value={textbook.visibility || 'institution'}
+                        disabled={textbook.status === 'deleting'}
+                        onChange={(event) => handleVisibilityChange(textbook, event.target.value)}
+                      >
+                        {visibilityOptions.map((option) => (
+                          <option key={option.value} value={option.value}>{option.label}</option>
+                        ))}
+                      </select>
+                    ) : (
+                      <span className="textbook-task__shared">他人共享</span>
+                    )}
                     {textbook.status === 'processing' && (
                       <Button size="sm" icon={XCircle} onClick={() => handleCancel(textbook)}>取消</Button>
                     )}
+                    {(textbook.status === 'failed' || textbook.status === 'canceled') && (
+                      <Button
+                        size="sm"
+                        icon={RefreshCw}
+                        disabled={textbook.ingest_job?.status === 'canceling'}
+                        onClick={() => handleRetry(textbook)}
+                      >
+                        {textbook.status === 'canceled' ? '继续解析' : '重试'}
+                      </Button>
+                    )}
+                    {isOwner && textbook.status !== 'processing' && textbook.status !== 'deleting' && !textbook.pending_version && (
+                      <Button size="sm" icon={Upload} onClick={() => handlePickVersion(textbook)}>上传新版本</Button>
+                    )}
                     <IconButton
                       icon={Trash2}
                       label={`删除教材 ${textbook.name}`}
-                      disabled={textbook.status === 'processing'}
+                      disabled={!isOwner || textbook.status === 'deleting'}
                       onClick={() => handleDelete(textbook)}
                     />
                   </div>
@@ -14,11 +14,17 @@ import { Blocks, Bot, Calculator, PanelLeft, X } from 'lucide-react';
 import './ChatPage.css';
 
 const API_BASE_URL = '';
+const SESSION_PAGE_SIZE = 100;
 const LAST_CHAT_ID_PREFIX = 'la-ai:last-chat-id';
 
 const getLastChatStorageKey = (user) => `${LAST_CHAT_ID_PREFIX}:${user?.sub || user?.name || 'anonymous'}`;
 const isRealSessionId = (id) => Boolean(id && id !== 'new' && !String(id).startsWith('temp-') && !Number.isNaN(Number(id)));
-const normalizeMessages = (messages) => Array.isArray(messages) ? messages : [];
+// 服务端保存的附件映射成 MessageList 使用的 files（带 attachmentId，点击时带鉴权下载）
+const normalizeMessages = (messages) => Array.isArray(messages)
+    ? messages.map(msg => (msg.attachments?.length && !msg.files
+        ? { ...msg, files: msg.attachments.map(att => ({ name: att.fileName, attachmentId: att.id })) }
+        : msg))
+    : [];
 const isPremiumModelExhausted = (model, modelConfig) => {
     const limitedIds = modelConfig?.features?.limited_chat_model_ids || [];
     const remaining = modelConfig?.usage?.premium_chat?.remaining;
@@ -40,6 +46,8 @@ const ChatPage = () => {
     const [isMobileHistoryOpen, setIsMobileHistoryOpen] = useState(false);
     const [isCalculatorOpen, setIsCalculatorOpen] = useState(false);
     const [fetchedMessageSessionIds, setFetchedMessageSessionIds] = useState(() => new Set());
+    const [sessionsCursor, setSessionsCursor] = useState(null);
+    const [isLoadingMoreSessions, setIsLoadingMoreSessions] = useState(false);
     const [modelConfig, setModelConfig] = useState(null);
     const [selectedModelId, setSelectedModelId] = useState('default');
     const chatPageRef = useRef(null);
@@ -122,11 +130,28 @@ const ChatPage = () => {
         }
     }, [modelConfig, selectedModelId]);
     
+    // 把一页会话并入侧边栏，保留已加载的消息
+    const mergeSessions = useCallback((sessions) => {
+        setChats(prev => {
+            const next = { ...prev };
+            sessions.forEach(session => {
+                const existing = prev[session.id] || prev[String(session.id)];
+                next[session.id] = {
+                    ...existing,
+                    ...session,
+                    messages: normalizeMessages(existing?.messages || session.messages),
+                };
+            });
+            return next;
+        });
+    }, []);
+
     useEffect(() => {
         if (!token) return;
-        axios.get(`${API_BASE_URL}/api/chat/sessions`)
+        axios.get(`${API_BASE_URL}/api/chat/sessions`, { params: { limit: SESSION_PAGE_SIZE } })
             .then(res => {
-                const sessions = Array.isArray(res.data) ? res.data : [];
+                const sessions = Array.isArray(res.data?.items) ? res.data.items : [];
+                setSessionsCursor(res.data?.hasMore ? res.data.nextCursor : null);
                 setChats(prev => {
                     const next = {};
                     Object.entries(prev).forEach(([id, chat]) => {
@@ -145,18 +170,35 @@ const ChatPage = () => {
                 if (!sessionId) {
                     const lastChatId = localStorage.getItem(lastChatStorageKey);
                     const hasLastChat = lastChatId && sessions.some(session => String(session.id) === String(lastChatId));
+                    const fallback = () => navigate(sessions.length > 0 ? `/chat/${sessions[0].id}` : '/chat/new', { replace: true });
                     if (hasLastChat) {
                         navigate(`/chat/${lastChatId}`, { replace: true });
-                    } else if (sessions.length > 0) {
-                        navigate(`/chat/${sessions[0].id}`, { replace: true });
+                    } else if (res.data?.hasMore && isRealSessionId(lastChatId)) {
+                        // 上次的会话不在第一页：确认它仍然存在再恢复
+                        axios.get(`${API_BASE_URL}/api/chat/messages/${lastChatId}`)
+                            .then(() => navigate(`/chat/${lastChatId}`, { replace: true }))
+                            .catch(fallback);
                     } else {
-                        navigate('/chat/new', { replace: true });
+                        fallback();
                     }
                 }
             })
             .catch(error => console.error("Failed to fetch sessions:", error));
     }, [token, sessionId, navigate, lastChatStorageKey]);
 
+    // 侧边栏翻页：按 nextCursor 继续加载更早的会话
+    const loadMoreSessions = useCallback(() => {
+        if (!sessionsCursor || isLoadingMoreSessions) return;
+        setIsLoadingMoreSessions(true);
+        axios.get(`${API_BASE_URL}/api/chat/sessions`, { params: { limit: SESSION_PAGE_SIZE, cursor: sessionsCursor } })
+            .then(res => {
+                mergeSessions(Array.isArray(res.data?.items) ? res.data.items : []);
+                setSessionsCursor(res.data?.hasMore ? res.data.nextCursor : null);
+            })
+            .catch(error => console.error("Failed to fetch more sessions:", error))
+            .finally(() => setIsLoadingMoreSessions(false));
+    }, [sessionsCursor, isLoadingMoreSessions, mergeSessions]);
+
     useEffect(() => {
         if (isRealSessionId(sessionId)) {
             localStorage.setItem(lastChatStorageKey, String(sessionId));
@@ -174,7 +216,8 @@ const ChatPage = () => {
                     ...prev,
                     [sessionId]: {
                         ...(prev[sessionId] || { id: sessionId, title: '对话记录' }),
-                        messages: normalizeMessages(res.data),
+                        messages: normalizeMessages(res.data?.items),
+                        olderCursor: res.data?.hasMore ? res.data.nextCursor : null,
                     },
                 })))
                 .catch(error => console.error(`Failed to fetch messages for session ${sessionId}:`, error))
@@ -185,6 +228,29 @@ const ChatPage = () => {
         }
     }, [sessionId, chats, fetchedMessageSessionIds]);
 
+    // 长对话分页：向前加载更早的一页消息，拼在当前消息之前
+    const [isLoadingOlder, setIsLoadingOlder] = useState(false);
+    const loadOlderMessages = useCallback(() => {
+        const cursor = chats[sessionId]?.olderCursor;
+        if (!cursor || isLoadingOlder) return;
+        setIsLoadingOlder(true);
+        axios.get(`${API_BASE_URL}/api/chat/messages/${sessionId}`, { params: { before: cursor } })
+            .then(res => setChats(prev => {
+                const chat = prev[sessionId];
+                if (!chat) return prev;
+                return {
+                    ...prev,
+                    [sessionId]: {
+                        ...chat,
+                        messages: [...normalizeMessages(res.data?.items), ...normalizeMessages(chat.messages)],
+                        olderCursor: res.data?.hasMore ? res.data.nextCursor : null,
+                    },
+                };
+            }))
+            .catch(error => console.error(`Failed to fetch older messages for session ${sessionId}:`, error))
+            .finally(() => setIsLoadingOlder(false));
+    }, [chats, sessionId, isLoadingOlder]);
+
     const removePendingRequestMessages = useCallback((request) => {
         setChats(prev => {
             const fallbackChatId = sessionId;
@@ -360,6 +426,9 @@ const ChatPage = () => {
                     onSelectChat={(id) => navigate(`/chat/${id}`)}
                     isCollapsed={isHistoryCollapsed}
                     onToggle={() => setIsHistoryCollapsed(!isHistoryCollapsed)}
+                    hasMore={Boolean(sessionsCursor)}
+                    isLoadingMore={isLoadingMoreSessions}
+                    onLoadMore={loadMoreSessions}
                 />
             </aside>
 
@@ -423,7 +492,16 @@ const ChatPage = () => {
                             <p>你好，{user?.displayName || user?.name}。我可以解释概念、检索教材，也可以陪你逐步解题。</p>
                         </div>
                     ) : (
-                        <MessageList messages={activeMessages} isLoading={isSending} user={user} />
+                        <>
+                            {activeChat?.olderCursor && (
+                                <div className="chat-page__load-older">
+                                    <Button variant="ghost" size="sm" loading={isLoadingOlder} onClick={loadOlderMessages}>
+                                        加载更早的消息
+                                    </Button>
+                                </div>
+                            )}
+                            <MessageList messages={activeMessages} isLoading={isSending} user={user} />
+                        </>
                     )}
 
                     <div className="chat-page__composer">
@@ -458,6 +536,9 @@ const ChatPage = () => {
                                 setIsMobileHistoryOpen(false);
                                 navigate(`/chat/${id}`);
                             }}
+                            hasMore={Boolean(sessionsCursor)}
+                            isLoadingMore={isLoadingMoreSessions}
+                            onLoadMore={loadMoreSessions}
                             mobile
                         />
                     </aside>
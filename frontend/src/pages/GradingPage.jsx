@@ -11,6 +11,7 @@ import PageHeader from '../components/ui/PageHeader';
 import Select from '../components/ui/Select';
 import { InlineAlert } from '../components/ui/FeedbackState';
 import autoWrapMath from '../utils/autoWrapMath';
+import { awaitJob } from '../utils/awaitJob';
 import './GradingPage.css';
 
 const GradingPage = () => {
@@ -89,10 +90,9 @@ const GradingPage = () => {
     formData.append('use_vision', useVisionOcr ? 'true' : 'false');
 
     try {
-      const response = await axios.post('/api/grading/ocr', formData, {
-        headers: { Authorization: `Bearer ${token}` },
-      });
-      const nextText = response.data.text || '';
+      const config = { headers: { Authorization: `Bearer ${token}` } };
+      const result = await awaitJob(await axios.post('/api/grading/ocr', formData, config), config);
+      const nextText = result?.text || '';
       setText((current) => current ? `${current}\n\n--- ${file.name} ---\n${nextText}` : nextText);
       setFiles((current) => current.map((item) => item.id === fileId ? { ...item, isLoading: false } : item));
     } catch (requestError) {
@@ -118,10 +118,8 @@ const GradingPage = () => {
     if (selectedAssignmentId) formData.append('assignmentId', selectedAssignmentId);
 
     try {
-      const response = await axios.post('/api/grading/upload', formData, {
-        headers: { Authorization: `Bearer ${token}` },
-      });
-      setGradeResult(response.data);
+      const config = { headers: { Authorization: `Bearer ${token}` } };
+      setGradeResult(await awaitJob(await axios.post('/api/grading/upload', formData, config), config));
     } catch (requestError) {
       setError(requestError.response?.data?.error || '批改失败');
     } finally {
@@ -143,13 +141,15 @@ const GradingPage = () => {
     formData.append('solutionText', gradeResult.solutionText);
     formData.append('correctionText', gradeResult.correction);
     formData.append('newQuestion', followUpQuestion);
+    if (gradeResult.gradeResultId) {
+      formData.append('gradeResultId', gradeResult.gradeResultId);
+    }
 
     try {
-      const response = await axios.post('/api/grading/followup', formData, {
-        headers: { Authorization: `Bearer ${token}` },
-      });
-      if (!response.data?.chatSessionId) throw new Error('未返回答疑会话');
-      navigate(`/chat/${response.data.chatSessionId}`);
+      const config = { headers: { Authorization: `Bearer ${token}` } };
+      const result = await awaitJob(await axios.post('/api/grading/followup', formData, config), config);
+      if (!result?.chatSessionId) throw new Error('未返回答疑会话');
+      navigate(`/chat/${result.chatSessionId}`);
     } catch (requestError) {
       setError(requestError.response?.data?.error || '开启答疑会话失败，请稍后重试');
     } finally {
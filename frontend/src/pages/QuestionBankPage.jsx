@@ -11,6 +11,7 @@ import Select from '../components/ui/Select';
 import { EmptyState, InlineAlert, LoadingState } from '../components/ui/FeedbackState';
 import { useToast } from '../contexts/ToastContext';
 import { useAuth } from '../hooks/useAuth';
+import { awaitJob } from '../utils/awaitJob';
 import { ALL_CONCEPT_TAGS, CONCEPT_TAXONOMY } from '../utils/conceptsTaxonomy';
 import './QuestionBankPage.css';
 
@@ -244,8 +245,8 @@ const QuestionBankPage = () => {
     setExplainingId(question.id);
     showToast('正在生成讲解，请稍候…', 'info');
     try {
-      const response = await axios.post(`/api/questions/${question.id}/explain`);
-      const sessionId = response.data?.chatSessionId;
+      const result = await awaitJob(await axios.post(`/api/questions/${question.id}/explain`));
+      const sessionId = result?.chatSessionId;
       if (!sessionId) throw new Error('no session');
       navigate(`/chat/${sessionId}`);
     } catch (requestError) {
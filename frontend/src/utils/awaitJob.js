@@ -0,0 +1,23 @@
+import axios from 'axios';
+
+const POLL_INTERVAL_MS = 1500;
+
+const sleep = (ms) => new Promise((resolve) => setTimeout(resolve, ms));
+
+// 长耗时接口默认返回 202 + jobId，这里轮询 /api/jobs/:id 直到任务结束，
+// 返回与同步接口一致的结果；失败时抛出与 axios 相同形状的错误，调用方照旧读取 response.data.error。
+export const awaitJob = async (response, config = {}) => {
+  if (response.status !== 202 || !response.data?.jobId) return response.data;
+
+  const { jobId } = response.data;
+  for (;;) {
+    await sleep(POLL_INTERVAL_MS);
+    const { data: job } = await axios.get(`/api/jobs/${jobId}`, config);
+    if (job.status === 'succeeded') return job.result;
+    if (job.status === 'failed' || job.status === 'canceled') {
+      const error = new Error(job.error || '任务失败');
+      error.response = { data: { error: job.error || '任务失败' } };
+      throw error;
+    }
+  }
+};
@@ -45,7 +45,24 @@ func CurrentUser(db *gorm.DB, c *gin.Context) (auth.User, bool, error) {
 	return user, true, nil
 }
 
+// TeacherVisibleTextbooks 限定为该老师能看到的教材：自己上传的、全校可见的（institution）、
+// 授权给他的（shared + textbook_shares），以及没有归属的旧数据
+func TeacherVisibleTextbooks(db *gorm.DB, teacherID uint) *gorm.DB {
+	return db.Where(
+		"textbooks.teacher_id = ? OR textbooks.teacher_id = 0 OR textbooks.visibility = ? OR "+
+			"(textbooks.visibility = ? AND textbooks.id IN (SELECT textbook_id FROM textbook_shares WHERE teacher_id = ?))",
+		teacherID, "institution", "shared", teacherID,
+	)
+}
+
+// AllowedTextbookIDsForUser 用户可用的教材范围：学生为本班选用的教材，老师为自己可见的教材。
+// 第二个返回值表示是否受限（目前两种角色都受限）。
 func AllowedTextbookIDsForUser(db *gorm.DB, user auth.User) ([]uint, bool, error) {
+	if user.Role == "teacher" {
+		ids := []uint{}
+		err := TeacherVisibleTextbooks(db.Table("textbooks"), user.ID).Order("textbooks.id asc").Pluck("textbooks.id", &ids).Error
+		return ids, true, err
+	}
 	if user.Role != "student" {
 		return nil, false, nil
 	}
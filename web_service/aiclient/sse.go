@@ -0,0 +1,87 @@
+package aiclient
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// StreamTimeout 流式请求的总时长上限（长回答逐 token 输出，不能沿用 180s 的整体超时）
+const StreamTimeout = 10 * time.Minute
+
+// PostStream 以 multipart 表单请求 ai_service 的流式接口。状态码 >= 400 时读出响应体作为错误返回。
+func PostStream(ctx context.Context, path string, body io.Reader, contentType string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", URL(path), body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("Accept", "text/event-stream")
+	client := &http.Client{Timeout: StreamTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= http.StatusBadRequest {
+		defer resp.Body.Close()
+		responseBody, _ := io.ReadAll(resp.Body)
+		return nil, &StatusError{Status: resp.StatusCode, Body: responseBody}
+	}
+	return resp, nil
+}
+
+// StatusError ai_service 返回的非 2xx 响应
+type StatusError struct {
+	Status int
+	Body   []byte
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("ai_service 返回 %d: %s", e.Status, string(e.Body))
+}
+
+// ReadSSE 逐个解析 Server-Sent Events，对每个事件调用 fn(event, data)；fn 返回错误时停止读取。
+// 上游正常结束返回 nil，连接中断或 ctx 取消返回读取错误。
+func ReadSSE(r io.Reader, fn func(event string, data []byte) error) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	event := ""
+	var data bytes.Buffer
+	dispatch := func() error {
+		defer func() {
+			event = ""
+			data.Reset()
+		}()
+		if data.Len() == 0 {
+			return nil
+		}
+		if event == "" {
+			event = "message"
+		}
+		return fn(event, bytes.TrimSuffix(data.Bytes(), []byte("\n")))
+	}
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		switch {
+		case len(line) == 0:
+			if err := dispatch(); err != nil {
+				return err
+			}
+		case line[0] == ':':
+			// 注释 / 心跳
+		case bytes.HasPrefix(line, []byte("event:")):
+			event = string(bytes.TrimSpace(line[len("event:"):]))
+		case bytes.HasPrefix(line, []byte("data:")):
+			data.Write(bytes.TrimPrefix(line[len("data:"):], []byte(" ")))
+			data.WriteByte('\n')
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return dispatch()
+}
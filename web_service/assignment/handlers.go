@@ -2,6 +2,7 @@ package assignment
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"mime"
@@ -13,6 +14,8 @@ import (
 	"time"
 	"workplace/web_service/accesscontrol"
 	"workplace/web_service/auth"
+	"workplace/web_service/jobs"
+	"workplace/web_service/ocr"
 
 	"github.com/gin-gonic/gin"
 	"gorm.io/gorm"
@@ -20,7 +23,8 @@ import (
 )
 
 type AssignmentHandler struct {
-	DB *gorm.DB
+	DB   *gorm.DB
+	Jobs *jobs.Queue
 }
 
 func parseExerciseIDs(raw string) ([]uint, error) {
@@ -136,6 +140,18 @@ func (h *AssignmentHandler) enrichAssignment(assignment *Assignment) {
 	}
 }
 
+// hideQuizContentForStudent 测验题目只能在开始作答（计时开始）后通过作答接口获取，列表/详情只给题量。
+func hideQuizContentForStudent(user auth.User, assignment *Assignment) {
+	if !assignment.IsQuiz() {
+		return
+	}
+	assignment.QuestionCount = len(assignment.ExerciseIDs)
+	if user.Role == "student" {
+		assignment.ExerciseIDs = nil
+		assignment.Exercises = nil
+	}
+}
+
 func (h *AssignmentHandler) attachStudentNames(assignment *Assignment) {
 	if len(assignment.Submissions) == 0 {
 		return
@@ -226,6 +242,37 @@ func (h *AssignmentHandler) CreateAssignmentHandler(c *gin.Context) {
 		return
 	}
 
+	assignmentType := strings.TrimSpace(c.DefaultPostForm("type", AssignmentTypeFile))
+	if assignmentType != AssignmentTypeFile && assignmentType != AssignmentTypeQuiz {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "作业类型不合法"})
+		return
+	}
+	timeLimitMinutes := 0
+	subjectiveGrading := "teacher"
+	if assignmentType == AssignmentTypeQuiz {
+		if len(exerciseIDs) == 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "在线测验需要从题库选择题目"})
+			return
+		}
+		if raw := strings.TrimSpace(c.PostForm("timeLimitMinutes")); raw != "" {
+			n, err := strconv.Atoi(raw)
+			if err != nil || n < 0 || n > 24*60 {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "限时分钟数不合法"})
+				return
+			}
+			timeLimitMinutes = n
+		}
+		if mode := strings.TrimSpace(c.PostForm("subjectiveGrading")); mode != "" {
+			if mode != "teacher" && mode != "ai" {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "主观题批改方式只能是 teacher 或 ai"})
+				return
+			}
+			subjectiveGrading = mode
+		}
+	}
+	shuffleQuestions, _ := strconv.ParseBool(c.PostForm("shuffleQuestions"))
+	shuffleOptions, _ := strconv.ParseBool(c.PostForm("shuffleOptions"))
+
 	user, ok := h.currentUser(c)
 	if !ok || user.Role != "teacher" {
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "未登录"})
@@ -254,11 +301,16 @@ func (h *AssignmentHandler) CreateAssignmentHandler(c *gin.Context) {
 	}
 
 	assignment := Assignment{
-		TeacherID:   user.ID,
-		ClassID:     classID,
-		Title:       title,
-		ProblemText: problemText,
-		CreatedAt:   time.Now(),
+		TeacherID:         user.ID,
+		ClassID:           classID,
+		Title:             title,
+		ProblemText:       problemText,
+		Type:              assignmentType,
+		TimeLimitMinutes:  timeLimitMinutes,
+		ShuffleQuestions:  shuffleQuestions && assignmentType == AssignmentTypeQuiz,
+		ShuffleOptions:    shuffleOptions && assignmentType == AssignmentTypeQuiz,
+		SubjectiveGrading: subjectiveGrading,
+		CreatedAt:         time.Now(),
 	}
 
 	if hasFile {
@@ -307,8 +359,10 @@ func (h *AssignmentHandler) CreateAssignmentHandler(c *gin.Context) {
 		}
 	}
 	tx.Commit()
+	h.enqueueProblemFileOCR(&assignment)
 
 	h.enrichAssignment(&assignment)
+	hideQuizContentForStudent(user, &assignment)
 	c.JSON(http.StatusOK, assignment)
 }
 
@@ -343,6 +397,7 @@ func (h *AssignmentHandler) ListAssignmentsHandler(c *gin.Context) {
 	}
 	for i := range assignments {
 		h.enrichAssignment(&assignments[i])
+		hideQuizContentForStudent(user, &assignments[i])
 	}
 	c.JSON(http.StatusOK, assignments)
 }
@@ -374,6 +429,7 @@ func (h *AssignmentHandler) GetAssignmentHandler(c *gin.Context) {
 			Order("created_at desc").Find(&assignment.Submissions)
 	}
 	h.enrichAssignment(&assignment)
+	hideQuizContentForStudent(user, &assignment)
 	c.JSON(http.StatusOK, assignment)
 }
 
@@ -385,8 +441,18 @@ func (h *AssignmentHandler) SubmitAssignmentHandler(c *gin.Context) {
 		return
 	}
 
-	file, err := c.FormFile("solutionFile")
-	if err != nil {
+	// 解答可以是上传的文件，也可以是学生校对过的识别文档（ocrDocumentId），至少其一
+	file, fileErr := c.FormFile("solutionFile")
+	var documentID uint
+	if raw := strings.TrimSpace(c.PostForm("ocrDocumentId")); raw != "" {
+		parsed, err := strconv.Atoi(raw)
+		if err != nil || parsed <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "识别文档 ID 不合法"})
+			return
+		}
+		documentID = uint(parsed)
+	}
+	if fileErr != nil && documentID == 0 {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "No file is received"})
 		return
 	}
@@ -405,29 +471,49 @@ func (h *AssignmentHandler) SubmitAssignmentHandler(c *gin.Context) {
 		c.JSON(http.StatusForbidden, gin.H{"error": "无权提交该作业"})
 		return
 	}
-
-	uploadDir := "./uploads/submissions"
-	if err := os.MkdirAll(uploadDir, os.ModePerm); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create upload directory"})
+	if assignment.IsQuiz() {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "在线测验请在页面内作答交卷"})
 		return
 	}
 
-	newFileName := fmt.Sprintf("%d-%d-%d-%s", assignmentID, user.ID, time.Now().UnixNano(), filepath.Base(file.Filename))
-	filePath := filepath.Join(uploadDir, newFileName)
-
-	if err := c.SaveUploadedFile(file, filePath); err != nil {
-		log.Printf("Error saving file: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save file"})
-		return
+	submission := Submission{
+		AssignmentID: uint(assignmentID),
+		StudentID:    user.ID,
+		Status:       "submitted",
+		CreatedAt:    time.Now(),
+	}
+	if documentID != 0 {
+		text, err := ocr.LoadDocumentText(h.DB, user.ID, documentID)
+		if errors.Is(err, ocr.ErrDocumentNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "读取识别文档失败"})
+			return
+		}
+		// 保存文本快照：学生之后再改识别文档也不影响已提交的内容
+		submission.OCRDocumentID = &documentID
+		submission.SolutionText = text
 	}
 
-	submission := Submission{
-		AssignmentID:     uint(assignmentID),
-		StudentID:        user.ID,
-		SolutionFilePath: filePath,
-		SolutionFileName: file.Filename,
-		Status:           "submitted",
-		CreatedAt:        time.Now(),
+	if fileErr == nil {
+		uploadDir := "./uploads/submissions"
+		if err := os.MkdirAll(uploadDir, os.ModePerm); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create upload directory"})
+			return
+		}
+
+		newFileName := fmt.Sprintf("%d-%d-%d-%s", assignmentID, user.ID, time.Now().UnixNano(), filepath.Base(file.Filename))
+		filePath := filepath.Join(uploadDir, newFileName)
+
+		if err := c.SaveUploadedFile(file, filePath); err != nil {
+			log.Printf("Error saving file: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save file"})
+			return
+		}
+		submission.SolutionFilePath = filePath
+		submission.SolutionFileName = file.Filename
 	}
 
 	if err := h.DB.Create(&submission).Error; err != nil {
@@ -490,6 +576,11 @@ func (h *AssignmentHandler) ServeSubmissionFileHandler(c *gin.Context) {
 		c.JSON(http.StatusForbidden, gin.H{"error": "无权查看该提交"})
 		return
 	}
+	if submission.SolutionFilePath == "" {
+		// 仅以识别文档提交，解答文本见 solutionText
+		c.JSON(http.StatusNotFound, gin.H{"error": "该提交没有附件"})
+		return
+	}
 
 	c.Header("Content-Disposition", fmt.Sprintf("inline; filename=%s", filepath.Base(submission.SolutionFileName)))
 	c.Header("Content-Type", "application/pdf")
@@ -0,0 +1,298 @@
+// web_service/assignment/integrity.go
+
+package assignment
+
+import (
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+	"unicode"
+	"workplace/web_service/auth"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const (
+	IntegrityMatchExercise = "exercise_id" // 直接对题库题目请求讲解
+	IntegrityMatchText     = "text"        // 提问文字与作业题面高度重合
+
+	IntegritySourceChat    = "chat"
+	IntegritySourceExplain = "explain"
+	IntegritySourceGrading = "grading" // 批改后答疑
+
+	// 题面规范化后少于这么多字符时不做文本比对（太短容易误判）
+	integrityMinStemRunes = 12
+	// 题面二元组有这么大比例出现在提问中即视为同一道题
+	integrityTextThreshold  = 0.6
+	maxIntegrityPromptRunes = 2000
+)
+
+// IntegrityEvent 诚信模式下被切换为“只给提示”的一次提问，供老师复核
+type IntegrityEvent struct {
+	ID           uint      `gorm:"primarykey" json:"id"`
+	AssignmentID uint      `gorm:"index;not null" json:"assignmentId"`
+	ExerciseID   *uint     `json:"exerciseId,omitempty"`
+	StudentID    uint      `gorm:"index;not null" json:"studentId"`
+	StudentName  string    `gorm:"-" json:"studentName,omitempty"`
+	Source       string    `gorm:"size:20;not null" json:"source"` // chat / explain / grading
+	MatchType    string    `gorm:"size:20;not null" json:"matchType"`
+	Similarity   float64   `json:"similarity"`
+	Prompt       string    `gorm:"type:text" json:"prompt"`
+	CreatedAt    time.Time `gorm:"index" json:"createdAt"`
+}
+
+// IntegrityMatch 命中的作业与题目
+type IntegrityMatch struct {
+	AssignmentID uint
+	ExerciseID   *uint
+	MatchType    string
+	Similarity   float64
+}
+
+// integrityAssignments 学生所在班级当前开启诚信模式的作业（未指定班级的旧作业按任课老师匹配）
+func integrityAssignments(db *gorm.DB, user auth.User) ([]Assignment, error) {
+	if user.Role != "student" || user.ClassID == nil {
+		return nil, nil
+	}
+	var assignments []Assignment
+	err := db.Preload("AssignmentItems").
+		Where("integrity_mode = ? AND (integrity_until IS NULL OR integrity_until > ?)", true, time.Now()).
+		Where("class_id = ? OR (class_id IS NULL AND teacher_id = (SELECT teacher_id FROM classes WHERE id = ?))", *user.ClassID, *user.ClassID).
+		Find(&assignments).Error
+	return assignments, err
+}
+
+// IntegrityActive 学生当前是否有开启诚信模式的作业；调用方据此决定要不要先识别附件再比对
+func IntegrityActive(db *gorm.DB, user auth.User) bool {
+	assignments, err := integrityAssignments(db, user)
+	if err != nil {
+		log.Printf("Failed to check assignment integrity mode for user %d: %v", user.ID, err)
+	}
+	return len(assignments) > 0
+}
+
+// problemPieces 把自由文本题目按空行或题号拆成单题，便于和学生粘贴的一道题比对
+var problemSplitter = regexp.MustCompile(`\n\s*\n|\n\s*(?:\d+|[一二三四五六七八九十]+)[.、．)）]`)
+
+func problemPieces(texts ...string) []string {
+	var pieces []string
+	for _, text := range texts {
+		for _, piece := range problemSplitter.Split(text, -1) {
+			if piece = strings.TrimSpace(piece); piece != "" {
+				pieces = append(pieces, piece)
+			}
+		}
+	}
+	return pieces
+}
+
+// textBigrams 去掉空白和标点后的相邻字符二元组，对中文题面与粘贴时的排版差异都比较稳
+func textBigrams(text string) map[string]bool {
+	runes := make([]rune, 0, len(text))
+	for _, r := range strings.ToLower(text) {
+		if unicode.IsSpace(r) || unicode.IsPunct(r) {
+			continue
+		}
+		runes = append(runes, r)
+	}
+	grams := make(map[string]bool, len(runes))
+	for i := 0; i+1 < len(runes); i++ {
+		grams[string(runes[i:i+2])] = true
+	}
+	return grams
+}
+
+// stemContainment 题面的二元组中有多大比例出现在提问里；题面过短时返回 0
+func stemContainment(stem string, prompt map[string]bool) float64 {
+	grams := textBigrams(stem)
+	if len(grams) < integrityMinStemRunes-1 {
+		return 0
+	}
+	hit := 0
+	for g := range grams {
+		if prompt[g] {
+			hit++
+		}
+	}
+	return float64(hit) / float64(len(grams))
+}
+
+// MatchIntegrity 判断学生本次提问是否涉及开启诚信模式的作业：exerciseID 非 0 时按题目 ID 匹配，
+// 否则把提问与作业的题库题面、题目文本及附件识别文字逐题比对。未命中返回 nil。
+func MatchIntegrity(db *gorm.DB, user auth.User, prompt string, exerciseID uint) (*IntegrityMatch, error) {
+	assignments, err := integrityAssignments(db, user)
+	if err != nil || len(assignments) == 0 {
+		return nil, err
+	}
+	if exerciseID != 0 {
+		for _, a := range assignments {
+			for _, item := range a.AssignmentItems {
+				if item.ExerciseID == exerciseID {
+					id := exerciseID
+					return &IntegrityMatch{AssignmentID: a.ID, ExerciseID: &id, MatchType: IntegrityMatchExercise, Similarity: 1}, nil
+				}
+			}
+		}
+	}
+	promptGrams := textBigrams(prompt)
+	if len(promptGrams) == 0 {
+		return nil, nil
+	}
+
+	var exerciseIDs []uint
+	for _, a := range assignments {
+		for _, item := range a.AssignmentItems {
+			exerciseIDs = append(exerciseIDs, item.ExerciseID)
+		}
+	}
+	stems := map[uint]string{}
+	if len(exerciseIDs) > 0 {
+		var rows []struct {
+			ID   uint
+			Stem string
+		}
+		if err := db.Table("textbook_exercises").Select("id, stem").Where("id IN ?", exerciseIDs).Scan(&rows).Error; err != nil {
+			return nil, err
+		}
+		for _, row := range rows {
+			stems[row.ID] = row.Stem
+		}
+	}
+
+	var best *IntegrityMatch
+	consider := func(assignmentID uint, exID *uint, text string) {
+		score := stemContainment(text, promptGrams)
+		if score >= integrityTextThreshold && (best == nil || score > best.Similarity) {
+			best = &IntegrityMatch{AssignmentID: assignmentID, ExerciseID: exID, MatchType: IntegrityMatchText, Similarity: score}
+		}
+	}
+	for _, a := range assignments {
+		for _, item := range a.AssignmentItems {
+			id := item.ExerciseID
+			consider(a.ID, &id, stems[id])
+		}
+		for _, piece := range problemPieces(a.ProblemText, a.ProblemFileText) {
+			consider(a.ID, nil, piece)
+		}
+	}
+	return best, nil
+}
+
+// LogIntegrityEvent 记录一次被切换为提示模式的提问；失败只打日志
+func LogIntegrityEvent(db *gorm.DB, user auth.User, match *IntegrityMatch, source, prompt string) {
+	runes := []rune(strings.TrimSpace(prompt))
+	if len(runes) > maxIntegrityPromptRunes {
+		runes = runes[:maxIntegrityPromptRunes]
+	}
+	event := IntegrityEvent{
+		AssignmentID: match.AssignmentID,
+		ExerciseID:   match.ExerciseID,
+		StudentID:    user.ID,
+		Source:       source,
+		MatchType:    match.MatchType,
+		Similarity:   match.Similarity,
+		Prompt:       string(runes),
+		CreatedAt:    time.Now(),
+	}
+	if err := db.Create(&event).Error; err != nil {
+		log.Printf("Failed to log integrity event for user %d: %v", user.ID, err)
+	}
+}
+
+// HintOnly 检查并在命中时记录，返回本次是否应切换为只给提示
+func HintOnly(db *gorm.DB, user auth.User, source, prompt string, exerciseID uint) bool {
+	match, err := MatchIntegrity(db, user, prompt, exerciseID)
+	if err != nil {
+		log.Printf("Failed to check assignment integrity mode for user %d: %v", user.ID, err)
+		return false
+	}
+	if match == nil {
+		return false
+	}
+	LogIntegrityEvent(db, user, match, source, prompt)
+	return true
+}
+
+// loadTeacherAssignment 读取当前老师自己的作业
+func (h *AssignmentHandler) loadTeacherAssignment(c *gin.Context) (Assignment, bool) {
+	var item Assignment
+	user, ok := h.currentUser(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "未登录"})
+		return item, false
+	}
+	if err := h.DB.First(&item, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Assignment not found"})
+		return item, false
+	}
+	if item.TeacherID != user.ID {
+		c.JSON(http.StatusForbidden, gin.H{"error": "无权操作该作业"})
+		return item, false
+	}
+	return item, true
+}
+
+// SetIntegrityModeHandler (老师) 开启/关闭作业诚信模式，可设置到期时间
+func (h *AssignmentHandler) SetIntegrityModeHandler(c *gin.Context) {
+	item, ok := h.loadTeacherAssignment(c)
+	if !ok {
+		return
+	}
+	var req struct {
+		Enabled bool       `json:"enabled"`
+		Until   *time.Time `json:"until"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "请求参数不合法"})
+		return
+	}
+	if req.Enabled && req.Until != nil && !req.Until.After(time.Now()) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "到期时间必须晚于当前时间"})
+		return
+	}
+	if !req.Enabled {
+		req.Until = nil
+	}
+	err := h.DB.Model(&item).Updates(map[string]interface{}{"integrity_mode": req.Enabled, "integrity_until": req.Until}).Error
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "更新诚信模式失败"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"id": item.ID, "integrityMode": req.Enabled, "integrityUntil": req.Until})
+}
+
+// ListIntegrityEventsHandler (老师) 某份作业下被切换为提示模式的提问记录
+func (h *AssignmentHandler) ListIntegrityEventsHandler(c *gin.Context) {
+	item, ok := h.loadTeacherAssignment(c)
+	if !ok {
+		return
+	}
+	var events []IntegrityEvent
+	if err := h.DB.Where("assignment_id = ?", item.ID).Order("created_at desc").Limit(500).Find(&events).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "读取诚信记录失败"})
+		return
+	}
+	ids := make([]uint, 0, len(events))
+	for _, e := range events {
+		ids = append(ids, e.StudentID)
+	}
+	names := map[uint]string{}
+	if len(ids) > 0 {
+		var users []auth.User
+		h.DB.Select("id, username, display_name").Where("id IN ?", ids).Find(&users)
+		for _, u := range users {
+			name := u.DisplayName
+			if name == "" {
+				name = u.Username
+			}
+			names[u.ID] = name
+		}
+	}
+	for i := range events {
+		events[i].StudentName = names[events[i].StudentID]
+	}
+	c.JSON(http.StatusOK, events)
+}
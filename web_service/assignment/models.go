@@ -19,6 +19,21 @@ type Assignment struct {
 	ProblemFilePath string `gorm:"size:255" json:"problemFilePath,omitempty"` // 存储题目附件的路径
 	ProblemFileName string `gorm:"size:255" json:"problemFileName,omitempty"` // 存储题目附件的原始文件名
 	ProblemFileURL  string `gorm:"-" json:"problemFileUrl,omitempty"`
+	// 附件识别文字：发布时异步识别一次并存档，老师可修订；自主批改直接使用，不再重复 OCR
+	ProblemFileText      string `gorm:"type:text" json:"problemFileText,omitempty"`
+	ProblemFileOCRStatus string `gorm:"size:20" json:"problemFileOcrStatus,omitempty"` // pending / done / failed / edited
+
+	// 在线测验：Type=quiz 时学生在浏览器内限时作答，客观题即时判分
+	Type              string `gorm:"size:20;not null;default:'file'" json:"type"` // file / quiz
+	TimeLimitMinutes  int    `gorm:"default:0" json:"timeLimitMinutes,omitempty"`
+	ShuffleQuestions  bool   `gorm:"default:false" json:"shuffleQuestions"`
+	ShuffleOptions    bool   `gorm:"default:false" json:"shuffleOptions"`
+	SubjectiveGrading string `gorm:"size:20;default:'teacher'" json:"subjectiveGrading,omitempty"` // teacher / ai
+	QuestionCount     int    `gorm:"-" json:"questionCount,omitempty"`
+
+	// 作业诚信模式：开启期间学生在聊天/讲解中问到本作业的题目时，AI 只给提示不给完整解答
+	IntegrityMode  bool       `gorm:"default:false" json:"integrityMode"`
+	IntegrityUntil *time.Time `json:"integrityUntil,omitempty"` // 到期自动失效（一般设为截止时间），为空表示直到老师关闭
 
 	CreatedAt       time.Time                   `json:"createdAt"`
 	DeletedAt       gorm.DeletedAt              `gorm:"index" json:"-"`
@@ -33,6 +48,7 @@ type AssignmentExercise struct {
 	AssignmentID uint      `gorm:"not null;uniqueIndex:idx_assignment_exercise;index" json:"assignmentId"`
 	ExerciseID   uint      `gorm:"not null;uniqueIndex:idx_assignment_exercise;index" json:"exerciseId"`
 	Position     int       `gorm:"default:0" json:"position"`
+	Points       float64   `gorm:"default:1" json:"points"` // 测验中该题满分
 	CreatedAt    time.Time `json:"createdAt"`
 }
 
@@ -57,9 +73,48 @@ type Submission struct {
 	StudentName      string         `gorm:"-" json:"studentName"`
 	SolutionFilePath string         `gorm:"size:255;not null" json:"solutionFilePath"`
 	SolutionFileName string         `gorm:"size:255;not null" json:"solutionFileName"`
+	OCRDocumentID    *uint          `json:"ocrDocumentId,omitempty"`                 // 以识别文档提交时引用的文档
+	SolutionText     string         `gorm:"type:text" json:"solutionText,omitempty"` // 识别文档校对后的文本快照
 	Comment          string         `gorm:"type:text" json:"comment"`
 	Status           string         `gorm:"size:50;default:'submitted'" json:"status"`
 	GradedAt         time.Time      `json:"gradedAt,omitempty"`
 	CreatedAt        time.Time      `json:"createdAt"`
 	DeletedAt        gorm.DeletedAt `gorm:"index" json:"-"`
 }
+
+// QuizAttempt 学生的一次限时测验作答；Deadline 由服务端在开始时确定，超时即自动交卷。
+type QuizAttempt struct {
+	ID             uint         `gorm:"primarykey" json:"id"`
+	AssignmentID   uint         `gorm:"not null;uniqueIndex:idx_quiz_attempt_student" json:"assignmentId"`
+	StudentID      uint         `gorm:"not null;uniqueIndex:idx_quiz_attempt_student;index" json:"studentId"`
+	StudentName    string       `gorm:"-" json:"studentName,omitempty"`
+	Status         string       `gorm:"size:20;not null;default:'in_progress';index" json:"status"` // in_progress / submitted / auto_submitted
+	QuestionOrder  string       `gorm:"type:text" json:"-"`                                         // JSON: 题目 ID 的展示顺序
+	OptionOrders   string       `gorm:"type:text" json:"-"`                                         // JSON: 每题选项的展示顺序（展示字母 -> 原字母）
+	StartedAt      time.Time    `json:"startedAt"`
+	Deadline       *time.Time   `gorm:"index" json:"deadline,omitempty"` // 不限时则为空
+	SubmittedAt    *time.Time   `json:"submittedAt,omitempty"`
+	ObjectiveScore float64      `gorm:"default:0" json:"objectiveScore"`
+	TotalScore     float64      `gorm:"default:0" json:"totalScore"`
+	MaxScore       float64      `gorm:"default:0" json:"maxScore"`
+	PendingCount   int          `gorm:"default:0" json:"pendingCount"` // 尚待老师/AI 批改的主观题数
+	Answers        []QuizAnswer `gorm:"foreignKey:AttemptID;constraint:OnDelete:CASCADE" json:"answers,omitempty"`
+	CreatedAt      time.Time    `json:"createdAt"`
+	UpdatedAt      time.Time    `json:"updatedAt"`
+}
+
+// QuizAnswer 测验中单题的作答与判分结果。
+type QuizAnswer struct {
+	ID            uint      `gorm:"primarykey" json:"id"`
+	AttemptID     uint      `gorm:"not null;uniqueIndex:idx_quiz_answer_exercise" json:"attemptId"`
+	ExerciseID    uint      `gorm:"not null;uniqueIndex:idx_quiz_answer_exercise" json:"exerciseId"`
+	Answer        string    `gorm:"type:text" json:"answer"` // 学生按展示选项作答，判分时换算回原选项
+	Objective     bool      `gorm:"default:false" json:"objective"`
+	IsCorrect     *bool     `json:"isCorrect,omitempty"`
+	Score         *float64  `json:"score,omitempty"`
+	MaxScore      float64   `gorm:"default:1" json:"maxScore"`
+	GradingStatus string    `gorm:"size:20;default:'unanswered'" json:"gradingStatus"` // unanswered / auto_graded / pending_teacher / pending_ai / ai_graded / teacher_graded
+	Feedback      string    `gorm:"type:text" json:"feedback,omitempty"`
+	CreatedAt     time.Time `json:"createdAt"`
+	UpdatedAt     time.Time `json:"updatedAt"`
+}
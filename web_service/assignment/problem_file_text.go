@@ -0,0 +1,132 @@
+// web_service/assignment/problem_file_text.go
+
+package assignment
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+	"workplace/web_service/accesscontrol"
+	"workplace/web_service/jobs"
+	"workplace/web_service/ocr"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const (
+	ProblemFileOCRPending = "pending"
+	ProblemFileOCRDone    = "done"
+	ProblemFileOCRFailed  = "failed"
+	ProblemFileOCREdited  = "edited" // 老师手动修订过，后续不再被自动识别覆盖
+)
+
+// JobTypeProblemFileOCR 发布作业后识别题目附件
+const JobTypeProblemFileOCR = "assignment_ocr"
+
+type problemFileOCRPayload struct {
+	AssignmentID uint `json:"assignmentId"`
+}
+
+// StoreProblemFileText 回填识别出的附件文字（仅在老师未手动修订时写入）。
+func StoreProblemFileText(db *gorm.DB, assignmentID uint, text string) {
+	if err := db.Model(&Assignment{}).
+		Where("id = ? AND (problem_file_ocr_status IS NULL OR problem_file_ocr_status <> ?)", assignmentID, ProblemFileOCREdited).
+		Updates(map[string]interface{}{"problem_file_text": text, "problem_file_ocr_status": ProblemFileOCRDone}).Error; err != nil {
+		log.Printf("Failed to store problem file text for assignment %d: %v", assignmentID, err)
+	}
+}
+
+// RegisterJobs 注册作业相关的异步任务类型
+func (h *AssignmentHandler) RegisterJobs(q *jobs.Queue) {
+	q.Register(JobTypeProblemFileOCR, func(ctx context.Context, job *jobs.Job) (interface{}, error) {
+		var payload problemFileOCRPayload
+		if err := job.DecodePayload(&payload); err != nil {
+			return nil, err
+		}
+		var item Assignment
+		if err := h.DB.First(&item, payload.AssignmentID).Error; err != nil {
+			return nil, jobs.Permanentf("作业不存在")
+		}
+		if item.ProblemFilePath == "" || item.ProblemFileOCRStatus == ProblemFileOCREdited {
+			return gin.H{"assignmentId": item.ID, "skipped": true}, nil
+		}
+		text, err := ocr.RecognizeFile(ctx, h.DB, item.ProblemFilePath, item.ProblemFileName, false, 180*time.Second)
+		if err != nil {
+			if job.Attempts >= job.MaxAttempts {
+				h.DB.Model(&Assignment{}).Where("id = ? AND problem_file_ocr_status = ?", item.ID, ProblemFileOCRPending).
+					Update("problem_file_ocr_status", ProblemFileOCRFailed)
+			}
+			return nil, err
+		}
+		StoreProblemFileText(h.DB, item.ID, text)
+		return gin.H{"assignmentId": item.ID, "characters": len([]rune(text))}, nil
+	})
+}
+
+// enqueueProblemFileOCR 发布带附件的作业后排队识别附件文字
+func (h *AssignmentHandler) enqueueProblemFileOCR(assignment *Assignment) {
+	if assignment.ProblemFilePath == "" || h.Jobs == nil {
+		return
+	}
+	if _, err := h.Jobs.Enqueue(JobTypeProblemFileOCR, assignment.TeacherID, problemFileOCRPayload{AssignmentID: assignment.ID}, 0); err != nil {
+		log.Printf("Failed to enqueue problem file OCR for assignment %d: %v", assignment.ID, err)
+		return
+	}
+	assignment.ProblemFileOCRStatus = ProblemFileOCRPending
+	h.DB.Model(assignment).Update("problem_file_ocr_status", ProblemFileOCRPending)
+}
+
+// UpdateProblemFileTextHandler (老师) 修订附件识别文字；提交空文本会重新排队自动识别。
+func (h *AssignmentHandler) UpdateProblemFileTextHandler(c *gin.Context) {
+	teacherID, ok := accesscontrol.CurrentUserID(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "未登录"})
+		return
+	}
+	var req struct {
+		Text *string `json:"text"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || req.Text == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "请提供附件文字 text"})
+		return
+	}
+	var item Assignment
+	if err := h.DB.First(&item, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Assignment not found"})
+		return
+	}
+	if item.TeacherID != teacherID {
+		c.JSON(http.StatusForbidden, gin.H{"error": "无权修改该作业"})
+		return
+	}
+	if item.ProblemFilePath == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "该作业没有题目附件"})
+		return
+	}
+
+	text := strings.TrimSpace(*req.Text)
+	if text == "" {
+		h.DB.Model(&item).Updates(map[string]interface{}{"problem_file_text": "", "problem_file_ocr_status": ""})
+		item.ProblemFileText = ""
+		item.ProblemFileOCRStatus = ""
+		h.enqueueProblemFileOCR(&item)
+	} else {
+		if err := h.DB.Model(&item).Updates(map[string]interface{}{
+			"problem_file_text":       text,
+			"problem_file_ocr_status": ProblemFileOCREdited,
+		}).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "保存附件文字失败"})
+			return
+		}
+		item.ProblemFileText = text
+		item.ProblemFileOCRStatus = ProblemFileOCREdited
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"id":                   item.ID,
+		"problemFileText":      item.ProblemFileText,
+		"problemFileOcrStatus": item.ProblemFileOCRStatus,
+	})
+}
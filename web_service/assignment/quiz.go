@@ -0,0 +1,792 @@
+// web_service/assignment/quiz.go
+
+package assignment
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"workplace/web_service/auth"
+	"workplace/web_service/jobs"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	AssignmentTypeFile = "file"
+	AssignmentTypeQuiz = "quiz"
+
+	// JobTypeQuizAIGrading 测验主观题 AI 批改，由 grading 注册执行（与作业批改共用缓存与用量）
+	JobTypeQuizAIGrading = "quiz_ai_grading"
+
+	quizStatusInProgress    = "in_progress"
+	quizStatusSubmitted     = "submitted"
+	quizStatusAutoSubmitted = "auto_submitted"
+
+	// 前端倒计时与网络延迟的宽限，超过 Deadline+宽限 的作答一律不再接受
+	quizDeadlineGrace = 5 * time.Second
+)
+
+// quizExercise 测验判分需要的题库字段（包含答案，只在服务端使用）
+type quizExercise struct {
+	ID             uint
+	ExerciseNumber string
+	Stem           string
+	Answer         string
+	QuestionType   string
+}
+
+// QuizQuestion 下发给学生的题目（不含答案；选项可能已打乱）
+type QuizQuestion struct {
+	ExerciseID     uint         `json:"exerciseId"`
+	Position       int          `json:"position"`
+	ExerciseNumber string       `json:"exerciseNumber,omitempty"`
+	QuestionType   string       `json:"questionType"`
+	Objective      bool         `json:"objective"`
+	Stem           string       `json:"stem"`
+	Options        []quizOption `json:"options,omitempty"`
+	Points         float64      `json:"points"`
+}
+
+type quizAnswerInput struct {
+	ExerciseID uint   `json:"exerciseId"`
+	Answer     string `json:"answer"`
+}
+
+type quizAnswersRequest struct {
+	Answers []quizAnswerInput `json:"answers"`
+}
+
+func (a Assignment) IsQuiz() bool {
+	return a.Type == AssignmentTypeQuiz
+}
+
+func loadQuizExercises(db *gorm.DB, ids []uint) (map[uint]quizExercise, error) {
+	result := map[uint]quizExercise{}
+	if len(ids) == 0 {
+		return result, nil
+	}
+	var rows []quizExercise
+	if err := db.Table("textbook_exercises").
+		Select("id, COALESCE(exercise_number, '') AS exercise_number, stem, COALESCE(answer, '') AS answer, COALESCE(question_type, '') AS question_type").
+		Where("id IN ?", ids).
+		Scan(&rows).Error; err != nil {
+		return nil, err
+	}
+	for _, row := range rows {
+		result[row.ID] = row
+	}
+	return result, nil
+}
+
+func loadQuizLinks(db *gorm.DB, assignmentID uint) ([]AssignmentExercise, error) {
+	var links []AssignmentExercise
+	err := db.Where("assignment_id = ?", assignmentID).Order("position asc, id asc").Find(&links).Error
+	return links, err
+}
+
+func decodeQuestionOrder(raw string) []uint {
+	var ids []uint
+	if raw != "" {
+		_ = json.Unmarshal([]byte(raw), &ids)
+	}
+	return ids
+}
+
+func decodeOptionOrders(raw string) map[uint][]string {
+	orders := map[uint][]string{}
+	if raw != "" {
+		_ = json.Unmarshal([]byte(raw), &orders)
+	}
+	return orders
+}
+
+// buildQuizQuestions 按作答记录里固定下来的题目/选项顺序生成学生看到的题目。
+func buildQuizQuestions(attempt QuizAttempt, links []AssignmentExercise, exercises map[uint]quizExercise) []QuizQuestion {
+	points := map[uint]float64{}
+	for _, link := range links {
+		points[link.ExerciseID] = link.Points
+	}
+	optionOrders := decodeOptionOrders(attempt.OptionOrders)
+	order := decodeQuestionOrder(attempt.QuestionOrder)
+	questions := make([]QuizQuestion, 0, len(order))
+	for i, id := range order {
+		ex, ok := exercises[id]
+		if !ok {
+			continue
+		}
+		q := QuizQuestion{
+			ExerciseID:     id,
+			Position:       i + 1,
+			ExerciseNumber: ex.ExerciseNumber,
+			QuestionType:   ex.QuestionType,
+			Objective:      isObjectiveQuestion(ex.QuestionType),
+			Stem:           ex.Stem,
+			Points:         points[id],
+		}
+		if strings.TrimSpace(ex.QuestionType) == "选择" {
+			if body, options, ok := splitChoiceOptions(ex.Stem); ok {
+				byLabel := map[string]string{}
+				for _, opt := range options {
+					byLabel[opt.Label] = opt.Text
+				}
+				q.Stem = body
+				if display, ok := optionOrders[id]; ok && len(display) == len(options) {
+					for j, original := range display {
+						q.Options = append(q.Options, quizOption{Label: string(rune('A' + j)), Text: byLabel[original]})
+					}
+				} else {
+					q.Options = options
+				}
+			}
+		}
+		questions = append(questions, q)
+	}
+	return questions
+}
+
+func (h *AssignmentHandler) loadStudentAttempt(c *gin.Context) (auth.User, QuizAttempt, Assignment, bool) {
+	user, ok := h.currentUser(c)
+	if !ok || user.Role != "student" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "未登录"})
+		return auth.User{}, QuizAttempt{}, Assignment{}, false
+	}
+	var attempt QuizAttempt
+	if err := h.DB.Where("id = ? AND student_id = ?", c.Param("id"), user.ID).First(&attempt).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "作答记录不存在"})
+		return auth.User{}, QuizAttempt{}, Assignment{}, false
+	}
+	var item Assignment
+	if err := h.DB.First(&item, attempt.AssignmentID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Assignment not found"})
+		return auth.User{}, QuizAttempt{}, Assignment{}, false
+	}
+	return user, attempt, item, true
+}
+
+func attemptExpired(attempt QuizAttempt, now time.Time) bool {
+	return attempt.Deadline != nil && now.After(attempt.Deadline.Add(quizDeadlineGrace))
+}
+
+// saveQuizAnswers 写入（覆盖）学生作答，只接受本测验中的题目。
+func saveQuizAnswers(tx *gorm.DB, attempt QuizAttempt, inputs []quizAnswerInput) error {
+	allowed := map[uint]bool{}
+	for _, id := range decodeQuestionOrder(attempt.QuestionOrder) {
+		allowed[id] = true
+	}
+	for _, in := range inputs {
+		if !allowed[in.ExerciseID] {
+			return fmt.Errorf("题目 %d 不属于该测验", in.ExerciseID)
+		}
+		answer := QuizAnswer{
+			AttemptID:     attempt.ID,
+			ExerciseID:    in.ExerciseID,
+			Answer:        strings.TrimSpace(in.Answer),
+			GradingStatus: "unanswered",
+		}
+		if err := tx.Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "attempt_id"}, {Name: "exercise_id"}},
+			DoUpdates: clause.AssignmentColumns([]string{"answer", "updated_at"}),
+		}).Create(&answer).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// finalizeQuizAttempt 交卷：客观题即时判分，主观题按作业设置转老师或 AI 批改。
+func finalizeQuizAttempt(db *gorm.DB, q *jobs.Queue, attemptID uint, status string) error {
+	var assignmentID uint
+	aiPending := false
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var attempt QuizAttempt
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&attempt, attemptID).Error; err != nil {
+			return err
+		}
+		if attempt.Status != quizStatusInProgress {
+			return nil
+		}
+		var item Assignment
+		if err := tx.First(&item, attempt.AssignmentID).Error; err != nil {
+			return err
+		}
+		assignmentID = item.ID
+
+		links, err := loadQuizLinks(tx, item.ID)
+		if err != nil {
+			return err
+		}
+		order := decodeQuestionOrder(attempt.QuestionOrder)
+		exercises, err := loadQuizExercises(tx, order)
+		if err != nil {
+			return err
+		}
+		points := map[uint]float64{}
+		for _, link := range links {
+			points[link.ExerciseID] = link.Points
+		}
+		var saved []QuizAnswer
+		if err := tx.Where("attempt_id = ?", attempt.ID).Find(&saved).Error; err != nil {
+			return err
+		}
+		byExercise := map[uint]QuizAnswer{}
+		for _, ans := range saved {
+			byExercise[ans.ExerciseID] = ans
+		}
+		optionOrders := decodeOptionOrders(attempt.OptionOrders)
+
+		for _, id := range order {
+			ex := exercises[id]
+			ans, exists := byExercise[id]
+			if !exists {
+				ans = QuizAnswer{AttemptID: attempt.ID, ExerciseID: id}
+			}
+			ans.MaxScore = points[id]
+			ans.Objective = isObjectiveQuestion(ex.QuestionType)
+			ans.IsCorrect = nil
+			ans.Score = nil
+			switch {
+			case strings.TrimSpace(ans.Answer) == "":
+				zero := 0.0
+				ans.Score = &zero
+				ans.GradingStatus = "unanswered"
+			case ans.Objective:
+				correct, gradable := gradeObjectiveAnswer(ex.QuestionType, ex.Answer, ans.Answer, optionOrders[id])
+				if gradable {
+					score := 0.0
+					if correct {
+						score = ans.MaxScore
+					}
+					ans.IsCorrect = &correct
+					ans.Score = &score
+					ans.GradingStatus = "auto_graded"
+				} else {
+					ans.GradingStatus = "pending_teacher"
+				}
+			case item.SubjectiveGrading == "ai":
+				ans.GradingStatus = "pending_ai"
+				aiPending = true
+			default:
+				ans.GradingStatus = "pending_teacher"
+			}
+			if err := tx.Save(&ans).Error; err != nil {
+				return err
+			}
+		}
+
+		now := time.Now()
+		attempt.Status = status
+		attempt.SubmittedAt = &now
+		if err := tx.Save(&attempt).Error; err != nil {
+			return err
+		}
+		return recomputeAttemptScores(tx, attempt.ID)
+	})
+	if err != nil {
+		return err
+	}
+	if assignmentID != 0 {
+		log.Printf("Quiz attempt %d of assignment %d finalized (%s)", attemptID, assignmentID, status)
+	}
+	if aiPending {
+		enqueueQuizAIGrading(q, pendingAIAnswers(db).Where("quiz_answers.attempt_id = ?", attemptID), nil)
+	}
+	return nil
+}
+
+// recomputeAttemptScores 汇总各题得分；Score 为空的题目计入待批改数。
+func recomputeAttemptScores(tx *gorm.DB, attemptID uint) error {
+	var answers []QuizAnswer
+	if err := tx.Where("attempt_id = ?", attemptID).Find(&answers).Error; err != nil {
+		return err
+	}
+	var objective, total, maxScore float64
+	pending := 0
+	for _, ans := range answers {
+		maxScore += ans.MaxScore
+		if ans.Score == nil {
+			pending++
+			continue
+		}
+		total += *ans.Score
+		if ans.Objective && ans.GradingStatus == "auto_graded" {
+			objective += *ans.Score
+		}
+	}
+	return tx.Model(&QuizAttempt{}).Where("id = ?", attemptID).Updates(map[string]interface{}{
+		"objective_score": objective,
+		"total_score":     total,
+		"max_score":       maxScore,
+		"pending_count":   pending,
+	}).Error
+}
+
+// QuizAIGradingPayload quiz_ai_grading 任务的入参
+type QuizAIGradingPayload struct {
+	AnswerID uint `json:"answerId"`
+}
+
+// pendingAIAnswers 待 AI 批改的主观题及布置老师
+func pendingAIAnswers(db *gorm.DB) *gorm.DB {
+	return db.Table("quiz_answers").Select("quiz_answers.id, assignments.teacher_id").
+		Joins("JOIN quiz_attempts ON quiz_attempts.id = quiz_answers.attempt_id").
+		Joins("JOIN assignments ON assignments.id = quiz_attempts.assignment_id").
+		Where("quiz_answers.grading_status = ?", "pending_ai")
+}
+
+// enqueueQuizAIGrading 每道待 AI 批改的主观题排一个批改任务，记在布置老师名下（用量计入老师）。
+// 任务由 grading 注册执行；入队失败的题目留在 pending_ai，下次启动时补排。
+func enqueueQuizAIGrading(q *jobs.Queue, pending *gorm.DB, skip map[uint]bool) {
+	if q == nil {
+		return
+	}
+	var rows []struct {
+		ID        uint
+		TeacherID uint
+	}
+	if err := pending.Scan(&rows).Error; err != nil {
+		log.Printf("Load pending AI quiz answers failed: %v", err)
+		return
+	}
+	for _, row := range rows {
+		if skip[row.ID] {
+			continue
+		}
+		if _, err := q.Enqueue(JobTypeQuizAIGrading, row.TeacherID, QuizAIGradingPayload{AnswerID: row.ID}, 0); err != nil {
+			log.Printf("Failed to enqueue AI grading for quiz answer %d: %v", row.ID, err)
+		}
+	}
+}
+
+// requeuePendingAIGrading 启动时为还停在 pending_ai、却没有排队或运行中任务的主观题补排批改任务
+func requeuePendingAIGrading(db *gorm.DB, q *jobs.Queue) {
+	var active []jobs.Job
+	if err := db.Where("type = ? AND status IN ?", JobTypeQuizAIGrading, []string{jobs.StatusQueued, jobs.StatusRunning}).
+		Find(&active).Error; err != nil {
+		log.Printf("Load quiz AI grading jobs failed: %v", err)
+		return
+	}
+	queued := map[uint]bool{}
+	for _, job := range active {
+		var payload QuizAIGradingPayload
+		if job.DecodePayload(&payload) == nil {
+			queued[payload.AnswerID] = true
+		}
+	}
+	enqueueQuizAIGrading(q, pendingAIAnswers(db), queued)
+}
+
+// StoreQuizAIFeedback 写回 AI 批改意见；AI 不直接给分，分数仍由老师确认。
+func StoreQuizAIFeedback(db *gorm.DB, answerID uint, feedback string) error {
+	return db.Model(&QuizAnswer{}).Where("id = ? AND grading_status = ?", answerID, "pending_ai").Updates(map[string]interface{}{
+		"grading_status": "ai_graded",
+		"feedback":       feedback,
+	}).Error
+}
+
+// ReleaseQuizAIGrading AI 批改最终失败或被取消时退回老师批改
+func ReleaseQuizAIGrading(db *gorm.DB, answerID uint) {
+	db.Model(&QuizAnswer{}).Where("id = ? AND grading_status = ?", answerID, "pending_ai").Update("grading_status", "pending_teacher")
+}
+
+// StartQuizAutoSubmitter 后台定时扫描超时未交卷的测验并自动交卷，保证学生离开页面后计时依然生效。
+// 启动时先为重启前遗留的 pending_ai 主观题补排 AI 批改任务。
+func StartQuizAutoSubmitter(db *gorm.DB, q *jobs.Queue, interval time.Duration) {
+	go func() {
+		requeuePendingAIGrading(db, q)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			var ids []uint
+			if err := db.Model(&QuizAttempt{}).
+				Where("status = ? AND deadline IS NOT NULL AND deadline < ?", quizStatusInProgress, time.Now().Add(-quizDeadlineGrace)).
+				Pluck("id", &ids).Error; err != nil {
+				log.Printf("Quiz auto-submit scan failed: %v", err)
+				continue
+			}
+			for _, id := range ids {
+				if err := finalizeQuizAttempt(db, q, id, quizStatusAutoSubmitted); err != nil {
+					log.Printf("Quiz auto-submit for attempt %d failed: %v", id, err)
+				}
+			}
+		}
+	}()
+}
+
+func (h *AssignmentHandler) quizAttemptResponse(attempt QuizAttempt, item Assignment) (gin.H, error) {
+	links, err := loadQuizLinks(h.DB, item.ID)
+	if err != nil {
+		return nil, err
+	}
+	exercises, err := loadQuizExercises(h.DB, decodeQuestionOrder(attempt.QuestionOrder))
+	if err != nil {
+		return nil, err
+	}
+	h.DB.Where("attempt_id = ?", attempt.ID).Order("id asc").Find(&attempt.Answers)
+	if attempt.Status == quizStatusInProgress {
+		// 交卷前只回显作答内容，不暴露判分字段
+		for i := range attempt.Answers {
+			attempt.Answers[i].IsCorrect = nil
+			attempt.Answers[i].Score = nil
+			attempt.Answers[i].Feedback = ""
+		}
+	}
+	resp := gin.H{
+		"attempt":    attempt,
+		"questions":  buildQuizQuestions(attempt, links, exercises),
+		"assignment": gin.H{"id": item.ID, "title": item.Title, "timeLimitMinutes": item.TimeLimitMinutes},
+		"serverTime": time.Now(),
+	}
+	if attempt.Deadline != nil && attempt.Status == quizStatusInProgress {
+		remaining := time.Until(*attempt.Deadline).Seconds()
+		if remaining < 0 {
+			remaining = 0
+		}
+		resp["remainingSeconds"] = int(remaining)
+	}
+	return resp, nil
+}
+
+// StartQuizHandler (学生) 开始或继续一次测验：首次开始时固定题目/选项顺序并确定截止时间。
+func (h *AssignmentHandler) StartQuizHandler(c *gin.Context) {
+	user, ok := h.currentUser(c)
+	if !ok || user.Role != "student" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "未登录"})
+		return
+	}
+	var item Assignment
+	if err := h.DB.First(&item, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Assignment not found"})
+		return
+	}
+	if !h.studentCanAccess(user, item) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "无权参加该测验"})
+		return
+	}
+	if !item.IsQuiz() {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "该作业不是在线测验"})
+		return
+	}
+
+	var attempt QuizAttempt
+	err := h.DB.Where("assignment_id = ? AND student_id = ?", item.ID, user.ID).First(&attempt).Error
+	if err == gorm.ErrRecordNotFound {
+		links, linkErr := loadQuizLinks(h.DB, item.ID)
+		if linkErr != nil || len(links) == 0 {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "测验题目加载失败"})
+			return
+		}
+		order := make([]uint, 0, len(links))
+		for _, link := range links {
+			order = append(order, link.ExerciseID)
+		}
+		if item.ShuffleQuestions {
+			rand.Shuffle(len(order), func(i, j int) { order[i], order[j] = order[j], order[i] })
+		}
+		optionOrders := map[uint][]string{}
+		if item.ShuffleOptions {
+			exercises, exErr := loadQuizExercises(h.DB, order)
+			if exErr != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "测验题目加载失败"})
+				return
+			}
+			for _, id := range order {
+				ex := exercises[id]
+				if strings.TrimSpace(ex.QuestionType) != "选择" {
+					continue
+				}
+				if _, options, ok := splitChoiceOptions(ex.Stem); ok {
+					labels := make([]string, len(options))
+					for i, opt := range options {
+						labels[i] = opt.Label
+					}
+					rand.Shuffle(len(labels), func(i, j int) { labels[i], labels[j] = labels[j], labels[i] })
+					optionOrders[id] = labels
+				}
+			}
+		}
+		orderJSON, _ := json.Marshal(order)
+		optionJSON, _ := json.Marshal(optionOrders)
+		now := time.Now()
+		attempt = QuizAttempt{
+			AssignmentID:  item.ID,
+			StudentID:     user.ID,
+			Status:        quizStatusInProgress,
+			QuestionOrder: string(orderJSON),
+			OptionOrders:  string(optionJSON),
+			StartedAt:     now,
+		}
+		if item.TimeLimitMinutes > 0 {
+			deadline := now.Add(time.Duration(item.TimeLimitMinutes) * time.Minute)
+			attempt.Deadline = &deadline
+		}
+		// 并发点击“开始”时依赖唯一索引去重，失败则回读已有记录
+		if err := h.DB.Clauses(clause.OnConflict{DoNothing: true}).Create(&attempt).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "创建作答记录失败"})
+			return
+		}
+		if attempt.ID == 0 {
+			h.DB.Where("assignment_id = ? AND student_id = ?", item.ID, user.ID).First(&attempt)
+		}
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "读取作答记录失败"})
+		return
+	}
+
+	if attempt.Status == quizStatusInProgress && attemptExpired(attempt, time.Now()) {
+		if err := finalizeQuizAttempt(h.DB, h.Jobs, attempt.ID, quizStatusAutoSubmitted); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "自动交卷失败"})
+			return
+		}
+		h.DB.First(&attempt, attempt.ID)
+	}
+
+	resp, err := h.quizAttemptResponse(attempt, item)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "测验题目加载失败"})
+		return
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// GetQuizAttemptHandler (学生) 查看作答进度或交卷后的判分结果。
+func (h *AssignmentHandler) GetQuizAttemptHandler(c *gin.Context) {
+	_, attempt, item, ok := h.loadStudentAttempt(c)
+	if !ok {
+		return
+	}
+	if attempt.Status == quizStatusInProgress && attemptExpired(attempt, time.Now()) {
+		if err := finalizeQuizAttempt(h.DB, h.Jobs, attempt.ID, quizStatusAutoSubmitted); err == nil {
+			h.DB.First(&attempt, attempt.ID)
+		}
+	}
+	resp, err := h.quizAttemptResponse(attempt, item)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "测验题目加载失败"})
+		return
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// SaveQuizAnswersHandler (学生) 暂存作答；超时后拒绝写入并自动交卷。
+func (h *AssignmentHandler) SaveQuizAnswersHandler(c *gin.Context) {
+	_, attempt, _, ok := h.loadStudentAttempt(c)
+	if !ok {
+		return
+	}
+	var req quizAnswersRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "请求体格式错误"})
+		return
+	}
+	if attempt.Status != quizStatusInProgress {
+		c.JSON(http.StatusConflict, gin.H{"error": "测验已交卷"})
+		return
+	}
+	if attemptExpired(attempt, time.Now()) {
+		_ = finalizeQuizAttempt(h.DB, h.Jobs, attempt.ID, quizStatusAutoSubmitted)
+		c.JSON(http.StatusConflict, gin.H{"error": "测验已超时，系统已自动交卷"})
+		return
+	}
+	if err := h.DB.Transaction(func(tx *gorm.DB) error {
+		return saveQuizAnswers(tx, attempt, req.Answers)
+	}); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "作答已保存", "savedAt": time.Now()})
+}
+
+// SubmitQuizHandler (学生) 交卷，可同时携带最后一批作答。
+func (h *AssignmentHandler) SubmitQuizHandler(c *gin.Context) {
+	_, attempt, item, ok := h.loadStudentAttempt(c)
+	if !ok {
+		return
+	}
+	var req quizAnswersRequest
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "请求体格式错误"})
+			return
+		}
+	}
+	if attempt.Status != quizStatusInProgress {
+		c.JSON(http.StatusConflict, gin.H{"error": "测验已交卷"})
+		return
+	}
+
+	status := quizStatusSubmitted
+	if attemptExpired(attempt, time.Now()) {
+		// 超时交卷：只按截止前已保存的作答判分
+		status = quizStatusAutoSubmitted
+	} else if len(req.Answers) > 0 {
+		if err := h.DB.Transaction(func(tx *gorm.DB) error {
+			return saveQuizAnswers(tx, attempt, req.Answers)
+		}); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	if err := finalizeQuizAttempt(h.DB, h.Jobs, attempt.ID, status); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "交卷失败"})
+		return
+	}
+	h.DB.First(&attempt, attempt.ID)
+	resp, err := h.quizAttemptResponse(attempt, item)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "测验题目加载失败"})
+		return
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// ListQuizAttemptsHandler (老师) 查看某个测验的全部作答与得分。
+func (h *AssignmentHandler) ListQuizAttemptsHandler(c *gin.Context) {
+	user, ok := h.currentUser(c)
+	if !ok || user.Role != "teacher" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "未登录"})
+		return
+	}
+	var item Assignment
+	if err := h.DB.First(&item, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Assignment not found"})
+		return
+	}
+	if item.TeacherID != user.ID {
+		c.JSON(http.StatusForbidden, gin.H{"error": "无权查看该测验"})
+		return
+	}
+	var attempts []QuizAttempt
+	if err := h.DB.Preload("Answers", func(db *gorm.DB) *gorm.DB {
+		return db.Order("quiz_answers.id asc")
+	}).Where("assignment_id = ?", item.ID).Order("started_at desc").Find(&attempts).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "读取作答记录失败"})
+		return
+	}
+	studentIDs := make([]uint, 0, len(attempts))
+	for _, attempt := range attempts {
+		studentIDs = append(studentIDs, attempt.StudentID)
+	}
+	names := map[uint]string{}
+	if len(studentIDs) > 0 {
+		var users []auth.User
+		h.DB.Where("id IN ?", studentIDs).Find(&users)
+		for _, u := range users {
+			name := u.DisplayName
+			if name == "" {
+				name = u.Username
+			}
+			names[u.ID] = name
+		}
+	}
+	for i := range attempts {
+		attempts[i].StudentName = names[attempts[i].StudentID]
+	}
+	c.JSON(http.StatusOK, attempts)
+}
+
+// GradeQuizAnswerHandler (老师) 为主观题（或无法自动判分的题）打分并写评语，也可覆盖自动判分结果。
+func (h *AssignmentHandler) GradeQuizAnswerHandler(c *gin.Context) {
+	user, ok := h.currentUser(c)
+	if !ok || user.Role != "teacher" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "未登录"})
+		return
+	}
+	var input struct {
+		Score    *float64 `json:"score" binding:"required"`
+		Feedback *string  `json:"feedback"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "需要提供分数"})
+		return
+	}
+
+	var answer QuizAnswer
+	if err := h.DB.First(&answer, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "作答不存在"})
+		return
+	}
+	var attempt QuizAttempt
+	if err := h.DB.First(&attempt, answer.AttemptID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "作答记录不存在"})
+		return
+	}
+	var item Assignment
+	if err := h.DB.First(&item, attempt.AssignmentID).Error; err != nil || item.TeacherID != user.ID {
+		c.JSON(http.StatusForbidden, gin.H{"error": "无权批阅该测验"})
+		return
+	}
+	if attempt.Status == quizStatusInProgress {
+		c.JSON(http.StatusConflict, gin.H{"error": "学生尚未交卷"})
+		return
+	}
+	if *input.Score < 0 || *input.Score > answer.MaxScore {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("分数需在 0 - %s 之间", strconv.FormatFloat(answer.MaxScore, 'f', -1, 64))})
+		return
+	}
+
+	answer.Score = input.Score
+	answer.GradingStatus = "teacher_graded"
+	if input.Feedback != nil {
+		answer.Feedback = *input.Feedback
+	}
+	if answer.Objective {
+		correct := *input.Score >= answer.MaxScore
+		answer.IsCorrect = &correct
+	}
+	if err := h.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Save(&answer).Error; err != nil {
+			return err
+		}
+		return recomputeAttemptScores(tx, attempt.ID)
+	}); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "保存评分失败"})
+		return
+	}
+	c.JSON(http.StatusOK, answer)
+}
+
+// RequestQuizAIGradingHandler (老师) 把某次作答中尚未批改的主观题交给 AI 生成批改意见。
+func (h *AssignmentHandler) RequestQuizAIGradingHandler(c *gin.Context) {
+	user, ok := h.currentUser(c)
+	if !ok || user.Role != "teacher" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "未登录"})
+		return
+	}
+	var attempt QuizAttempt
+	if err := h.DB.First(&attempt, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "作答记录不存在"})
+		return
+	}
+	var item Assignment
+	if err := h.DB.First(&item, attempt.AssignmentID).Error; err != nil || item.TeacherID != user.ID {
+		c.JSON(http.StatusForbidden, gin.H{"error": "无权批阅该测验"})
+		return
+	}
+	if attempt.Status == quizStatusInProgress {
+		c.JSON(http.StatusConflict, gin.H{"error": "学生尚未交卷"})
+		return
+	}
+	if h.Jobs == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "任务队列未启用"})
+		return
+	}
+	res := h.DB.Model(&QuizAnswer{}).
+		Where("attempt_id = ? AND objective = ? AND grading_status = ?", attempt.ID, false, "pending_teacher").
+		Update("grading_status", "pending_ai")
+	if res.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "提交 AI 批改失败"})
+		return
+	}
+	if res.RowsAffected > 0 {
+		enqueueQuizAIGrading(h.Jobs, pendingAIAnswers(h.DB).Where("quiz_answers.attempt_id = ?", attempt.ID), nil)
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "已提交 AI 批改", "count": res.RowsAffected})
+}
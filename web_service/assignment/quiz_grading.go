@@ -0,0 +1,198 @@
+// web_service/assignment/quiz_grading.go
+
+package assignment
+
+import (
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// 客观题题型：可以对照题库 answer 即时判分；其余（计算/证明/简答）为主观题
+var objectiveQuestionTypes = map[string]bool{
+	"选择": true,
+	"填空": true,
+	"判断": true,
+}
+
+func isObjectiveQuestion(questionType string) bool {
+	return objectiveQuestionTypes[strings.TrimSpace(questionType)]
+}
+
+// quizOption 选择题的一个选项（Label 为展示字母）
+type quizOption struct {
+	Label string `json:"label"`
+	Text  string `json:"text"`
+}
+
+// 选项标记：(A) （A） A. A． A、 A:，前面必须是行首或空白，避免把题干里的矩阵名 A 当成选项
+var optionMarkerRe = regexp.MustCompile(`(?:^|\s)[(（]?([A-F])(?:[)）]|[.．、:：])\s*`)
+
+// splitChoiceOptions 从题干中拆出选项。要求从 A 开始按字母顺序连续出现至少两个选项，否则返回 ok=false。
+func splitChoiceOptions(stem string) (body string, options []quizOption, ok bool) {
+	matches := optionMarkerRe.FindAllStringSubmatchIndex(stem, -1)
+	if len(matches) < 2 {
+		return stem, nil, false
+	}
+	type marker struct {
+		letter     byte
+		start, end int
+	}
+	var picked []marker
+	expect := byte('A')
+	for _, m := range matches {
+		letter := stem[m[2]]
+		if letter != expect {
+			if letter == 'A' {
+				// 题干中较早出现的误匹配，从新的 A 重新开始
+				picked = picked[:0]
+				expect = 'A'
+			} else {
+				continue
+			}
+		}
+		picked = append(picked, marker{letter: letter, start: m[0], end: m[1]})
+		expect++
+	}
+	if len(picked) < 2 {
+		return stem, nil, false
+	}
+	body = strings.TrimSpace(stem[:picked[0].start])
+	for i, mk := range picked {
+		end := len(stem)
+		if i+1 < len(picked) {
+			end = picked[i+1].start
+		}
+		text := strings.TrimSpace(stem[mk.end:end])
+		if text == "" {
+			return stem, nil, false
+		}
+		options = append(options, quizOption{Label: string(mk.letter), Text: text})
+	}
+	return body, options, true
+}
+
+var answerPrefixRe = regexp.MustCompile(`^(?:参考)?(?:答案|故选|应选|选)?\s*[:：]?\s*`)
+
+// parseChoiceLetters 提取答案中的选项字母集合（按字母排序去重），如 "答案：(A)(C)" -> "AC"。
+func parseChoiceLetters(raw string) string {
+	s := answerPrefixRe.ReplaceAllString(strings.TrimSpace(strings.ToUpper(raw)), "")
+	seen := map[rune]bool{}
+scan:
+	for _, r := range s {
+		switch {
+		case r >= 'A' && r <= 'F':
+			seen[r] = true
+		case strings.ContainsRune("()（）,，、;；和 .．", r):
+		default:
+			break scan
+		}
+	}
+	var out strings.Builder
+	for r := 'A'; r <= 'F'; r++ {
+		if seen[r] {
+			out.WriteRune(r)
+		}
+	}
+	return out.String()
+}
+
+// parseTrueFalse 把各种写法的判断题答案归一成 true/false；无法识别时 ok=false。
+func parseTrueFalse(raw string) (value bool, ok bool) {
+	s := strings.ToLower(strings.TrimSpace(answerPrefixRe.ReplaceAllString(strings.TrimSpace(raw), "")))
+	s = strings.Trim(s, "。.()（） ")
+	switch s {
+	case "对", "正确", "√", "✓", "✔", "t", "true", "是", "yes", "y":
+		return true, true
+	case "错", "错误", "×", "✗", "✘", "x", "f", "false", "否", "no", "n":
+		return false, true
+	}
+	return false, false
+}
+
+var fullWidthReplacer = strings.NewReplacer(
+	"，", ",", "（", "(", "）", ")", "：", ":", "；", ";", "－", "-", "＋", "+", "＝", "=",
+	"$", "", "\\left", "", "\\right", "", "。", "",
+)
+
+func normalizeBlank(s string) string {
+	s = fullWidthReplacer.Replace(strings.TrimSpace(s))
+	var b strings.Builder
+	for _, r := range s {
+		if unicode.IsSpace(r) {
+			continue
+		}
+		b.WriteRune(unicode.ToLower(r))
+	}
+	return b.String()
+}
+
+// splitBlanks 多空填空题的答案用 ; ； | 分隔
+func splitBlanks(s string) []string {
+	parts := strings.FieldsFunc(s, func(r rune) bool { return r == ';' || r == '；' || r == '|' })
+	out := make([]string, 0, len(parts))
+	for _, p := range parts {
+		if n := normalizeBlank(p); n != "" {
+			out = append(out, n)
+		}
+	}
+	return out
+}
+
+// gradeObjectiveAnswer 对照题库标准答案判分。gradable=false 表示题库答案缺失或无法解析，需转人工。
+// optionOrder 为展示字母 -> 原字母（按展示顺序），用于把打乱后的作答换算回原选项。
+func gradeObjectiveAnswer(questionType, standard, answer string, optionOrder []string) (correct bool, gradable bool) {
+	standard = strings.TrimSpace(standard)
+	if standard == "" {
+		return false, false
+	}
+	switch strings.TrimSpace(questionType) {
+	case "选择":
+		want := parseChoiceLetters(standard)
+		if want == "" {
+			return false, false
+		}
+		got := parseChoiceLetters(answer)
+		if len(optionOrder) > 0 {
+			mapped := map[rune]bool{}
+			for _, r := range got {
+				idx := int(r - 'A')
+				if idx < 0 || idx >= len(optionOrder) {
+					return false, true
+				}
+				mapped[rune(optionOrder[idx][0])] = true
+			}
+			var b strings.Builder
+			for r := 'A'; r <= 'F'; r++ {
+				if mapped[r] {
+					b.WriteRune(r)
+				}
+			}
+			got = b.String()
+		}
+		return got == want, true
+	case "判断":
+		want, ok := parseTrueFalse(standard)
+		if !ok {
+			return false, false
+		}
+		got, ok := parseTrueFalse(answer)
+		return ok && got == want, true
+	case "填空":
+		want := splitBlanks(standard)
+		if len(want) == 0 {
+			return false, false
+		}
+		got := splitBlanks(answer)
+		if len(got) != len(want) {
+			return false, true
+		}
+		for i := range want {
+			if got[i] != want[i] {
+				return false, true
+			}
+		}
+		return true, true
+	}
+	return false, false
+}
@@ -0,0 +1,293 @@
+// web_service/chat/attachments.go
+
+package chat
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"workplace/web_service/assignment"
+	"workplace/web_service/auth"
+	"workplace/web_service/jobs"
+	"workplace/web_service/ocr"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const (
+	JobTypeDescribeAttachments = "chat_attachment_describe"
+
+	attachmentDir             = "./uploads/chat"
+	attachmentDescribeTimeout = 90 * time.Second
+	// 历史中每个附件的识别文字上限，避免长 PDF 挤占上下文
+	maxAttachmentContextRunes = 4000
+)
+
+// inlineContentTypes 允许在浏览器里直接预览的附件类型，其余一律按下载处理
+var inlineContentTypes = map[string]bool{
+	"image/png":       true,
+	"image/jpeg":      true,
+	"image/gif":       true,
+	"image/webp":      true,
+	"application/pdf": true,
+}
+
+// ChatAttachment 聊天消息附带的文件。原文件保存在 uploads/chat 下，识别出的文字（OCR / 视觉描述）
+// 随后续轮次的历史一起发给 AI，让模型始终“看得到”之前上传的手写解答。
+type ChatAttachment struct {
+	ID          uint       `gorm:"primarykey" json:"id"`
+	MessageID   uint       `gorm:"index;not null" json:"messageId"`
+	SessionID   uint       `gorm:"index;not null" json:"chatSessionId"`
+	UserID      uint       `gorm:"index;not null" json:"-"`
+	FileName    string     `gorm:"size:255" json:"fileName"`
+	ContentType string     `gorm:"size:100" json:"contentType"`
+	Size        int64      `json:"size"`
+	StoragePath string     `gorm:"size:500" json:"-"`
+	Description string     `gorm:"type:text" json:"-"` // 识别结果，只用于拼装历史
+	DescribedAt *time.Time `json:"describedAt,omitempty"`
+	CreatedAt   time.Time  `json:"createdAt"`
+}
+
+// uploadedFiles 本次请求上传的附件
+func uploadedFiles(c *gin.Context) []*multipart.FileHeader {
+	form, err := c.MultipartForm()
+	if err != nil {
+		return nil
+	}
+	return form.File["files"]
+}
+
+func saveUploadedFile(fileHeader *multipart.FileHeader, path string) error {
+	src, err := fileHeader.Open()
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		return err
+	}
+	return dst.Close()
+}
+
+// sniffContentType 按文件内容判断类型，不信任客户端声明的 Content-Type；
+// 图片、PDF 与纯文本（供 ai_service 识别）之外一律记为 application/octet-stream
+func sniffContentType(path string) string {
+	f, err := os.Open(path)
+	if err != nil {
+		return "application/octet-stream"
+	}
+	defer f.Close()
+	buf := make([]byte, 512)
+	n, _ := io.ReadFull(f, buf)
+	contentType := http.DetectContentType(buf[:n])
+	if inlineContentTypes[contentType] || strings.HasPrefix(contentType, "text/plain") {
+		return contentType
+	}
+	return "application/octet-stream"
+}
+
+// saveAttachments 把本次上传的附件落盘并关联到用户消息；写库失败时调用方回滚事务，已写的文件由这里清理
+func saveAttachments(tx *gorm.DB, c *gin.Context, userID, sessionID, messageID uint) ([]ChatAttachment, error) {
+	files := uploadedFiles(c)
+	if len(files) == 0 {
+		return nil, nil
+	}
+	dir := filepath.Join(attachmentDir, strconv.Itoa(int(userID)))
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, err
+	}
+	attachments := make([]ChatAttachment, 0, len(files))
+	removeSaved := func() {
+		for _, att := range attachments {
+			os.Remove(att.StoragePath)
+		}
+	}
+	for i, fileHeader := range files {
+		path := filepath.Join(dir, fmt.Sprintf("%d-%d-%d%s", messageID, time.Now().UnixNano(), i, strings.ToLower(filepath.Ext(fileHeader.Filename))))
+		if err := saveUploadedFile(fileHeader, path); err != nil {
+			removeSaved()
+			return nil, err
+		}
+		attachments = append(attachments, ChatAttachment{
+			MessageID:   messageID,
+			SessionID:   sessionID,
+			UserID:      userID,
+			FileName:    filepath.Base(fileHeader.Filename),
+			ContentType: sniffContentType(path),
+			Size:        fileHeader.Size,
+			StoragePath: path,
+			CreatedAt:   time.Now(),
+		})
+	}
+	if err := tx.Create(&attachments).Error; err != nil {
+		removeSaved()
+		return nil, err
+	}
+	return attachments, nil
+}
+
+// enqueueDescribe 落库后在后台识别附件，下一轮对话时通常已可直接使用识别结果
+func (h *ChatHandler) enqueueDescribe(attachments []ChatAttachment) {
+	if h.Jobs == nil || len(attachments) == 0 {
+		return
+	}
+	ids := make([]uint, 0, len(attachments))
+	for _, att := range attachments {
+		ids = append(ids, att.ID)
+	}
+	if _, err := h.Jobs.Enqueue(JobTypeDescribeAttachments, attachments[0].UserID, describeRequest{AttachmentIDs: ids}, 0); err != nil {
+		log.Printf("Failed to enqueue chat attachment describe job: %v", err)
+	}
+}
+
+type describeRequest struct {
+	AttachmentIDs []uint `json:"attachmentIds"`
+}
+
+// RegisterJobs 注册附件识别与滚动摘要任务
+func (h *ChatHandler) RegisterJobs(q *jobs.Queue) {
+	h.registerSummaryJob(q)
+	q.Register(JobTypeDescribeAttachments, func(ctx context.Context, job *jobs.Job) (interface{}, error) {
+		var req describeRequest
+		if err := job.DecodePayload(&req); err != nil {
+			return nil, err
+		}
+		var attachments []ChatAttachment
+		if err := h.DB.Where("id IN ? AND user_id = ?", req.AttachmentIDs, job.UserID).Find(&attachments).Error; err != nil {
+			return nil, err
+		}
+		for i := range attachments {
+			if err := h.describeAttachment(ctx, &attachments[i]); err != nil {
+				return nil, err
+			}
+		}
+		return gin.H{"described": len(attachments)}, nil
+	})
+}
+
+// describeAttachment 识别附件并保存结果；已识别过的直接返回。识别走 OCR 缓存，同一文件只识别一次。
+func (h *ChatHandler) describeAttachment(ctx context.Context, att *ChatAttachment) error {
+	if att.DescribedAt != nil {
+		return nil
+	}
+	text, err := ocr.RecognizeFile(ctx, h.DB, att.StoragePath, att.FileName, true, attachmentDescribeTimeout)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return jobs.Permanentf("附件文件已丢失")
+		}
+		return err
+	}
+	now := time.Now()
+	att.Description = strings.TrimSpace(text)
+	att.DescribedAt = &now
+	return h.DB.Model(att).Updates(map[string]interface{}{"description": att.Description, "described_at": now}).Error
+}
+
+// attachmentContext 历史消息里附件的文字版：识别结果（必要时当场识别），识别失败时只保留文件名
+func (h *ChatHandler) attachmentContext(ctx context.Context, attachments []ChatAttachment) string {
+	var b strings.Builder
+	for i := range attachments {
+		att := &attachments[i]
+		if err := h.describeAttachment(ctx, att); err != nil {
+			log.Printf("Failed to describe chat attachment %d: %v", att.ID, err)
+		}
+		if att.Description == "" {
+			fmt.Fprintf(&b, "\n\n[附件 '%s'，内容未能识别]", att.FileName)
+			continue
+		}
+		fmt.Fprintf(&b, "\n\n--- 附件 '%s' 的识别内容 ---\n%s\n--- 附件内容结束 ---", att.FileName, trimRunes(att.Description, maxAttachmentContextRunes))
+	}
+	return b.String()
+}
+
+// integrityText 诚信模式比对用的文字：提问加上本轮附件的识别结果（题目常以照片或 PDF 发送）。
+// 学生没有开启诚信模式的作业时直接返回提问，不多做一次识别。识别走 OCR 缓存，之后的附件识别任务可直接复用。
+func (h *ChatHandler) integrityText(c *gin.Context, user auth.User, prompt string, resend []ChatAttachment) string {
+	files := uploadedFiles(c)
+	if (len(files) == 0 && len(resend) == 0) || !assignment.IntegrityActive(h.DB, user) {
+		return prompt
+	}
+	ctx := c.Request.Context()
+	var b strings.Builder
+	b.WriteString(prompt)
+	for _, fileHeader := range files {
+		data, err := readUploadedFile(fileHeader)
+		if err != nil {
+			continue
+		}
+		req := ocr.Request{Data: data, Filename: fileHeader.Filename, ContentType: http.DetectContentType(data), UseVision: true}
+		result, err := ocr.Recognize(ctx, h.DB, req, attachmentDescribeTimeout)
+		if err != nil || result.Status >= http.StatusBadRequest {
+			log.Printf("Failed to recognize chat attachment %q for integrity check: %v", fileHeader.Filename, err)
+			continue
+		}
+		b.WriteString("\n\n")
+		b.WriteString(result.Text)
+	}
+	b.WriteString(h.attachmentContext(ctx, resend))
+	return b.String()
+}
+
+func readUploadedFile(fileHeader *multipart.FileHeader) ([]byte, error) {
+	src, err := fileHeader.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer src.Close()
+	return io.ReadAll(src)
+}
+
+// resendFile 把已保存的附件作为本轮 files 重新发给 ai_service（编辑/重新生成时沿用原附件）
+func resendFile(writer *multipart.Writer, att ChatAttachment) error {
+	f, err := os.Open(att.StoragePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	part, err := writer.CreatePart(attachmentPartHeader(att.FileName, att.ContentType))
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(part, f)
+	return err
+}
+
+// ServeAttachmentHandler 下载/预览附件，只有会话本人可以访问
+func (h *ChatHandler) ServeAttachmentHandler(c *gin.Context) {
+	var att ChatAttachment
+	err := h.DB.Joins("JOIN chat_sessions ON chat_sessions.id = chat_attachments.session_id AND chat_sessions.deleted_at IS NULL").
+		Where("chat_attachments.id = ? AND chat_sessions.user_id = ?", c.Param("id"), userIDFromContext(c)).
+		First(&att).Error
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "附件不存在"})
+		return
+	}
+	if _, err := os.Stat(att.StoragePath); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "附件文件已丢失"})
+		return
+	}
+	// 只有图片和 PDF 内联预览（旧数据的类型来自客户端，同样按白名单判断），其余作为下载，避免 HTML/SVG 在 API 域名下渲染
+	c.Header("X-Content-Type-Options", "nosniff")
+	if inlineContentTypes[att.ContentType] {
+		c.Header("Content-Disposition", contentDisposition("inline", "attachment", att.FileName))
+		c.Header("Content-Type", att.ContentType)
+	} else {
+		c.Header("Content-Disposition", contentDisposition("attachment", "attachment", att.FileName))
+		c.Header("Content-Type", "application/octet-stream")
+	}
+	c.File(att.StoragePath)
+}
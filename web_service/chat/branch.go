@@ -0,0 +1,312 @@
+// web_service/chat/branch.go
+
+package chat
+
+import (
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// 会话是一棵消息树：每条消息的 ParentID 指向上一条，编辑用户消息或重新生成回答时在同一父消息下长出新分支。
+// ChatSession.ActiveLeafID 记录当前所在分支的末端，发给 AI 的历史和前端展示都只取根到该叶子的这条路径。
+
+// AppendMessages 依次写入消息，第一条挂在 parentID 下、之后每条挂在前一条下，并把会话的活动分支指向最后一条
+func AppendMessages(tx *gorm.DB, sessionID uint, parentID *uint, messages ...*ChatMessage) error {
+	for _, msg := range messages {
+		msg.SessionID = sessionID
+		msg.ParentID = parentID
+		if err := tx.Create(msg).Error; err != nil {
+			return err
+		}
+		id := msg.ID
+		parentID = &id
+	}
+	return tx.Model(&ChatSession{}).Where("id = ?", sessionID).Update("active_leaf_id", parentID).Error
+}
+
+// BackfillMessageTree 旧会话的消息没有 ParentID：按时间顺序串成一条链，并把最后一条设为活动叶子
+func BackfillMessageTree(db *gorm.DB) {
+	err := db.Exec(`UPDATE chat_messages m SET parent_id = p.prev_id
+		FROM (SELECT id, LAG(id) OVER (PARTITION BY session_id ORDER BY created_at, id) AS prev_id FROM chat_messages) p
+		WHERE m.id = p.id AND m.parent_id IS NULL AND p.prev_id IS NOT NULL
+		AND m.session_id IN (SELECT id FROM chat_sessions WHERE active_leaf_id IS NULL)`).Error
+	if err == nil {
+		err = db.Exec(`UPDATE chat_sessions s SET active_leaf_id = (
+			SELECT id FROM chat_messages WHERE session_id = s.id ORDER BY created_at DESC, id DESC LIMIT 1)
+		WHERE active_leaf_id IS NULL`).Error
+	}
+	if err != nil {
+		log.Printf("Failed to backfill chat message tree: %v", err)
+	}
+}
+
+// currentLeaf 新消息应挂在哪条消息下；没有叶子指针的旧会话取最后一条
+func currentLeaf(session ChatSession, all []ChatMessage) *uint {
+	if session.ActiveLeafID != nil || len(all) == 0 {
+		return session.ActiveLeafID
+	}
+	id := all[len(all)-1].ID
+	return &id
+}
+
+// activePath 从 leafID 沿 ParentID 回溯出根 → 叶的路径；all 需按时间顺序排列。
+// leafID 为空时：会话尚未建树（旧数据）则原样返回全部消息。
+func activePath(all []ChatMessage, leafID *uint) []ChatMessage {
+	if leafID == nil {
+		return all
+	}
+	byID := make(map[uint]int, len(all))
+	for i, msg := range all {
+		byID[msg.ID] = i
+	}
+	var path []ChatMessage
+	id := *leafID
+	for {
+		idx, found := byID[id]
+		if !found {
+			break
+		}
+		path = append(path, all[idx])
+		delete(byID, id) // 防止脏数据成环
+		if all[idx].ParentID == nil {
+			break
+		}
+		id = *all[idx].ParentID
+	}
+	for i, j := 0, len(path)-1; i < j; i, j = i+1, j-1 {
+		path[i], path[j] = path[j], path[i]
+	}
+	return path
+}
+
+func parentKey(msg ChatMessage) uint {
+	if msg.ParentID == nil {
+		return 0
+	}
+	return *msg.ParentID
+}
+
+// withSiblings 给消息标上同一父消息下的全部分支 ID，供前端显示“2/3”并切换
+func withSiblings(messages, all []ChatMessage) []ChatMessage {
+	children := make(map[uint][]uint)
+	for _, msg := range all {
+		children[parentKey(msg)] = append(children[parentKey(msg)], msg.ID)
+	}
+	out := make([]ChatMessage, len(messages))
+	for i, msg := range messages {
+		if ids := children[parentKey(msg)]; len(ids) > 1 {
+			msg.SiblingIDs = ids
+		}
+		out[i] = msg
+	}
+	return out
+}
+
+// activeBranch 当前分支上的消息（带分支信息）
+func activeBranch(session ChatSession, all []ChatMessage) []ChatMessage {
+	return withSiblings(activePath(all, session.ActiveLeafID), all)
+}
+
+// deepestLeaf 从某条消息一路往下走到最新的子分支末端
+func deepestLeaf(all []ChatMessage, id uint) uint {
+	children := make(map[uint][]uint)
+	for _, msg := range all {
+		if msg.ParentID != nil {
+			children[*msg.ParentID] = append(children[*msg.ParentID], msg.ID)
+		}
+	}
+	for {
+		ids := children[id]
+		if len(ids) == 0 {
+			return id
+		}
+		sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+		id = ids[len(ids)-1]
+	}
+}
+
+// sessionMessages 会话的全部消息（含所有分支与 system 消息），按时间顺序
+func (h *ChatHandler) sessionMessages(sessionID uint) ([]ChatMessage, error) {
+	var messages []ChatMessage
+	err := h.DB.Preload("Attachments").Preload("Correction").Preload("Feedback").Where("session_id = ?", sessionID).Order("created_at asc, id asc").Find(&messages).Error
+	return messages, err
+}
+
+// loadOwnMessage 读取当前用户会话中的某条消息以及该会话的全部消息
+func (h *ChatHandler) loadOwnMessage(c *gin.Context) (ChatMessage, ChatSession, []ChatMessage, bool) {
+	var message ChatMessage
+	var session ChatSession
+	messageID, err := strconv.Atoi(c.Param("id"))
+	if err != nil || messageID <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid message ID"})
+		return message, session, nil, false
+	}
+	if err := h.DB.Preload("Attachments").First(&message, messageID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Message not found"})
+		return message, session, nil, false
+	}
+	if err := h.DB.Where("user_id = ?", userIDFromContext(c)).First(&session, message.SessionID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Message not found"})
+		return message, session, nil, false
+	}
+	all, err := h.sessionMessages(session.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve messages"})
+		return message, session, nil, false
+	}
+	return message, session, all, true
+}
+
+// branchFrom 在 parentID 下生成一轮新回答并切换到新分支：history 为 historyID（含）之前的路径，不含本轮提问，
+// 编辑时与 parentID 相同，重新生成时是提问的上一条。userMessage 非空时先写入这条（编辑后的）用户消息。
+// resend 为沿用的已保存附件，会作为本轮文件重新发送。model_id 等表单字段与普通发送一致。
+func (h *ChatHandler) branchFrom(c *gin.Context, session ChatSession, all []ChatMessage, historyID, parentID *uint, prompt string, userMessage *ChatMessage, resend []ChatAttachment) {
+	userID := userIDFromContext(c)
+	history := session
+	history.Messages = []ChatMessage{}
+	if historyID != nil {
+		history.Messages = activePath(all, historyID)
+	}
+	aiResp, responseDurationMs, status, err := h.callChatAI(c, userID, prompt, history, false, resend)
+	if err != nil {
+		if status != 0 {
+			c.JSON(status, gin.H{"error": err.Error()})
+		}
+		return
+	}
+	aiMessage := &ChatMessage{Role: "ai", Content: aiMessageText(aiResp), Citations: marshalCitations(aiResp.Citations), ModelID: aiResp.ModelID, ResponseDurationMs: &responseDurationMs, CreatedAt: time.Now()}
+	newMessages := []*ChatMessage{aiMessage}
+	if userMessage != nil {
+		newMessages = []*ChatMessage{userMessage, aiMessage}
+	}
+	var attachments []ChatAttachment
+	err = h.DB.Transaction(func(tx *gorm.DB) error {
+		if err := AppendMessages(tx, session.ID, parentID, newMessages...); err != nil {
+			return err
+		}
+		if userMessage == nil {
+			return nil
+		}
+		// 编辑后的消息带上本次新上传的附件；没有新附件时沿用原消息的附件（共用同一份文件与识别结果）
+		if len(resend) == 0 {
+			attachments, err = saveAttachments(tx, c, userID, session.ID, userMessage.ID)
+			return err
+		}
+		copies := make([]ChatAttachment, len(resend))
+		for i, att := range resend {
+			att.ID = 0
+			att.MessageID = userMessage.ID
+			att.CreatedAt = time.Now()
+			copies[i] = att
+		}
+		return tx.Create(&copies).Error
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save messages"})
+		return
+	}
+	h.enqueueDescribe(attachments)
+	h.respondWithSession(c, session.ID, aiResp)
+}
+
+// respondWithSession 返回会话及当前分支上的消息
+func (h *ChatHandler) respondWithSession(c *gin.Context, sessionID uint, aiResp AIChatResponse) {
+	var session ChatSession
+	h.DB.First(&session, sessionID)
+	all, _ := h.sessionMessages(sessionID)
+	session.Messages = h.visibleMessages(c, activeBranch(session, all))
+	c.JSON(http.StatusOK, gin.H{"session": session, "ai_response": aiResp})
+}
+
+// EditMessageHandler 修改之前的一条用户消息：在原消息旁新建分支并重新回答，原分支保留可切回
+func (h *ChatHandler) EditMessageHandler(c *gin.Context) {
+	message, session, all, ok := h.loadOwnMessage(c)
+	if !ok {
+		return
+	}
+	if message.Role != "user" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "只能编辑自己发送的消息"})
+		return
+	}
+	prompt := c.PostForm("prompt")
+	if strings.TrimSpace(prompt) == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "消息内容不能为空"})
+		return
+	}
+	var resend []ChatAttachment
+	if len(uploadedFiles(c)) == 0 {
+		resend = message.Attachments
+	}
+	userMessage := &ChatMessage{Role: "user", Content: prompt, CreatedAt: time.Now()}
+	h.branchFrom(c, session, all, message.ParentID, message.ParentID, prompt, userMessage, resend)
+}
+
+// RegenerateMessageHandler 重新生成一条 AI 回答（可换 model_id），新回答与旧回答同为该问题下的分支
+func (h *ChatHandler) RegenerateMessageHandler(c *gin.Context) {
+	message, session, all, ok := h.loadOwnMessage(c)
+	if !ok {
+		return
+	}
+	if message.Role != "ai" || message.ParentID == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "只能重新生成 AI 的回答"})
+		return
+	}
+	var question ChatMessage
+	for _, msg := range all {
+		if msg.ID == *message.ParentID {
+			question = msg
+		}
+	}
+	if question.Role != "user" {
+		c.JSON(http.StatusConflict, gin.H{"error": "找不到这条回答对应的提问"})
+		return
+	}
+	// 提问本身作为本轮 prompt 重新发送，history 截止到它的上一条，避免同一轮提问和附件发两次
+	h.branchFrom(c, session, all, question.ParentID, &question.ID, question.Content, nil, question.Attachments)
+}
+
+// SwitchBranchRequest 切换到包含某条消息的分支
+type SwitchBranchRequest struct {
+	MessageID uint `json:"messageId" binding:"required"`
+}
+
+// SwitchBranchHandler 切换活动分支：从指定消息往下走到最新的末端，之后的提问都接在这条分支上
+func (h *ChatHandler) SwitchBranchHandler(c *gin.Context) {
+	session, ok := h.loadOwnSession(c, false)
+	if !ok {
+		return
+	}
+	var req SwitchBranchRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "请求参数不合法"})
+		return
+	}
+	all, err := h.sessionMessages(session.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve messages"})
+		return
+	}
+	found := false
+	for _, msg := range all {
+		found = found || msg.ID == req.MessageID
+	}
+	if !found {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Message not found"})
+		return
+	}
+	leaf := deepestLeaf(all, req.MessageID)
+	if err := h.DB.Model(&session).Update("active_leaf_id", leaf).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update session"})
+		return
+	}
+	session.ActiveLeafID = &leaf
+	session.Messages = h.visibleMessages(c, activeBranch(session, all))
+	c.JSON(http.StatusOK, session)
+}
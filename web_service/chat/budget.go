@@ -0,0 +1,391 @@
+// web_service/chat/budget.go
+
+package chat
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"workplace/web_service/aiclient"
+	"workplace/web_service/auth"
+	"workplace/web_service/jobs"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm/clause"
+)
+
+// 上下文预算：每轮发给 AI 的历史与周总结按 token 估算控制在模型预算内。
+// 最近的若干轮原样保留，更早的轮次由 ai_service 异步压缩成滚动摘要（chat_summaries），周总结只挑与问题最相关的几周。
+const (
+	JobTypeSummarize = "chat_summarize"
+
+	defaultContextTokens = 12000
+	// 系统提示词、教材检索片段与回答本身预留的比例
+	contextReservePercent = 35
+	// 剩余预算中分给周总结的比例，其余给对话历史
+	weeklyBudgetPercent = 30
+	// 摘要请求在这段时间内未完成才会重新入队，避免每轮都排一个任务
+	summaryRequestCooldown = 10 * time.Minute
+	summarizeTimeout       = 120 * time.Second
+)
+
+// ChatSummary 会话的滚动摘要：覆盖从根到 ThroughMessageID（含）这段路径上的消息
+type ChatSummary struct {
+	ID               uint       `gorm:"primarykey" json:"id"`
+	SessionID        uint       `gorm:"uniqueIndex;not null" json:"chatSessionId"`
+	Summary          string     `gorm:"type:text" json:"summary"`
+	ThroughMessageID *uint      `json:"throughMessageId,omitempty"`
+	RequestedAt      *time.Time `json:"requestedAt,omitempty"` // 摘要任务已入队、尚未完成
+	UpdatedAt        time.Time  `json:"updatedAt"`
+}
+
+// contextBudget 本轮历史与周总结各自可用的 token 数
+type contextBudget struct {
+	History int
+	Weekly  int
+}
+
+// parseModelBudgets 解析 CHAT_CONTEXT_TOKENS_BY_MODEL，格式 "default=12000,gpt_5_5=48000"（键为 model_id）
+func parseModelBudgets(raw string) map[string]int {
+	budgets := map[string]int{}
+	for _, item := range strings.Split(raw, ",") {
+		name, value, ok := strings.Cut(strings.TrimSpace(item), "=")
+		if !ok {
+			continue
+		}
+		if n, err := strconv.Atoi(strings.TrimSpace(value)); err == nil && n > 0 {
+			budgets[strings.TrimSpace(name)] = n
+		}
+	}
+	return budgets
+}
+
+// modelContextTokens 模型的上下文预算：按 model_id 配置，未配置时取 CHAT_CONTEXT_TOKENS
+func modelContextTokens(modelID string) int {
+	budgets := parseModelBudgets(os.Getenv("CHAT_CONTEXT_TOKENS_BY_MODEL"))
+	if modelID == "" {
+		modelID = "default"
+	}
+	if n, ok := budgets[modelID]; ok {
+		return n
+	}
+	if n, err := strconv.Atoi(strings.TrimSpace(os.Getenv("CHAT_CONTEXT_TOKENS"))); err == nil && n > 0 {
+		return n
+	}
+	return defaultContextTokens
+}
+
+func newContextBudget(modelID, prompt string) contextBudget {
+	total := modelContextTokens(modelID)
+	available := total*(100-contextReservePercent)/100 - estimateTokens(prompt)
+	if available < 0 {
+		available = 0
+	}
+	weekly := available * weeklyBudgetPercent / 100
+	return contextBudget{History: available - weekly, Weekly: weekly}
+}
+
+// estimateTokens 粗略估算 token 数：汉字等按每字 1 个，ASCII 约 4 个字符 1 个
+func estimateTokens(s string) int {
+	wide, ascii := 0, 0
+	for _, r := range s {
+		if r < 0x80 {
+			ascii++
+		} else {
+			wide++
+		}
+	}
+	return wide + (ascii+3)/4
+}
+
+// keptWindowStart 从后往前保留能放进预算的消息，返回保留窗口的起点；至少保留最后一轮问答，且窗口不以 AI 回答开头
+func keptWindowStart(contents []string, roles []string, budget int) int {
+	start, used := len(contents), 0
+	for start > 0 {
+		cost := estimateTokens(contents[start-1])
+		if used+cost > budget && len(contents)-start >= 2 {
+			break
+		}
+		used += cost
+		start--
+	}
+	for start < len(contents)-1 && roles[start] == "ai" {
+		start++
+	}
+	return start
+}
+
+// buildHistory 组装本轮发给 AI 的历史：滚动摘要 + 预算内的最近消息（附件以识别文字代替）。
+// 摘要没能覆盖到保留窗口之前的全部消息时，入队刷新摘要，下一轮即可用上。
+func (h *ChatHandler) buildHistory(ctx context.Context, session ChatSession, budget int) ([]MessageForAI, string) {
+	path := session.Messages
+	if len(path) == 0 {
+		return nil, ""
+	}
+	summary, summarized := h.summaryOnPath(session.ID, path)
+	budget -= estimateTokens(summary)
+
+	contents := make([]string, len(path))
+	roles := make([]string, len(path))
+	for i, msg := range path {
+		contents[i], roles[i] = msg.Content, msg.Role
+	}
+	// 从新到旧补上附件文字，超出预算后更早消息的附件不再识别
+	used := 0
+	for i := len(path) - 1; i > summarized && used <= budget; i-- {
+		if len(path[i].Attachments) > 0 {
+			contents[i] += h.attachmentContext(ctx, path[i].Attachments)
+		}
+		used += estimateTokens(contents[i])
+	}
+
+	start := summarized + 1
+	if windowStart := summarized + 1 + keptWindowStart(contents[summarized+1:], roles[summarized+1:], budget); windowStart > start {
+		start = windowStart
+		h.requestSummary(session, path[start-1].ID)
+	}
+	history := make([]MessageForAI, 0, len(path)-start)
+	for i := start; i < len(path); i++ {
+		history = append(history, MessageForAI{Role: roles[i], Content: contents[i]})
+	}
+	return history, summary
+}
+
+// summaryOnPath 当前分支可用的摘要及其覆盖到的路径下标；摘要属于其他分支或尚未生成时返回 -1
+func (h *ChatHandler) summaryOnPath(sessionID uint, path []ChatMessage) (string, int) {
+	var summary ChatSummary
+	if err := h.DB.Where("session_id = ?", sessionID).Limit(1).Find(&summary).Error; err != nil || summary.ThroughMessageID == nil {
+		return "", -1
+	}
+	for i, msg := range path {
+		if msg.ID == *summary.ThroughMessageID {
+			return summary.Summary, i
+		}
+	}
+	return "", -1
+}
+
+// requestSummary 入队刷新摘要，使其覆盖到 throughID；已有未完成的请求时跳过
+func (h *ChatHandler) requestSummary(session ChatSession, throughID uint) {
+	if h.Jobs == nil {
+		return
+	}
+	now := time.Now()
+	result := h.DB.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "session_id"}},
+		DoUpdates: clause.Assignments(map[string]interface{}{"requested_at": now}),
+		Where: clause.Where{Exprs: []clause.Expression{
+			clause.Expr{SQL: "chat_summaries.requested_at IS NULL OR chat_summaries.requested_at < ?", Vars: []interface{}{now.Add(-summaryRequestCooldown)}},
+		}},
+	}).Create(&ChatSummary{SessionID: session.ID, RequestedAt: &now, UpdatedAt: now})
+	if result.Error != nil || result.RowsAffected == 0 {
+		return
+	}
+	if _, err := h.Jobs.Enqueue(JobTypeSummarize, session.UserID, summarizeRequest{SessionID: session.ID, ThroughMessageID: throughID}, 0); err != nil {
+		log.Printf("Failed to enqueue chat summary job for session %d: %v", session.ID, err)
+		h.DB.Model(&ChatSummary{}).Where("session_id = ?", session.ID).Update("requested_at", nil)
+	}
+}
+
+type summarizeRequest struct {
+	SessionID        uint `json:"sessionId"`
+	ThroughMessageID uint `json:"throughMessageId"`
+}
+
+// summarize 在已有摘要基础上并入新的消息，生成覆盖到 ThroughMessageID 的新摘要
+func (h *ChatHandler) summarize(ctx context.Context, req summarizeRequest) error {
+	var session ChatSession
+	if err := h.DB.First(&session, req.SessionID).Error; err != nil {
+		return jobs.Permanentf("会话不存在")
+	}
+	all, err := h.sessionMessages(session.ID)
+	if err != nil {
+		return err
+	}
+	path := activePath(all, &req.ThroughMessageID)
+	if len(path) == 0 || path[len(path)-1].ID != req.ThroughMessageID {
+		return jobs.Permanentf("消息不存在")
+	}
+	previous, summarized := h.summaryOnPath(session.ID, path)
+	var messages []MessageForAI
+	for _, msg := range path[summarized+1:] {
+		if msg.Role == "system" {
+			continue
+		}
+		content := msg.Content
+		if len(msg.Attachments) > 0 {
+			content += h.attachmentContext(ctx, msg.Attachments)
+		}
+		messages = append(messages, MessageForAI{Role: msg.Role, Content: content})
+	}
+	summary := previous
+	if len(messages) > 0 {
+		if summary, err = requestAISummary(ctx, previous, messages); err != nil {
+			return err
+		}
+	}
+	return h.DB.Model(&ChatSummary{}).Where("session_id = ?", session.ID).Updates(map[string]interface{}{
+		"summary":            summary,
+		"through_message_id": req.ThroughMessageID,
+		"requested_at":       nil,
+		"updated_at":         time.Now(),
+	}).Error
+}
+
+// requestAISummary 调 ai_service /api/v1/chat/summarize
+func requestAISummary(ctx context.Context, previous string, messages []MessageForAI) (string, error) {
+	historyJSON, err := json.Marshal(messages)
+	if err != nil {
+		return "", jobs.Permanent(err)
+	}
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	_ = writer.WriteField("previous_summary", previous)
+	_ = writer.WriteField("history", string(historyJSON))
+	writer.Close()
+
+	ctx, cancel := context.WithTimeout(ctx, summarizeTimeout)
+	defer cancel()
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, aiclient.URL("/api/v1/chat/summarize"), body)
+	if err != nil {
+		return "", err
+	}
+	httpReq.Header.Set("Content-Type", writer.FormDataContentType())
+	resp, err := http.DefaultClient.Do(httpReq)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	responseBody, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode >= http.StatusBadRequest {
+		err := fmt.Errorf("ai_service returned %d: %s", resp.StatusCode, aiErrorMessage(responseBody))
+		if resp.StatusCode < http.StatusInternalServerError {
+			return "", jobs.Permanent(err)
+		}
+		return "", err
+	}
+	var result struct {
+		Summary string `json:"summary"`
+	}
+	if err := json.Unmarshal(responseBody, &result); err != nil {
+		return "", err
+	}
+	if strings.TrimSpace(result.Summary) == "" {
+		return "", errors.New("ai_service 返回了空摘要")
+	}
+	return strings.TrimSpace(result.Summary), nil
+}
+
+// registerSummaryJob 注册滚动摘要任务；最终失败时清掉 requested_at，之后的对话可以重新请求
+func (h *ChatHandler) registerSummaryJob(q *jobs.Queue) {
+	q.Register(JobTypeSummarize, func(ctx context.Context, job *jobs.Job) (interface{}, error) {
+		var req summarizeRequest
+		if err := job.DecodePayload(&req); err != nil {
+			return nil, err
+		}
+		if err := h.summarize(ctx, req); err != nil {
+			if jobs.IsPermanent(err) || job.Attempts >= job.MaxAttempts {
+				h.DB.Model(&ChatSummary{}).Where("session_id = ?", req.SessionID).Update("requested_at", nil)
+			}
+			return nil, err
+		}
+		return gin.H{"chatSessionId": req.SessionID, "throughMessageId": req.ThroughMessageID}, nil
+	})
+}
+
+// promptKeywords 问题中的检索词：英文/数字按词，汉字按相邻两字
+func promptKeywords(s string) map[string]bool {
+	keywords := map[string]bool{}
+	var word []rune
+	var han []rune
+	flush := func() {
+		if len(word) >= 2 {
+			keywords[string(word)] = true
+		}
+		word = word[:0]
+		for i := 0; i+1 < len(han); i++ {
+			keywords[string(han[i:i+2])] = true
+		}
+		if len(han) == 1 {
+			keywords[string(han)] = true
+		}
+		han = han[:0]
+	}
+	for _, r := range strings.ToLower(s) {
+		switch {
+		case unicode.Is(unicode.Han, r):
+			if len(word) > 0 {
+				flush()
+			}
+			han = append(han, r)
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			if len(han) > 0 {
+				flush()
+			}
+			word = append(word, r)
+		default:
+			flush()
+		}
+	}
+	flush()
+	return keywords
+}
+
+// selectWeeklySummaries 在预算内挑选周总结：当前周必选，其余按与问题的关键词重合度排序，同分时近的周优先；输出按周次排列
+func selectWeeklySummaries(materials []auth.ClassWeeklyMaterial, prompt string, currentWeek, budget int) string {
+	keywords := promptKeywords(prompt)
+	type candidate struct {
+		material auth.ClassWeeklyMaterial
+		score    int
+	}
+	candidates := make([]candidate, 0, len(materials))
+	for _, mat := range materials {
+		score := 0
+		text := strings.ToLower(mat.Summary)
+		for kw := range keywords {
+			if strings.Contains(text, kw) {
+				score++
+			}
+		}
+		candidates = append(candidates, candidate{material: mat, score: score})
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		ci, cj := candidates[i], candidates[j]
+		if (ci.material.WeekNum == currentWeek) != (cj.material.WeekNum == currentWeek) {
+			return ci.material.WeekNum == currentWeek
+		}
+		if ci.score != cj.score {
+			return ci.score > cj.score
+		}
+		return ci.material.WeekNum > cj.material.WeekNum
+	})
+
+	var chosen []auth.ClassWeeklyMaterial
+	used := 0
+	for _, cand := range candidates {
+		cost := estimateTokens(cand.material.Summary) + 8
+		if used+cost > budget && len(chosen) > 0 {
+			continue
+		}
+		used += cost
+		chosen = append(chosen, cand.material)
+	}
+	sort.Slice(chosen, func(i, j int) bool { return chosen[i].WeekNum < chosen[j].WeekNum })
+	var b strings.Builder
+	for _, mat := range chosen {
+		fmt.Fprintf(&b, "【第%d周】：\n%s\n\n", mat.WeekNum, mat.Summary)
+	}
+	return b.String()
+}
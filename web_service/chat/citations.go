@@ -0,0 +1,119 @@
+// web_service/chat/citations.go
+
+package chat
+
+import (
+	"encoding/json"
+	"log"
+	"strings"
+	"workplace/web_service/accesscontrol"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Citation ai_service 返回的一条 RAG 出处。旧消息上的引用没有 textbook_id，按教材名对应
+type Citation struct {
+	Index          int      `json:"index"`
+	SourceType     string   `json:"source_type"` // textbook 正文片段 / exercise 题目
+	TextbookID     uint     `json:"textbook_id,omitempty"`
+	TextbookName   string   `json:"textbook_name"`
+	WeekNum        *int     `json:"week_num"`
+	PageNum        *int     `json:"page_num"`
+	ChunkID        *uint    `json:"chunk_id,omitempty"`
+	ExerciseID     *uint    `json:"exercise_id,omitempty"`
+	ExerciseNumber string   `json:"exercise_number,omitempty"`
+	Distance       *float64 `json:"distance"`
+	Snippet        string   `json:"snippet"`
+	Content        string   `json:"content,omitempty"`
+}
+
+// parseCitations 解析消息上存的引用 JSON，无法解析时返回 nil
+func parseCitations(raw string) []Citation {
+	if strings.TrimSpace(raw) == "" {
+		return nil
+	}
+	var citations []Citation
+	if err := json.Unmarshal([]byte(raw), &citations); err != nil {
+		return nil
+	}
+	return citations
+}
+
+// marshalCitations 引用序列化后存到消息的 citations 列，没有引用时为空串
+func marshalCitations(citations []Citation) string {
+	if len(citations) == 0 {
+		return ""
+	}
+	b, err := json.Marshal(citations)
+	if err != nil {
+		return ""
+	}
+	return string(b)
+}
+
+// citationScope 当前用户能看到哪些教材的引用；老师不受限
+type citationScope struct {
+	restricted bool
+	ids        map[uint]bool
+	names      map[string]bool
+}
+
+// citationScopeFor 按 AllowedTextbookIDsForUser 取当前用户的教材范围；读取失败时按无权限处理
+func (h *ChatHandler) citationScopeFor(c *gin.Context) citationScope {
+	scope := citationScope{ids: map[uint]bool{}, names: map[string]bool{}}
+	ids, restricted, _, err := accesscontrol.AllowedTextbookIDsForContext(h.DB, c)
+	if err != nil {
+		log.Printf("Failed to load textbook scope for citations: %v", err)
+		return citationScope{restricted: true}
+	}
+	scope.restricted = restricted
+	if !restricted || len(ids) == 0 {
+		return scope
+	}
+	var names []string
+	h.DB.Table("textbooks").Where("id IN ?", ids).Pluck("name", &names)
+	for _, id := range ids {
+		scope.ids[id] = true
+	}
+	for _, name := range names {
+		scope.names[name] = true
+	}
+	return scope
+}
+
+func (s citationScope) allows(ct Citation) bool {
+	if !s.restricted {
+		return true
+	}
+	if ct.TextbookID != 0 {
+		return s.ids[ct.TextbookID]
+	}
+	return s.names[ct.TextbookName]
+}
+
+// filter 去掉范围外教材的引用
+func (s citationScope) filter(citations []Citation) []Citation {
+	if !s.restricted {
+		return citations
+	}
+	out := make([]Citation, 0, len(citations))
+	for _, ct := range citations {
+		if s.allows(ct) {
+			out = append(out, ct)
+		}
+	}
+	return out
+}
+
+// filterMessages 按范围重写每条消息的引用；班级教材调整后，旧消息里范围外的出处也不再展示
+func (s citationScope) filterMessages(messages []ChatMessage) []ChatMessage {
+	if !s.restricted {
+		return messages
+	}
+	for i := range messages {
+		if messages[i].Citations != "" {
+			messages[i].Citations = marshalCitations(s.filter(parseCitations(messages[i].Citations)))
+		}
+	}
+	return messages
+}
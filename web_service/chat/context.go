@@ -0,0 +1,224 @@
+// web_service/chat/context.go
+
+package chat
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"workplace/web_service/accesscontrol"
+	"workplace/web_service/assignment"
+	"workplace/web_service/auth"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	ContextChat    = "chat"    // 自由问答
+	ContextGrading = "grading" // 批改后答疑：后续每轮都走 /api/v1/grading/chat
+	ContextExplain = "explain" // 题库题目讲解
+)
+
+// 旧版答疑会话把批改上下文存成一条 system 消息，格式固定
+const (
+	legacyProblemHeading    = "### 原始题目\n"
+	legacySolutionHeading   = "\n\n### 学生的解答\n"
+	legacyCorrectionHeading = "\n\n### 你给出的批改意见\n"
+)
+
+// GradingContext 答疑会话讨论的那次批改
+type GradingContext struct {
+	ProblemText    string
+	SolutionText   string
+	CorrectionText string
+}
+
+// FormatGradingContextMessage 生成答疑会话中隐藏的 system 消息（未关联批改记录时用它保存上下文）
+func FormatGradingContextMessage(gc GradingContext) string {
+	return legacyProblemHeading + gc.ProblemText + legacySolutionHeading + gc.SolutionText + legacyCorrectionHeading + gc.CorrectionText
+}
+
+func parseGradingContextMessage(content string) (GradingContext, bool) {
+	if !strings.HasPrefix(content, legacyProblemHeading) {
+		return GradingContext{}, false
+	}
+	rest := strings.TrimPrefix(content, legacyProblemHeading)
+	problem, rest, ok := strings.Cut(rest, legacySolutionHeading)
+	if !ok {
+		return GradingContext{}, false
+	}
+	solution, correction, ok := strings.Cut(rest, legacyCorrectionHeading)
+	if !ok {
+		return GradingContext{}, false
+	}
+	return GradingContext{ProblemText: problem, SolutionText: solution, CorrectionText: correction}, true
+}
+
+// loadGradingContext 取答疑会话的批改上下文：优先用关联的批改记录（含已从历史中删除的），否则解析旧版 system 消息。
+func (h *ChatHandler) loadGradingContext(session ChatSession) (GradingContext, bool) {
+	if session.GradeResultID != nil {
+		var row struct {
+			Problem    string
+			Content    string
+			Correction string
+		}
+		// grading 包依赖 chat，这里直接查表避免循环引用
+		if err := h.DB.Table("grade_results").Select("problem, content, correction").
+			Where("id = ? AND user_id = ?", *session.GradeResultID, session.UserID).
+			Limit(1).Scan(&row).Error; err == nil && row.Correction != "" {
+			return GradingContext{ProblemText: row.Problem, SolutionText: row.Content, CorrectionText: row.Correction}, true
+		}
+	}
+	for _, msg := range session.Messages {
+		if msg.Role == "system" {
+			if gc, ok := parseGradingContextMessage(msg.Content); ok {
+				return gc, true
+			}
+		}
+	}
+	return GradingContext{}, false
+}
+
+// isGradingSession 旧会话没有 ContextType，凭 system 上下文消息识别
+func isGradingSession(session ChatSession) bool {
+	if session.ContextType == ContextGrading {
+		return true
+	}
+	if session.ContextType != "" && session.ContextType != ContextChat {
+		return false
+	}
+	for _, msg := range session.Messages {
+		if msg.Role == "system" && strings.HasPrefix(msg.Content, legacyProblemHeading) {
+			return true
+		}
+	}
+	return false
+}
+
+// buildGradingChatForm 组装 /api/v1/grading/chat 的表单：批改上下文 + 之前的问答（不含 system）+ 本轮问题。
+// hintOnly 为 true 时（题目属于开启诚信模式的作业）要求只给提示。
+func buildGradingChatForm(gc GradingContext, question string, messages []ChatMessage, hintOnly bool) (*bytes.Buffer, string) {
+	history := make([]MessageForAI, 0, len(messages))
+	for _, msg := range messages {
+		if msg.Role == "user" || msg.Role == "ai" {
+			history = append(history, MessageForAI{Role: msg.Role, Content: msg.Content})
+		}
+	}
+	historyJSON, err := json.Marshal(history)
+	if err != nil {
+		historyJSON = []byte("[]")
+	}
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	_ = writer.WriteField("problem_text", gc.ProblemText)
+	_ = writer.WriteField("solution_text", gc.SolutionText)
+	_ = writer.WriteField("correction_text", gc.CorrectionText)
+	_ = writer.WriteField("new_question", question)
+	_ = writer.WriteField("chat_history", string(historyJSON))
+	if hintOnly {
+		_ = writer.WriteField("hint_only", "true")
+	}
+	writer.Close()
+	return body, writer.FormDataContentType()
+}
+
+// gradingHistoryWithinBudget 答疑会话只保留预算内最近的问答；批改上下文单独发送，不占这部分预算
+func gradingHistoryWithinBudget(messages []ChatMessage, budget int) []ChatMessage {
+	var contents, roles []string
+	var kept []ChatMessage
+	for _, msg := range messages {
+		if msg.Role == "user" || msg.Role == "ai" {
+			contents = append(contents, msg.Content)
+			roles = append(roles, msg.Role)
+			kept = append(kept, msg)
+		}
+	}
+	return kept[keptWindowStart(contents, roles, budget):]
+}
+
+// hasAttachments 请求是否带了附件（答疑会话不支持附件）
+func hasAttachments(c *gin.Context) bool {
+	form, err := c.MultipartForm()
+	return err == nil && len(form.File["files"]) > 0
+}
+
+// visibleMessages 学生看不到答疑会话里承载批改上下文的 system 消息，引用只保留其教材范围内的出处
+func (h *ChatHandler) visibleMessages(c *gin.Context, messages []ChatMessage) []ChatMessage {
+	if accesscontrol.CurrentRole(c) == "teacher" {
+		return messages
+	}
+	out := make([]ChatMessage, 0, len(messages))
+	for _, msg := range messages {
+		if msg.Role != "system" {
+			out = append(out, msg)
+		}
+	}
+	return h.citationScopeFor(c).filterMessages(out)
+}
+
+// integrityRecentTurns 诚信检查时连同本轮一起比对的最近几轮学生提问数
+const integrityRecentTurns = 4
+
+// sessionHintOnly 诚信模式检查：讲解会话按题目 ID 匹配；文字比对的范围是本轮提问与附件识别文字，
+// 加上当前分支上最近几轮学生提问及其附件，避免上一轮贴题面、下一轮再要完整解答绕过检查。
+// 命中时记录一条诚信事件。
+func (h *ChatHandler) sessionHintOnly(c *gin.Context, userID uint, session ChatSession, prompt string, resend []ChatAttachment) bool {
+	var user auth.User
+	if err := h.DB.First(&user, userID).Error; err != nil {
+		return false
+	}
+	source := assignment.IntegritySourceChat
+	var exerciseID uint
+	if session.ContextType == ContextExplain && session.ExerciseID != nil {
+		source = assignment.IntegritySourceExplain
+		exerciseID = *session.ExerciseID
+	}
+	text := h.integrityText(c, user, prompt, resend)
+	if assignment.IntegrityActive(h.DB, user) {
+		var earlier []ChatAttachment
+		turns := 0
+		for i := len(session.Messages) - 1; i >= 0 && turns < integrityRecentTurns; i-- {
+			msg := session.Messages[i]
+			if msg.Role != "user" {
+				continue
+			}
+			turns++
+			text += "\n\n" + msg.Content
+			earlier = append(earlier, msg.Attachments...)
+		}
+		text += h.attachmentContext(c.Request.Context(), earlier)
+	}
+	return assignment.HintOnly(h.DB, user, source, text, exerciseID)
+}
+
+// sessionAIRequest 决定本轮请求发往哪个 ai_service 接口：答疑会话带着批改上下文走 /api/v1/grading/chat，
+// 其余会话走通用聊天 /api/v1/chat，历史按模型的上下文预算裁剪（见 budget.go）。出错时返回对应的 HTTP 状态码。
+func (h *ChatHandler) sessionAIRequest(c *gin.Context, userID uint, prompt string, session ChatSession, isFirstMessage bool, resend []ChatAttachment) (path string, body *bytes.Buffer, contentType string, status int, err error) {
+	if !isFirstMessage && isGradingSession(session) {
+		gc, ok := h.loadGradingContext(session)
+		if !ok {
+			return "", nil, "", http.StatusConflict, errors.New("答疑会话缺少批改上下文")
+		}
+		if hasAttachments(c) || len(resend) > 0 {
+			return "", nil, "", http.StatusBadRequest, errors.New("批改答疑会话暂不支持上传附件")
+		}
+		// 自评的题目属于进行中的诚信模式作业时，答疑同样只给提示，避免借答疑拿到完整解答
+		var user auth.User
+		h.DB.First(&user, userID)
+		hintOnly := assignment.HintOnly(h.DB, user, assignment.IntegritySourceGrading, gc.ProblemText+"\n\n"+prompt, 0)
+		body, contentType = buildGradingChatForm(gc, prompt, gradingHistoryWithinBudget(session.Messages, newContextBudget(c.PostForm("model_id"), prompt).History), hintOnly)
+		return "/api/v1/grading/chat", body, contentType, http.StatusOK, nil
+	}
+
+	budget := newContextBudget(c.PostForm("model_id"), prompt)
+	historyForAI, summary := h.buildHistory(c.Request.Context(), session, budget.History)
+	hintOnly := h.sessionHintOnly(c, userID, session, prompt, resend)
+	body, contentType, err = h.buildChatAIForm(c, userID, prompt, historyForAI, summary, budget.Weekly, resend, hintOnly)
+	if err != nil {
+		return "", nil, "", http.StatusInternalServerError, err
+	}
+	return "/api/v1/chat", body, contentType, http.StatusOK, nil
+}
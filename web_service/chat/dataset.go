@@ -0,0 +1,234 @@
+// web_service/chat/dataset.go
+
+package chat
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// 每条样本最多带上提问之前的几条消息作为上下文
+	datasetContextMessages = 10
+	maxDatasetRecords      = 5000
+)
+
+// DatasetTurn 样本上下文中的一条消息
+type DatasetTurn struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+// DatasetRecord 偏好数据集的一行：chosen 优于 rejected，任一侧可能为空（只有单边评价时）
+type DatasetRecord struct {
+	ID       string        `json:"id"`
+	Prompt   string        `json:"prompt"`
+	Context  []DatasetTurn `json:"context"`
+	Chosen   *string       `json:"chosen"`
+	Rejected *string       `json:"rejected"`
+	Metadata gin.H         `json:"metadata"`
+}
+
+// pseudonymizer 用 HMAC 把用户 ID 映射为稳定的假名：同一学生在多次导出中一致，但无法反推出身份
+type pseudonymizer struct {
+	key []byte
+}
+
+// newPseudonymizer 密钥取自 FEEDBACK_EXPORT_SECRET，未配置时返回 false：空密钥下的假名可以按顺序枚举用户 ID 反推，
+// 也不复用 JWT_SECRET，避免一个密钥承担两种用途
+func newPseudonymizer() (pseudonymizer, bool) {
+	key := os.Getenv("FEEDBACK_EXPORT_SECRET")
+	return pseudonymizer{key: []byte(key)}, key != ""
+}
+
+func (p pseudonymizer) id(prefix string, id uint) string {
+	mac := hmac.New(sha256.New, p.key)
+	fmt.Fprintf(mac, "%s:%d", prefix, id)
+	return prefix + "_" + hex.EncodeToString(mac.Sum(nil))[:12]
+}
+
+// preferencePair 为一条被评价的回答找出对照：点踩的回答以老师更正、学生给出的更好回答、
+// 同一问题下被点赞的其它分支依次作为 chosen；点赞的回答以同一问题下被点踩的分支作为 rejected。
+func preferencePair(msg ChatMessage, siblings []ChatMessage, correction *AnswerCorrection, feedback *MessageFeedback) (chosen, rejected *string, source string) {
+	answer := msg.Content
+	if msg.FeedbackScore > 0 {
+		chosen = &answer
+		for _, sib := range siblings {
+			if sib.ID != msg.ID && sib.Role == "ai" && sib.FeedbackScore < 0 {
+				text := sib.Content
+				return chosen, &text, "rejected_branch"
+			}
+		}
+		return chosen, nil, ""
+	}
+	rejected = &answer
+	switch {
+	case correction != nil:
+		text := correction.Content
+		return &text, rejected, "teacher_correction"
+	case feedback != nil && feedback.BetterAnswer != "":
+		text := feedback.BetterAnswer
+		return &text, rejected, "student_better_answer"
+	}
+	for _, sib := range siblings {
+		if sib.ID != msg.ID && sib.Role == "ai" && sib.FeedbackScore > 0 {
+			text := sib.Content
+			return &text, rejected, "preferred_branch"
+		}
+	}
+	return nil, rejected, ""
+}
+
+// ExportFeedbackDatasetHandler (老师) 把本班学生评价过的 AI 回答导出为 JSONL 偏好数据集，供离线评测与微调。
+// 学生身份以假名替代，不含用户名/学号/邮箱；pairsOnly=1 时只输出 chosen 与 rejected 都有的样本。
+func (h *ChatHandler) ExportFeedbackDatasetHandler(c *gin.Context) {
+	cls, _, ok := h.teacherClass(c)
+	if !ok {
+		return
+	}
+	names, ok := newPseudonymizer()
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "服务器未配置 FEEDBACK_EXPORT_SECRET，无法导出数据集"})
+		return
+	}
+	since, ok := parseSince(c)
+	if !ok {
+		return
+	}
+	pairsOnly, _ := strconv.ParseBool(c.Query("pairsOnly"))
+
+	query := h.classFeedbackQuery(cls.ID).
+		Select("chat_messages.id, chat_messages.session_id, chat_messages.created_at").
+		Where("chat_messages.feedback_score <> 0")
+	if since != nil {
+		query = query.Where("chat_messages.created_at >= ?", *since)
+	}
+	var rows []feedbackRow
+	if err := query.Order("chat_messages.created_at asc, chat_messages.id asc").Limit(maxDatasetRecords).Scan(&rows).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "读取反馈失败"})
+		return
+	}
+
+	// 按会话整体读出消息，用于还原提问、上下文与同级分支
+	sessionIDs := make([]uint, 0, len(rows))
+	messageIDs := make([]uint, 0, len(rows))
+	for _, row := range rows {
+		sessionIDs = append(sessionIDs, row.SessionID)
+		messageIDs = append(messageIDs, row.ID)
+	}
+	bySession := map[uint][]ChatMessage{}
+	sessionOwner := map[uint]uint{}
+	corrections := map[uint]*AnswerCorrection{}
+	feedbacks := map[uint]*MessageFeedback{}
+	if len(rows) > 0 {
+		var messages []ChatMessage
+		if err := h.DB.Where("session_id IN ?", sessionIDs).Order("created_at asc, id asc").Find(&messages).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "读取会话消息失败"})
+			return
+		}
+		for _, msg := range messages {
+			bySession[msg.SessionID] = append(bySession[msg.SessionID], msg)
+		}
+		var sessions []ChatSession
+		h.DB.Select("id, user_id").Where("id IN ?", sessionIDs).Find(&sessions)
+		for _, s := range sessions {
+			sessionOwner[s.ID] = s.UserID
+		}
+		var list []AnswerCorrection
+		h.DB.Where("message_id IN ?", messageIDs).Find(&list)
+		for i := range list {
+			corrections[list[i].MessageID] = &list[i]
+		}
+		var details []MessageFeedback
+		h.DB.Where("message_id IN ?", messageIDs).Find(&details)
+		for i := range details {
+			feedbacks[details[i].MessageID] = &details[i]
+		}
+	}
+
+	filename := fmt.Sprintf("feedback-class-%d-%s.jsonl", cls.ID, time.Now().Format("20060102"))
+	c.Header("Content-Type", "application/x-ndjson; charset=utf-8")
+	c.Header("Content-Disposition", contentDisposition("attachment", "feedback", filename))
+	c.Status(http.StatusOK)
+	w := bufio.NewWriter(c.Writer)
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	for _, row := range rows {
+		all := bySession[row.SessionID]
+		var msg ChatMessage
+		for _, m := range all {
+			if m.ID == row.ID {
+				msg = m
+			}
+		}
+		if msg.ID == 0 || msg.ParentID == nil {
+			continue
+		}
+		path := activePath(all, msg.ParentID)
+		if len(path) == 0 || path[len(path)-1].Role != "user" {
+			continue
+		}
+		question := path[len(path)-1]
+		var siblings []ChatMessage
+		for _, m := range all {
+			if parentKey(m) == question.ID {
+				siblings = append(siblings, m)
+			}
+		}
+		chosen, rejected, source := preferencePair(msg, siblings, corrections[msg.ID], feedbacks[msg.ID])
+		if pairsOnly && (chosen == nil || rejected == nil) {
+			continue
+		}
+
+		context := make([]DatasetTurn, 0, datasetContextMessages)
+		earlier := path[:len(path)-1]
+		if len(earlier) > datasetContextMessages {
+			earlier = earlier[len(earlier)-datasetContextMessages:]
+		}
+		for _, m := range earlier {
+			context = append(context, DatasetTurn{Role: m.Role, Content: m.Content})
+		}
+		meta := gin.H{
+			"student":    names.id("stu", sessionOwner[row.SessionID]),
+			"session":    names.id("ses", row.SessionID),
+			"classId":    cls.ID,
+			"modelId":    msg.ModelID,
+			"score":      msg.FeedbackScore,
+			"topic":      citationTopic(msg.Citations),
+			"pairSource": source,
+			"createdAt":  msg.CreatedAt,
+		}
+		if fb := feedbacks[msg.ID]; fb != nil {
+			meta["reasons"] = fb.ReasonList()
+			if fb.Comment != "" {
+				meta["comment"] = fb.Comment
+			}
+		}
+		if msg.Citations != "" && json.Valid([]byte(msg.Citations)) {
+			meta["citations"] = json.RawMessage(msg.Citations)
+		}
+		record := DatasetRecord{
+			ID:       names.id("msg", msg.ID),
+			Prompt:   strings.TrimSpace(question.Content),
+			Context:  context,
+			Chosen:   chosen,
+			Rejected: rejected,
+			Metadata: meta,
+		}
+		if err := enc.Encode(record); err != nil {
+			return
+		}
+	}
+	w.Flush()
+}
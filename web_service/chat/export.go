@@ -0,0 +1,175 @@
+// web_service/chat/export.go
+
+package chat
+
+import (
+	"archive/zip"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+	"workplace/web_service/export"
+
+	"github.com/gin-gonic/gin"
+)
+
+var unsafeFilenameChars = regexp.MustCompile(`[\\/:*?"<>|\x00-\x1f]+`)
+
+// exportFilename 由会话标题生成文件名（去掉路径与非法字符）
+func exportFilename(session ChatSession, format string) string {
+	title := strings.TrimSpace(unsafeFilenameChars.ReplaceAllString(session.Title, "_"))
+	if title == "" {
+		title = "未命名对话"
+	}
+	return fmt.Sprintf("%s-%d.%s", trimRunes(title, 40), session.ID, format)
+}
+
+// speakerLabel 导出时的发言人名称
+func speakerLabel(role string) string {
+	if role == "ai" {
+		return "AI 助手"
+	}
+	return "我"
+}
+
+// buildExportDocument 会话转为导出文档；system 消息（批改上下文）不导出
+func buildExportDocument(session ChatSession, messages []ChatMessage, exportedAt time.Time) export.Document {
+	doc := export.Document{Title: session.Title, ExportedAt: exportedAt}
+	if strings.TrimSpace(doc.Title) == "" {
+		doc.Title = "未命名对话"
+	}
+	for _, msg := range messages {
+		if msg.Role == "system" {
+			continue
+		}
+		doc.Entries = append(doc.Entries, export.Entry{
+			Speaker:   speakerLabel(msg.Role),
+			CreatedAt: msg.CreatedAt,
+			Content:   msg.Content,
+			Footnotes: export.CitationFootnotes(msg.Citations),
+		})
+	}
+	return doc
+}
+
+// exportMessages 导出/分享用的消息：只取当前分支，去掉 system 消息，引用按 scope 过滤
+func (h *ChatHandler) exportMessages(session ChatSession, scope citationScope) ([]ChatMessage, error) {
+	all, err := h.sessionMessages(session.ID)
+	if err != nil {
+		return nil, err
+	}
+	var messages []ChatMessage
+	for _, msg := range activePath(all, session.ActiveLeafID) {
+		if msg.Role != "system" {
+			messages = append(messages, msg)
+		}
+	}
+	return scope.filterMessages(messages), nil
+}
+
+// attachmentDisposition 带 UTF-8 文件名的下载头
+func attachmentDisposition(filename string) string {
+	return contentDisposition("attachment", "export", filename)
+}
+
+// contentDisposition 旧客户端用 ASCII 的 fallback 名（保留扩展名），新客户端用 filename* 中的原文件名
+func contentDisposition(kind, fallback, filename string) string {
+	return fmt.Sprintf("%s; filename=\"%s%s\"; filename*=UTF-8''%s",
+		kind, fallback, filenameExt(filename), url.PathEscape(filename))
+}
+
+func filenameExt(filename string) string {
+	if i := strings.LastIndex(filename, "."); i >= 0 {
+		return filename[i:]
+	}
+	return ""
+}
+
+func exportFormat(c *gin.Context) (string, bool) {
+	format := strings.ToLower(c.DefaultQuery("format", export.FormatMarkdown))
+	if !export.ValidFormat(format) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "format 只支持 md / tex / pdf"})
+		return "", false
+	}
+	return format, true
+}
+
+// ExportSessionHandler 导出单个会话为 Markdown / LaTeX / PDF。
+// PDF 在服务内本地生成，只是纯文本近似（公式转为近似文字、不嵌入字体），由 X-Export-Fidelity 响应头标明。
+func (h *ChatHandler) ExportSessionHandler(c *gin.Context) {
+	format, ok := exportFormat(c)
+	if !ok {
+		return
+	}
+	session, ok := h.loadOwnSession(c, false)
+	if !ok {
+		return
+	}
+	messages, err := h.exportMessages(session, h.citationScopeFor(c))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve messages"})
+		return
+	}
+	data, err := export.Render(buildExportDocument(session, messages, time.Now()), format)
+	if err != nil {
+		log.Printf("Failed to export chat session %d: %v", session.ID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "导出失败"})
+		return
+	}
+	c.Header("Content-Disposition", attachmentDisposition(exportFilename(session, format)))
+	c.Header("X-Export-Fidelity", export.Fidelity(format))
+	c.Data(http.StatusOK, export.ContentType(format), data)
+}
+
+// ExportAllSessionsHandler 把当前用户所有未删除的会话（含归档）打包为 ZIP，每个会话一个文件
+func (h *ChatHandler) ExportAllSessionsHandler(c *gin.Context) {
+	format, ok := exportFormat(c)
+	if !ok {
+		return
+	}
+	var sessions []ChatSession
+	if err := h.DB.Where("user_id = ?", userIDFromContext(c)).Order("created_at asc, id asc").Find(&sessions).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve chat sessions"})
+		return
+	}
+	if len(sessions) == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "没有可导出的会话"})
+		return
+	}
+
+	now := time.Now()
+	c.Header("Content-Disposition", attachmentDisposition(fmt.Sprintf("聊天记录-%s.zip", now.Format("20060102"))))
+	c.Header("Content-Type", "application/zip")
+	c.Header("X-Export-Fidelity", export.Fidelity(format))
+	c.Status(http.StatusOK)
+	scope := h.citationScopeFor(c)
+	zw := zip.NewWriter(c.Writer)
+	defer zw.Close()
+	for _, session := range sessions {
+		messages, err := h.exportMessages(session, scope)
+		if err == nil {
+			err = h.writeZipEntry(zw, session, messages, format, now)
+		}
+		if err != nil {
+			// 响应头已发出，只能记日志并跳过该会话
+			log.Printf("Failed to export chat session %d into zip: %v", session.ID, err)
+		}
+	}
+}
+
+func (h *ChatHandler) writeZipEntry(zw *zip.Writer, session ChatSession, messages []ChatMessage, format string, now time.Time) error {
+	data, err := export.Render(buildExportDocument(session, messages, now), format)
+	if err != nil {
+		return err
+	}
+	header := &zip.FileHeader{Name: exportFilename(session, format), Method: zip.Deflate, Modified: session.CreatedAt}
+	w, err := zw.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
@@ -0,0 +1,464 @@
+// web_service/chat/feedback.go
+
+package chat
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	maxFeedbackQueueItems = 200
+	// 回答没有引用教材时归入的主题
+	uncitedTopic = "未引用教材"
+)
+
+// AnswerCorrection 老师对被点踩的 AI 回答写的更正，学生查看该消息时一并展示
+type AnswerCorrection struct {
+	ID        uint      `gorm:"primarykey" json:"id"`
+	MessageID uint      `gorm:"not null;uniqueIndex" json:"messageId"`
+	ClassID   uint      `gorm:"index;not null" json:"classId"`
+	TeacherID uint      `gorm:"index;not null" json:"teacherId"`
+	Content   string    `gorm:"type:text;not null" json:"content"`
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// 点踩原因
+const (
+	FeedbackReasonWrongMath = "wrong_math" // 数学错误
+	FeedbackReasonUnclear   = "unclear"    // 讲得不清楚
+	FeedbackReasonOffTopic  = "off_topic"  // 答非所问
+	FeedbackReasonGivesAway = "gives_away" // 直接给出了答案，没有引导
+)
+
+var feedbackReasons = map[string]bool{
+	FeedbackReasonWrongMath: true,
+	FeedbackReasonUnclear:   true,
+	FeedbackReasonOffTopic:  true,
+	FeedbackReasonGivesAway: true,
+}
+
+const (
+	maxFeedbackCommentRunes = 1000
+	maxBetterAnswerRunes    = 8000
+)
+
+// MessageFeedback 学生对一条 AI 回答的详细评价；ChatMessage.FeedbackScore 同步保存分数供统计
+type MessageFeedback struct {
+	ID           uint      `gorm:"primarykey" json:"id"`
+	MessageID    uint      `gorm:"not null;uniqueIndex" json:"messageId"`
+	UserID       uint      `gorm:"index;not null" json:"-"`
+	Score        int       `gorm:"not null" json:"score"`
+	Reasons      string    `gorm:"type:text" json:"-"` // 原因 JSON 数组，自定义 MarshalJSON 暴露为数组
+	Comment      string    `gorm:"type:text" json:"comment,omitempty"`
+	BetterAnswer string    `gorm:"type:text" json:"betterAnswer,omitempty"`
+	CreatedAt    time.Time `json:"createdAt"`
+	UpdatedAt    time.Time `json:"updatedAt"`
+}
+
+// MarshalJSON 把 Reasons 以数组形式输出
+func (f MessageFeedback) MarshalJSON() ([]byte, error) {
+	type alias MessageFeedback
+	return json.Marshal(struct {
+		alias
+		Reasons []string `json:"reasons"`
+	}{alias: alias(f), Reasons: f.ReasonList()})
+}
+
+// ReasonList 解析后的点踩原因
+func (f MessageFeedback) ReasonList() []string {
+	reasons := []string{}
+	if f.Reasons != "" {
+		_ = json.Unmarshal([]byte(f.Reasons), &reasons)
+	}
+	return reasons
+}
+
+// normalizeFeedback 校验原因并截断文字，返回原因的 JSON；原因与更好的回答只在点踩时有意义
+func normalizeFeedback(req *FeedbackRequest) (string, error) {
+	req.Comment = trimRunes(strings.TrimSpace(req.Comment), maxFeedbackCommentRunes)
+	req.BetterAnswer = trimRunes(strings.TrimSpace(req.BetterAnswer), maxBetterAnswerRunes)
+	if req.Score > 0 && (len(req.Reasons) > 0 || req.BetterAnswer != "") {
+		return "", errors.New("点赞时不能填写点踩原因或更好的回答")
+	}
+	seen := map[string]bool{}
+	reasons := make([]string, 0, len(req.Reasons))
+	for _, reason := range req.Reasons {
+		if !feedbackReasons[reason] {
+			return "", fmt.Errorf("未知的反馈原因: %s", reason)
+		}
+		if !seen[reason] {
+			seen[reason] = true
+			reasons = append(reasons, reason)
+		}
+	}
+	if len(reasons) == 0 {
+		return "", nil
+	}
+	raw, err := json.Marshal(reasons)
+	return string(raw), err
+}
+
+// saveFeedback 按 message_id 写入或覆盖评价（同一条回答只保留最后一次评价）
+func saveFeedback(tx *gorm.DB, feedback *MessageFeedback) error {
+	now := time.Now()
+	feedback.CreatedAt = now
+	feedback.UpdatedAt = now
+	err := tx.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "message_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"user_id", "score", "reasons", "comment", "better_answer", "updated_at"}),
+	}).Create(feedback).Error
+	if err != nil {
+		return err
+	}
+	return tx.Where("message_id = ?", feedback.MessageID).First(feedback).Error
+}
+
+// FeedbackBucket 一个维度取值（某周 / 某模型 / 某主题）下的点赞点踩数
+type FeedbackBucket struct {
+	Key   string `json:"key"`
+	Up    int    `json:"up"`
+	Down  int    `json:"down"`
+	Total int    `json:"total"`
+}
+
+// feedbackRow 班级学生收到评价的 AI 回答
+type feedbackRow struct {
+	ID            uint
+	SessionID     uint
+	ParentID      *uint
+	UserID        uint
+	Username      string
+	DisplayName   string
+	Content       string
+	Citations     string
+	ModelID       string
+	FeedbackScore int
+	Reasons       string
+	CreatedAt     time.Time
+}
+
+// classFeedbackQuery 班级学生（未删除会话中）的 AI 回答
+func (h *ChatHandler) classFeedbackQuery(classID uint) *gorm.DB {
+	return h.DB.Table("chat_messages").
+		Joins("JOIN chat_sessions ON chat_sessions.id = chat_messages.session_id AND chat_sessions.deleted_at IS NULL").
+		Joins("JOIN users ON users.id = chat_sessions.user_id").
+		Where("users.class_id = ? AND users.role = ? AND chat_messages.role = ?", classID, "student", "ai")
+}
+
+// weekStart 评价所在自然周的周一，作为按周统计的键
+func weekStart(t time.Time) string {
+	offset := (int(t.Weekday()) + 6) % 7
+	return t.AddDate(0, 0, -offset).Format("2006-01-02")
+}
+
+// citationTopic 以回答的第一条教材引用作为主题：“教材名 第 N 周”，没有引用时归入 uncitedTopic
+func citationTopic(citations string) string {
+	var items []struct {
+		TextbookName string `json:"textbook_name"`
+		WeekNum      *int   `json:"week_num"`
+	}
+	if citations == "" || json.Unmarshal([]byte(citations), &items) != nil {
+		return uncitedTopic
+	}
+	for _, item := range items {
+		name := strings.TrimSpace(item.TextbookName)
+		if name == "" {
+			continue
+		}
+		if item.WeekNum != nil && *item.WeekNum > 0 {
+			return fmt.Sprintf("%s 第 %d 周", name, *item.WeekNum)
+		}
+		return name
+	}
+	return uncitedTopic
+}
+
+// addFeedback 把一条评价累加到 key 对应的桶
+func addFeedback(buckets map[string]*FeedbackBucket, key string, score int) {
+	b, ok := buckets[key]
+	if !ok {
+		b = &FeedbackBucket{Key: key}
+		buckets[key] = b
+	}
+	if score > 0 {
+		b.Up++
+	} else {
+		b.Down++
+	}
+	b.Total++
+}
+
+// sortedBuckets byKey 为真时按键排序（周），否则点踩多的在前
+func sortedBuckets(buckets map[string]*FeedbackBucket, byKey bool) []FeedbackBucket {
+	out := make([]FeedbackBucket, 0, len(buckets))
+	for _, b := range buckets {
+		out = append(out, *b)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if !byKey && out[i].Down != out[j].Down {
+			return out[i].Down > out[j].Down
+		}
+		return out[i].Key < out[j].Key
+	})
+	return out
+}
+
+// parseSince 解析 ?since=YYYY-MM-DD，缺省不限
+func parseSince(c *gin.Context) (*time.Time, bool) {
+	return parseDateParam(c, "since")
+}
+
+// FeedbackAnalyticsHandler (老师) 本班学生对 AI 回答的评价，按自然周、模型、主题汇总
+func (h *ChatHandler) FeedbackAnalyticsHandler(c *gin.Context) {
+	cls, _, ok := h.teacherClass(c)
+	if !ok {
+		return
+	}
+	since, ok := parseSince(c)
+	if !ok {
+		return
+	}
+	query := h.classFeedbackQuery(cls.ID).
+		Select("chat_messages.id, chat_messages.citations, chat_messages.model_id, chat_messages.feedback_score, chat_messages.created_at, message_feedbacks.reasons").
+		Joins("LEFT JOIN message_feedbacks ON message_feedbacks.message_id = chat_messages.id").
+		Where("chat_messages.feedback_score <> 0")
+	if since != nil {
+		query = query.Where("chat_messages.created_at >= ?", *since)
+	}
+	var rows []feedbackRow
+	if err := query.Scan(&rows).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "统计反馈失败"})
+		return
+	}
+
+	byWeek := map[string]*FeedbackBucket{}
+	byModel := map[string]*FeedbackBucket{}
+	byTopic := map[string]*FeedbackBucket{}
+	byReason := map[string]*FeedbackBucket{}
+	total := FeedbackBucket{Key: "all"}
+	for _, row := range rows {
+		model := row.ModelID
+		if model == "" {
+			model = "unknown"
+		}
+		addFeedback(byWeek, weekStart(row.CreatedAt), row.FeedbackScore)
+		addFeedback(byModel, model, row.FeedbackScore)
+		addFeedback(byTopic, citationTopic(row.Citations), row.FeedbackScore)
+		for _, reason := range (MessageFeedback{Reasons: row.Reasons}).ReasonList() {
+			addFeedback(byReason, reason, row.FeedbackScore)
+		}
+		if row.FeedbackScore > 0 {
+			total.Up++
+		} else {
+			total.Down++
+		}
+		total.Total++
+	}
+
+	var corrected int64
+	h.DB.Model(&AnswerCorrection{}).Where("class_id = ?", cls.ID).Count(&corrected)
+	c.JSON(http.StatusOK, gin.H{
+		"classId":   cls.ID,
+		"total":     total,
+		"byWeek":    sortedBuckets(byWeek, true),
+		"byModel":   sortedBuckets(byModel, false),
+		"byTopic":   sortedBuckets(byTopic, false),
+		"byReason":  sortedBuckets(byReason, false),
+		"corrected": corrected,
+	})
+}
+
+// FeedbackQueueItem 待老师复核的一条被点踩回答
+type FeedbackQueueItem struct {
+	MessageID     uint              `json:"messageId"`
+	SessionID     uint              `json:"chatSessionId"`
+	Student       gin.H             `json:"student"`
+	Question      string            `json:"question"`
+	Answer        string            `json:"answer"`
+	Citations     json.RawMessage   `json:"citations,omitempty"`
+	ModelID       string            `json:"modelId,omitempty"`
+	Topic         string            `json:"topic"`
+	CreatedAt     time.Time         `json:"createdAt"`
+	Correction    *AnswerCorrection `json:"correction,omitempty"`
+	FeedbackScore int               `json:"feedbackScore"`
+	Feedback      *MessageFeedback  `json:"feedback,omitempty"` // 学生填写的原因、说明与更好的回答
+}
+
+// FeedbackQueueHandler (老师) 本班被点踩的 AI 回答，附提问、回答与引用；status=pending（默认，未更正）/ corrected / all
+func (h *ChatHandler) FeedbackQueueHandler(c *gin.Context) {
+	cls, _, ok := h.teacherClass(c)
+	if !ok {
+		return
+	}
+	since, ok := parseSince(c)
+	if !ok {
+		return
+	}
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "50"))
+	if err != nil || limit <= 0 {
+		limit = 50
+	}
+	if limit > maxFeedbackQueueItems {
+		limit = maxFeedbackQueueItems
+	}
+	query := h.classFeedbackQuery(cls.ID).
+		Select("chat_messages.id, chat_messages.session_id, chat_messages.parent_id, chat_messages.content, chat_messages.citations, chat_messages.model_id, chat_messages.feedback_score, chat_messages.created_at, users.id AS user_id, users.username, users.display_name").
+		Where("chat_messages.feedback_score < 0")
+	switch c.DefaultQuery("status", "pending") {
+	case "pending":
+		query = query.Where("NOT EXISTS (SELECT 1 FROM answer_corrections WHERE answer_corrections.message_id = chat_messages.id)")
+	case "corrected":
+		query = query.Where("EXISTS (SELECT 1 FROM answer_corrections WHERE answer_corrections.message_id = chat_messages.id)")
+	case "all":
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "status 只能是 pending、corrected 或 all"})
+		return
+	}
+	if since != nil {
+		query = query.Where("chat_messages.created_at >= ?", *since)
+	}
+	var rows []feedbackRow
+	if err := query.Order("chat_messages.created_at desc, chat_messages.id desc").Limit(limit).Scan(&rows).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "读取反馈队列失败"})
+		return
+	}
+
+	// 提问即回答的父消息；旧数据没有 ParentID 时留空
+	var parentIDs, messageIDs []uint
+	for _, row := range rows {
+		messageIDs = append(messageIDs, row.ID)
+		if row.ParentID != nil {
+			parentIDs = append(parentIDs, *row.ParentID)
+		}
+	}
+	questions := map[uint]string{}
+	if len(parentIDs) > 0 {
+		var parents []ChatMessage
+		h.DB.Select("id, role, content").Where("id IN ?", parentIDs).Find(&parents)
+		for _, p := range parents {
+			if p.Role == "user" {
+				questions[p.ID] = p.Content
+			}
+		}
+	}
+	corrections := map[uint]*AnswerCorrection{}
+	feedbacks := map[uint]*MessageFeedback{}
+	if len(messageIDs) > 0 {
+		var list []AnswerCorrection
+		h.DB.Where("message_id IN ?", messageIDs).Find(&list)
+		for i := range list {
+			corrections[list[i].MessageID] = &list[i]
+		}
+		var details []MessageFeedback
+		h.DB.Where("message_id IN ?", messageIDs).Find(&details)
+		for i := range details {
+			feedbacks[details[i].MessageID] = &details[i]
+		}
+	}
+
+	items := make([]FeedbackQueueItem, 0, len(rows))
+	for _, row := range rows {
+		item := FeedbackQueueItem{
+			MessageID:     row.ID,
+			SessionID:     row.SessionID,
+			Student:       gin.H{"id": row.UserID, "username": row.Username, "displayName": row.DisplayName},
+			Answer:        row.Content,
+			ModelID:       row.ModelID,
+			Topic:         citationTopic(row.Citations),
+			CreatedAt:     row.CreatedAt,
+			Correction:    corrections[row.ID],
+			FeedbackScore: row.FeedbackScore,
+			Feedback:      feedbacks[row.ID],
+		}
+		if row.ParentID != nil {
+			item.Question = questions[*row.ParentID]
+		}
+		if row.Citations != "" && json.Valid([]byte(row.Citations)) {
+			item.Citations = json.RawMessage(row.Citations)
+		}
+		items = append(items, item)
+	}
+	c.JSON(http.StatusOK, items)
+}
+
+// classAIMessage 校验消息是本班学生会话中的 AI 回答
+func (h *ChatHandler) classAIMessage(c *gin.Context, classID uint) (uint, bool) {
+	messageID, err := strconv.Atoi(c.Param("messageId"))
+	if err != nil || messageID <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid message ID"})
+		return 0, false
+	}
+	var count int64
+	if err := h.classFeedbackQuery(classID).Where("chat_messages.id = ?", messageID).Count(&count).Error; err != nil || count == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Message not found"})
+		return 0, false
+	}
+	return uint(messageID), true
+}
+
+// SaveCorrectionHandler (老师) 为本班学生的一条 AI 回答写入或修改更正
+func (h *ChatHandler) SaveCorrectionHandler(c *gin.Context) {
+	cls, teacherID, ok := h.teacherClass(c)
+	if !ok {
+		return
+	}
+	messageID, ok := h.classAIMessage(c, cls.ID)
+	if !ok {
+		return
+	}
+	var req struct {
+		Content string `json:"content" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || strings.TrimSpace(req.Content) == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "更正内容不能为空"})
+		return
+	}
+	now := time.Now()
+	correction := AnswerCorrection{
+		MessageID: messageID,
+		ClassID:   cls.ID,
+		TeacherID: teacherID,
+		Content:   strings.TrimSpace(req.Content),
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	err := h.DB.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "message_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"class_id", "teacher_id", "content", "updated_at"}),
+	}).Create(&correction).Error
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "保存更正失败"})
+		return
+	}
+	h.DB.Where("message_id = ?", messageID).First(&correction)
+	c.JSON(http.StatusOK, correction)
+}
+
+// DeleteCorrectionHandler (老师) 撤回更正，回答重新回到待复核队列
+func (h *ChatHandler) DeleteCorrectionHandler(c *gin.Context) {
+	cls, _, ok := h.teacherClass(c)
+	if !ok {
+		return
+	}
+	messageID, ok := h.classAIMessage(c, cls.ID)
+	if !ok {
+		return
+	}
+	if err := h.DB.Where("message_id = ?", messageID).Delete(&AnswerCorrection{}).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "撤回更正失败"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "已撤回更正", "messageId": messageID})
+}
@@ -17,6 +17,8 @@ import (
 	"strings"
 	"time"
 	"workplace/web_service/accesscontrol"
+	"workplace/web_service/jobs"
+	"workplace/web_service/quota"
 
 	"github.com/gin-gonic/gin"
 	"gorm.io/gorm"
@@ -25,16 +27,19 @@ import (
 )
 
 type ChatHandler struct {
-	DB *gorm.DB
+	DB   *gorm.DB
+	Jobs *jobs.Queue
 }
 
 type AIChatResponse struct {
-	Title           string            `json:"title"`
-	TextExplanation string            `json:"text_explanation"`
-	Response        string            `json:"response"`
-	Visualizations  interface{}       `json:"visualizations,omitempty"`
-	Citations       []json.RawMessage `json:"citations,omitempty"`
-	Error           string            `json:"error,omitempty"`
+	Title           string      `json:"title"`
+	TextExplanation string      `json:"text_explanation"`
+	Response        string      `json:"response"`
+	Visualizations  interface{} `json:"visualizations,omitempty"`
+	Citations       []Citation  `json:"citations,omitempty"`
+	ModelID         string      `json:"model_id,omitempty"`
+	HintOnly        bool        `json:"hint_only,omitempty"` // 命中诚信模式作业，本轮只给提示
+	Error           string      `json:"error,omitempty"`
 }
 
 func userIDFromContext(c *gin.Context) uint {
@@ -73,6 +78,79 @@ func normalizeAITitle(title string) string {
 	return trimRunes(title, 12)
 }
 
+// buildChatAIForm 组装发给 ai_service 聊天接口的表单：历史与滚动摘要、已学周总结（按 weeklyBudget 挑选）、教学周、教材范围、模型与附件。
+// hintOnly 为诚信模式检查结果（见 sessionHintOnly），为真时带上 hint_only。
+// 附件为本次上传的文件加上 resend（重新生成/编辑时沿用的已保存附件）。同步与流式发送共用。
+func (h *ChatHandler) buildChatAIForm(c *gin.Context, userID uint, prompt string, historyForAI []MessageForAI, historySummary string, weeklyBudget int, resend []ChatAttachment, hintOnly bool) (*bytes.Buffer, string, error) {
+	var learnedSummaries string
+	var currentWeek int
+	var user auth.User
+	if err := h.DB.First(&user, userID).Error; err == nil && user.ClassID != nil {
+		var class auth.Class
+		if err := h.DB.First(&class, *user.ClassID).Error; err == nil {
+			currentWeek = class.CurrentWeek
+			var materials []auth.ClassWeeklyMaterial
+			if err := h.DB.Where("class_id = ? AND week_num <= ?", class.ID, class.CurrentWeek).
+				Order("week_num asc").Find(&materials).Error; err == nil && len(materials) > 0 {
+				learnedSummaries = selectWeeklySummaries(materials, prompt, class.CurrentWeek, weeklyBudget)
+			}
+		}
+	}
+	allowedTextbookIDs, restrictTextbooks, err := accesscontrol.AllowedTextbookIDsForUser(h.DB, user)
+	if err != nil {
+		return nil, "", errors.New("Failed to load textbook access scope")
+	}
+
+	historyJSON, err := json.Marshal(historyForAI)
+	if err != nil {
+		return nil, "", errors.New("Failed to serialize history")
+	}
+
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	_ = writer.WriteField("prompt", prompt)
+	_ = writer.WriteField("is_first_message", c.PostForm("is_first_message"))
+	_ = writer.WriteField("history", string(historyJSON))            // 预算内的最近历史
+	_ = writer.WriteField("history_summary", historySummary)         // 更早轮次的滚动摘要（可为空）
+	_ = writer.WriteField("learned_summaries", learnedSummaries)     // 发送已学知识总结
+	_ = writer.WriteField("current_week", strconv.Itoa(currentWeek)) // **新增：RAG 检索用的教学周约束**
+	_ = writer.WriteField("user_id", strconv.Itoa(int(userID)))
+	if hintOnly {
+		_ = writer.WriteField("hint_only", "true")
+	}
+	if restrictTextbooks {
+		if textbookIDsJSON, err := json.Marshal(allowedTextbookIDs); err == nil {
+			_ = writer.WriteField("textbook_ids", string(textbookIDsJSON))
+		} else {
+			_ = writer.WriteField("textbook_ids", "[]")
+		}
+	}
+	if modelID := c.PostForm("model_id"); modelID != "" {
+		_ = writer.WriteField("model_id", modelID)
+	}
+
+	for _, fileHeader := range uploadedFiles(c) {
+		part, _ := writer.CreatePart(attachmentPartHeader(fileHeader.Filename, fileHeader.Header.Get("Content-Type")))
+		file, _ := fileHeader.Open()
+		io.Copy(part, file)
+		file.Close()
+	}
+	for _, att := range resend {
+		if err := resendFile(writer, att); err != nil {
+			log.Printf("Failed to resend chat attachment %d: %v", att.ID, err)
+		}
+	}
+	writer.Close()
+	return body, writer.FormDataContentType(), nil
+}
+
+func attachmentPartHeader(filename, contentType string) textproto.MIMEHeader {
+	h := make(textproto.MIMEHeader)
+	h.Set("Content-Disposition", fmt.Sprintf(`form-data; name="files"; filename="%s"`, filename))
+	h.Set("Content-Type", contentType)
+	return h
+}
+
 func (h *ChatHandler) SendMessageHandler(c *gin.Context) {
 	// --- 1. 解析通用表单数据 ---
 	userID := userIDFromContext(c)
@@ -81,7 +159,6 @@ func (h *ChatHandler) SendMessageHandler(c *gin.Context) {
 	sessionIDStr := c.PostForm("chat_session_id")
 
 	var session ChatSession
-	var historyForAI []MessageForAI
 	tx := h.DB.Begin()
 
 	defer func() {
@@ -116,175 +193,126 @@ func (h *ChatHandler) SendMessageHandler(c *gin.Context) {
 		if err := tx.Preload("Messages", func(db *gorm.DB) *gorm.DB {
 			// created_at 可能因同一轮 user/ai 几乎同时落库而相等，必须再用 id 兜底，保证顺序确定
 			return db.Order("chat_messages.created_at ASC, chat_messages.id ASC")
-		}).Where("user_id = ?", userID).First(&session, sessionID).Error; err != nil {
+		}).Preload("Messages.Attachments").Where("user_id = ?", userID).First(&session, sessionID).Error; err != nil {
 			tx.Rollback()
 			c.JSON(http.StatusNotFound, gin.H{"error": "Session not found"})
 			return
 		}
 
-		// 将从数据库加载的消息转换为AI服务需要的格式
-		for _, msg := range session.Messages {
-			historyForAI = append(historyForAI, MessageForAI{Role: msg.Role, Content: msg.Content})
-		}
 	}
 
-	// --- 3. 获取班级进度并准备已学知识总结 ---
-	var learnedSummaries string
-	var currentWeek int
-	var allowedTextbookIDs []uint
-	var restrictTextbooks bool
-	var user auth.User
-	if err := h.DB.First(&user, userID).Error; err == nil && user.ClassID != nil {
-		var class auth.Class
-		if err := h.DB.First(&class, *user.ClassID).Error; err == nil {
-			currentWeek = class.CurrentWeek
-			var materials []auth.ClassWeeklyMaterial
-			if err := h.DB.Where("class_id = ? AND week_num <= ?", class.ID, class.CurrentWeek).
-				Order("week_num asc").Find(&materials).Error; err == nil && len(materials) > 0 {
-				for _, mat := range materials {
-					learnedSummaries += fmt.Sprintf("【第%d周】：\n%s\n\n", mat.WeekNum, mat.Summary)
-				}
-			}
+	// --- 3. 构造 AI 请求：只带当前分支上的历史；答疑会话带批改上下文走批改答疑接口，其余带班级进度/教材范围走通用聊天 ---
+	parentID := currentLeaf(session, session.Messages)
+	session.Messages = activePath(session.Messages, session.ActiveLeafID)
+	aiResp, responseDurationMs, status, err := h.callChatAI(c, userID, prompt, session, isFirstMessage, nil)
+	if err != nil {
+		tx.Rollback()
+		if status != 0 {
+			c.JSON(status, gin.H{"error": err.Error()})
 		}
+		return
 	}
-	if ids, restricted, err := accesscontrol.AllowedTextbookIDsForUser(h.DB, user); err == nil {
-		allowedTextbookIDs = ids
-		restrictTextbooks = restricted
-	} else {
+
+	// --- 4. 存储新消息：接在当前分支末端 ---
+	// 将 citations（教材检索出处）序列化到 AI 消息里，方便前端在任何时候回显
+	userMessage := &ChatMessage{Role: "user", Content: prompt, CreatedAt: time.Now()}
+	aiMessage := &ChatMessage{Role: "ai", Content: aiMessageText(aiResp), Citations: marshalCitations(aiResp.Citations), ModelID: aiResp.ModelID, ResponseDurationMs: &responseDurationMs, CreatedAt: time.Now()}
+
+	if err := AppendMessages(tx, session.ID, parentID, userMessage, aiMessage); err != nil {
 		tx.Rollback()
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load textbook access scope"})
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save messages"})
 		return
 	}
-
-	// --- 4. 准备并发送请求到AI服务 ---
-	historyJSON, err := json.Marshal(historyForAI)
+	attachments, err := saveAttachments(tx, c, userID, session.ID, userMessage.ID)
 	if err != nil {
 		tx.Rollback()
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to serialize history"})
+		log.Printf("Failed to save chat attachments: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save attachments"})
 		return
 	}
 
-	targetURL := aiclient.URL("/api/v1/chat")
-	body := &bytes.Buffer{}
-	writer := multipart.NewWriter(body)
-	_ = writer.WriteField("prompt", prompt)
-	_ = writer.WriteField("is_first_message", c.PostForm("is_first_message"))
-	_ = writer.WriteField("history", string(historyJSON))            // 发送完整的历史记录
-	_ = writer.WriteField("learned_summaries", learnedSummaries)     // 发送已学知识总结
-	_ = writer.WriteField("current_week", strconv.Itoa(currentWeek)) // **新增：RAG 检索用的教学周约束**
-	_ = writer.WriteField("user_id", strconv.Itoa(int(userID)))
-	if restrictTextbooks {
-		if textbookIDsJSON, err := json.Marshal(allowedTextbookIDs); err == nil {
-			_ = writer.WriteField("textbook_ids", string(textbookIDsJSON))
-		} else {
-			_ = writer.WriteField("textbook_ids", "[]")
+	// 更新会话标题（如果需要）
+	if isFirstMessage {
+		session.Title = normalizeAITitle(aiResp.Title)
+		aiResp.Title = session.Title
+		// 只更新标题：Save 会用内存中的旧值覆盖刚写入的 active_leaf_id
+		if err := tx.Model(&session).Update("title", session.Title).Error; err != nil {
+			tx.Rollback()
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update session title"})
+			return
 		}
 	}
-	if modelID := c.PostForm("model_id"); modelID != "" {
-		_ = writer.WriteField("model_id", modelID)
-	}
 
-	// ... (文件处理部分保持不变)
-	form, err := c.MultipartForm()
-	if err == nil {
-		files := form.File["files"]
-		for _, fileHeader := range files {
-			h := make(textproto.MIMEHeader)
-			h.Set("Content-Disposition", fmt.Sprintf(`form-data; name="files"; filename="%s"`, fileHeader.Filename))
-			h.Set("Content-Type", fileHeader.Header.Get("Content-Type"))
-			part, _ := writer.CreatePart(h)
-			file, _ := fileHeader.Open()
-			io.Copy(part, file)
-			file.Close()
+	tx.Commit()
+	h.enqueueDescribe(attachments)
+
+	// --- 5. 返回最新会话数据给前端（只含当前分支） ---
+	h.respondWithSession(c, session.ID, aiResp)
+}
+
+// callChatAI 同步请求 ai_service 生成一轮回答，不落库。status 为 0 表示无需再写响应（客户端已断开或已回复 429）。
+// 先扣配额再组装请求（超额的请求不会触发诚信检查等副作用），没拿到回答时退回本次计数。
+func (h *ChatHandler) callChatAI(c *gin.Context, userID uint, prompt string, session ChatSession, isFirstMessage bool, resend []ChatAttachment) (AIChatResponse, int64, int, error) {
+	var aiResp AIChatResponse
+	if !checkChatQuota(h.DB, c) {
+		return aiResp, 0, 0, errQuotaExceeded
+	}
+	answered := false
+	defer func() {
+		if !answered {
+			refundChatQuota(h.DB, c, userID)
 		}
+	}()
+	aiPath, body, contentType, status, err := h.sessionAIRequest(c, userID, prompt, session, isFirstMessage, resend)
+	if err != nil {
+		return aiResp, 0, status, err
 	}
-	writer.Close()
 
-	proxyReq, _ := http.NewRequestWithContext(c.Request.Context(), "POST", targetURL, body)
-	proxyReq.Header.Set("Content-Type", writer.FormDataContentType())
+	proxyReq, _ := http.NewRequestWithContext(c.Request.Context(), "POST", aiclient.URL(aiPath), body)
+	proxyReq.Header.Set("Content-Type", contentType)
 	client := &http.Client{Timeout: time.Second * 180}
 	aiStartedAt := time.Now()
 	resp, err := client.Do(proxyReq)
 	if err != nil {
-		tx.Rollback()
 		if errors.Is(err, context.Canceled) || c.Request.Context().Err() != nil {
-			return
+			return aiResp, 0, 0, err
 		}
-		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "AI service is unreachable"})
-		return
+		return aiResp, 0, http.StatusServiceUnavailable, errors.New("AI service is unreachable")
 	}
 	defer resp.Body.Close()
 
 	responseBody, _ := io.ReadAll(resp.Body)
 	responseDurationMs := time.Since(aiStartedAt).Milliseconds()
 	if resp.StatusCode >= http.StatusBadRequest {
-		tx.Rollback()
-		var errResp struct {
-			Detail interface{} `json:"detail"`
-			Error  interface{} `json:"error"`
-		}
-		message := string(responseBody)
-		if err := json.Unmarshal(responseBody, &errResp); err == nil {
-			if errResp.Detail != nil {
-				message = fmt.Sprint(errResp.Detail)
-			} else if errResp.Error != nil {
-				message = fmt.Sprint(errResp.Error)
-			}
-		}
-		c.JSON(resp.StatusCode, gin.H{"error": message})
-		return
+		return aiResp, responseDurationMs, resp.StatusCode, errors.New(aiErrorMessage(responseBody))
 	}
-
-	var aiResp AIChatResponse
 	if err := json.Unmarshal(responseBody, &aiResp); err != nil {
-		tx.Rollback()
 		log.Printf("Failed to decode AI response. Raw body: %s", string(responseBody))
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decode AI response"})
-		return
-	}
-
-	// --- 4. 存储新消息 ---
-	aiMessageContent := aiResp.TextExplanation
-	if aiMessageContent == "" {
-		aiMessageContent = aiResp.Response
+		return aiResp, responseDurationMs, http.StatusInternalServerError, errors.New("Failed to decode AI response")
 	}
+	aiResp.Citations = h.citationScopeFor(c).filter(aiResp.Citations)
+	answered = true
+	return aiResp, responseDurationMs, http.StatusOK, nil
+}
 
-	// 将 citations（教材检索出处）序列化到 AI 消息里，方便前端在任何时候回显
-	citationsJSON := ""
-	if len(aiResp.Citations) > 0 {
-		if b, err := json.Marshal(aiResp.Citations); err == nil {
-			citationsJSON = string(b)
-		}
-	}
+var errQuotaExceeded = errors.New("AI usage quota exceeded")
 
-	userMessage := ChatMessage{SessionID: session.ID, Role: "user", Content: prompt, CreatedAt: time.Now()}
-	aiMessage := ChatMessage{SessionID: session.ID, Role: "ai", Content: aiMessageContent, Citations: citationsJSON, ResponseDurationMs: &responseDurationMs, CreatedAt: time.Now()}
+// checkChatQuota 聊天计入 chat 桶，指定了模型时同时计入该模型的桶
+func checkChatQuota(db *gorm.DB, c *gin.Context) bool {
+	return quota.Check(db, c, quota.BucketChat, quota.ModelBucket(quota.BucketChat, c.PostForm("model_id")))
+}
 
-	if err := tx.Create(&[]ChatMessage{userMessage, aiMessage}).Error; err != nil {
-		tx.Rollback()
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save messages"})
-		return
-	}
+// refundChatQuota 退回 checkChatQuota 的计数
+func refundChatQuota(db *gorm.DB, c *gin.Context, userID uint) {
+	quota.Refund(db, userID, quota.BucketChat, quota.ModelBucket(quota.BucketChat, c.PostForm("model_id")))
+}
 
-	// 更新会话标题（如果需要）
-	if isFirstMessage {
-		session.Title = normalizeAITitle(aiResp.Title)
-		aiResp.Title = session.Title
-		if err := tx.Save(&session).Error; err != nil {
-			tx.Rollback()
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update session title"})
-			return
-		}
+// aiMessageText AI 回答正文：优先 text_explanation，兼容只返回 response 的接口
+func aiMessageText(aiResp AIChatResponse) string {
+	if aiResp.TextExplanation != "" {
+		return aiResp.TextExplanation
 	}
-
-	tx.Commit()
-
-	// --- 5. 返回最新会话数据给前端 ---
-	// 必须显式排序：未指定 order 时 Preload 走堆表顺序，多轮对话会错乱（user/ai 顺序乱跳）
-	h.DB.Preload("Messages", func(db *gorm.DB) *gorm.DB {
-		return db.Order("chat_messages.created_at ASC, chat_messages.id ASC")
-	}).First(&session, session.ID)
-	c.JSON(http.StatusOK, gin.H{"session": session, "ai_response": aiResp})
+	return aiResp.Response
 }
 
 func (h *ChatHandler) GetModelOptionsHandler(c *gin.Context) {
@@ -301,63 +329,124 @@ func (h *ChatHandler) GetModelOptionsHandler(c *gin.Context) {
 	c.Data(resp.StatusCode, resp.Header.Get("Content-Type"), responseBody)
 }
 
-// GetSessionsHandler 和 GetMessagesHandler 保持不变
+// GetSessionsHandler 会话列表，按 (created_at, id) 倒序游标分页。
+// 置顶会话只在第一页（不带 cursor）最前面返回，不参与翻页；归档会话默认隐藏，archived=1 时只列出归档会话。
+// 可按 type（chat / grading / explain）与 from、to（YYYY-MM-DD，含当天）筛选。
 func (h *ChatHandler) GetSessionsHandler(c *gin.Context) {
-	userIDRaw, _ := c.Get("userID")
-	// 注意类型断言，如果是从 JWT 解析来的数字通常是 float64
-	var userID uint
-	switch v := userIDRaw.(type) {
-	case float64:
-		userID = uint(v)
-	case uint:
-		userID = v
-	case int:
-		userID = uint(v)
+	userID := userIDFromContext(c)
+	limit := pageLimit(c, defaultSessionPageSize, maxSessionPageSize)
+	cursor, err := decodeSessionCursor(c.Query("cursor"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid cursor"})
+		return
+	}
+	from, ok := parseDateParam(c, "from")
+	if !ok {
+		return
+	}
+	to, ok := parseDateParam(c, "to")
+	if !ok {
+		return
+	}
+	switch c.Query("type") {
+	case "", ContextChat, ContextGrading, ContextExplain:
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "type 只能是 chat、grading 或 explain"})
+		return
 	}
 
-	var sessions []ChatSession
-	if err := h.DB.Where("user_id = ?", userID).Order("created_at desc").Find(&sessions).Error; err != nil {
+	filter := func() *gorm.DB {
+		query := h.DB.Where("user_id = ?", userID)
+		if archived, _ := strconv.ParseBool(c.Query("archived")); archived {
+			query = query.Where("archived_at IS NOT NULL")
+		} else {
+			query = query.Where("archived_at IS NULL")
+		}
+		if contextType := c.Query("type"); contextType != "" {
+			query = query.Where("context_type = ?", contextType)
+		}
+		if from != nil {
+			query = query.Where("created_at >= ?", *from)
+		}
+		if to != nil {
+			query = query.Where("created_at < ?", to.AddDate(0, 0, 1))
+		}
+		return query
+	}
+
+	sessions := []ChatSession{}
+	if cursor == nil {
+		if err := filter().Where("pinned_at IS NOT NULL").Order("pinned_at desc").Find(&sessions).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve chat sessions"})
+			return
+		}
+	}
+	query := filter().Where("pinned_at IS NULL")
+	if cursor != nil {
+		query = query.Where("(created_at, id) < (?, ?)", cursor.CreatedAt, cursor.ID)
+	}
+	var rest []ChatSession
+	if err := query.Order("created_at desc, id desc").Limit(limit + 1).Find(&rest).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve chat sessions"})
 		return
 	}
-	c.JSON(http.StatusOK, sessions)
+	page := Page{HasMore: len(rest) > limit}
+	if page.HasMore {
+		rest = rest[:limit]
+	}
+	if len(rest) > 0 {
+		page.NextCursor = encodeSessionCursor(rest[len(rest)-1])
+	}
+	page.Items = append(sessions, rest...)
+	c.JSON(http.StatusOK, page)
 }
 
+// GetMessagesHandler 当前分支的消息，按时间顺序分页：before=消息ID 向前翻、after=消息ID 向后取，都不带时返回最新一页。
+// tree=1 时返回整棵消息树（带 parentId），不分页。
 func (h *ChatHandler) GetMessagesHandler(c *gin.Context) {
-	userIDRaw, _ := c.Get("userID")
-	var userID uint
-	switch v := userIDRaw.(type) {
-	case float64:
-		userID = uint(v)
-	case uint:
-		userID = v
-	case int:
-		userID = uint(v)
-	}
-
-	sessionIDStr := c.Param("id")
-	sessionID, err := strconv.Atoi(sessionIDStr)
+	userID := userIDFromContext(c)
+	sessionID, err := strconv.Atoi(c.Param("id"))
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid session ID"})
 		return
 	}
+	before, errBefore := strconv.ParseUint(c.DefaultQuery("before", "0"), 10, 64)
+	after, errAfter := strconv.ParseUint(c.DefaultQuery("after", "0"), 10, 64)
+	if errBefore != nil || errAfter != nil || (before != 0 && after != 0) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "before 和 after 须为消息 ID，且只能指定其一"})
+		return
+	}
 
-	var messages []ChatMessage
-	err = h.DB.Joins("JOIN chat_sessions ON chat_sessions.id = chat_messages.session_id").
-		Where("chat_sessions.user_id = ? AND chat_messages.session_id = ?", userID, sessionID).
-		Order("chat_messages.created_at asc, chat_messages.id asc").
-		Find(&messages).Error
-
+	var session ChatSession
+	if err := h.DB.Where("user_id = ?", userID).First(&session, sessionID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Session not found"})
+		return
+	}
+	all, err := h.sessionMessages(session.ID)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve messages"})
 		return
 	}
-	c.JSON(http.StatusOK, messages)
+	// 答疑会话的批改上下文以 system 消息保存，只供 AI 使用，不展示给学生
+	if tree, _ := strconv.ParseBool(c.Query("tree")); tree {
+		c.JSON(http.StatusOK, Page{Items: h.visibleMessages(c, withSiblings(all, all))})
+		return
+	}
+	messages := h.visibleMessages(c, activeBranch(session, all))
+	page, ok := messageWindow(messages, uint(before), uint(after), pageLimit(c, defaultMessagePageSize, maxMessagePageSize))
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "消息不在当前分支上"})
+		return
+	}
+	c.JSON(http.StatusOK, page)
 }
 
 // FeedbackRequest 结构体
 type FeedbackRequest struct {
-	Score int `json:"score" binding:"required"` // 1 或 -1
+	Score        int      `json:"score" binding:"required"` // 1 或 -1
+	Reasons      []string `json:"reasons"`                  // 点踩原因，取值见 feedbackReasons
+	Comment      string   `json:"comment"`                  // 补充说明
+	BetterAnswer string   `json:"betterAnswer"`             // 学生认为更好的回答（可选）
 }
 
 // **新增: 记录用户反馈**
@@ -390,6 +479,11 @@ func (h *ChatHandler) SubmitFeedbackHandler(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Score must be 1 or -1"})
 		return
 	}
+	reasons, err := normalizeFeedback(&req)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
 
 	// 鉴权：确认这个 message 属于当前登录用户
 	var message ChatMessage
@@ -408,11 +502,24 @@ func (h *ChatHandler) SubmitFeedbackHandler(c *gin.Context) {
 		return
 	}
 
-	message.FeedbackScore = req.Score
-	if err := h.DB.Save(&message).Error; err != nil {
+	feedback := MessageFeedback{
+		MessageID:    message.ID,
+		UserID:       userID,
+		Score:        req.Score,
+		Reasons:      reasons,
+		Comment:      req.Comment,
+		BetterAnswer: req.BetterAnswer,
+	}
+	err = h.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&message).Update("feedback_score", req.Score).Error; err != nil {
+			return err
+		}
+		return saveFeedback(tx, &feedback)
+	})
+	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save feedback"})
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"message": "Feedback submitted successfully"})
+	c.JSON(http.StatusOK, gin.H{"message": "Feedback submitted successfully", "feedback": feedback})
 }
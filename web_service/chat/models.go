@@ -9,24 +9,37 @@ import (
 
 // ChatSession 代表一个完整的对话会话
 type ChatSession struct {
-	ID        uint           `gorm:"primarykey" json:"id"`
-	UserID    uint           `gorm:"index;not null" json:"-"`
-	Title     string         `gorm:"size:255" json:"title"`
-	CreatedAt time.Time      `json:"createdAt"`
-	Messages  []ChatMessage  `gorm:"foreignKey:SessionID;constraint:OnDelete:CASCADE;" json:"messages,omitempty"` // **修复关联键: SessionID**
-	DeletedAt gorm.DeletedAt `gorm:"index" json:"-"`
+	ID            uint           `gorm:"primarykey" json:"id"`
+	UserID        uint           `gorm:"index;not null" json:"-"`
+	Title         string         `gorm:"size:255" json:"title"`
+	ContextType   string         `gorm:"size:20;not null;default:'chat';index" json:"contextType"` // chat 自由问答 / grading 批改后答疑 / explain 题目讲解
+	GradeResultID *uint          `gorm:"index" json:"gradeResultId,omitempty"`                     // 答疑会话对应的批改记录
+	ExerciseID    *uint          `gorm:"index" json:"exerciseId,omitempty"`                        // 讲解会话对应的题目
+	PinnedAt      *time.Time     `gorm:"index" json:"pinnedAt,omitempty"`                          // 置顶时间，置顶会话排在列表最前
+	ArchivedAt    *time.Time     `gorm:"index" json:"archivedAt,omitempty"`                        // 归档后默认不出现在会话列表
+	ActiveLeafID  *uint          `json:"activeLeafId,omitempty"`                                   // 当前分支的最后一条消息，历史由它沿 ParentID 回溯
+	CreatedAt     time.Time      `json:"createdAt"`
+	Messages      []ChatMessage  `gorm:"foreignKey:SessionID;constraint:OnDelete:CASCADE;" json:"messages,omitempty"` // **修复关联键: SessionID**
+	DeletedAt     gorm.DeletedAt `gorm:"index" json:"-"`
 }
 
 // ChatMessage 代表对话中的一条消息
 type ChatMessage struct {
-	ID                 uint      `gorm:"primarykey" json:"id"`
-	SessionID          uint      `gorm:"column:session_id;index;not null" json:"chatSessionId"` // **修复: 映射到数据库的 session_id**
-	Role               string    `gorm:"column:role;size:20;not null" json:"sender"`            // **修复: 映射到数据库的 role ('user' or 'ai')**
-	Content            string    `gorm:"column:content;type:text;not null" json:"text"`         // 消息内容
-	Citations          string    `gorm:"column:citations;type:text" json:"-"`                   // **新增: RAG 教材检索引用 (JSON 数组字符串)，自定义 MarshalJSON 暴露为结构化数组**
-	FeedbackScore      int       `gorm:"column:feedback_score;default:0" json:"feedbackScore"`  // **新增: RLHF 评价**
-	ResponseDurationMs *int64    `gorm:"column:response_duration_ms" json:"responseDurationMs,omitempty"`
-	CreatedAt          time.Time `gorm:"column:created_at" json:"createdAt"`
+	ID                 uint              `gorm:"primarykey" json:"id"`
+	SessionID          uint              `gorm:"column:session_id;index;not null" json:"chatSessionId"`  // **修复: 映射到数据库的 session_id**
+	ParentID           *uint             `gorm:"column:parent_id;index" json:"parentId,omitempty"`       // 上一条消息；编辑/重新生成时同一父消息下出现多个分支
+	Role               string            `gorm:"column:role;size:20;not null" json:"sender"`             // **修复: 映射到数据库的 role ('user' or 'ai')**
+	Content            string            `gorm:"column:content;type:text;not null" json:"text"`          // 消息内容
+	Citations          string            `gorm:"column:citations;type:text" json:"-"`                    // **新增: RAG 教材检索引用 (JSON 数组字符串)，自定义 MarshalJSON 暴露为结构化数组**
+	FeedbackScore      int               `gorm:"column:feedback_score;default:0" json:"feedbackScore"`   // **新增: RLHF 评价**
+	ModelID            string            `gorm:"column:model_id;size:64;index" json:"modelId,omitempty"` // 生成该回答的模型（ai_service 返回的 model_id）
+	ResponseDurationMs *int64            `gorm:"column:response_duration_ms" json:"responseDurationMs,omitempty"`
+	Partial            bool              `gorm:"column:partial;default:false" json:"partial,omitempty"` // 流式回答中途失败/断开时保存的不完整内容
+	CreatedAt          time.Time         `gorm:"column:created_at" json:"createdAt"`
+	Attachments        []ChatAttachment  `gorm:"foreignKey:MessageID" json:"attachments,omitempty"` // 用户上传的附件
+	Correction         *AnswerCorrection `gorm:"foreignKey:MessageID" json:"correction,omitempty"`  // 老师对这条 AI 回答的更正
+	Feedback           *MessageFeedback  `gorm:"foreignKey:MessageID" json:"feedback,omitempty"`    // 本人对这条回答的详细评价
+	SiblingIDs         []uint            `gorm:"-" json:"siblingIds,omitempty"`                     // 同一父消息下的全部分支（含自身），只有一个时省略
 }
 
 // MarshalJSON 让 Citations 字段在前端看到的是真正的 JSON 数组而不是一段转义的字符串。
@@ -0,0 +1,134 @@
+// web_service/chat/pagination.go
+
+package chat
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	defaultSessionPageSize = 30
+	maxSessionPageSize     = 100
+	defaultMessagePageSize = 50
+	maxMessagePageSize     = 200
+)
+
+// Page 会话与消息列表统一的分页信封：nextCursor 原样作为下一页的 cursor（消息为 before/after）传回
+type Page struct {
+	Items      interface{} `json:"items"`
+	NextCursor string      `json:"nextCursor,omitempty"`
+	HasMore    bool        `json:"hasMore"`
+}
+
+// pageLimit 读取 limit 参数，缺省或非法时用默认值，超过上限时截断
+func pageLimit(c *gin.Context, def, max int) int {
+	limit, err := strconv.Atoi(c.Query("limit"))
+	if err != nil || limit <= 0 {
+		return def
+	}
+	if limit > max {
+		return max
+	}
+	return limit
+}
+
+// sessionCursor 会话列表游标：上一页最后一条的 (created_at, id)
+type sessionCursor struct {
+	CreatedAt time.Time
+	ID        uint
+}
+
+func encodeSessionCursor(s ChatSession) string {
+	raw := fmt.Sprintf("%d_%d", s.CreatedAt.UnixNano(), s.ID)
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func decodeSessionCursor(raw string) (*sessionCursor, error) {
+	if raw == "" {
+		return nil, nil
+	}
+	data, err := base64.RawURLEncoding.DecodeString(raw)
+	if err != nil {
+		return nil, err
+	}
+	nanos, id, ok := strings.Cut(string(data), "_")
+	if !ok {
+		return nil, fmt.Errorf("malformed cursor")
+	}
+	n, err := strconv.ParseInt(nanos, 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	sid, err := strconv.ParseUint(id, 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	return &sessionCursor{CreatedAt: time.Unix(0, n), ID: uint(sid)}, nil
+}
+
+// parseDateParam 读取 YYYY-MM-DD 格式的日期参数（本地时区当天零点），为空时返回 nil
+func parseDateParam(c *gin.Context, key string) (*time.Time, bool) {
+	raw := strings.TrimSpace(c.Query(key))
+	if raw == "" {
+		return nil, true
+	}
+	t, err := time.ParseInLocation("2006-01-02", raw, time.Local)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": key + " 格式应为 YYYY-MM-DD"})
+		return nil, false
+	}
+	return &t, true
+}
+
+// messageWindow 按 before/after（消息 ID）从当前分支中截取一页，两者都没有时取最新的 limit 条。
+// before 方向 nextCursor 为本页最早一条的 ID，after 方向为最新一条的 ID。
+func messageWindow(messages []ChatMessage, before, after uint, limit int) (Page, bool) {
+	index := func(id uint) int {
+		for i, msg := range messages {
+			if msg.ID == id {
+				return i
+			}
+		}
+		return -1
+	}
+	if after != 0 {
+		start := index(after)
+		if start < 0 {
+			return Page{}, false
+		}
+		start++
+		end := start + limit
+		if end > len(messages) {
+			end = len(messages)
+		}
+		items := messages[start:end]
+		page := Page{Items: items, HasMore: end < len(messages)}
+		if len(items) > 0 {
+			page.NextCursor = strconv.FormatUint(uint64(items[len(items)-1].ID), 10)
+		}
+		return page, true
+	}
+	end := len(messages)
+	if before != 0 {
+		if end = index(before); end < 0 {
+			return Page{}, false
+		}
+	}
+	start := end - limit
+	if start < 0 {
+		start = 0
+	}
+	items := messages[start:end]
+	page := Page{Items: items, HasMore: start > 0}
+	if len(items) > 0 {
+		page.NextCursor = strconv.FormatUint(uint64(items[0].ID), 10)
+	}
+	return page, true
+}
@@ -0,0 +1,401 @@
+// web_service/chat/search.go
+
+package chat
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const (
+	SearchTokenizerZhparser = "zhparser" // PostgreSQL zhparser 中文分词
+	SearchTokenizerBigram   = "bigram"   // 未安装 zhparser 时：汉字按单字 + 相邻二元组切分
+)
+
+// searchTokenizer 启动时由 SetupSearch 确定；为空表示全文索引不可用，搜索退化为 ILIKE
+var searchTokenizer string
+
+// chatSearchBigramsSQL 二元切分函数：汉字输出单字与相邻二字组，英文数字原样保留，其余字符视为分隔符。
+// 声明为 IMMUTABLE，才能用于生成列；写入与查询用同一函数切分，保证口径一致。
+const chatSearchBigramsSQL = `CREATE OR REPLACE FUNCTION chat_search_bigrams(src text) RETURNS text
+LANGUAGE plpgsql IMMUTABLE STRICT PARALLEL SAFE AS $$
+DECLARE
+	s text := lower(src);
+	buf text := '';
+	ch text;
+	nxt text;
+	i int;
+BEGIN
+	FOR i IN 1..char_length(s) LOOP
+		ch := substr(s, i, 1);
+		IF ch ~ '[一-鿿]' THEN
+			buf := buf || ' ' || ch;
+			nxt := substr(s, i + 1, 1);
+			IF nxt ~ '[一-鿿]' THEN
+				buf := buf || ' ' || ch || nxt;
+			END IF;
+			buf := buf || ' ';
+		ELSIF ch ~ '[a-z0-9α-ω]' THEN
+			buf := buf || ch;
+		ELSE
+			buf := buf || ' ';
+		END IF;
+	END LOOP;
+	RETURN buf;
+END
+$$`
+
+// SetupSearch 为会话标题与消息内容建立 tsvector 生成列和 GIN 索引，在 AutoMigrate 之后调用。
+// CHAT_SEARCH_TOKENIZER=auto（默认）优先使用 zhparser，不可用时退化为二元切分；也可显式指定 zhparser / bigram。
+func SetupSearch(db *gorm.DB) {
+	mode := strings.ToLower(strings.TrimSpace(os.Getenv("CHAT_SEARCH_TOKENIZER")))
+	if err := db.Exec(chatSearchBigramsSQL).Error; err != nil {
+		log.Printf("Chat search disabled, failed to create bigram function: %v", err)
+		return
+	}
+
+	tokenizer := SearchTokenizerBigram
+	if mode != SearchTokenizerBigram && ensureZhparser(db) {
+		tokenizer = SearchTokenizerZhparser
+	} else if mode == SearchTokenizerZhparser {
+		log.Printf("CHAT_SEARCH_TOKENIZER=zhparser but zhparser is unavailable, falling back to bigram")
+	}
+
+	for _, table := range []string{"chat_sessions", "chat_messages"} {
+		source := "content"
+		if table == "chat_sessions" {
+			source = "title"
+		}
+		if err := ensureSearchColumn(db, table, source, tokenizer); err != nil {
+			log.Printf("Chat search disabled, failed to prepare %s.search_vector: %v", table, err)
+			return
+		}
+	}
+	searchTokenizer = tokenizer
+	log.Printf("Chat full-text search ready (tokenizer: %s)", tokenizer)
+}
+
+// ensureZhparser 确保存在名为 chinese 的 zhparser 文本搜索配置
+func ensureZhparser(db *gorm.DB) bool {
+	var count int64
+	db.Raw("SELECT count(*) FROM pg_ts_config WHERE cfgname = 'chinese'").Scan(&count)
+	if count > 0 {
+		return true
+	}
+	db.Raw("SELECT count(*) FROM pg_available_extensions WHERE name = 'zhparser'").Scan(&count)
+	if count == 0 {
+		return false
+	}
+	err := db.Transaction(func(tx *gorm.DB) error {
+		for _, stmt := range []string{
+			"CREATE EXTENSION IF NOT EXISTS zhparser",
+			"CREATE TEXT SEARCH CONFIGURATION chinese (PARSER = zhparser)",
+			"ALTER TEXT SEARCH CONFIGURATION chinese ADD MAPPING FOR n,v,a,i,e,l,j,x WITH simple",
+		} {
+			if err := tx.Exec(stmt).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("Failed to set up zhparser: %v", err)
+		return false
+	}
+	return true
+}
+
+// ensureSearchColumn 建立 search_vector 生成列；分词方式变化（如后来装了 zhparser）时重建该列
+func ensureSearchColumn(db *gorm.DB, table, source, tokenizer string) error {
+	expr := "to_tsvector('simple'::regconfig, chat_search_bigrams(coalesce(" + source + ", '')))"
+	marker := "chat_search_bigrams"
+	if tokenizer == SearchTokenizerZhparser {
+		expr = "to_tsvector('chinese'::regconfig, coalesce(" + source + ", ''))"
+		marker = "chinese"
+	}
+
+	var existing string
+	db.Raw(`SELECT coalesce(generation_expression, '') FROM information_schema.columns
+		WHERE table_schema = current_schema() AND table_name = ? AND column_name = 'search_vector'`, table).Scan(&existing)
+	if existing != "" && !strings.Contains(existing, marker) {
+		if err := db.Exec("ALTER TABLE " + table + " DROP COLUMN search_vector").Error; err != nil {
+			return err
+		}
+	}
+	if err := db.Exec("ALTER TABLE " + table + " ADD COLUMN IF NOT EXISTS search_vector tsvector GENERATED ALWAYS AS (" + expr + ") STORED").Error; err != nil {
+		return err
+	}
+	return db.Exec("CREATE INDEX IF NOT EXISTS idx_" + table + "_search ON " + table + " USING GIN (search_vector)").Error
+}
+
+// Snippet 命中片段；Highlights 为需高亮的 [起, 止) 区间，按字符（rune）计
+type Snippet struct {
+	MessageID  uint     `json:"messageId,omitempty"`
+	Sender     string   `json:"sender,omitempty"`
+	Text       string   `json:"text"`
+	Highlights [][2]int `json:"highlights"`
+}
+
+// SearchResult 一个命中的会话
+type SearchResult struct {
+	Session  ChatSession `json:"session"`
+	Title    *Snippet    `json:"title,omitempty"` // 标题命中时的高亮
+	Snippets []Snippet   `json:"snippets"`
+	Score    float64     `json:"score"`
+}
+
+type messageHit struct {
+	MessageID uint
+	SessionID uint
+	Role      string
+	Content   string
+	Rank      float64
+}
+
+type titleHit struct {
+	ID   uint
+	Rank float64
+}
+
+const (
+	maxSnippetsPerSession = 3
+	snippetRadius         = 30
+)
+
+// SearchHandler 在当前用户未删除的会话中搜索标题和消息内容（含归档），按相关度返回会话及高亮片段
+func (h *ChatHandler) SearchHandler(c *gin.Context) {
+	userID := userIDFromContext(c)
+	q := strings.TrimSpace(c.Query("q"))
+	if q == "" || len([]rune(q)) > 100 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "搜索词长度需在 1-100 字之间"})
+		return
+	}
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "20"))
+	if limit <= 0 || limit > 50 {
+		limit = 20
+	}
+
+	var messages []messageHit
+	var titles []titleHit
+	var err error
+	if searchTokenizer != "" {
+		tsq := "plainto_tsquery('simple'::regconfig, chat_search_bigrams(?))"
+		if searchTokenizer == SearchTokenizerZhparser {
+			tsq = "plainto_tsquery('chinese'::regconfig, ?)"
+		}
+		err = h.DB.Raw(`SELECT m.id AS message_id, m.session_id, m.role, m.content, ts_rank(m.search_vector, q) AS rank
+			FROM chat_messages m JOIN chat_sessions s ON s.id = m.session_id, `+tsq+` AS q
+			WHERE s.user_id = ? AND s.deleted_at IS NULL AND m.role <> 'system' AND m.search_vector @@ q
+			ORDER BY rank DESC, m.id DESC LIMIT 200`, q, userID).Scan(&messages).Error
+		if err == nil {
+			err = h.DB.Raw(`SELECT s.id, ts_rank(s.search_vector, q) AS rank
+				FROM chat_sessions s, `+tsq+` AS q
+				WHERE s.user_id = ? AND s.deleted_at IS NULL AND s.search_vector @@ q`, q, userID).Scan(&titles).Error
+		}
+	} else {
+		pattern := "%" + strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(q) + "%"
+		err = h.DB.Raw(`SELECT m.id AS message_id, m.session_id, m.role, m.content, 0 AS rank
+			FROM chat_messages m JOIN chat_sessions s ON s.id = m.session_id
+			WHERE s.user_id = ? AND s.deleted_at IS NULL AND m.role <> 'system' AND m.content ILIKE ?
+			ORDER BY m.id DESC LIMIT 200`, userID, pattern).Scan(&messages).Error
+		if err == nil {
+			err = h.DB.Raw(`SELECT id, 1 AS rank FROM chat_sessions
+				WHERE user_id = ? AND deleted_at IS NULL AND title ILIKE ?`, userID, pattern).Scan(&titles).Error
+		}
+	}
+	if err != nil {
+		log.Printf("Chat search failed: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "搜索失败"})
+		return
+	}
+
+	terms := searchTerms(q)
+	results := map[uint]*SearchResult{}
+	get := func(sessionID uint) *SearchResult {
+		r, ok := results[sessionID]
+		if !ok {
+			r = &SearchResult{Snippets: []Snippet{}}
+			results[sessionID] = r
+		}
+		return r
+	}
+	for _, hit := range titles {
+		// 标题命中权重更高
+		get(hit.ID).Score += hit.Rank*2 + 0.1
+	}
+	// messages 已按相关度降序，每个会话只计最相关的一条消息
+	scored := map[uint]bool{}
+	for _, hit := range messages {
+		r := get(hit.SessionID)
+		if !scored[hit.SessionID] {
+			scored[hit.SessionID] = true
+			r.Score += hit.Rank
+		}
+		if len(r.Snippets) < maxSnippetsPerSession {
+			snippet := buildSnippet(hit.Content, terms, snippetRadius)
+			snippet.MessageID = hit.MessageID
+			snippet.Sender = hit.Role
+			r.Snippets = append(r.Snippets, snippet)
+		}
+	}
+	if len(results) == 0 {
+		c.JSON(http.StatusOK, gin.H{"results": []SearchResult{}, "tokenizer": searchTokenizer})
+		return
+	}
+
+	ids := make([]uint, 0, len(results))
+	for id := range results {
+		ids = append(ids, id)
+	}
+	var sessions []ChatSession
+	if err := h.DB.Where("user_id = ? AND id IN ?", userID, ids).Find(&sessions).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "搜索失败"})
+		return
+	}
+	out := make([]SearchResult, 0, len(sessions))
+	for _, session := range sessions {
+		r := results[session.ID]
+		r.Session = session
+		if title := buildSnippet(session.Title, terms, len([]rune(session.Title))); len(title.Highlights) > 0 {
+			r.Title = &title
+		}
+		out = append(out, *r)
+	}
+	sort.SliceStable(out, func(i, j int) bool {
+		if out[i].Score != out[j].Score {
+			return out[i].Score > out[j].Score
+		}
+		return out[i].Session.CreatedAt.After(out[j].Session.CreatedAt)
+	})
+	if len(out) > limit {
+		out = out[:limit]
+	}
+	c.JSON(http.StatusOK, gin.H{"results": out, "tokenizer": searchTokenizer})
+}
+
+// searchTerms 高亮用的词：按空白切分并转小写
+func searchTerms(q string) [][]rune {
+	var terms [][]rune
+	for _, field := range strings.Fields(q) {
+		terms = append(terms, lowerRunes([]rune(field)))
+	}
+	return terms
+}
+
+// lowerRunes 逐字符转小写，保证与原文的下标一一对应
+func lowerRunes(runes []rune) []rune {
+	out := make([]rune, len(runes))
+	for i, r := range runes {
+		out[i] = unicode.ToLower(r)
+	}
+	return out
+}
+
+func findRunes(haystack, needle []rune, from int) int {
+	for i := from; i+len(needle) <= len(haystack); i++ {
+		match := true
+		for j := range needle {
+			if haystack[i+j] != needle[j] {
+				match = false
+				break
+			}
+		}
+		if match {
+			return i
+		}
+	}
+	return -1
+}
+
+// matchRanges 找出所有命中区间；整词找不到时（分词检索可能只命中词的一部分）退而匹配其中的二字组、单字
+func matchRanges(text []rune, terms [][]rune) [][2]int {
+	var ranges [][2]int
+	collect := func(term []rune) bool {
+		found := false
+		for pos := findRunes(text, term, 0); pos >= 0; pos = findRunes(text, term, pos+len(term)) {
+			ranges = append(ranges, [2]int{pos, pos + len(term)})
+			found = true
+		}
+		return found
+	}
+	for _, term := range terms {
+		if len(term) == 0 || collect(term) || len(term) == 1 {
+			continue
+		}
+		found := false
+		for i := 0; i+2 <= len(term); i++ {
+			found = collect(term[i:i+2]) || found
+		}
+		if found {
+			continue
+		}
+		// 二字组也没命中时退到单个汉字（与二元切分索引中的单字对应）
+		for _, r := range term {
+			if unicode.Is(unicode.Han, r) {
+				collect([]rune{r})
+			}
+		}
+	}
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i][0] < ranges[j][0] })
+	merged := make([][2]int, 0, len(ranges))
+	for _, r := range ranges {
+		if n := len(merged); n > 0 && r[0] <= merged[n-1][1] {
+			if r[1] > merged[n-1][1] {
+				merged[n-1][1] = r[1]
+			}
+			continue
+		}
+		merged = append(merged, r)
+	}
+	return merged
+}
+
+// buildSnippet 以第一个命中处为中心截取前后 radius 个字，换行折叠为空格；没有命中时取开头
+func buildSnippet(content string, terms [][]rune, radius int) Snippet {
+	text := []rune(content)
+	for i, r := range text {
+		if r == '\n' || r == '\r' || r == '\t' {
+			text[i] = ' '
+		}
+	}
+	ranges := matchRanges(lowerRunes(text), terms)
+
+	start, end := 0, len(text)
+	if len(ranges) > 0 {
+		start = ranges[0][0] - radius
+		end = ranges[0][1] + radius
+	} else {
+		end = 2 * radius
+	}
+	if start < 0 {
+		start = 0
+	}
+	if end > len(text) {
+		end = len(text)
+	}
+
+	prefix := ""
+	if start > 0 {
+		prefix = "…"
+	}
+	offset := len([]rune(prefix)) - start
+	highlights := [][2]int{}
+	for _, r := range ranges {
+		if r[0] >= start && r[1] <= end {
+			highlights = append(highlights, [2]int{r[0] + offset, r[1] + offset})
+		}
+	}
+	snippet := prefix + string(text[start:end])
+	if end < len(text) {
+		snippet += "…"
+	}
+	return Snippet{Text: snippet, Highlights: highlights}
+}
@@ -0,0 +1,172 @@
+// web_service/chat/sessions.go
+
+package chat
+
+import (
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// maxTitleRunes 手动重命名允许的最大长度（AI 生成的标题截断到 12 字）
+const maxTitleRunes = 50
+
+// loadOwnSession 读取当前用户的会话；trashed 为 true 时只在回收站中查找
+func (h *ChatHandler) loadOwnSession(c *gin.Context, trashed bool) (ChatSession, bool) {
+	var session ChatSession
+	sessionID, err := strconv.Atoi(c.Param("id"))
+	if err != nil || sessionID <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid session ID"})
+		return session, false
+	}
+	query := h.DB
+	if trashed {
+		query = query.Unscoped().Where("deleted_at IS NOT NULL")
+	}
+	if err := query.Where("user_id = ?", userIDFromContext(c)).First(&session, sessionID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Session not found"})
+		return session, false
+	}
+	return session, true
+}
+
+// UpdateSessionRequest 会话的可修改项，未传的字段保持不变
+type UpdateSessionRequest struct {
+	Title    *string `json:"title"`
+	Pinned   *bool   `json:"pinned"`
+	Archived *bool   `json:"archived"`
+}
+
+// UpdateSessionHandler 重命名 / 置顶 / 归档会话
+func (h *ChatHandler) UpdateSessionHandler(c *gin.Context) {
+	session, ok := h.loadOwnSession(c, false)
+	if !ok {
+		return
+	}
+	var req UpdateSessionRequest
+	if err := c.ShouldBindJSON(&req); err != nil || (req.Title == nil && req.Pinned == nil && req.Archived == nil) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "请求参数不合法"})
+		return
+	}
+
+	now := time.Now()
+	updates := map[string]interface{}{}
+	if req.Title != nil {
+		title := strings.TrimSpace(*req.Title)
+		if title == "" || len([]rune(title)) > maxTitleRunes {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "标题长度需在 1-50 字之间"})
+			return
+		}
+		updates["title"] = title
+	}
+	if req.Pinned != nil {
+		if *req.Pinned {
+			updates["pinned_at"] = now
+		} else {
+			updates["pinned_at"] = nil
+		}
+	}
+	if req.Archived != nil {
+		if *req.Archived {
+			updates["archived_at"] = now
+		} else {
+			updates["archived_at"] = nil
+		}
+	}
+	if err := h.DB.Model(&session).Updates(updates).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update session"})
+		return
+	}
+	h.DB.First(&session, session.ID)
+	c.JSON(http.StatusOK, session)
+}
+
+// DeleteSessionHandler 把会话移入回收站（软删除），可在回收站中恢复
+func (h *ChatHandler) DeleteSessionHandler(c *gin.Context) {
+	session, ok := h.loadOwnSession(c, false)
+	if !ok {
+		return
+	}
+	if err := h.DB.Delete(&session).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete session"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "已移入回收站", "id": session.ID})
+}
+
+// trashedSession 回收站条目：会话本身不输出 deletedAt，这里单独带上
+type trashedSession struct {
+	ChatSession
+	DeletedAt time.Time `json:"deletedAt"`
+}
+
+// ListTrashHandler 回收站中的会话，按删除时间倒序
+func (h *ChatHandler) ListTrashHandler(c *gin.Context) {
+	var sessions []ChatSession
+	if err := h.DB.Unscoped().Where("user_id = ? AND deleted_at IS NOT NULL", userIDFromContext(c)).
+		Order("deleted_at desc").Find(&sessions).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve chat sessions"})
+		return
+	}
+	items := make([]trashedSession, 0, len(sessions))
+	for _, session := range sessions {
+		items = append(items, trashedSession{ChatSession: session, DeletedAt: session.DeletedAt.Time})
+	}
+	c.JSON(http.StatusOK, items)
+}
+
+// RestoreSessionHandler 从回收站恢复会话
+func (h *ChatHandler) RestoreSessionHandler(c *gin.Context) {
+	session, ok := h.loadOwnSession(c, true)
+	if !ok {
+		return
+	}
+	if err := h.DB.Unscoped().Model(&session).Update("deleted_at", nil).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to restore session"})
+		return
+	}
+	session.DeletedAt = gorm.DeletedAt{}
+	c.JSON(http.StatusOK, session)
+}
+
+// PurgeSessionHandler 彻底删除回收站中的会话及其消息、附件文件
+func (h *ChatHandler) PurgeSessionHandler(c *gin.Context) {
+	session, ok := h.loadOwnSession(c, true)
+	if !ok {
+		return
+	}
+	var paths []string
+	h.DB.Model(&ChatAttachment{}).Where("session_id = ?", session.ID).Distinct().Pluck("storage_path", &paths)
+	err := h.DB.Transaction(func(tx *gorm.DB) error {
+		// 旧库未必建了级联外键，消息与附件显式删除
+		if err := tx.Where("session_id = ?", session.ID).Delete(&ChatAttachment{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("session_id = ?", session.ID).Delete(&ChatSummary{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("message_id IN (SELECT id FROM chat_messages WHERE session_id = ?)", session.ID).Delete(&AnswerCorrection{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("message_id IN (SELECT id FROM chat_messages WHERE session_id = ?)", session.ID).Delete(&MessageFeedback{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("session_id = ?", session.ID).Delete(&ChatMessage{}).Error; err != nil {
+			return err
+		}
+		return tx.Unscoped().Delete(&session).Error
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete session"})
+		return
+	}
+	for _, path := range paths {
+		os.Remove(path)
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "已彻底删除", "id": session.ID})
+}
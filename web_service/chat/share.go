@@ -0,0 +1,424 @@
+// web_service/chat/share.go
+
+package chat
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"workplace/web_service/accesscontrol"
+	"workplace/web_service/auth"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const (
+	ShareScopeUser          = "user"          // 指定的某个用户（分享给老师时即老师本人）
+	ShareScopeClass         = "class"         // 某个班级的同学和任课老师
+	ShareScopeAuthenticated = "authenticated" // 任何已登录用户
+)
+
+// ChatShare 会话的只读分享：创建时保存消息快照，之后会话再变化也不影响分享内容。
+type ChatShare struct {
+	ID            uint       `gorm:"primarykey" json:"id"`
+	Token         string     `gorm:"size:32;not null;uniqueIndex" json:"token"`
+	SessionID     uint       `gorm:"index;not null" json:"chatSessionId"`
+	OwnerID       uint       `gorm:"index;not null" json:"ownerId"`
+	Scope         string     `gorm:"size:20;not null" json:"scope"`
+	TargetUserID  *uint      `gorm:"index" json:"targetUserId,omitempty"`
+	TargetClassID *uint      `gorm:"index" json:"targetClassId,omitempty"`
+	Title         string     `gorm:"size:255" json:"title"`
+	Snapshot      string     `gorm:"type:text" json:"-"` // JSON []SharedMessage
+	ExpiresAt     *time.Time `json:"expiresAt,omitempty"`
+	RevokedAt     *time.Time `json:"revokedAt,omitempty"`
+	ViewCount     int        `gorm:"default:0" json:"viewCount"`
+	CreatedAt     time.Time  `json:"createdAt"`
+}
+
+// RecommendedExplanation 老师把某个分享推荐到班级的“推荐讲解”列表
+type RecommendedExplanation struct {
+	ID        uint      `gorm:"primarykey" json:"id"`
+	ShareID   uint      `gorm:"not null;uniqueIndex:idx_recommended_share_class" json:"shareId"`
+	ClassID   uint      `gorm:"not null;uniqueIndex:idx_recommended_share_class;index" json:"classId"`
+	TeacherID uint      `gorm:"not null" json:"teacherId"`
+	Note      string    `gorm:"size:500" json:"note"`
+	CreatedAt time.Time `json:"createdAt"`
+	Share     ChatShare `gorm:"foreignKey:ShareID" json:"share"`
+}
+
+// SharedMessage 快照中的一条消息（不含 system 消息与反馈等个人信息）
+type SharedMessage struct {
+	Sender    string          `json:"sender"`
+	Text      string          `json:"text"`
+	Citations json.RawMessage `json:"citations,omitempty"`
+	CreatedAt time.Time       `json:"createdAt"`
+}
+
+// Active 分享未撤销且未过期
+func (s ChatShare) Active(now time.Time) bool {
+	return s.RevokedAt == nil && (s.ExpiresAt == nil || s.ExpiresAt.After(now))
+}
+
+func newShareToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// recommendable 只有全员可见、或面向该班级的分享才能推荐到该班级；
+// 推荐不扩大可见范围，分享给个人（含分享给老师）的会话需学生自己改为班级分享
+func recommendable(share ChatShare, classID uint) bool {
+	switch share.Scope {
+	case ShareScopeAuthenticated:
+		return true
+	case ShareScopeClass:
+		return share.TargetClassID != nil && *share.TargetClassID == classID
+	}
+	return false
+}
+
+// canView 判断用户能否查看分享：本人或分享范围内的用户（推荐到班级不额外授权）
+func (h *ChatHandler) canView(share ChatShare, user auth.User) bool {
+	if share.OwnerID == user.ID {
+		return true
+	}
+	switch share.Scope {
+	case ShareScopeAuthenticated:
+		return true
+	case ShareScopeUser:
+		if share.TargetUserID != nil && *share.TargetUserID == user.ID {
+			return true
+		}
+	case ShareScopeClass:
+		if share.TargetClassID != nil && h.inClass(user, *share.TargetClassID) {
+			return true
+		}
+	}
+	return false
+}
+
+// inClass 学生属于该班级，或老师是该班级的任课老师
+func (h *ChatHandler) inClass(user auth.User, classID uint) bool {
+	if user.Role == "teacher" {
+		var count int64
+		h.DB.Model(&auth.Class{}).Where("id = ? AND teacher_id = ?", classID, user.ID).Count(&count)
+		return count > 0
+	}
+	return user.ClassID != nil && *user.ClassID == classID
+}
+
+// CreateShareRequest 创建分享；scope=teacher 是分享给本班任课老师的快捷方式
+type CreateShareRequest struct {
+	Scope          string `json:"scope" binding:"required"` // user / class / authenticated / teacher
+	Username       string `json:"username"`                 // scope=user 时指定对方（用户名或学工号）
+	ClassID        *uint  `json:"classId"`                  // scope=class 时可选，默认本人所在班级
+	ExpiresInHours int    `json:"expiresInHours"`           // 0 表示不过期
+}
+
+// CreateShareHandler 为自己的会话创建只读分享链接
+func (h *ChatHandler) CreateShareHandler(c *gin.Context) {
+	session, ok := h.loadOwnSession(c, false)
+	if !ok {
+		return
+	}
+	user, exists, err := accesscontrol.CurrentUser(h.DB, c)
+	if err != nil || !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "未登录"})
+		return
+	}
+	var req CreateShareRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "请求参数不合法"})
+		return
+	}
+	if req.ExpiresInHours < 0 || req.ExpiresInHours > 24*365 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "有效期需在 0-8760 小时之间"})
+		return
+	}
+
+	share := ChatShare{SessionID: session.ID, OwnerID: user.ID, Scope: req.Scope, Title: session.Title, CreatedAt: time.Now()}
+	switch req.Scope {
+	case "teacher":
+		if user.ClassID == nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "尚未加入班级，无法分享给老师"})
+			return
+		}
+		var cls auth.Class
+		if err := h.DB.First(&cls, *user.ClassID).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "班级不存在"})
+			return
+		}
+		share.Scope = ShareScopeUser
+		share.TargetUserID = &cls.TeacherID
+	case ShareScopeUser:
+		name := strings.TrimSpace(req.Username)
+		var target auth.User
+		if name == "" || h.DB.Where("username = ? OR user_id_no = ?", name, name).First(&target).Error != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "找不到要分享的用户"})
+			return
+		}
+		share.TargetUserID = &target.ID
+	case ShareScopeClass:
+		classID := user.ClassID
+		if req.ClassID != nil {
+			classID = req.ClassID
+		}
+		if classID == nil || !h.inClass(user, *classID) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "只能分享到自己所在/任教的班级"})
+			return
+		}
+		share.TargetClassID = classID
+	case ShareScopeAuthenticated:
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "scope 只支持 user / class / authenticated / teacher"})
+		return
+	}
+	if req.ExpiresInHours > 0 {
+		expiresAt := share.CreatedAt.Add(time.Duration(req.ExpiresInHours) * time.Hour)
+		share.ExpiresAt = &expiresAt
+	}
+
+	messages, err := h.exportMessages(session, h.citationScopeFor(c))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve messages"})
+		return
+	}
+	snapshot := make([]SharedMessage, 0, len(messages))
+	for _, msg := range messages {
+		item := SharedMessage{Sender: msg.Role, Text: msg.Content, CreatedAt: msg.CreatedAt}
+		if msg.Citations != "" && json.Valid([]byte(msg.Citations)) {
+			item.Citations = json.RawMessage(msg.Citations)
+		}
+		snapshot = append(snapshot, item)
+	}
+	raw, err := json.Marshal(snapshot)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "创建分享失败"})
+		return
+	}
+	share.Snapshot = string(raw)
+	if share.Token, err = newShareToken(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "创建分享失败"})
+		return
+	}
+	if err := h.DB.Create(&share).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "创建分享失败"})
+		return
+	}
+	c.JSON(http.StatusOK, share)
+}
+
+// ListMySharesHandler 我创建的分享（含已撤销/过期的）
+func (h *ChatHandler) ListMySharesHandler(c *gin.Context) {
+	var shares []ChatShare
+	if err := h.DB.Where("owner_id = ?", userIDFromContext(c)).Order("created_at desc").Find(&shares).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "读取分享失败"})
+		return
+	}
+	c.JSON(http.StatusOK, shares)
+}
+
+// ListSharedWithMeHandler 分享给我或我所在班级、仍有效的分享
+func (h *ChatHandler) ListSharedWithMeHandler(c *gin.Context) {
+	user, exists, err := accesscontrol.CurrentUser(h.DB, c)
+	if err != nil || !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "未登录"})
+		return
+	}
+	query := h.DB.Where("owner_id <> ? AND revoked_at IS NULL AND (expires_at IS NULL OR expires_at > ?)", user.ID, time.Now())
+	if user.Role == "teacher" {
+		query = query.Where("target_user_id = ? OR target_class_id IN (?)",
+			user.ID, h.DB.Model(&auth.Class{}).Select("id").Where("teacher_id = ?", user.ID))
+	} else if user.ClassID != nil {
+		query = query.Where("target_user_id = ? OR target_class_id = ?", user.ID, *user.ClassID)
+	} else {
+		query = query.Where("target_user_id = ?", user.ID)
+	}
+	var shares []ChatShare
+	if err := query.Order("created_at desc").Limit(100).Find(&shares).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "读取分享失败"})
+		return
+	}
+	c.JSON(http.StatusOK, shares)
+}
+
+// RevokeShareHandler 撤销自己的分享（推荐列表中也随之失效）
+func (h *ChatHandler) RevokeShareHandler(c *gin.Context) {
+	var share ChatShare
+	if err := h.DB.Where("owner_id = ?", userIDFromContext(c)).First(&share, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "分享不存在"})
+		return
+	}
+	if share.RevokedAt == nil {
+		now := time.Now()
+		share.RevokedAt = &now
+		if err := h.DB.Model(&share).Update("revoked_at", now).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "撤销分享失败"})
+			return
+		}
+	}
+	c.JSON(http.StatusOK, share)
+}
+
+// loadViewableShare 按 token 读取分享并校验可见性，出错时已写回响应
+func (h *ChatHandler) loadViewableShare(c *gin.Context, token string) (ChatShare, auth.User, bool) {
+	var share ChatShare
+	user, exists, err := accesscontrol.CurrentUser(h.DB, c)
+	if err != nil || !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "未登录"})
+		return share, user, false
+	}
+	if err := h.DB.Where("token = ?", token).First(&share).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "分享不存在"})
+		return share, user, false
+	}
+	if !share.Active(time.Now()) {
+		c.JSON(http.StatusGone, gin.H{"error": "分享已撤销或过期"})
+		return share, user, false
+	}
+	if !h.canView(share, user) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "无权查看该分享"})
+		return share, user, false
+	}
+	return share, user, true
+}
+
+// GetSharedSessionHandler 只读查看分享快照
+func (h *ChatHandler) GetSharedSessionHandler(c *gin.Context) {
+	share, user, ok := h.loadViewableShare(c, c.Param("token"))
+	if !ok {
+		return
+	}
+	if share.OwnerID != user.ID {
+		h.DB.Model(&ChatShare{}).Where("id = ?", share.ID).UpdateColumn("view_count", gorm.Expr("view_count + 1"))
+	}
+	var owner auth.User
+	h.DB.Select("id", "username", "display_name").First(&owner, share.OwnerID)
+	ownerName := owner.DisplayName
+	if ownerName == "" {
+		ownerName = owner.Username
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"share":     share,
+		"ownerName": ownerName,
+		"messages":  json.RawMessage(share.Snapshot),
+		"readOnly":  true,
+	})
+}
+
+// teacherClass 校验老师是否任教该班级
+func (h *ChatHandler) teacherClass(c *gin.Context) (auth.Class, uint, bool) {
+	var cls auth.Class
+	teacherID := userIDFromContext(c)
+	classID, err := strconv.Atoi(c.Param("id"))
+	if err != nil || classID <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "班级 ID 不合法"})
+		return cls, teacherID, false
+	}
+	if err := h.DB.Where("id = ? AND teacher_id = ?", classID, teacherID).First(&cls).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "班级不存在"})
+		return cls, teacherID, false
+	}
+	return cls, teacherID, true
+}
+
+// RecommendShareHandler 老师把面向该班级或全员可见的分享推荐到班级
+func (h *ChatHandler) RecommendShareHandler(c *gin.Context) {
+	cls, teacherID, ok := h.teacherClass(c)
+	if !ok {
+		return
+	}
+	var req struct {
+		Token string `json:"token" binding:"required"`
+		Note  string `json:"note"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "请求参数不合法"})
+		return
+	}
+	share, _, ok := h.loadViewableShare(c, strings.TrimSpace(req.Token))
+	if !ok {
+		return
+	}
+	if !recommendable(share, cls.ID) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "只能推荐分享给本班或所有登录用户的会话，私人分享需由作者改为班级分享"})
+		return
+	}
+	rec := RecommendedExplanation{ShareID: share.ID, ClassID: cls.ID, TeacherID: teacherID, Note: trimRunes(strings.TrimSpace(req.Note), 200), CreatedAt: time.Now()}
+	err := h.DB.Where(RecommendedExplanation{ShareID: share.ID, ClassID: cls.ID}).
+		Assign(map[string]interface{}{"note": rec.Note, "teacher_id": teacherID}).
+		FirstOrCreate(&rec).Error
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "推荐失败"})
+		return
+	}
+	rec.Share = share
+	c.JSON(http.StatusOK, rec)
+}
+
+// UnrecommendShareHandler 老师取消推荐
+func (h *ChatHandler) UnrecommendShareHandler(c *gin.Context) {
+	cls, _, ok := h.teacherClass(c)
+	if !ok {
+		return
+	}
+	result := h.DB.Where("id = ? AND class_id = ?", c.Param("recId"), cls.ID).Delete(&RecommendedExplanation{})
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "取消推荐失败"})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "推荐不存在"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "已取消推荐"})
+}
+
+// ListRecommendedHandler 班级推荐讲解列表：学生看本班，老师需带 classId 且为任课老师；已撤销/过期的分享不再列出
+func (h *ChatHandler) ListRecommendedHandler(c *gin.Context) {
+	user, exists, err := accesscontrol.CurrentUser(h.DB, c)
+	if err != nil || !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "未登录"})
+		return
+	}
+	var classID uint
+	if user.Role == "teacher" {
+		id, err := strconv.Atoi(c.Query("classId"))
+		if err != nil || id <= 0 || !h.inClass(user, uint(id)) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "请指定自己任教的班级"})
+			return
+		}
+		classID = uint(id)
+	} else {
+		if user.ClassID == nil {
+			c.JSON(http.StatusOK, []RecommendedExplanation{})
+			return
+		}
+		classID = *user.ClassID
+	}
+
+	var recs []RecommendedExplanation
+	err = h.DB.Joins("Share").
+		Where("recommended_explanations.class_id = ? AND \"Share\".revoked_at IS NULL AND (\"Share\".expires_at IS NULL OR \"Share\".expires_at > ?)", classID, time.Now()).
+		Order("recommended_explanations.created_at desc").Find(&recs).Error
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "读取推荐讲解失败"})
+		return
+	}
+	// 早先推荐的私人分享不再列出（班级成员也无权查看）
+	visible := make([]RecommendedExplanation, 0, len(recs))
+	for _, rec := range recs {
+		if recommendable(rec.Share, classID) {
+			visible = append(visible, rec)
+		}
+	}
+	c.JSON(http.StatusOK, visible)
+}
@@ -0,0 +1,226 @@
+// web_service/chat/stream.go
+
+package chat
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"workplace/web_service/aiclient"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// aiErrorMessage 从 ai_service 的错误响应中取出 detail / error 字段，取不到就用原文。
+func aiErrorMessage(body []byte) string {
+	var errResp struct {
+		Detail interface{} `json:"detail"`
+		Error  interface{} `json:"error"`
+	}
+	message := string(body)
+	if err := json.Unmarshal(body, &errResp); err == nil {
+		if errResp.Detail != nil {
+			message = fmt.Sprint(errResp.Detail)
+		} else if errResp.Error != nil {
+			message = fmt.Sprint(errResp.Error)
+		}
+	}
+	return message
+}
+
+// StartSSE 设置 SSE 响应头；nginx 需关闭缓冲才能逐条下发。
+func StartSSE(c *gin.Context) {
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+}
+
+// SendSSE 写出一个事件并立即 flush；客户端已断开时写入失败会被忽略。
+func SendSSE(c *gin.Context, event string, data interface{}) {
+	if c.Request.Context().Err() != nil {
+		return
+	}
+	c.SSEvent(event, data)
+	c.Writer.Flush()
+}
+
+// StreamMessageHandler 流式版 SendMessageHandler：把 ai_service 的 token 增量以 SSE 转发给前端。
+// 事件：meta（引用/模型）→ delta{text}* → done{session, ai_response, partial} | error{error}。
+// 流结束后才落库；中途失败或客户端断开时，已收到的内容仍保存为 partial 消息。
+func (h *ChatHandler) StreamMessageHandler(c *gin.Context) {
+	userID := userIDFromContext(c)
+	isFirstMessage, _ := strconv.ParseBool(c.PostForm("is_first_message"))
+	prompt := c.PostForm("prompt")
+
+	// 流式期间不持有事务：首条消息的会话在流结束后与消息一起创建
+	var session ChatSession
+	if !isFirstMessage {
+		sessionID, err := strconv.Atoi(c.PostForm("chat_session_id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid session ID"})
+			return
+		}
+		if err := h.DB.Preload("Messages", func(db *gorm.DB) *gorm.DB {
+			return db.Order("chat_messages.created_at ASC, chat_messages.id ASC")
+		}).Preload("Messages.Attachments").Where("user_id = ?", userID).First(&session, sessionID).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Session not found"})
+			return
+		}
+	}
+
+	// 只把当前分支上的历史发给 AI，新消息接在分支末端
+	parentID := currentLeaf(session, session.Messages)
+	session.Messages = activePath(session.Messages, session.ActiveLeafID)
+	if !checkChatQuota(h.DB, c) {
+		return
+	}
+	aiPath, body, contentType, status, err := h.sessionAIRequest(c, userID, prompt, session, isFirstMessage, nil)
+	if err != nil {
+		refundChatQuota(h.DB, c, userID)
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+
+	aiStartedAt := time.Now()
+	resp, err := aiclient.PostStream(c.Request.Context(), aiPath+"/stream", body, contentType)
+	if err != nil {
+		refundChatQuota(h.DB, c, userID)
+		var statusErr *aiclient.StatusError
+		switch {
+		case c.Request.Context().Err() != nil:
+		case errors.As(err, &statusErr):
+			c.JSON(statusErr.Status, gin.H{"error": aiErrorMessage(statusErr.Body)})
+		default:
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "AI service is unreachable"})
+		}
+		return
+	}
+	defer resp.Body.Close()
+
+	StartSSE(c)
+	var content strings.Builder
+	var final AIChatResponse
+	scope := h.citationScopeFor(c)
+	var meta map[string]interface{}
+	var metaCitations []Citation
+	finished := false
+	streamErr := ""
+	readErr := aiclient.ReadSSE(resp.Body, func(event string, data []byte) error {
+		switch event {
+		case "meta":
+			// 引用先按教材范围过滤再转发
+			var parsed struct {
+				Citations []Citation `json:"citations"`
+			}
+			_ = json.Unmarshal(data, &parsed)
+			_ = json.Unmarshal(data, &meta)
+			metaCitations = scope.filter(parsed.Citations)
+			if meta == nil {
+				meta = map[string]interface{}{}
+			}
+			meta["citations"] = metaCitations
+			SendSSE(c, "meta", meta)
+		case "delta":
+			var delta struct {
+				Text string `json:"text"`
+			}
+			if err := json.Unmarshal(data, &delta); err == nil && delta.Text != "" {
+				content.WriteString(delta.Text)
+				SendSSE(c, "delta", string(data))
+			}
+		case "done":
+			if err := json.Unmarshal(data, &final); err == nil {
+				finished = true
+			}
+		case "error":
+			var e struct {
+				Error string `json:"error"`
+			}
+			_ = json.Unmarshal(data, &e)
+			streamErr = e.Error
+		}
+		return nil
+	})
+	responseDurationMs := time.Since(aiStartedAt).Milliseconds()
+	if !finished && streamErr == "" {
+		streamErr = "AI 回答中断"
+		if readErr != nil && c.Request.Context().Err() == nil {
+			log.Printf("Chat stream read error: %v", readErr)
+		}
+	}
+
+	aiMessageContent := content.String()
+	if finished {
+		if text := final.TextExplanation; text != "" {
+			aiMessageContent = text
+		} else if final.Response != "" {
+			aiMessageContent = final.Response
+		}
+	}
+	if strings.TrimSpace(aiMessageContent) == "" {
+		// 一个字都没收到：不落库，首条消息也不创建空会话，也不计用量
+		refundChatQuota(h.DB, c, userID)
+		SendSSE(c, "error", gin.H{"error": streamErr})
+		return
+	}
+
+	final.Citations = scope.filter(final.Citations)
+	if len(final.Citations) == 0 {
+		final.Citations = metaCitations
+	}
+	citationsJSON := marshalCitations(final.Citations)
+	modelID := final.ModelID
+	if modelID == "" {
+		modelID, _ = meta["model_id"].(string)
+	}
+
+	var attachments []ChatAttachment
+	err = h.DB.Transaction(func(tx *gorm.DB) error {
+		if isFirstMessage {
+			title := normalizeAITitle(final.Title)
+			if !finished || final.Title == "" {
+				title = normalizeAITitle(prompt)
+			}
+			session = ChatSession{UserID: userID, Title: title, CreatedAt: time.Now()}
+			if err := tx.Create(&session).Error; err != nil {
+				return err
+			}
+			final.Title = session.Title
+		}
+		now := time.Now()
+		userMessage := &ChatMessage{Role: "user", Content: prompt, CreatedAt: now}
+		err := AppendMessages(tx, session.ID, parentID, userMessage,
+			&ChatMessage{Role: "ai", Content: aiMessageContent, Citations: citationsJSON, ModelID: modelID, ResponseDurationMs: &responseDurationMs, Partial: !finished, CreatedAt: now},
+		)
+		if err != nil {
+			return err
+		}
+		attachments, err = saveAttachments(tx, c, userID, session.ID, userMessage.ID)
+		return err
+	})
+	if err != nil {
+		log.Printf("Failed to save streamed chat messages: %v", err)
+		SendSSE(c, "error", gin.H{"error": "Failed to save messages"})
+		return
+	}
+	h.enqueueDescribe(attachments)
+
+	if !finished {
+		SendSSE(c, "error", gin.H{"error": streamErr, "partial": true, "chatSessionId": session.ID})
+		return
+	}
+	final.TextExplanation = aiMessageContent
+	final.Response = aiMessageContent
+	h.DB.First(&session, session.ID)
+	all, _ := h.sessionMessages(session.ID)
+	session.Messages = h.visibleMessages(c, activeBranch(session, all))
+	SendSSE(c, "done", gin.H{"session": session, "ai_response": final, "partial": false})
+}
@@ -10,6 +10,9 @@ import (
 	"workplace/web_service/chat"
 	"workplace/web_service/favorite"
 	"workplace/web_service/grading"
+	"workplace/web_service/jobs"
+	"workplace/web_service/ocr"
+	"workplace/web_service/quota"
 	"workplace/web_service/textbook"
 
 	"github.com/joho/godotenv"
@@ -46,17 +49,41 @@ func ConnectDB() *gorm.DB {
 		&grading.GradeResult{},
 		&chat.ChatSession{},
 		&chat.ChatMessage{},
+		&chat.ChatAttachment{},
+		&chat.ChatSummary{},
+		&chat.ChatShare{},
+		&chat.RecommendedExplanation{},
+		&chat.AnswerCorrection{},
+		&chat.MessageFeedback{},
 		&assignment.Assignment{},
 		&assignment.AssignmentExercise{},
 		&assignment.Submission{},
+		&assignment.QuizAttempt{},
+		&assignment.QuizAnswer{},
+		&assignment.IntegrityEvent{},
 		&textbook.Textbook{},
+		&textbook.IngestJob{},
+		&textbook.TextbookVersion{},
+		&textbook.TextbookShare{},
+		&textbook.TextbookDeletion{},
 		&auth.VerificationCode{},
 		&favorite.FavoriteExercise{},
+		&jobs.Job{},
+		&ocr.CacheEntry{},
+		&ocr.Document{},
+		&grading.GradeCacheEntry{},
+		&quota.Usage{},
+		&quota.ClassRule{},
 	)
 	if err != nil {
 		log.Fatalf("GORM AutoMigrate failed: %v", err)
 	}
 	db.Exec("ALTER TABLE assignments ALTER COLUMN problem_text SET DEFAULT ''")
+	// 旧版答疑会话只靠一条 system 消息承载批改上下文，回填会话类型
+	db.Exec(`UPDATE chat_sessions SET context_type = 'grading'
+		WHERE context_type = 'chat' AND id IN (SELECT DISTINCT session_id FROM chat_messages WHERE role = 'system')`)
+	chat.BackfillMessageTree(db)
+	chat.SetupSearch(db)
 
 	log.Println("Successfully connected to the database and migrated schema!")
 	return db
@@ -0,0 +1,125 @@
+// web_service/export/document.go
+package export
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	FormatMarkdown = "md"
+	FormatLaTeX    = "tex"
+	FormatPDF      = "pdf"
+)
+
+// Document 待导出的一份笔记（一次会话）
+type Document struct {
+	Title      string
+	ExportedAt time.Time
+	Entries    []Entry
+}
+
+// Entry 一条消息；Footnotes 为该消息引用的教材出处
+type Entry struct {
+	Speaker   string
+	CreatedAt time.Time
+	Content   string
+	Footnotes []string
+}
+
+// Citation ai_service 返回的 RAG 引用（只取导出需要的字段）
+type Citation struct {
+	Index          int    `json:"index"`
+	SourceType     string `json:"source_type"`
+	TextbookName   string `json:"textbook_name"`
+	WeekNum        *int   `json:"week_num"`
+	PageNum        *int   `json:"page_num"`
+	ExerciseNumber string `json:"exercise_number"`
+}
+
+// Label 脚注文字：《教材》· 第N周 · 第N页 · 习题号
+func (c Citation) Label() string {
+	parts := []string{fmt.Sprintf("《%s》", strings.TrimSpace(c.TextbookName))}
+	if c.WeekNum != nil {
+		parts = append(parts, fmt.Sprintf("第%d周", *c.WeekNum))
+	}
+	if c.PageNum != nil {
+		parts = append(parts, fmt.Sprintf("第%d页", *c.PageNum))
+	}
+	if c.SourceType == "exercise" && strings.TrimSpace(c.ExerciseNumber) != "" {
+		parts = append(parts, "习题 "+strings.TrimSpace(c.ExerciseNumber))
+	}
+	return strings.Join(parts, " · ")
+}
+
+// CitationFootnotes 把消息上存的引用 JSON 转成脚注；无法解析的条目跳过，同一出处只保留一次
+func CitationFootnotes(raw string) []string {
+	if strings.TrimSpace(raw) == "" {
+		return nil
+	}
+	var items []json.RawMessage
+	if err := json.Unmarshal([]byte(raw), &items); err != nil {
+		return nil
+	}
+	seen := make(map[string]bool)
+	var notes []string
+	for _, item := range items {
+		var c Citation
+		if err := json.Unmarshal(item, &c); err != nil || strings.TrimSpace(c.TextbookName) == "" {
+			continue
+		}
+		label := c.Label()
+		if !seen[label] {
+			seen[label] = true
+			notes = append(notes, label)
+		}
+	}
+	return notes
+}
+
+// Render 按格式渲染；format 取 md / tex / pdf
+func Render(doc Document, format string) ([]byte, error) {
+	switch format {
+	case FormatMarkdown:
+		return Markdown(doc), nil
+	case FormatLaTeX:
+		return LaTeX(doc), nil
+	case FormatPDF:
+		return PDF(doc)
+	default:
+		return nil, fmt.Errorf("不支持的导出格式 %q", format)
+	}
+}
+
+// ContentType 各格式的 MIME 类型
+func ContentType(format string) string {
+	switch format {
+	case FormatLaTeX:
+		return "application/x-tex; charset=utf-8"
+	case FormatPDF:
+		return "application/pdf"
+	default:
+		return "text/markdown; charset=utf-8"
+	}
+}
+
+// Fidelity 导出内容的保真程度：Markdown / LaTeX 保留公式源码（source）；
+// PDF 只是纯文本近似（text-approximation）：公式转为近似文本，字体不嵌入，依赖阅读器自带的中文字体。
+func Fidelity(format string) string {
+	if format == FormatPDF {
+		return "text-approximation"
+	}
+	return "source"
+}
+
+// PDFNotice 写在 PDF 开头的说明，避免被当作公式完整的版本
+const PDFNotice = "说明：本 PDF 为纯文本近似版本，公式已转为近似文字（矩阵、分式等可能失真），未嵌入字体，部分阅读器可能无法显示中文。需要完整公式请导出 Markdown 或 LaTeX。"
+
+// ValidFormat 是否为支持的导出格式
+func ValidFormat(format string) bool {
+	return format == FormatMarkdown || format == FormatLaTeX || format == FormatPDF
+}
+
+const timeLayout = "2006-01-02 15:04"
@@ -0,0 +1,136 @@
+// web_service/export/latex.go
+package export
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// 需要原样保留的片段：代码块与公式。先换成占位符，转义其余文字后再放回。
+var (
+	codeFencePattern   = regexp.MustCompile("(?s)```[^\n]*\n(.*?)```")
+	displayMathPattern = regexp.MustCompile(`(?s)\$\$(.+?)\$\$|\\\[(.+?)\\\]`)
+	inlineMathPattern  = regexp.MustCompile(`\\\((.+?)\\\)|\$([^$\n]+?)\$`)
+	inlineCodePattern  = regexp.MustCompile("`([^`\n]+)`")
+	boldPattern        = regexp.MustCompile(`\*\*(.+?)\*\*`)
+	headingPattern     = regexp.MustCompile(`^(#{1,6})\s+(.*)$`)
+	listItemPattern    = regexp.MustCompile(`^\s*(?:[-*+]|\d+[.)])\s+(.*)$`)
+	placeholderPattern = regexp.MustCompile("\x00(\\d+)\x00")
+)
+
+var latexEscaper = strings.NewReplacer(
+	`\`, `\textbackslash{}`,
+	`{`, `\{`,
+	`}`, `\}`,
+	`#`, `\#`,
+	`$`, `\$`,
+	`%`, `\%`,
+	`&`, `\&`,
+	`_`, `\_`,
+	`^`, `\^{}`,
+	`~`, `\textasciitilde{}`,
+)
+
+func escapeLaTeX(s string) string { return latexEscaper.Replace(s) }
+
+// LaTeX 生成可用 xelatex 编译的 ctexart 文档：公式原样保留，常见 Markdown 结构（标题、列表、粗体、代码）转换为对应命令，引用写成 \footnote。
+func LaTeX(doc Document) []byte {
+	var b bytes.Buffer
+	b.WriteString("% 由学习平台导出，使用 xelatex 编译\n")
+	b.WriteString("\\documentclass[11pt]{ctexart}\n")
+	b.WriteString("\\usepackage{amsmath,amssymb}\n")
+	b.WriteString("\\usepackage[margin=2.5cm]{geometry}\n\n")
+	fmt.Fprintf(&b, "\\title{%s}\n", escapeLaTeX(doc.Title))
+	fmt.Fprintf(&b, "\\date{导出时间：%s}\n", doc.ExportedAt.Format(timeLayout))
+	b.WriteString("\\begin{document}\n\\maketitle\n\n")
+	for _, entry := range doc.Entries {
+		fmt.Fprintf(&b, "\\subsection*{%s \\textmd{\\small %s}}\n\n", escapeLaTeX(entry.Speaker), entry.CreatedAt.Format(timeLayout))
+		b.WriteString(markdownToLaTeX(entry.Content))
+		for _, note := range entry.Footnotes {
+			fmt.Fprintf(&b, "\\footnote{%s}", escapeLaTeX(note))
+		}
+		b.WriteString("\n\n")
+	}
+	b.WriteString("\\end{document}\n")
+	return b.Bytes()
+}
+
+// markdownToLaTeX 轻量转换一条消息的 Markdown 内容
+func markdownToLaTeX(content string) string {
+	var kept []string
+	keep := func(s string) string {
+		kept = append(kept, s)
+		return fmt.Sprintf("\x00%d\x00", len(kept)-1)
+	}
+
+	text := strings.ReplaceAll(content, "\r\n", "\n")
+	text = codeFencePattern.ReplaceAllStringFunc(text, func(m string) string {
+		code := codeFencePattern.FindStringSubmatch(m)[1]
+		return "\n" + keep("\\begin{verbatim}\n"+strings.TrimRight(code, "\n")+"\n\\end{verbatim}") + "\n"
+	})
+	text = displayMathPattern.ReplaceAllStringFunc(text, func(m string) string {
+		sub := displayMathPattern.FindStringSubmatch(m)
+		body := sub[1]
+		if body == "" {
+			body = sub[2]
+		}
+		return keep("\\[" + body + "\\]")
+	})
+	text = inlineMathPattern.ReplaceAllStringFunc(text, func(m string) string {
+		return keep(m)
+	})
+	text = inlineCodePattern.ReplaceAllStringFunc(text, func(m string) string {
+		return keep("\\texttt{" + escapeLaTeX(inlineCodePattern.FindStringSubmatch(m)[1]) + "}")
+	})
+
+	var out []string
+	inList := false
+	for _, line := range strings.Split(text, "\n") {
+		if item := listItemPattern.FindStringSubmatch(line); item != nil {
+			if !inList {
+				out = append(out, "\\begin{itemize}")
+				inList = true
+			}
+			out = append(out, "\\item "+inlineLaTeX(item[1]))
+			continue
+		}
+		if inList {
+			out = append(out, "\\end{itemize}")
+			inList = false
+		}
+		if heading := headingPattern.FindStringSubmatch(line); heading != nil {
+			command := "paragraph"
+			if len(heading[1]) <= 2 {
+				command = "subsubsection"
+			}
+			out = append(out, fmt.Sprintf("\\%s*{%s}", command, inlineLaTeX(heading[2])))
+			continue
+		}
+		line = strings.TrimPrefix(line, "> ")
+		out = append(out, inlineLaTeX(line))
+	}
+	if inList {
+		out = append(out, "\\end{itemize}")
+	}
+
+	result := strings.Join(out, "\n")
+	// 后提取的片段可能包住先前的占位符，循环替换直到全部展开
+	for placeholderPattern.MatchString(result) {
+		result = placeholderPattern.ReplaceAllStringFunc(result, func(m string) string {
+			var idx int
+			fmt.Sscanf(placeholderPattern.FindStringSubmatch(m)[1], "%d", &idx)
+			if idx < 0 || idx >= len(kept) {
+				return ""
+			}
+			return kept[idx]
+		})
+	}
+	return result
+}
+
+// inlineLaTeX 转义一行文字并处理粗体；占位符中的 \x00 与数字不受转义影响
+func inlineLaTeX(s string) string {
+	return boldPattern.ReplaceAllString(escapeLaTeX(s), `\textbf{$1}`)
+}
@@ -0,0 +1,32 @@
+// web_service/export/markdown.go
+package export
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// Markdown 消息内容本身就是 Markdown（公式用 $...$ / $$...$$），原样写出；引用写成脚注。
+func Markdown(doc Document) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "# %s\n\n", doc.Title)
+	fmt.Fprintf(&b, "> 导出时间：%s · 共 %d 条消息\n\n", doc.ExportedAt.Format(timeLayout), len(doc.Entries))
+	for i, entry := range doc.Entries {
+		fmt.Fprintf(&b, "## %s · %s\n\n", entry.Speaker, entry.CreatedAt.Format(timeLayout))
+		b.WriteString(strings.TrimRight(entry.Content, "\n"))
+		b.WriteString("\n")
+		if len(entry.Footnotes) > 0 {
+			refs := make([]string, len(entry.Footnotes))
+			for j := range entry.Footnotes {
+				refs[j] = fmt.Sprintf("[^%d-%d]", i+1, j+1)
+			}
+			fmt.Fprintf(&b, "\n参考：%s\n\n", strings.Join(refs, " "))
+			for j, note := range entry.Footnotes {
+				fmt.Fprintf(&b, "[^%d-%d]: %s\n", i+1, j+1, note)
+			}
+		}
+		b.WriteString("\n")
+	}
+	return b.Bytes()
+}
@@ -0,0 +1,263 @@
+// web_service/export/mathtext.go
+package export
+
+import (
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// PDF 只有内置字体、不排版公式，这里把常见 LaTeX 转成可读的纯文本：\frac{a}{b} → a/b、\sqrt{x} → √x、
+// 希腊字母与常用运算符换成对应字符、矩阵写成 [a, b; c, d]。只用 GB2312 里有的字符，其余退化为 ASCII 或命令名。
+var mathSegment = regexp.MustCompile(`(?s)\$\$(.+?)\$\$|\\\[(.+?)\\\]|\\\((.+?)\\\)|\$([^$\n]+?)\$`)
+
+var mathSymbols = map[string]string{
+	"alpha": "α", "beta": "β", "gamma": "γ", "delta": "δ", "epsilon": "ε", "varepsilon": "ε", "zeta": "ζ",
+	"eta": "η", "theta": "θ", "vartheta": "θ", "iota": "ι", "kappa": "κ", "lambda": "λ", "mu": "μ", "nu": "ν",
+	"xi": "ξ", "pi": "π", "rho": "ρ", "sigma": "σ", "tau": "τ", "upsilon": "υ", "phi": "φ", "varphi": "φ",
+	"chi": "χ", "psi": "ψ", "omega": "ω", "Gamma": "Γ", "Delta": "Δ", "Theta": "Θ", "Lambda": "Λ", "Xi": "Ξ",
+	"Pi": "Π", "Sigma": "Σ", "Phi": "Φ", "Psi": "Ψ", "Omega": "Ω",
+
+	"cdot": "·", "times": "×", "div": "÷", "pm": "±", "leq": "≤", "le": "≤", "geq": "≥", "ge": "≥",
+	"neq": "≠", "ne": "≠", "approx": "≈", "equiv": "≡", "sim": "~", "propto": "∝", "infty": "∞",
+	"sum": "∑", "prod": "∏", "int": "∫", "oint": "∮", "in": "∈", "cup": "∪", "cap": "∩", "perp": "⊥",
+	"parallel": "∥", "angle": "∠", "land": "∧", "wedge": "∧", "lor": "∨", "vee": "∨", "because": "∵",
+	"therefore": "∴", "to": "→", "rightarrow": "→", "longrightarrow": "→", "leftarrow": "←", "uparrow": "↑",
+	"downarrow": "↓", "Rightarrow": "=>", "implies": "=>", "Leftrightarrow": "<=>", "iff": "<=>", "mapsto": "|->",
+	"ldots": "…", "cdots": "…", "dots": "…", "vdots": "…", "ddots": "…", "langle": "〈", "rangle": "〉",
+	"mid": "|", "vert": "|", "lvert": "|", "rvert": "|", "Vert": "‖", "lVert": "‖", "rVert": "‖",
+	"top": "T", "intercal": "T", "prime": "'", "circ": "°", "forall": "任意", "exists": "存在",
+	"quad": "  ", "qquad": "    ", "lfloor": "⌊", "rfloor": "⌋", "lceil": "⌈", "rceil": "⌉",
+}
+
+// 只取参数内容的命令（字体、修饰）
+var mathArgOnly = map[string]bool{
+	"text": true, "textrm": true, "textbf": true, "mathrm": true, "mathbf": true, "mathit": true, "mathsf": true,
+	"mathbb": true, "mathcal": true, "boldsymbol": true, "bm": true, "operatorname": true, "vec": true,
+	"bar": true, "hat": true, "tilde": true, "overline": true, "underline": true, "widehat": true, "dot": true,
+}
+
+// 直接忽略的命令（定界符尺寸、间距、样式）
+var mathIgnored = map[string]bool{
+	"left": true, "right": true, "big": true, "Big": true, "bigg": true, "Bigg": true, "bigl": true, "bigr": true,
+	"Bigl": true, "Bigr": true, "displaystyle": true, "textstyle": true, "limits": true, "nolimits": true,
+}
+
+var matrixBrackets = map[string][2]string{
+	"matrix": {"[", "]"}, "pmatrix": {"(", ")"}, "bmatrix": {"[", "]"}, "Bmatrix": {"{", "}"},
+	"vmatrix": {"|", "|"}, "Vmatrix": {"‖", "‖"}, "array": {"[", "]"}, "smallmatrix": {"[", "]"},
+}
+
+// plainMath 把一段正文中 $…$、$$…$$、\(…\)、\[…\] 里的公式转换为纯文本
+func plainMath(s string) string {
+	return mathSegment.ReplaceAllStringFunc(s, func(m string) string {
+		for _, group := range mathSegment.FindStringSubmatch(m)[1:] {
+			if group != "" {
+				return mathToText(group)
+			}
+		}
+		return m
+	})
+}
+
+// mathToText 转换一段公式源码
+func mathToText(src string) string {
+	p := &mathParser{src: []rune(src), cellSep: " "}
+	return strings.Join(strings.Fields(p.until(0)), " ")
+}
+
+type mathParser struct {
+	src     []rune
+	pos     int
+	cellSep string // & 的替换：矩阵里是逗号，对齐环境里是空格
+}
+
+// until 转换到遇见 stop（0 表示到结尾）为止，不消费 stop
+func (p *mathParser) until(stop rune) string {
+	var b strings.Builder
+	for p.pos < len(p.src) {
+		r := p.src[p.pos]
+		if r == stop {
+			break
+		}
+		p.pos++
+		switch r {
+		case '\\':
+			b.WriteString(p.command())
+		case '{':
+			b.WriteString(p.group())
+		case '}':
+		case '^', '_':
+			arg := p.arg()
+			if arg == "'" {
+				b.WriteString(arg)
+				continue
+			}
+			b.WriteRune(r)
+			b.WriteString(wrapMath(arg))
+		case '&':
+			b.WriteString(p.cellSep)
+		case '~':
+			b.WriteRune(' ')
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// group 读取 { 之后到配对 } 的内容（{ 已消费）
+func (p *mathParser) group() string {
+	text := p.until('}')
+	if p.pos < len(p.src) {
+		p.pos++
+	}
+	return text
+}
+
+// arg 读取一个参数：花括号分组、一条命令或单个字符
+func (p *mathParser) arg() string {
+	for p.pos < len(p.src) && unicode.IsSpace(p.src[p.pos]) {
+		p.pos++
+	}
+	if p.pos >= len(p.src) {
+		return ""
+	}
+	r := p.src[p.pos]
+	p.pos++
+	switch r {
+	case '{':
+		return p.group()
+	case '\\':
+		return p.command()
+	}
+	return string(r)
+}
+
+// optional 读取可选参数 [...]，没有时返回空串
+func (p *mathParser) optional() string {
+	if p.pos >= len(p.src) || p.src[p.pos] != '[' {
+		return ""
+	}
+	p.pos++
+	text := p.until(']')
+	if p.pos < len(p.src) {
+		p.pos++
+	}
+	return text
+}
+
+// command 转换 \ 之后的一条命令（\ 已消费）
+func (p *mathParser) command() string {
+	if p.pos >= len(p.src) {
+		return ""
+	}
+	start := p.pos
+	for p.pos < len(p.src) && unicode.IsLetter(p.src[p.pos]) && p.src[p.pos] < unicode.MaxASCII {
+		p.pos++
+	}
+	if p.pos == start {
+		r := p.src[p.pos]
+		p.pos++
+		switch r {
+		case '\\':
+			return "; "
+		case ',', ':', ';', ' ':
+			return " "
+		case '!':
+			return ""
+		case '|':
+			return "‖"
+		}
+		return string(r)
+	}
+	name := string(p.src[start:p.pos])
+	switch {
+	case name == "frac" || name == "dfrac" || name == "tfrac":
+		num, den := p.arg(), p.arg()
+		return wrapMath(num) + "/" + wrapMath(den)
+	case name == "sqrt":
+		index := p.optional()
+		return index + "√" + wrapMath(p.arg())
+	case name == "begin":
+		return p.environment(p.arg())
+	case name == "end":
+		p.arg()
+		return ""
+	case mathArgOnly[name]:
+		return p.arg()
+	case mathIgnored[name]:
+		// \left. \right. 的点号只占位
+		if p.pos < len(p.src) && p.src[p.pos] == '.' {
+			p.pos++
+		}
+		return ""
+	}
+	if symbol, ok := mathSymbols[name]; ok {
+		return symbol
+	}
+	return name
+}
+
+// environment 矩阵写成 [a, b; c, d]，cases / aligned 等按行以分号连接
+func (p *mathParser) environment(name string) string {
+	closing := []rune(`\end{` + name + `}`)
+	end := len(p.src)
+	for i := p.pos; i+len(closing) <= len(p.src); i++ {
+		if string(p.src[i:i+len(closing)]) == string(closing) {
+			end = i
+			break
+		}
+	}
+	body := p.src[p.pos:end]
+	p.pos = end + len(closing)
+	if p.pos > len(p.src) {
+		p.pos = len(p.src)
+	}
+	if name == "array" && len(body) > 0 && body[0] == '{' {
+		// 跳过列格式 {cc|c}
+		for i, r := range body {
+			if r == '}' {
+				body = body[i+1:]
+				break
+			}
+		}
+	}
+	brackets, isMatrix := matrixBrackets[name]
+	sub := &mathParser{src: body, cellSep: " "}
+	if isMatrix {
+		sub.cellSep = ", "
+	}
+	inner := sub.until(0)
+	var rows []string
+	for _, row := range strings.Split(inner, ";") {
+		if row = strings.Join(strings.Fields(row), " "); row != "" {
+			rows = append(rows, strings.Trim(row, ", "))
+		}
+	}
+	text := strings.Join(rows, "; ")
+	if isMatrix {
+		return brackets[0] + text + brackets[1]
+	}
+	if name == "cases" {
+		return "{ " + text + " }"
+	}
+	return text
+}
+
+// wrapMath 多字符的分子、分母、上下标加括号，避免 a+b/c 之类的歧义
+func wrapMath(s string) string {
+	s = strings.TrimSpace(s)
+	if len([]rune(s)) <= 1 {
+		return s
+	}
+	for _, r := range s {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+			if strings.HasPrefix(s, "(") && strings.HasSuffix(s, ")") || strings.HasPrefix(s, "[") && strings.HasSuffix(s, "]") {
+				return s
+			}
+			return "(" + s + ")"
+		}
+	}
+	return s
+}
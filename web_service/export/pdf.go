@@ -0,0 +1,225 @@
+// web_service/export/pdf.go
+package export
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"strings"
+	"unicode/utf16"
+)
+
+// 最小 PDF 写出器：只用阅读器内置的 Adobe-GB1 字体 STSong-Light（UniGB-UCS2-H 编码），不嵌入字体，
+// 因此无需外部依赖即可在服务内生成中英文 PDF。这只是纯文本近似：公式转换为近似文字（见 mathtext.go），
+// 非 Adobe 阅读器可能缺少该字体；开头写明 PDFNotice，接口响应头 X-Export-Fidelity 同样标明。
+const (
+	pdfPageWidth  = 595.28 // A4
+	pdfPageHeight = 841.89
+	pdfMargin     = 56.0
+	pdfBodySize   = 10.5
+	pdfBodyLead   = 16.0
+)
+
+type pdfWriter struct {
+	pages [][]byte
+	cur   bytes.Buffer
+	y     float64
+}
+
+func (w *pdfWriter) flushPage() {
+	if w.cur.Len() == 0 && len(w.pages) > 0 {
+		return
+	}
+	number := fmt.Sprintf("- %d -", len(w.pages)+1)
+	w.textAt((pdfPageWidth-textWidth(number, 9))/2, pdfMargin/2, 9, 0.5, number)
+	w.pages = append(w.pages, append([]byte(nil), w.cur.Bytes()...))
+	w.cur.Reset()
+}
+
+func (w *pdfWriter) newPage() {
+	if w.cur.Len() > 0 {
+		w.flushPage()
+	}
+	w.y = pdfPageHeight - pdfMargin
+}
+
+// ensure 剩余高度不足时换页
+func (w *pdfWriter) ensure(height float64) {
+	if w.y-height < pdfMargin {
+		w.newPage()
+	}
+}
+
+func (w *pdfWriter) textAt(x, y, size, gray float64, s string) {
+	fmt.Fprintf(&w.cur, "BT /F1 %.2f Tf %.2f g %.2f %.2f Td <%s> Tj ET\n", size, gray, x, y, encodeUCS2(s))
+}
+
+// paragraph 按宽度折行写出一段文字，跨页自动换页
+func (w *pdfWriter) paragraph(s string, size, leading, indent, gray float64) {
+	width := pdfPageWidth - 2*pdfMargin - indent
+	for _, raw := range strings.Split(s, "\n") {
+		lines := wrapLine(raw, size, width)
+		if len(lines) == 0 {
+			lines = []string{""}
+		}
+		for _, line := range lines {
+			w.ensure(leading)
+			w.y -= leading
+			if line != "" {
+				w.textAt(pdfMargin+indent, w.y, size, gray, line)
+			}
+		}
+	}
+}
+
+func (w *pdfWriter) space(h float64) {
+	w.y -= h
+}
+
+// runeWidth STSong-Light 中 ASCII 按半角（W 数组设为 500），其余全角
+func runeWidth(r rune, size float64) float64 {
+	if r >= 0x20 && r <= 0x7e {
+		return size * 0.5
+	}
+	return size
+}
+
+func textWidth(s string, size float64) float64 {
+	total := 0.0
+	for _, r := range s {
+		total += runeWidth(r, size)
+	}
+	return total
+}
+
+// wrapLine 折行：英文单词尽量不拆开，中文可在任意字间断行
+func wrapLine(s string, size, width float64) []string {
+	s = strings.ReplaceAll(s, "\t", "    ")
+	runes := []rune(s)
+	var lines []string
+	start, lastBreak := 0, -1
+	lineWidth := 0.0
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		w := runeWidth(r, size)
+		if lineWidth+w > width && i > start {
+			cut := i
+			if lastBreak > start {
+				cut = lastBreak
+			}
+			lines = append(lines, strings.TrimRight(string(runes[start:cut]), " "))
+			start = cut
+			for start < len(runes) && runes[start] == ' ' {
+				start++
+			}
+			lastBreak = -1
+			lineWidth = 0
+			for j := start; j < i; j++ {
+				lineWidth += runeWidth(runes[j], size)
+			}
+		}
+		lineWidth += w
+		if r == ' ' || r > 0x7e {
+			lastBreak = i + 1
+		}
+	}
+	if start < len(runes) {
+		lines = append(lines, string(runes[start:]))
+	}
+	return lines
+}
+
+// encodeUCS2 UniGB-UCS2-H 使用 UCS-2 大端编码；BMP 以外或控制字符替换为 ?
+func encodeUCS2(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if r > 0xFFFF || r < 0x20 {
+			r = '?'
+		}
+		fmt.Fprintf(&b, "%04X", r)
+	}
+	return b.String()
+}
+
+// pdfTextString 文档信息中的字符串：UTF-16BE 带 BOM
+func pdfTextString(s string) string {
+	var b strings.Builder
+	b.WriteString("FEFF")
+	for _, u := range utf16.Encode([]rune(s)) {
+		fmt.Fprintf(&b, "%04X", u)
+	}
+	return "<" + b.String() + ">"
+}
+
+// PDF 渲染会话笔记：标题、每条消息（发言人/时间 + 正文）及其教材出处脚注
+func PDF(doc Document) ([]byte, error) {
+	w := &pdfWriter{}
+	w.newPage()
+	w.paragraph(doc.Title, 18, 26, 0, 0)
+	w.paragraph(fmt.Sprintf("导出时间：%s · 共 %d 条消息", doc.ExportedAt.Format(timeLayout), len(doc.Entries)), 9, 14, 0, 0.45)
+	w.paragraph(PDFNotice, 8.5, 13, 0, 0.45)
+	w.space(10)
+	for _, entry := range doc.Entries {
+		w.ensure(pdfBodyLead * 3)
+		w.space(6)
+		w.paragraph(fmt.Sprintf("%s · %s", entry.Speaker, entry.CreatedAt.Format(timeLayout)), 11.5, 18, 0, 0.25)
+		w.paragraph(plainMath(strings.TrimRight(entry.Content, "\n")), pdfBodySize, pdfBodyLead, 8, 0)
+		if len(entry.Footnotes) > 0 {
+			w.space(4)
+			for i, note := range entry.Footnotes {
+				w.paragraph(fmt.Sprintf("[%d] %s", i+1, plainMath(note)), 8.5, 13, 8, 0.4)
+			}
+		}
+		w.space(8)
+	}
+	w.flushPage()
+	return w.bytes(doc.Title)
+}
+
+// bytes 组装 PDF 文件：目录、页树、字体、信息字典、每页（页对象 + 压缩的内容流）、xref
+func (w *pdfWriter) bytes(title string) ([]byte, error) {
+	var out bytes.Buffer
+	var offsets []int
+	obj := func(body string) {
+		offsets = append(offsets, out.Len())
+		fmt.Fprintf(&out, "%d 0 obj\n%s\nendobj\n", len(offsets), body)
+	}
+
+	out.WriteString("%PDF-1.4\n%\xE2\xE3\xCF\xD3\n")
+	const firstPageObj = 7
+	kids := make([]string, len(w.pages))
+	for i := range w.pages {
+		kids[i] = fmt.Sprintf("%d 0 R", firstPageObj+2*i)
+	}
+	obj("<< /Type /Catalog /Pages 2 0 R >>")
+	obj(fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(w.pages)))
+	obj("<< /Type /Font /Subtype /Type0 /BaseFont /STSong-Light /Encoding /UniGB-UCS2-H /DescendantFonts [4 0 R] >>")
+	obj("<< /Type /Font /Subtype /CIDFontType0 /BaseFont /STSong-Light " +
+		"/CIDSystemInfo << /Registry (Adobe) /Ordering (GB1) /Supplement 2 >> " +
+		"/FontDescriptor 5 0 R /DW 1000 /W [1 95 500] >>")
+	obj("<< /Type /FontDescriptor /FontName /STSong-Light /Flags 6 /FontBBox [-25 -254 1000 880] " +
+		"/ItalicAngle 0 /Ascent 880 /Descent -120 /CapHeight 880 /StemV 93 >>")
+	obj(fmt.Sprintf("<< /Title %s /Producer (web_service export) >>", pdfTextString(title)))
+
+	for i, content := range w.pages {
+		obj(fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %.2f %.2f] "+
+			"/Resources << /Font << /F1 3 0 R >> >> /Contents %d 0 R >>", pdfPageWidth, pdfPageHeight, firstPageObj+2*i+1))
+		var compressed bytes.Buffer
+		zw := zlib.NewWriter(&compressed)
+		if _, err := zw.Write(content); err != nil {
+			return nil, err
+		}
+		if err := zw.Close(); err != nil {
+			return nil, err
+		}
+		obj(fmt.Sprintf("<< /Length %d /Filter /FlateDecode >>\nstream\n%s\nendstream", compressed.Len(), compressed.String()))
+	}
+
+	xref := out.Len()
+	fmt.Fprintf(&out, "xref\n0 %d\n0000000000 65535 f \n", len(offsets)+1)
+	for _, off := range offsets {
+		fmt.Fprintf(&out, "%010d 00000 n \n", off)
+	}
+	fmt.Fprintf(&out, "trailer\n<< /Size %d /Root 1 0 R /Info 6 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(offsets)+1, xref)
+	return out.Bytes(), nil
+}
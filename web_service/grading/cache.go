@@ -0,0 +1,96 @@
+// web_service/grading/cache.go
+
+package grading
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// GradeCacheEntry 相同 题目+解答 的批改结果缓存；有效期由 GRADE_CACHE_TTL_MINUTES 控制。
+type GradeCacheEntry struct {
+	ID         uint      `gorm:"primarykey"`
+	CacheKey   string    `gorm:"size:64;not null;uniqueIndex"`
+	Correction string    `gorm:"type:text"`
+	Model      string    `gorm:"size:100"`
+	Structured string    `gorm:"type:text"` // 结构化批改 JSON，纯文本批改为空
+	CreatedAt  time.Time `gorm:"index"`
+}
+
+// structured 还原缓存的结构化批改；旧条目或校验不通过时为 nil
+func (e GradeCacheEntry) structured() *StructuredGrade {
+	if e.Structured == "" {
+		return nil
+	}
+	grade, err := parseStructuredGrade(json.RawMessage(e.Structured))
+	if err != nil {
+		return nil
+	}
+	return grade
+}
+
+// gradeCacheTTL 默认 24 小时；设为 0 关闭批改缓存
+func gradeCacheTTL() time.Duration {
+	raw := strings.TrimSpace(os.Getenv("GRADE_CACHE_TTL_MINUTES"))
+	if raw == "" {
+		return 24 * time.Hour
+	}
+	minutes, err := strconv.Atoi(raw)
+	if err != nil || minutes <= 0 {
+		return 0
+	}
+	return time.Duration(minutes) * time.Minute
+}
+
+// gradeCacheKey 对题目与解答做规范化（去首尾空白、统一换行）后取 sha256
+func gradeCacheKey(problemText, solutionText string) string {
+	normalize := func(s string) string {
+		return strings.TrimSpace(strings.ReplaceAll(s, "\r\n", "\n"))
+	}
+	sum := sha256.Sum256([]byte(normalize(problemText) + "\x00" + normalize(solutionText)))
+	return hex.EncodeToString(sum[:])
+}
+
+// lookupGradeCache 返回 TTL 内的缓存批改；未命中或缓存关闭时 ok=false
+func lookupGradeCache(db *gorm.DB, problemText, solutionText string) (entry GradeCacheEntry, ok bool) {
+	ttl := gradeCacheTTL()
+	if ttl <= 0 {
+		return entry, false
+	}
+	err := db.Where("cache_key = ? AND created_at > ?", gradeCacheKey(problemText, solutionText), time.Now().Add(-ttl)).
+		Limit(1).Find(&entry).Error
+	return entry, err == nil && entry.ID != 0
+}
+
+// storeGradeCache 写入/刷新缓存（过期条目直接覆盖）
+func storeGradeCache(db *gorm.DB, problemText, solutionText, correction, model string, structured *StructuredGrade) {
+	if gradeCacheTTL() <= 0 || strings.TrimSpace(correction) == "" {
+		return
+	}
+	entry := GradeCacheEntry{
+		CacheKey:   gradeCacheKey(problemText, solutionText),
+		Correction: correction,
+		Model:      model,
+		CreatedAt:  time.Now(),
+	}
+	if structured != nil {
+		if b, err := json.Marshal(structured); err == nil {
+			entry.Structured = string(b)
+		}
+	}
+	if err := db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "cache_key"}},
+		DoUpdates: clause.AssignmentColumns([]string{"correction", "model", "structured", "created_at"}),
+	}).Create(&entry).Error; err != nil {
+		log.Printf("Failed to cache grade result: %v", err)
+	}
+}
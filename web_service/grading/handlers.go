@@ -4,13 +4,14 @@ package grading
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"mime/multipart"
 	"net/http"
-	"net/textproto"
 	"os"
 	"path/filepath"
 	"strconv"
@@ -21,71 +22,53 @@ import (
 	"workplace/web_service/assignment"
 	"workplace/web_service/auth"
 	"workplace/web_service/chat"
+	"workplace/web_service/jobs"
+	"workplace/web_service/ocr"
+	"workplace/web_service/quota"
 
 	"github.com/gin-gonic/gin"
 	"gorm.io/gorm"
 )
 
 type GradingHandler struct {
-	DB *gorm.DB
+	DB   *gorm.DB
+	Jobs *jobs.Queue
 }
 
 type AIGradeResponse struct {
-	Correction string `json:"correction"`
-	Error      string `json:"error,omitempty"`
+	Correction    string          `json:"correction"`
+	Model         string          `json:"model,omitempty"`
+	Structured    json.RawMessage `json:"structured,omitempty"` // grading.v1 结构化结果，模型输出不合规时为 null
+	SchemaVersion string          `json:"schema_version,omitempty"`
+	Error         string          `json:"error,omitempty"`
 }
 
-func extractAssignmentFileText(path string, name string) (string, error) {
-	src, err := os.Open(path)
+// postAIForm 以 multipart 表单调用 ai_service，返回状态码与响应体；ctx 取消时请求随之中断。
+func postAIForm(ctx context.Context, path string, body *bytes.Buffer, contentType string, timeout time.Duration) (int, []byte, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", aiclient.URL(path), body)
 	if err != nil {
-		return "", err
+		return 0, nil, err
 	}
-	defer src.Close()
-
-	body := &bytes.Buffer{}
-	writer := multipart.NewWriter(body)
-	part, err := writer.CreateFormFile("file", filepath.Base(name))
-	if err != nil {
-		return "", err
-	}
-	if _, err := io.Copy(part, src); err != nil {
-		return "", err
-	}
-	writer.Close()
-
-	req, err := http.NewRequest("POST", aiclient.URL("/api/v1/ocr"), body)
-	if err != nil {
-		return "", err
-	}
-	req.Header.Set("Content-Type", writer.FormDataContentType())
-	client := &http.Client{Timeout: 180 * time.Second}
+	req.Header.Set("Content-Type", contentType)
+	client := &http.Client{Timeout: timeout}
 	resp, err := client.Do(req)
 	if err != nil {
-		return "", err
+		return 0, nil, err
 	}
 	defer resp.Body.Close()
-	responseBody, _ := io.ReadAll(resp.Body)
-	if resp.StatusCode >= http.StatusBadRequest {
-		return "", fmt.Errorf("题目附件识别失败: %s", string(responseBody))
-	}
-	var result struct {
-		Text string `json:"text"`
-	}
-	if err := json.Unmarshal(responseBody, &result); err != nil {
-		return "", err
-	}
-	return strings.TrimSpace(result.Text), nil
+	responseBody, err := io.ReadAll(resp.Body)
+	return resp.StatusCode, responseBody, err
 }
 
-func (h *GradingHandler) resolveAssignmentProblem(c *gin.Context, assignmentID uint) (string, error) {
-	user, ok, err := accesscontrol.CurrentUser(h.DB, c)
-	if err != nil || !ok || user.Role != "student" {
-		return "", fmt.Errorf("只有学生可以使用已有作业进行自主批改")
+func (h *GradingHandler) resolveAssignmentProblem(ctx context.Context, userID uint, assignmentID uint) (string, error) {
+	var user auth.User
+	if err := h.DB.First(&user, userID).Error; err != nil || user.Role != "student" {
+		return "", jobs.NewStatusError(http.StatusForbidden, "只有学生可以使用已有作业进行自主批改")
 	}
 
 	var item assignment.Assignment
 	if err := h.DB.First(&item, assignmentID).Error; err != nil {
-		return "", fmt.Errorf("作业不存在")
+		return "", jobs.NewStatusError(http.StatusForbidden, "作业不存在")
 	}
 	allowed := false
 	if user.ClassID != nil {
@@ -99,7 +82,7 @@ func (h *GradingHandler) resolveAssignmentProblem(c *gin.Context, assignmentID u
 		}
 	}
 	if !allowed {
-		return "", fmt.Errorf("无权使用该作业")
+		return "", jobs.NewStatusError(http.StatusForbidden, "无权使用该作业")
 	}
 
 	parts := []string{}
@@ -126,9 +109,17 @@ func (h *GradingHandler) resolveAssignmentProblem(c *gin.Context, assignmentID u
 	}
 
 	if item.ProblemFilePath != "" {
-		fileText, fileErr := extractAssignmentFileText(item.ProblemFilePath, item.ProblemFileName)
-		if fileErr != nil && len(parts) == 0 {
-			return "", fileErr
+		// 附件文字在发布作业时已识别并存档（老师可修订）；旧作业或识别失败时现场识别（走 OCR 缓存）并回填
+		fileText := strings.TrimSpace(item.ProblemFileText)
+		if fileText == "" {
+			var fileErr error
+			fileText, fileErr = ocr.RecognizeFile(ctx, h.DB, item.ProblemFilePath, item.ProblemFileName, false, 180*time.Second)
+			if fileErr != nil && len(parts) == 0 {
+				return "", fileErr
+			}
+			if fileText != "" {
+				assignment.StoreProblemFileText(h.DB, item.ID, fileText)
+			}
 		}
 		if fileText != "" {
 			parts = append(parts, "### 教师附件题目\n"+fileText)
@@ -137,117 +128,256 @@ func (h *GradingHandler) resolveAssignmentProblem(c *gin.Context, assignmentID u
 
 	problemText := strings.TrimSpace(strings.Join(parts, "\n\n"))
 	if problemText == "" {
-		return "", fmt.Errorf("该作业没有可用于批改的题目内容")
+		return "", jobs.NewStatusError(http.StatusForbidden, "该作业没有可用于批改的题目内容")
 	}
 	return problemText, nil
 }
 
-// GradeHomeworkHandler 调用 AI 获取批改结果；可选 assignmentId 使用老师发布的题目作为可信来源。
-func (h *GradingHandler) GradeHomeworkHandler(c *gin.Context) {
-	problemText := c.PostForm("problemText")
-	solutionText := c.PostForm("solutionText")
-	assignmentIDRaw := strings.TrimSpace(c.PostForm("assignmentId"))
-	var assignmentID uint
-	if assignmentIDRaw != "" {
-		parsedID, err := strconv.Atoi(assignmentIDRaw)
-		if err != nil || parsedID <= 0 {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "作业 ID 不合法"})
-			return
-		}
-		assignmentID = uint(parsedID)
-		resolvedProblem, err := h.resolveAssignmentProblem(c, assignmentID)
+// gradeRequest 一次 AI 批改的入参，同时作为 grading 任务的 payload
+type gradeRequest struct {
+	ProblemText   string `json:"problemText"`
+	SolutionText  string `json:"solutionText"`
+	AssignmentID  uint   `json:"assignmentId,omitempty"`
+	Filename      string `json:"filename,omitempty"`
+	OCRDocumentID uint   `json:"ocrDocumentId,omitempty"` // 解答来自学生校对过的识别文档
+}
+
+// resolveGradeProblem 确定批改所用题目：带 assignmentId 时以老师发布的题目为准。
+func (h *GradingHandler) resolveGradeProblem(ctx context.Context, userID uint, req gradeRequest) (string, error) {
+	problemText := req.ProblemText
+	if req.AssignmentID != 0 {
+		resolvedProblem, err := h.resolveAssignmentProblem(ctx, userID, req.AssignmentID)
 		if err != nil {
-			c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
-			return
+			return "", err
 		}
 		problemText = resolvedProblem
 	}
+	if req.SolutionText == "" || problemText == "" {
+		return "", jobs.NewStatusError(http.StatusBadRequest, "Problem and solution text are required")
+	}
+	return problemText, nil
+}
 
-	if solutionText == "" || problemText == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Problem and solution text are required"})
-		return
+// saveGradeResult 每次批改都落库，学生可在批改历史中回看，老师可统计自主批改使用情况
+func (h *GradingHandler) saveGradeResult(userID uint, req gradeRequest, problemText, correction, model string, structured *StructuredGrade, partial bool) GradeResult {
+	result := GradeResult{
+		UserID:     userID,
+		Filename:   req.Filename,
+		Problem:    problemText,
+		Content:    req.SolutionText,
+		Correction: correction,
+		Model:      model,
+		Partial:    partial,
+		CreatedAt:  time.Now(),
+	}
+	if req.AssignmentID != 0 {
+		assignmentID := req.AssignmentID
+		result.AssignmentID = &assignmentID
+	}
+	if req.OCRDocumentID != 0 {
+		documentID := req.OCRDocumentID
+		result.OCRDocumentID = &documentID
+	}
+	if structured != nil {
+		if b, err := json.Marshal(structured); err == nil {
+			result.Structured = string(b)
+			result.SchemaVersion = structured.SchemaVersion
+			result.Score = structured.score()
+		}
+		if b, err := json.Marshal(structured.allConceptTags()); err == nil {
+			result.ConceptTags = string(b)
+		}
+	}
+	if err := h.DB.Create(&result).Error; err != nil {
+		log.Printf("Failed to save grade result: %v", err)
+	}
+	return result
+}
+
+// gradeResponse 将所有需要的信息直接返回给前端，用于开启后续的答疑会话
+func gradeResponse(result GradeResult, req gradeRequest) gin.H {
+	return gin.H{
+		"problemText":   result.Problem,
+		"solutionText":  result.Content,
+		"correction":    result.Correction,
+		"assignmentId":  req.AssignmentID,
+		"gradeResultId": result.ID,
+		"model":         result.Model,
+		"score":         result.Score,
+		"structured":    json.RawMessage(nullIfEmpty(result.Structured)),
+		"schemaVersion": result.SchemaVersion,
+	}
+}
+
+// gradeHomework 批改核心逻辑：解析作业题目 → 调 AI 批改 → 落库，返回给前端的结果。
+func (h *GradingHandler) gradeHomework(ctx context.Context, userID uint, req gradeRequest) (gin.H, error) {
+	problemText, err := h.resolveGradeProblem(ctx, userID, req)
+	if err != nil {
+		return nil, err
 	}
 
-	// 调用AI服务进行批改
-	targetURL := aiclient.URL("/api/v1/grade")
+	// 相同题目+解答在缓存有效期内直接复用，仍记一条批改历史
+	if cached, ok := lookupGradeCache(h.DB, problemText, req.SolutionText); ok {
+		result := h.saveGradeResult(userID, req, problemText, cached.Correction, cached.Model, cached.structured(), false)
+		response := gradeResponse(result, req)
+		response["cached"] = true
+		return response, nil
+	}
+
+	aiResp, structured, err := h.requestGrade(ctx, problemText, req.SolutionText)
+	if err != nil {
+		return nil, err
+	}
+	result := h.saveGradeResult(userID, req, problemText, aiResp.Correction, aiResp.Model, structured, false)
+	return gradeResponse(result, req), nil
+}
+
+// requestGrade 调 ai_service 批改一份解答，成功后写入批改缓存（作业批改与测验主观题共用）
+func (h *GradingHandler) requestGrade(ctx context.Context, problemText, solutionText string) (AIGradeResponse, *StructuredGrade, error) {
+	var aiResp AIGradeResponse
 	body := &bytes.Buffer{}
 	writer := multipart.NewWriter(body)
 	_ = writer.WriteField("problem_text", problemText)
 	_ = writer.WriteField("solution_text", solutionText)
 	writer.Close()
 
-	proxyReq, _ := http.NewRequest("POST", targetURL, body)
-	proxyReq.Header.Set("Content-Type", writer.FormDataContentType())
-
-	client := &http.Client{Timeout: time.Second * 180}
-	resp, err := client.Do(proxyReq)
+	status, responseBody, err := postAIForm(ctx, "/api/v1/grade", body, writer.FormDataContentType(), 180*time.Second)
 	if err != nil {
-		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "AI service is unreachable"})
-		return
+		if ctx.Err() != nil {
+			return aiResp, nil, ctx.Err()
+		}
+		return aiResp, nil, jobs.NewStatusError(http.StatusServiceUnavailable, "AI service is unreachable")
 	}
-	defer resp.Body.Close()
-
-	responseBody, _ := io.ReadAll(resp.Body)
 	log.Printf("AI Service Response: %s", string(responseBody))
-	if resp.StatusCode >= http.StatusBadRequest {
-		c.JSON(resp.StatusCode, gin.H{"error": string(responseBody)})
-		return
+	if status >= http.StatusBadRequest {
+		return aiResp, nil, jobs.NewStatusError(status, string(responseBody))
 	}
 
-	var aiResp AIGradeResponse
 	if err := json.Unmarshal(responseBody, &aiResp); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decode AI response"})
-		return
+		return aiResp, nil, jobs.NewStatusError(http.StatusInternalServerError, "Failed to decode AI response")
 	}
 
 	if aiResp.Error != "" {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": aiResp.Error})
-		return
+		return aiResp, nil, jobs.NewStatusError(http.StatusInternalServerError, aiResp.Error)
 	}
 
-	// 将所有需要的信息直接返回给前端，用于开启后续的答疑会话
-	c.JSON(http.StatusOK, gin.H{
-		"problemText":  problemText,
-		"solutionText": solutionText,
-		"correction":   aiResp.Correction,
-		"assignmentId": assignmentID,
-	})
+	structured := structuredFromAI(aiResp.Structured)
+	storeGradeCache(h.DB, problemText, solutionText, aiResp.Correction, aiResp.Model, structured)
+	return aiResp, structured, nil
 }
 
-// StartFollowUpChatHandler (已重构)
-// 接收作业上下文和用户的第一条问题，创建会话，保存所有消息，然后返回会话ID
-func (h *GradingHandler) StartFollowUpChatHandler(c *gin.Context) {
-	userIDRaw, _ := c.Get("userID")
-	userID := uint(userIDRaw.(float64))
-
-	var req struct {
-		ProblemText    string `form:"problemText"`
-		SolutionText   string `form:"solutionText"`
-		CorrectionText string `form:"correctionText"`
-		NewQuestion    string `form:"newQuestion"`
+// parseGradeRequest 解析批改表单；未直接提交解答文本时可用 ocrDocumentId 引用识别文档。出错时已写回 4xx。
+func (h *GradingHandler) parseGradeRequest(c *gin.Context) (gradeRequest, bool) {
+	req := gradeRequest{
+		ProblemText:  c.PostForm("problemText"),
+		SolutionText: c.PostForm("solutionText"),
+		Filename:     strings.TrimSpace(c.PostForm("filename")),
+	}
+	if assignmentIDRaw := strings.TrimSpace(c.PostForm("assignmentId")); assignmentIDRaw != "" {
+		parsedID, err := strconv.Atoi(assignmentIDRaw)
+		if err != nil || parsedID <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "作业 ID 不合法"})
+			return req, false
+		}
+		req.AssignmentID = uint(parsedID)
 	}
+	if documentIDRaw := strings.TrimSpace(c.PostForm("ocrDocumentId")); documentIDRaw != "" {
+		documentID, err := strconv.Atoi(documentIDRaw)
+		if err != nil || documentID <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "识别文档 ID 不合法"})
+			return req, false
+		}
+		req.OCRDocumentID = uint(documentID)
+		// 同时提交了解答文本时也要校验文档归属，否则批改记录会关联到别人的识别文档
+		userID, _ := accesscontrol.CurrentUserID(c)
+		text, err := ocr.LoadDocumentText(h.DB, userID, req.OCRDocumentID)
+		if errors.Is(err, ocr.ErrDocumentNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return req, false
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "读取识别文档失败"})
+			return req, false
+		}
+		if req.SolutionText == "" {
+			req.SolutionText = text
+		}
+	}
+	return req, true
+}
 
-	if err := c.ShouldBind(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request data: " + err.Error()})
+// GradeHomeworkHandler 调用 AI 获取批改结果；可选 assignmentId 使用老师发布的题目作为可信来源。
+// 默认只创建任务并返回 jobId，结果通过 GET /api/jobs/:id 轮询；async=0 时同步等待结果。
+func (h *GradingHandler) GradeHomeworkHandler(c *gin.Context) {
+	userID, _ := accesscontrol.CurrentUserID(c)
+	req, ok := h.parseGradeRequest(c)
+	if !ok {
 		return
 	}
 
-	tx := h.DB.Begin()
+	if jobs.WantsAsync(c) {
+		if req.SolutionText == "" || (req.ProblemText == "" && req.AssignmentID == 0) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Problem and solution text are required"})
+			return
+		}
+		if !quota.Check(h.DB, c, quota.BucketGrading) {
+			return
+		}
+		job, err := h.Jobs.Enqueue(JobTypeGrading, userID, req, 0)
+		if err != nil {
+			quota.Refund(h.DB, userID, quota.BucketGrading)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "创建批改任务失败"})
+			return
+		}
+		jobs.Accepted(c, job)
+		return
+	}
 
-	// 1. 创建新的聊天会话
-	newSession := chat.ChatSession{
-		UserID:    userID,
-		Title:     "作业批改答疑",
-		CreatedAt: time.Now(),
+	if !quota.Check(h.DB, c, quota.BucketGrading) {
+		return
+	}
+	result, err := h.gradeHomework(c.Request.Context(), userID, req)
+	if gradeNotCharged(result, err) {
+		quota.Refund(h.DB, userID, quota.BucketGrading)
 	}
-	if err := tx.Create(&newSession).Error; err != nil {
-		tx.Rollback()
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create chat session"})
+	if err != nil {
+		jobs.RespondError(c, err)
 		return
 	}
+	c.JSON(http.StatusOK, result)
+}
+
+// gradeNotCharged 批改失败或命中缓存（没有实际调用 AI）时，入口处扣的配额应退回
+func gradeNotCharged(result gin.H, err error) bool {
+	return err != nil || result["cached"] == true
+}
+
+// followUpRequest 批改后答疑的入参，同时作为 grading_followup 任务的 payload
+type followUpRequest struct {
+	ProblemText    string `form:"problemText" json:"problemText"`
+	SolutionText   string `form:"solutionText" json:"solutionText"`
+	CorrectionText string `form:"correctionText" json:"correctionText"`
+	NewQuestion    string `form:"newQuestion" json:"newQuestion"`
+	GradeResultID  uint   `form:"gradeResultId" json:"gradeResultId,omitempty"` // 带上时以批改记录为准，会话关联到该记录
+}
+
+// startFollowUpChat 携带批改上下文请 AI 回答第一个问题，并把上下文与问答落成新会话。
+func (h *GradingHandler) startFollowUpChat(ctx context.Context, userID uint, req followUpRequest) (gin.H, error) {
+	var gradeResultID *uint
+	if req.GradeResultID != 0 {
+		var result GradeResult
+		if err := h.DB.Where("id = ? AND user_id = ?", req.GradeResultID, userID).First(&result).Error; err != nil {
+			return nil, jobs.NewStatusError(http.StatusNotFound, "批改记录不存在")
+		}
+		req.ProblemText, req.SolutionText, req.CorrectionText = result.Problem, result.Content, result.Correction
+		gradeResultID = &result.ID
+	}
+	// 题目属于进行中的诚信模式作业时只给提示
+	var user auth.User
+	h.DB.First(&user, userID)
+	hintOnly := assignment.HintOnly(h.DB, user, assignment.IntegritySourceGrading, req.ProblemText+"\n\n"+req.NewQuestion, 0)
 
-	// 2. 将完整的对话历史（包括批改上下文）发送给AI
-	targetURL := aiclient.URL("/api/v1/grading/chat")
+	// 1. 将完整的对话历史（包括批改上下文）发送给AI
 	aiBody := &bytes.Buffer{}
 	writer := multipart.NewWriter(aiBody)
 	_ = writer.WriteField("problem_text", req.ProblemText)
@@ -256,73 +386,159 @@ func (h *GradingHandler) StartFollowUpChatHandler(c *gin.Context) {
 	_ = writer.WriteField("new_question", req.NewQuestion)
 	// 在这种模式下，我们不需要发送 chat_history，因为这是会话的开始
 	_ = writer.WriteField("chat_history", "[]")
+	if hintOnly {
+		_ = writer.WriteField("hint_only", "true")
+	}
 	writer.Close()
 
-	proxyReq, _ := http.NewRequest("POST", targetURL, aiBody)
-	proxyReq.Header.Set("Content-Type", writer.FormDataContentType())
-	client := &http.Client{Timeout: time.Second * 180}
-	resp, err := client.Do(proxyReq)
-
+	status, responseBody, err := postAIForm(ctx, "/api/v1/grading/chat", aiBody, writer.FormDataContentType(), 180*time.Second)
 	if err != nil {
-		tx.Rollback()
-		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "AI service is unreachable"})
-		return
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, jobs.NewStatusError(http.StatusServiceUnavailable, "AI service is unreachable")
+	}
+	if status >= http.StatusBadRequest {
+		return nil, jobs.NewStatusError(status, string(responseBody))
 	}
-	defer resp.Body.Close()
-
-	responseBody, _ := io.ReadAll(resp.Body)
 	var aiResp struct {
 		Response string `json:"response"`
 	}
 	if err := json.Unmarshal(responseBody, &aiResp); err != nil {
-		tx.Rollback()
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decode AI response"})
-		return
+		return nil, jobs.NewStatusError(http.StatusInternalServerError, "Failed to decode AI response")
 	}
 
-	// 3. 将上下文、用户问题和AI回答作为消息存入数据库
-	// 注意：为了保持对话的流畅性，我们将上下文合并为一条对用户不可见的 "system" 消息
-	contextMessage := fmt.Sprintf("### 原始题目\n%s\n\n### 学生的解答\n%s\n\n### 你给出的批改意见\n%s", req.ProblemText, req.SolutionText, req.CorrectionText)
+	// 2. 创建会话并保存问答。关联了批改记录时上下文从记录中取；否则把上下文存成一条对学生隐藏的 "system" 消息
+	newSession := chat.ChatSession{
+		UserID:        userID,
+		Title:         "作业批改答疑",
+		ContextType:   chat.ContextGrading,
+		GradeResultID: gradeResultID,
+		CreatedAt:     time.Now(),
+	}
+	err = h.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&newSession).Error; err != nil {
+			return jobs.NewStatusError(http.StatusInternalServerError, "Failed to create chat session")
+		}
+		messagesToSave := []*chat.ChatMessage{}
+		if gradeResultID == nil {
+			contextMessage := chat.FormatGradingContextMessage(chat.GradingContext{
+				ProblemText:    req.ProblemText,
+				SolutionText:   req.SolutionText,
+				CorrectionText: req.CorrectionText,
+			})
+			messagesToSave = append(messagesToSave, &chat.ChatMessage{Role: "system", Content: contextMessage, CreatedAt: time.Now()})
+		}
+		messagesToSave = append(messagesToSave,
+			&chat.ChatMessage{Role: "user", Content: req.NewQuestion, CreatedAt: time.Now().Add(time.Second)},
+			&chat.ChatMessage{Role: "ai", Content: aiResp.Response, CreatedAt: time.Now().Add(2 * time.Second)},
+		)
+		if err := chat.AppendMessages(tx, newSession.ID, nil, messagesToSave...); err != nil {
+			return jobs.NewStatusError(http.StatusInternalServerError, "Failed to save messages")
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// 3. 返回新会话的ID，前端将用此ID跳转
+	return gin.H{"chatSessionId": newSession.ID}, nil
+}
+
+// StartFollowUpChatHandler (已重构)
+// 接收作业上下文和用户的第一条问题，创建会话，保存所有消息，然后返回会话ID；默认返回 jobId，async=0 时同步返回
+func (h *GradingHandler) StartFollowUpChatHandler(c *gin.Context) {
+	userID, _ := accesscontrol.CurrentUserID(c)
+
+	var req followUpRequest
+	if err := c.ShouldBind(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request data: " + err.Error()})
+		return
+	}
+	if !quota.Check(h.DB, c, quota.BucketChat) {
+		return
+	}
 
-	messagesToSave := []chat.ChatMessage{
-		{SessionID: newSession.ID, Role: "system", Content: contextMessage, CreatedAt: time.Now()},
-		{SessionID: newSession.ID, Role: "user", Content: req.NewQuestion, CreatedAt: time.Now().Add(time.Second)},
-		{SessionID: newSession.ID, Role: "ai", Content: aiResp.Response, CreatedAt: time.Now().Add(2 * time.Second)},
+	if jobs.WantsAsync(c) {
+		job, err := h.Jobs.Enqueue(JobTypeFollowUp, userID, req, 0)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "创建答疑任务失败"})
+			return
+		}
+		jobs.Accepted(c, job)
+		return
 	}
 
-	if err := tx.Create(&messagesToSave).Error; err != nil {
-		tx.Rollback()
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save messages"})
+	result, err := h.startFollowUpChat(c.Request.Context(), userID, req)
+	if err != nil {
+		jobs.RespondError(c, err)
 		return
 	}
+	c.JSON(http.StatusOK, result)
+}
 
-	tx.Commit()
+// ocrRequest OCR 任务的 payload：上传文件先落盘，任务完成后删除
+type ocrRequest struct {
+	Path        string `json:"path"`
+	Filename    string `json:"filename"`
+	ContentType string `json:"contentType,omitempty"`
+	UseVision   bool   `json:"useVision,omitempty"`
+}
 
-	// 4. 返回新会话的ID，前端将用此ID跳转
-	c.JSON(http.StatusOK, gin.H{"chatSessionId": newSession.ID})
+// runOCR 识别上传的文件（同一文件+模式命中缓存时不再调用 ai_service），返回 ai_service 的状态码与响应体。
+func (h *GradingHandler) runOCR(ctx context.Context, data []byte, req ocrRequest, timeout time.Duration) (int, []byte, error) {
+	result, err := ocr.Recognize(ctx, h.DB, ocr.Request{
+		Data:        data,
+		Filename:    req.Filename,
+		ContentType: req.ContentType,
+		UseVision:   req.UseVision,
+	}, timeout)
+	if err != nil {
+		if ctx.Err() != nil {
+			return 0, nil, ctx.Err()
+		}
+		return 0, nil, jobs.NewStatusError(http.StatusServiceUnavailable, "AI service is unreachable")
+	}
+	return result.Status, result.Body, nil
 }
 
-// OcrHandler 保持不变
+// OcrHandler 默认先把文件落盘再创建任务（扫描件走视觉模型时耗时较长）；async=0 时同步转发 OCR
 func (h *GradingHandler) OcrHandler(c *gin.Context) {
 	file, err := c.FormFile("file")
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "No file for OCR"})
 		return
 	}
-
-	targetURL := aiclient.URL("/api/v1/ocr")
-	body := &bytes.Buffer{}
-	writer := multipart.NewWriter(body)
-
-	originalContentType := file.Header.Get("Content-Type")
-	header := make(textproto.MIMEHeader)
-	header.Set("Content-Disposition", fmt.Sprintf(`form-data; name="file"; filename="%s"`, file.Filename))
-	if originalContentType != "" {
-		header.Set("Content-Type", originalContentType)
+	if !quota.Check(h.DB, c, quota.BucketOCR) {
+		return
 	}
-	part, err := writer.CreatePart(header)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create form file for OCR"})
+	useVision, _ := strconv.ParseBool(c.PostForm("use_vision"))
+	req := ocrRequest{
+		Filename:    file.Filename,
+		ContentType: file.Header.Get("Content-Type"),
+		UseVision:   useVision,
+	}
+
+	if jobs.WantsAsync(c) {
+		userID, _ := accesscontrol.CurrentUserID(c)
+		uploadDir := "./uploads/jobs"
+		if err := os.MkdirAll(uploadDir, os.ModePerm); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create upload directory"})
+			return
+		}
+		req.Path = filepath.Join(uploadDir, fmt.Sprintf("ocr-%d-%d-%s", userID, time.Now().UnixNano(), filepath.Base(file.Filename)))
+		if err := c.SaveUploadedFile(file, req.Path); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save file"})
+			return
+		}
+		job, err := h.Jobs.Enqueue(JobTypeOCR, userID, req, 0)
+		if err != nil {
+			os.Remove(req.Path)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "创建识别任务失败"})
+			return
+		}
+		jobs.Accepted(c, job)
 		return
 	}
 
@@ -331,27 +547,16 @@ func (h *GradingHandler) OcrHandler(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to open OCR file"})
 		return
 	}
-	defer src.Close()
-	_, err = io.Copy(part, src)
+	data, err := io.ReadAll(src)
+	src.Close()
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to copy OCR file content"})
 		return
 	}
-	// 透传是否用视觉模型识别 PDF（扫描件/手写选 true，默认走 PyMuPDF 文字层）
-	_ = writer.WriteField("use_vision", c.PostForm("use_vision"))
-	writer.Close()
-
-	proxyReq, _ := http.NewRequest("POST", targetURL, body)
-	proxyReq.Header.Set("Content-Type", writer.FormDataContentType())
-
-	client := &http.Client{Timeout: time.Second * 60}
-	resp, err := client.Do(proxyReq)
+	status, responseBody, err := h.runOCR(c.Request.Context(), data, req, 60*time.Second)
 	if err != nil {
-		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "AI service is unreachable"})
+		jobs.RespondError(c, err)
 		return
 	}
-	defer resp.Body.Close()
-
-	responseBody, _ := io.ReadAll(resp.Body)
-	c.Data(resp.StatusCode, "application/json", responseBody)
+	c.Data(status, "application/json", responseBody)
 }
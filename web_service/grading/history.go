@@ -0,0 +1,195 @@
+// web_service/grading/history.go
+
+package grading
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+	"workplace/web_service/accesscontrol"
+	"workplace/web_service/assignment"
+	"workplace/web_service/auth"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ListGradeHistoryHandler 学生查看自己的 AI 批改历史，可按作业筛选，limit/offset 分页；
+// sort=score_asc / score_desc 按结构化批改得分排序（纯文本批改排在最后）。
+func (h *GradingHandler) ListGradeHistoryHandler(c *gin.Context) {
+	userID, ok := accesscontrol.CurrentUserID(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "未登录"})
+		return
+	}
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "20"))
+	offset, _ := strconv.Atoi(c.DefaultQuery("offset", "0"))
+	if limit <= 0 || limit > 100 {
+		limit = 20
+	}
+	if offset < 0 {
+		offset = 0
+	}
+
+	query := h.DB.Model(&GradeResult{}).Where("user_id = ?", userID)
+	if raw := c.Query("assignmentId"); raw != "" {
+		assignmentID, err := strconv.Atoi(raw)
+		if err != nil || assignmentID <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "作业 ID 不合法"})
+			return
+		}
+		query = query.Where("assignment_id = ?", assignmentID)
+	}
+
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "读取批改历史失败"})
+		return
+	}
+	order := "created_at desc, id desc"
+	switch c.Query("sort") {
+	case "", "created_desc":
+	case "score_asc":
+		order = "score asc nulls last, id desc"
+	case "score_desc":
+		order = "score desc nulls last, id desc"
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "排序方式不合法"})
+		return
+	}
+	var results []GradeResult
+	if err := query.Order(order).Limit(limit).Offset(offset).Find(&results).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "读取批改历史失败"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"results":  results,
+		"total":    total,
+		"limit":    limit,
+		"offset":   offset,
+		"has_more": int64(offset+len(results)) < total,
+	})
+}
+
+// GetGradeResultHandler 学生查看单条批改记录。
+func (h *GradingHandler) GetGradeResultHandler(c *gin.Context) {
+	userID, ok := accesscontrol.CurrentUserID(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "未登录"})
+		return
+	}
+	var result GradeResult
+	if err := h.DB.Where("id = ? AND user_id = ?", c.Param("id"), userID).First(&result).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "批改记录不存在"})
+		return
+	}
+	c.JSON(http.StatusOK, result)
+}
+
+// DeleteGradeResultHandler 学生删除自己的批改记录（软删除，老师端的使用统计仍计入）。
+func (h *GradingHandler) DeleteGradeResultHandler(c *gin.Context) {
+	userID, ok := accesscontrol.CurrentUserID(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "未登录"})
+		return
+	}
+	res := h.DB.Where("id = ? AND user_id = ?", c.Param("id"), userID).Delete(&GradeResult{})
+	if res.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "删除批改记录失败"})
+		return
+	}
+	if res.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "批改记录不存在"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "已删除批改记录"})
+}
+
+// AssignmentAIUsageHandler (老师) 查看某份作业下本班学生使用 AI 自主批改的情况（只给次数与时间，不暴露批改内容）。
+func (h *GradingHandler) AssignmentAIUsageHandler(c *gin.Context) {
+	teacherID, ok := accesscontrol.CurrentUserID(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "未登录"})
+		return
+	}
+	var item assignment.Assignment
+	if err := h.DB.First(&item, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Assignment not found"})
+		return
+	}
+	if item.TeacherID != teacherID {
+		c.JSON(http.StatusForbidden, gin.H{"error": "无权查看该作业"})
+		return
+	}
+
+	// 未指定班级的旧作业对该老师所有班级可见
+	var students []auth.User
+	studentQuery := h.DB.Where("role = ?", "student")
+	if item.ClassID != nil {
+		studentQuery = studentQuery.Where("class_id = ?", *item.ClassID)
+	} else {
+		studentQuery = studentQuery.Where("class_id IN (SELECT id FROM classes WHERE teacher_id = ?)", teacherID)
+	}
+	if err := studentQuery.Order("username asc").Find(&students).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "读取班级学生失败"})
+		return
+	}
+
+	type usageRow struct {
+		UserID    uint
+		Count     int64
+		FirstUsed time.Time
+		LastUsed  time.Time
+	}
+	var rows []usageRow
+	if len(students) > 0 {
+		ids := make([]uint, 0, len(students))
+		for _, stu := range students {
+			ids = append(ids, stu.ID)
+		}
+		// 含学生已删除的记录：删除只影响学生自己的列表，不能借此抹掉使用记录
+		if err := h.DB.Unscoped().Model(&GradeResult{}).
+			Select("user_id, COUNT(*) AS count, MIN(created_at) AS first_used, MAX(created_at) AS last_used").
+			Where("assignment_id = ? AND user_id IN ?", item.ID, ids).
+			Group("user_id").
+			Scan(&rows).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "统计 AI 批改使用情况失败"})
+			return
+		}
+	}
+	byUser := map[uint]usageRow{}
+	for _, row := range rows {
+		byUser[row.UserID] = row
+	}
+
+	type StudentUsage struct {
+		ID          uint       `json:"id"`
+		Username    string     `json:"username"`
+		DisplayName string     `json:"display_name"`
+		GradeCount  int64      `json:"grade_count"`
+		FirstUsedAt *time.Time `json:"first_used_at,omitempty"`
+		LastUsedAt  *time.Time `json:"last_used_at,omitempty"`
+	}
+	usage := make([]StudentUsage, 0, len(students))
+	var totalRuns int64
+	activeStudents := 0
+	for _, stu := range students {
+		entry := StudentUsage{ID: stu.ID, Username: stu.Username, DisplayName: stu.DisplayName}
+		if row, ok := byUser[stu.ID]; ok {
+			entry.GradeCount = row.Count
+			first, last := row.FirstUsed, row.LastUsed
+			entry.FirstUsedAt = &first
+			entry.LastUsedAt = &last
+			totalRuns += row.Count
+			activeStudents++
+		}
+		usage = append(usage, entry)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"assignment_id":   item.ID,
+		"total_students":  len(students),
+		"active_students": activeStudents,
+		"total_runs":      totalRuns,
+		"students":        usage,
+	})
+}
@@ -0,0 +1,130 @@
+// web_service/grading/jobs.go
+
+package grading
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"time"
+	"workplace/web_service/assignment"
+	"workplace/web_service/auth"
+	"workplace/web_service/jobs"
+	"workplace/web_service/quota"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	JobTypeGrading  = "grading"
+	JobTypeFollowUp = "grading_followup"
+	JobTypeOCR      = "ocr"
+)
+
+// RegisterJobs 注册批改相关的异步任务类型
+func (h *GradingHandler) RegisterJobs(q *jobs.Queue) {
+	q.Register(JobTypeGrading, func(ctx context.Context, job *jobs.Job) (interface{}, error) {
+		var req gradeRequest
+		if err := job.DecodePayload(&req); err != nil {
+			return nil, err
+		}
+		result, err := h.gradeHomework(ctx, job.UserID, req)
+		err = jobs.TaskError(err)
+		// 配额在入队时已扣：命中缓存、或不会再重试的失败时退回
+		final := err == nil || jobs.IsPermanent(err) || job.Attempts >= job.MaxAttempts || ctx.Err() != nil
+		if final && gradeNotCharged(result, err) {
+			quota.Refund(h.DB, job.UserID, quota.BucketGrading)
+		}
+		return result, err
+	})
+	q.Register(JobTypeFollowUp, func(ctx context.Context, job *jobs.Job) (interface{}, error) {
+		var req followUpRequest
+		if err := job.DecodePayload(&req); err != nil {
+			return nil, err
+		}
+		result, err := h.startFollowUpChat(ctx, job.UserID, req)
+		return result, jobs.TaskError(err)
+	})
+	q.Register(JobTypeOCR, func(ctx context.Context, job *jobs.Job) (interface{}, error) {
+		var req ocrRequest
+		if err := job.DecodePayload(&req); err != nil {
+			return nil, err
+		}
+		data, err := os.ReadFile(req.Path)
+		if err != nil {
+			return nil, jobs.Permanentf("待识别文件已丢失")
+		}
+		status, responseBody, err := h.runOCR(ctx, data, req, 180*time.Second)
+		if err == nil && status >= http.StatusBadRequest {
+			err = jobs.NewStatusError(status, string(responseBody))
+		}
+		if err != nil {
+			return nil, jobs.TaskError(err)
+		}
+		return json.RawMessage(responseBody), nil
+	})
+	q.Register(assignment.JobTypeQuizAIGrading, func(ctx context.Context, job *jobs.Job) (interface{}, error) {
+		var payload assignment.QuizAIGradingPayload
+		if err := job.DecodePayload(&payload); err != nil {
+			return nil, err
+		}
+		return h.gradeQuizAnswer(ctx, job.UserID, payload.AnswerID)
+	})
+	// 重试用尽、被取消或被清扫后仍未批改的题目退回老师批改
+	q.OnFinished(assignment.JobTypeQuizAIGrading, func(job *jobs.Job) {
+		var payload assignment.QuizAIGradingPayload
+		if job.DecodePayload(&payload) == nil {
+			assignment.ReleaseQuizAIGrading(h.DB, payload.AnswerID)
+		}
+	})
+	// 上传的临时文件在任务结束后删除（含排队中被取消、孤儿任务被清扫），还会重试时保留
+	q.OnFinished(JobTypeOCR, func(job *jobs.Job) {
+		var req ocrRequest
+		if job.DecodePayload(&req) == nil && req.Path != "" {
+			os.Remove(req.Path)
+		}
+	})
+}
+
+// gradeQuizAnswer 为测验主观题生成 AI 批改意见；命中批改缓存时不调 AI，否则计入布置老师的批改用量。
+func (h *GradingHandler) gradeQuizAnswer(ctx context.Context, teacherID, answerID uint) (interface{}, error) {
+	var answer assignment.QuizAnswer
+	if err := h.DB.First(&answer, answerID).Error; err != nil {
+		return nil, jobs.Permanentf("作答不存在")
+	}
+	if answer.GradingStatus != "pending_ai" {
+		return gin.H{"answerId": answer.ID, "skipped": true}, nil
+	}
+	var stem string
+	h.DB.Table("textbook_exercises").Select("stem").Where("id = ?", answer.ExerciseID).Scan(&stem)
+
+	cached, ok := lookupGradeCache(h.DB, stem, answer.Answer)
+	correction := cached.Correction
+	if !ok {
+		var teacher auth.User
+		if err := h.DB.First(&teacher, teacherID).Error; err != nil {
+			return nil, jobs.Permanentf("布置老师不存在")
+		}
+		if err := quota.Consume(h.DB, teacher, quota.BucketGrading); err != nil {
+			var exceeded *quota.ExceededError
+			if errors.As(err, &exceeded) {
+				return nil, jobs.Permanent(err)
+			}
+			log.Printf("Failed to record AI usage for user %d: %v", teacher.ID, err)
+		}
+		aiResp, _, err := h.requestGrade(ctx, stem, answer.Answer)
+		if err != nil {
+			// 每次尝试都会重新计数，失败的这次退回
+			quota.Refund(h.DB, teacher.ID, quota.BucketGrading)
+			return nil, jobs.TaskError(err)
+		}
+		correction = aiResp.Correction
+	}
+	if err := assignment.StoreQuizAIFeedback(h.DB, answer.ID, correction); err != nil {
+		return nil, err
+	}
+	return gin.H{"answerId": answer.ID, "attemptId": answer.AttemptID, "cached": ok}, nil
+}
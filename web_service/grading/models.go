@@ -1,6 +1,7 @@
 package grading
 
 import (
+	"encoding/json"
 	"time"
 
 	"gorm.io/gorm"
@@ -8,12 +9,37 @@ import (
 
 // GradeResult 代表一条AI批改作业的记录
 type GradeResult struct {
-	ID         uint           `gorm:"primarykey" json:"id"`
-	UserID     uint           `gorm:"index;not null" json:"-"`
-	Filename   string         `json:"filename"`                 // 解答的文件名
-	Problem    string         `gorm:"type:text" json:"problem"` // 题目的内容
-	Content    string         `gorm:"type:text" json:"content"` // 解答的内容
-	Correction string         `gorm:"type:text" json:"correction"`
-	CreatedAt  time.Time      `json:"createdAt"`
-	DeletedAt  gorm.DeletedAt `gorm:"index" json:"-"`
+	ID            uint           `gorm:"primarykey" json:"id"`
+	UserID        uint           `gorm:"index;not null" json:"-"`
+	AssignmentID  *uint          `gorm:"index" json:"assignmentId,omitempty"` // 基于老师发布作业的自主批改
+	Filename      string         `json:"filename"`                            // 解答的文件名
+	OCRDocumentID *uint          `json:"ocrDocumentId,omitempty"`             // 解答引用的识别文档
+	Problem       string         `gorm:"type:text" json:"problem"`            // 题目的内容
+	Content       string         `gorm:"type:text" json:"content"`            // 解答的内容
+	Correction    string         `gorm:"type:text" json:"correction"`
+	Model         string         `gorm:"size:100" json:"model,omitempty"`        // 实际批改所用模型
+	Partial       bool           `gorm:"default:false" json:"partial,omitempty"` // 流式批改中途失败时保存的不完整批改
+	SchemaVersion string         `gorm:"size:20" json:"schemaVersion,omitempty"` // 结构化批改版本，纯文本批改为空
+	Score         *float64       `gorm:"index" json:"score,omitempty"`           // 整体建议得分（0-100），可排序/聚合
+	ConceptTags   string         `gorm:"type:text" json:"-"`                     // 涉及知识点 JSON 数组，自定义 MarshalJSON 暴露为数组
+	Structured    string         `gorm:"type:text" json:"-"`                     // grading.v1 结构化结果 JSON
+	CreatedAt     time.Time      `json:"createdAt"`
+	DeletedAt     gorm.DeletedAt `gorm:"index" json:"-"`
+}
+
+// MarshalJSON 把结构化批改与知识点以 JSON 对象/数组返回给前端
+func (r GradeResult) MarshalJSON() ([]byte, error) {
+	type alias GradeResult
+	out := struct {
+		alias
+		ConceptTags json.RawMessage `json:"conceptTags,omitempty"`
+		Structured  json.RawMessage `json:"structured,omitempty"`
+	}{alias: alias(r)}
+	if r.ConceptTags != "" && json.Valid([]byte(r.ConceptTags)) {
+		out.ConceptTags = json.RawMessage(r.ConceptTags)
+	}
+	if r.Structured != "" && json.Valid([]byte(r.Structured)) {
+		out.Structured = json.RawMessage(r.Structured)
+	}
+	return json.Marshal(out)
 }
@@ -0,0 +1,156 @@
+// web_service/grading/schema.go
+
+package grading
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// GradingSchemaVersion 结构化批改结果的版本号，与 ai_service/grading.py 保持一致
+const GradingSchemaVersion = "grading.v1"
+
+const (
+	VerdictCorrect    = "correct"
+	VerdictMinorError = "minor_error"
+	VerdictMajorError = "major_error"
+)
+
+// GradeStep 学生解答中的一个步骤及判定
+type GradeStep struct {
+	Index   int    `json:"index"`
+	Summary string `json:"summary"`
+	Verdict string `json:"verdict"` // correct / minor_error / major_error
+	Comment string `json:"comment,omitempty"`
+}
+
+// ExerciseGrade 单道题的结构化批改
+type ExerciseGrade struct {
+	Label          string      `json:"label"`
+	MaxScore       float64     `json:"max_score"`
+	SuggestedScore *float64    `json:"suggested_score"`
+	Steps          []GradeStep `json:"steps"`
+	ErrorStep      *int        `json:"error_step"` // 第一个出错步骤的 index，全对为 null
+	ConceptTags    []string    `json:"concept_tags"`
+}
+
+// StructuredGrade grading.v1 结构化批改结果
+type StructuredGrade struct {
+	SchemaVersion       string          `json:"schema_version"`
+	Exercises           []ExerciseGrade `json:"exercises"`
+	OverallScore        *float64        `json:"overall_score"`
+	ConceptTags         []string        `json:"concept_tags"`
+	ExplanationMarkdown string          `json:"explanation_markdown,omitempty"`
+}
+
+var validVerdicts = map[string]bool{VerdictCorrect: true, VerdictMinorError: true, VerdictMajorError: true}
+
+// parseStructuredGrade 解析并校验 ai_service 返回的结构化结果；不符合 schema 时返回错误，调用方降级为纯文本批改。
+func parseStructuredGrade(raw json.RawMessage) (*StructuredGrade, error) {
+	trimmed := strings.TrimSpace(string(raw))
+	if trimmed == "" || trimmed == "null" {
+		return nil, fmt.Errorf("缺少结构化批改结果")
+	}
+	var grade StructuredGrade
+	if err := json.Unmarshal(raw, &grade); err != nil {
+		return nil, fmt.Errorf("结构化批改结果无法解析: %w", err)
+	}
+	if err := grade.validate(); err != nil {
+		return nil, err
+	}
+	return &grade, nil
+}
+
+func (g *StructuredGrade) validate() error {
+	if g.SchemaVersion != GradingSchemaVersion {
+		return fmt.Errorf("不支持的批改结构版本 %q", g.SchemaVersion)
+	}
+	if len(g.Exercises) == 0 {
+		return fmt.Errorf("结构化批改缺少题目")
+	}
+	if g.OverallScore != nil && (*g.OverallScore < 0 || *g.OverallScore > 100) {
+		return fmt.Errorf("overall_score 超出 0-100")
+	}
+	for i := range g.Exercises {
+		ex := &g.Exercises[i]
+		if ex.MaxScore <= 0 {
+			return fmt.Errorf("第 %d 题 max_score 必须为正数", i+1)
+		}
+		if ex.SuggestedScore != nil && (*ex.SuggestedScore < 0 || *ex.SuggestedScore > ex.MaxScore) {
+			return fmt.Errorf("第 %d 题建议得分超出 0-%g", i+1, ex.MaxScore)
+		}
+		for j, step := range ex.Steps {
+			if !validVerdicts[step.Verdict] {
+				return fmt.Errorf("第 %d 题第 %d 步判定 %q 不合法", i+1, j+1, step.Verdict)
+			}
+		}
+		if ex.ErrorStep != nil && (*ex.ErrorStep < 1 || *ex.ErrorStep > len(ex.Steps)) {
+			return fmt.Errorf("第 %d 题 error_step 不对应任何步骤", i+1)
+		}
+	}
+	return nil
+}
+
+// score 结构化结果的整体得分（0-100）；模型未给出时按各题建议得分折算
+func (g *StructuredGrade) score() *float64 {
+	if g.OverallScore != nil {
+		return g.OverallScore
+	}
+	var got, total float64
+	for _, ex := range g.Exercises {
+		if ex.SuggestedScore == nil {
+			return nil
+		}
+		got += *ex.SuggestedScore
+		total += ex.MaxScore
+	}
+	if total <= 0 {
+		return nil
+	}
+	score := got / total * 100
+	return &score
+}
+
+// allConceptTags 汇总整体与各题的知识点（去重，保持出现顺序）
+func (g *StructuredGrade) allConceptTags() []string {
+	seen := make(map[string]bool)
+	tags := make([]string, 0, len(g.ConceptTags))
+	add := func(list []string) {
+		for _, tag := range list {
+			tag = strings.TrimSpace(tag)
+			if tag != "" && !seen[tag] {
+				seen[tag] = true
+				tags = append(tags, tag)
+			}
+		}
+	}
+	add(g.ConceptTags)
+	for _, ex := range g.Exercises {
+		add(ex.ConceptTags)
+	}
+	return tags
+}
+
+// structuredFromAI 校验 ai_service 返回的结构化结果；不合规时记录日志并降级为纯文本批改（返回 nil）。
+func structuredFromAI(raw json.RawMessage) *StructuredGrade {
+	trimmed := strings.TrimSpace(string(raw))
+	if trimmed == "" || trimmed == "null" {
+		return nil
+	}
+	grade, err := parseStructuredGrade(raw)
+	if err != nil {
+		log.Printf("Structured grade rejected, falling back to text-only: %v", err)
+		return nil
+	}
+	return grade
+}
+
+// nullIfEmpty 空字符串按 JSON null 输出
+func nullIfEmpty(s string) string {
+	if s == "" {
+		return "null"
+	}
+	return s
+}
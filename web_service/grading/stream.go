@@ -0,0 +1,142 @@
+// web_service/grading/stream.go
+
+package grading
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"workplace/web_service/accesscontrol"
+	"workplace/web_service/aiclient"
+	"workplace/web_service/chat"
+	"workplace/web_service/jobs"
+	"workplace/web_service/quota"
+
+	"github.com/gin-gonic/gin"
+)
+
+// StreamGradeHandler 流式版 GradeHomeworkHandler：批改意见逐段以 SSE 下发。
+// 事件：meta{model} → delta{text}* → done{与同步接口相同的结果} | error{error, partial, gradeResultId}。
+// 中途失败或学生关闭页面时，已生成的部分批改仍会落库并标记 partial。
+func (h *GradingHandler) StreamGradeHandler(c *gin.Context) {
+	userID, _ := accesscontrol.CurrentUserID(c)
+	req, ok := h.parseGradeRequest(c)
+	if !ok {
+		return
+	}
+	ctx := c.Request.Context()
+	problemText, err := h.resolveGradeProblem(ctx, userID, req)
+	if err != nil {
+		jobs.RespondError(c, err)
+		return
+	}
+	if cached, ok := lookupGradeCache(h.DB, problemText, req.SolutionText); ok {
+		// 命中缓存：一次性下发完整批改，事件序列与正常流式一致；没有调用 AI，不计用量
+		result := h.saveGradeResult(userID, req, problemText, cached.Correction, cached.Model, cached.structured(), false)
+		response := gradeResponse(result, req)
+		response["cached"] = true
+		chat.StartSSE(c)
+		chat.SendSSE(c, "meta", gin.H{"model": cached.Model, "cached": true})
+		chat.SendSSE(c, "delta", gin.H{"text": cached.Correction})
+		chat.SendSSE(c, "done", response)
+		return
+	}
+
+	if !quota.Check(h.DB, c, quota.BucketGrading) {
+		return
+	}
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	_ = writer.WriteField("problem_text", problemText)
+	_ = writer.WriteField("solution_text", req.SolutionText)
+	writer.Close()
+
+	resp, err := aiclient.PostStream(ctx, "/api/v1/grade/stream", body, writer.FormDataContentType())
+	if err != nil {
+		quota.Refund(h.DB, userID, quota.BucketGrading)
+		var statusErr *aiclient.StatusError
+		switch {
+		case ctx.Err() != nil:
+		case errors.As(err, &statusErr):
+			c.JSON(statusErr.Status, gin.H{"error": string(statusErr.Body)})
+		default:
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "AI service is unreachable"})
+		}
+		return
+	}
+	defer resp.Body.Close()
+
+	chat.StartSSE(c)
+	var correction strings.Builder
+	var final AIGradeResponse
+	model := ""
+	finished := false
+	streamErr := ""
+	readErr := aiclient.ReadSSE(resp.Body, func(event string, data []byte) error {
+		switch event {
+		case "meta":
+			var meta struct {
+				Model string `json:"model"`
+			}
+			_ = json.Unmarshal(data, &meta)
+			model = meta.Model
+			chat.SendSSE(c, "meta", string(data))
+		case "delta":
+			var delta struct {
+				Text string `json:"text"`
+			}
+			if err := json.Unmarshal(data, &delta); err == nil && delta.Text != "" {
+				correction.WriteString(delta.Text)
+				chat.SendSSE(c, "delta", string(data))
+			}
+		case "done":
+			if err := json.Unmarshal(data, &final); err == nil {
+				finished = true
+			}
+		case "error":
+			var e struct {
+				Error string `json:"error"`
+			}
+			_ = json.Unmarshal(data, &e)
+			streamErr = e.Error
+		}
+		return nil
+	})
+	if !finished && streamErr == "" {
+		streamErr = "AI 批改中断"
+		if readErr != nil && ctx.Err() == nil {
+			log.Printf("Grading stream read error: %v", readErr)
+		}
+	}
+
+	text := correction.String()
+	if finished {
+		if final.Correction != "" {
+			text = final.Correction
+		}
+		if final.Model != "" {
+			model = final.Model
+		}
+	}
+	if strings.TrimSpace(text) == "" {
+		quota.Refund(h.DB, userID, quota.BucketGrading)
+		chat.SendSSE(c, "error", gin.H{"error": streamErr})
+		return
+	}
+
+	var structured *StructuredGrade
+	if finished {
+		structured = structuredFromAI(final.Structured)
+		storeGradeCache(h.DB, problemText, req.SolutionText, text, model, structured)
+	}
+	result := h.saveGradeResult(userID, req, problemText, text, model, structured, !finished)
+	if !finished {
+		chat.SendSSE(c, "error", gin.H{"error": streamErr, "partial": true, "gradeResultId": result.ID})
+		return
+	}
+	chat.SendSSE(c, "done", gradeResponse(result, req))
+}
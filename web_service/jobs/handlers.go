@@ -0,0 +1,93 @@
+// web_service/jobs/handlers.go
+package jobs
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"workplace/web_service/accesscontrol"
+
+	"github.com/gin-gonic/gin"
+)
+
+// RespondError 把核心逻辑返回的错误写回 HTTP 响应：StatusError 按其状态码，其余为 500
+func RespondError(c *gin.Context, err error) {
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		c.JSON(statusErr.Status, gin.H{"error": statusErr.Msg})
+		return
+	}
+	c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+}
+
+type JobHandler struct {
+	Queue *Queue
+}
+
+func (h *JobHandler) loadJobID(c *gin.Context) (jobID, userID uint, ok bool) {
+	userID, ok = accesscontrol.CurrentUserID(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "未登录"})
+		return 0, 0, false
+	}
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil || id <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "任务 ID 不合法"})
+		return 0, 0, false
+	}
+	return uint(id), userID, true
+}
+
+// GetJobHandler 轮询任务状态；完成后 result 中是与同步接口一致的返回内容。
+func (h *JobHandler) GetJobHandler(c *gin.Context) {
+	jobID, userID, ok := h.loadJobID(c)
+	if !ok {
+		return
+	}
+	job, err := h.Queue.Get(jobID, userID)
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "任务不存在"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "读取任务失败"})
+		return
+	}
+	c.JSON(http.StatusOK, job)
+}
+
+// CancelJobHandler 取消排队中或运行中的任务；已结束的任务原样返回。
+func (h *JobHandler) CancelJobHandler(c *gin.Context) {
+	jobID, userID, ok := h.loadJobID(c)
+	if !ok {
+		return
+	}
+	job, err := h.Queue.Cancel(jobID, userID)
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "任务不存在"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "取消任务失败"})
+		return
+	}
+	c.JSON(http.StatusOK, job)
+}
+
+// Accepted 异步接口统一的 202 响应
+func Accepted(c *gin.Context, job *Job) {
+	c.JSON(http.StatusAccepted, gin.H{"jobId": job.ID, "status": job.Status, "type": job.Type})
+}
+
+// WantsAsync 长耗时接口默认异步（返回 jobId）；旧调用方可带 ?async=0 或表单字段 async=false 继续同步等待结果
+func WantsAsync(c *gin.Context) bool {
+	raw := c.Query("async")
+	if raw == "" {
+		raw = c.PostForm("async")
+	}
+	if raw == "" {
+		return true
+	}
+	v, err := strconv.ParseBool(raw)
+	return err != nil || v
+}
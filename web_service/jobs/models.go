@@ -0,0 +1,53 @@
+// web_service/jobs/models.go
+package jobs
+
+import (
+	"encoding/json"
+	"time"
+)
+
+const (
+	StatusQueued    = "queued"
+	StatusRunning   = "running"
+	StatusSucceeded = "succeeded"
+	StatusFailed    = "failed"
+	StatusCanceled  = "canceled"
+)
+
+// Job 一条落库的异步 AI 任务（批改 / OCR / 讲解等），HTTP 请求只拿 job ID，结果通过轮询获取。
+type Job struct {
+	ID              uint       `gorm:"primarykey" json:"id"`
+	Type            string     `gorm:"size:50;not null;index" json:"type"`
+	UserID          uint       `gorm:"not null;index" json:"-"`
+	Status          string     `gorm:"size:20;not null;default:'queued';index" json:"status"` // queued / running / succeeded / failed / canceled
+	Payload         string     `gorm:"type:text" json:"-"`                                    // 任务入参 JSON
+	Result          string     `gorm:"type:text" json:"-"`                                    // 任务结果 JSON，自定义 MarshalJSON 暴露为结构化对象
+	Error           string     `gorm:"type:text" json:"error,omitempty"`
+	Attempts        int        `gorm:"default:0" json:"attempts"`
+	MaxAttempts     int        `gorm:"default:3" json:"maxAttempts"`
+	NextRunAt       time.Time  `gorm:"index" json:"nextRunAt"`
+	CancelRequested bool       `gorm:"default:false" json:"cancelRequested"`
+	HeartbeatAt     *time.Time `json:"-"` // 运行中的 worker 定期续约，超时未续约视为进程已崩溃
+	StartedAt       *time.Time `json:"startedAt,omitempty"`
+	FinishedAt      *time.Time `json:"finishedAt,omitempty"`
+	CreatedAt       time.Time  `json:"createdAt"`
+	UpdatedAt       time.Time  `json:"updatedAt"`
+}
+
+// MarshalJSON 让 Result 以 JSON 对象而不是转义字符串返回给前端。
+func (j Job) MarshalJSON() ([]byte, error) {
+	type alias Job
+	out := struct {
+		alias
+		Result json.RawMessage `json:"result,omitempty"`
+	}{alias: alias(j)}
+	if j.Result != "" && json.Valid([]byte(j.Result)) {
+		out.Result = json.RawMessage(j.Result)
+	}
+	return json.Marshal(out)
+}
+
+// Finished 任务是否已到终态
+func (j Job) Finished() bool {
+	return j.Status == StatusSucceeded || j.Status == StatusFailed || j.Status == StatusCanceled
+}
@@ -0,0 +1,488 @@
+// web_service/jobs/queue.go
+package jobs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// HandlerFunc 执行一条任务，返回值会序列化为 Job.Result。ctx 在任务被取消时结束。
+type HandlerFunc func(ctx context.Context, job *Job) (interface{}, error)
+
+// permanentError 不值得重试的错误（参数错误、无权访问、AI 返回 4xx 等）
+type permanentError struct{ err error }
+
+func (e permanentError) Error() string { return e.err.Error() }
+func (e permanentError) Unwrap() error { return e.err }
+
+// Permanent 标记错误为不可重试，任务直接失败。
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return permanentError{err: err}
+}
+
+// Permanentf 等价于 Permanent(fmt.Errorf(...))
+func Permanentf(format string, args ...interface{}) error {
+	return Permanent(fmt.Errorf(format, args...))
+}
+
+// IsPermanent 错误是否已被标记为不可重试
+func IsPermanent(err error) bool {
+	var perm permanentError
+	return errors.As(err, &perm)
+}
+
+// StatusError 带 HTTP 状态码的业务错误：同步接口按 Status 返回（见 RespondError），作为任务错误时 4xx 不重试（见 TaskError）
+type StatusError struct {
+	Status int
+	Msg    string
+}
+
+func (e *StatusError) Error() string { return e.Msg }
+
+// NewStatusError 创建带状态码的错误
+func NewStatusError(status int, msg string) error {
+	return &StatusError{Status: status, Msg: msg}
+}
+
+// TaskError 把核心逻辑返回的错误转换为任务错误：StatusError 中的 4xx 不重试，网络错误与 5xx 按退避重试
+func TaskError(err error) error {
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) && statusErr.Status < http.StatusInternalServerError {
+		return Permanent(err)
+	}
+	return err
+}
+
+// ErrNotFound 任务不存在或不属于当前用户
+var ErrNotFound = errors.New("任务不存在")
+
+const (
+	heartbeatInterval = 30 * time.Second
+	staleAfter        = 2 * time.Minute // 心跳超过该时长未更新，视为 worker 所在进程已退出
+	maxBackoff        = 5 * time.Minute
+)
+
+// Queue 基于数据库的任务队列：任务先落库再由 worker 池领取，进程重启后未完成的任务会继续执行。
+// 并发限制（总数 / 按类型 / 按用户）以库中 running 状态统计，多实例部署时同样生效。
+type Queue struct {
+	DB *gorm.DB
+
+	workers      int
+	perUserLimit int
+	typeLimits   map[string]int
+	baseBackoff  time.Duration
+	pollInterval time.Duration
+
+	mu       sync.Mutex
+	handlers map[string]HandlerFunc
+	cleanups map[string]func(job *Job)
+	running  map[uint]context.CancelFunc
+	slots    chan struct{}
+	wake     chan struct{}
+}
+
+func envInt(key string, def int) int {
+	if v, err := strconv.Atoi(strings.TrimSpace(os.Getenv(key))); err == nil && v > 0 {
+		return v
+	}
+	return def
+}
+
+// parseTypeLimits 解析 JOB_TYPE_LIMITS，格式 "grading=4,ocr=2"
+func parseTypeLimits(raw string) map[string]int {
+	limits := map[string]int{}
+	for _, item := range strings.Split(raw, ",") {
+		name, value, ok := strings.Cut(strings.TrimSpace(item), "=")
+		if !ok {
+			continue
+		}
+		if n, err := strconv.Atoi(strings.TrimSpace(value)); err == nil && n > 0 {
+			limits[strings.TrimSpace(name)] = n
+		}
+	}
+	return limits
+}
+
+// NewQueue 按环境变量创建队列：JOB_WORKERS / JOB_PER_USER_LIMIT / JOB_TYPE_LIMITS / JOB_RETRY_BASE_SECONDS。
+func NewQueue(db *gorm.DB) *Queue {
+	workers := envInt("JOB_WORKERS", 4)
+	return &Queue{
+		DB:           db,
+		workers:      workers,
+		perUserLimit: envInt("JOB_PER_USER_LIMIT", 2),
+		typeLimits:   parseTypeLimits(os.Getenv("JOB_TYPE_LIMITS")),
+		baseBackoff:  time.Duration(envInt("JOB_RETRY_BASE_SECONDS", 5)) * time.Second,
+		pollInterval: 2 * time.Second,
+		handlers:     map[string]HandlerFunc{},
+		cleanups:     map[string]func(job *Job){},
+		running:      map[uint]context.CancelFunc{},
+		slots:        make(chan struct{}, workers),
+		wake:         make(chan struct{}, 1),
+	}
+}
+
+// Register 注册任务类型的执行函数，需在 Start 之前调用。
+func (q *Queue) Register(jobType string, fn HandlerFunc) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.handlers[jobType] = fn
+}
+
+// OnFinished 注册任务进入终态（成功 / 最终失败 / 取消，含排队中被取消与清扫出的孤儿任务）后的清理函数，
+// 用于删除入队时落盘的临时文件等。需在 Start 之前调用；会重试的失败不会触发。
+func (q *Queue) OnFinished(jobType string, fn func(job *Job)) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.cleanups[jobType] = fn
+}
+
+// finished 调用任务类型的清理函数
+func (q *Queue) finished(job *Job) {
+	q.mu.Lock()
+	fn := q.cleanups[job.Type]
+	q.mu.Unlock()
+	if fn != nil {
+		fn(job)
+	}
+}
+
+// Enqueue 创建一条任务并唤醒调度。maxAttempts<=0 时默认 3 次。
+func (q *Queue) Enqueue(jobType string, userID uint, payload interface{}, maxAttempts int) (*Job, error) {
+	q.mu.Lock()
+	_, known := q.handlers[jobType]
+	q.mu.Unlock()
+	if !known {
+		return nil, fmt.Errorf("未知的任务类型: %s", jobType)
+	}
+	raw, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	if maxAttempts <= 0 {
+		maxAttempts = 3
+	}
+	job := Job{
+		Type:        jobType,
+		UserID:      userID,
+		Status:      StatusQueued,
+		Payload:     string(raw),
+		MaxAttempts: maxAttempts,
+		NextRunAt:   time.Now(),
+	}
+	if err := q.DB.Create(&job).Error; err != nil {
+		return nil, err
+	}
+	q.notify()
+	return &job, nil
+}
+
+// DecodePayload 把任务入参解到 v 中。
+func (j *Job) DecodePayload(v interface{}) error {
+	if err := json.Unmarshal([]byte(j.Payload), v); err != nil {
+		return Permanentf("任务参数无法解析: %v", err)
+	}
+	return nil
+}
+
+func (q *Queue) notify() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Start 启动调度循环与心跳/取消检查循环。
+func (q *Queue) Start() {
+	q.requeueStale()
+	go q.dispatchLoop()
+	go q.maintenanceLoop()
+	log.Printf("Job queue started: workers=%d per_user=%d type_limits=%v", q.workers, q.perUserLimit, q.typeLimits)
+}
+
+func (q *Queue) dispatchLoop() {
+	ticker := time.NewTicker(q.pollInterval)
+	defer ticker.Stop()
+	for {
+		// 先占一个 worker 槽位，再去库里领任务
+		q.slots <- struct{}{}
+		job, err := q.claim()
+		if err != nil {
+			log.Printf("Job claim failed: %v", err)
+		}
+		if job == nil {
+			<-q.slots
+			select {
+			case <-ticker.C:
+			case <-q.wake:
+			}
+			continue
+		}
+		go func(job *Job) {
+			defer func() {
+				<-q.slots
+				q.notify()
+			}()
+			q.run(job)
+		}(job)
+	}
+}
+
+// claim 在事务中领取一条可执行的任务（跳过已达并发上限的类型与用户）。
+func (q *Queue) claim() (*Job, error) {
+	var claimed *Job
+	err := q.DB.Transaction(func(tx *gorm.DB) error {
+		type countRow struct {
+			JobType string
+			Count   int
+		}
+		var byType []countRow
+		if err := tx.Model(&Job{}).Select("type AS job_type, COUNT(*) AS count").
+			Where("status = ?", StatusRunning).Group("type").Scan(&byType).Error; err != nil {
+			return err
+		}
+		var fullTypes []string
+		for _, row := range byType {
+			if limit, ok := q.typeLimits[row.JobType]; ok && row.Count >= limit {
+				fullTypes = append(fullTypes, row.JobType)
+			}
+		}
+		var fullUsers []uint
+		if err := tx.Model(&Job{}).Select("user_id").
+			Where("status = ?", StatusRunning).Group("user_id").
+			Having("COUNT(*) >= ?", q.perUserLimit).Pluck("user_id", &fullUsers).Error; err != nil {
+			return err
+		}
+
+		q.mu.Lock()
+		types := make([]string, 0, len(q.handlers))
+		for name := range q.handlers {
+			types = append(types, name)
+		}
+		q.mu.Unlock()
+
+		query := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Where("status = ? AND next_run_at <= ? AND type IN ?", StatusQueued, time.Now(), types)
+		if len(fullTypes) > 0 {
+			query = query.Where("type NOT IN ?", fullTypes)
+		}
+		if len(fullUsers) > 0 {
+			query = query.Where("user_id NOT IN ?", fullUsers)
+		}
+		var job Job
+		if err := query.Order("next_run_at asc, id asc").Limit(1).Find(&job).Error; err != nil {
+			return err
+		}
+		if job.ID == 0 {
+			return nil
+		}
+		now := time.Now()
+		if err := tx.Model(&job).Updates(map[string]interface{}{
+			"status":       StatusRunning,
+			"attempts":     gorm.Expr("attempts + 1"),
+			"started_at":   now,
+			"heartbeat_at": now,
+		}).Error; err != nil {
+			return err
+		}
+		job.Status = StatusRunning
+		job.Attempts++
+		job.StartedAt = &now
+		claimed = &job
+		return nil
+	})
+	return claimed, err
+}
+
+func (q *Queue) run(job *Job) {
+	q.mu.Lock()
+	fn := q.handlers[job.Type]
+	ctx, cancel := context.WithCancel(context.Background())
+	q.running[job.ID] = cancel
+	q.mu.Unlock()
+	defer func() {
+		q.mu.Lock()
+		delete(q.running, job.ID)
+		q.mu.Unlock()
+		cancel()
+	}()
+
+	var result interface{}
+	err := func() (err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				err = Permanentf("任务执行异常: %v", r)
+			}
+		}()
+		result, err = fn(ctx, job)
+		return err
+	}()
+
+	now := time.Now()
+	updates := map[string]interface{}{"heartbeat_at": nil}
+	var current Job
+	q.DB.Select("cancel_requested").First(&current, job.ID)
+	switch {
+	case current.CancelRequested:
+		updates["status"] = StatusCanceled
+		updates["error"] = "任务已取消"
+		updates["finished_at"] = now
+	case err == nil:
+		raw, marshalErr := json.Marshal(result)
+		if marshalErr != nil {
+			updates["status"] = StatusFailed
+			updates["error"] = "任务结果无法序列化"
+		} else {
+			updates["status"] = StatusSucceeded
+			updates["result"] = string(raw)
+			updates["error"] = ""
+		}
+		updates["finished_at"] = now
+	default:
+		updates["error"] = err.Error()
+		if IsPermanent(err) || job.Attempts >= job.MaxAttempts {
+			updates["status"] = StatusFailed
+			updates["finished_at"] = now
+		} else {
+			updates["status"] = StatusQueued
+			updates["next_run_at"] = now.Add(q.backoff(job.Attempts))
+		}
+		log.Printf("Job %d (%s) attempt %d/%d failed: %v", job.ID, job.Type, job.Attempts, job.MaxAttempts, err)
+	}
+	if err := q.DB.Model(&Job{}).Where("id = ?", job.ID).Updates(updates).Error; err != nil {
+		log.Printf("Failed to update job %d: %v", job.ID, err)
+	}
+	if _, done := updates["finished_at"]; done {
+		q.finished(job)
+	}
+}
+
+// backoff 指数退避 + 抖动：base * 2^(attempt-1)，上限 5 分钟
+func (q *Queue) backoff(attempt int) time.Duration {
+	d := q.baseBackoff << uint(attempt-1)
+	if d <= 0 || d > maxBackoff {
+		d = maxBackoff
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// maintenanceLoop 为本进程的运行中任务续约心跳，并响应其他实例发起的取消。
+func (q *Queue) maintenanceLoop() {
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		q.mu.Lock()
+		ids := make([]uint, 0, len(q.running))
+		for id := range q.running {
+			ids = append(ids, id)
+		}
+		q.mu.Unlock()
+		if len(ids) > 0 {
+			q.DB.Model(&Job{}).Where("id IN ? AND status = ?", ids, StatusRunning).Update("heartbeat_at", time.Now())
+			var canceled []uint
+			q.DB.Model(&Job{}).Where("id IN ? AND cancel_requested = ?", ids, true).Pluck("id", &canceled)
+			for _, id := range canceled {
+				q.cancelLocal(id)
+			}
+		}
+		q.requeueStale()
+	}
+}
+
+// requeueStale 心跳超时的 running 任务（进程崩溃/重启遗留）重新排队；已请求取消的直接标记为取消。
+func (q *Queue) requeueStale() {
+	cutoff := time.Now().Add(-staleAfter)
+	stale := q.DB.Model(&Job{}).Where("status = ? AND (heartbeat_at IS NULL OR heartbeat_at < ?)", StatusRunning, cutoff)
+	var canceled []Job
+	stale.Session(&gorm.Session{}).Where("cancel_requested = ?", true).Find(&canceled)
+	for i := range canceled {
+		res := q.DB.Model(&Job{}).Where("id = ? AND status = ?", canceled[i].ID, StatusRunning).
+			Updates(map[string]interface{}{"status": StatusCanceled, "error": "任务已取消", "finished_at": time.Now()})
+		if res.RowsAffected > 0 {
+			q.finished(&canceled[i])
+		}
+	}
+	if len(canceled) > 0 {
+		log.Printf("Marked %d orphaned canceled jobs", len(canceled))
+	}
+	if res := stale.Session(&gorm.Session{}).Where("cancel_requested = ?", false).
+		Updates(map[string]interface{}{"status": StatusQueued, "next_run_at": time.Now(), "heartbeat_at": nil}); res.RowsAffected > 0 {
+		log.Printf("Requeued %d orphaned jobs", res.RowsAffected)
+		q.notify()
+	}
+}
+
+func (q *Queue) cancelLocal(id uint) {
+	q.mu.Lock()
+	cancel, ok := q.running[id]
+	q.mu.Unlock()
+	if ok {
+		cancel()
+	}
+}
+
+// Cancel 取消当前用户的任务：排队中的直接取消；运行中的打上取消标记并中断执行。
+func (q *Queue) Cancel(jobID, userID uint) (*Job, error) {
+	var job Job
+	err := q.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("id = ? AND user_id = ?", jobID, userID).First(&job).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrNotFound
+			}
+			return err
+		}
+		if job.Finished() {
+			return nil
+		}
+		updates := map[string]interface{}{"cancel_requested": true}
+		if job.Status == StatusQueued {
+			updates["status"] = StatusCanceled
+			updates["error"] = "任务已取消"
+			updates["finished_at"] = time.Now()
+		}
+		return tx.Model(&job).Updates(updates).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	wasQueued := job.Status == StatusQueued
+	if job.Status == StatusRunning {
+		q.cancelLocal(job.ID)
+	}
+	if err := q.DB.First(&job, job.ID).Error; err != nil {
+		return nil, err
+	}
+	// 排队中被取消的任务不会再进入执行函数，由这里清理
+	if wasQueued && job.Status == StatusCanceled {
+		q.finished(&job)
+	}
+	return &job, nil
+}
+
+// Get 读取当前用户的任务
+func (q *Queue) Get(jobID, userID uint) (*Job, error) {
+	var job Job
+	if err := q.DB.Where("id = ? AND user_id = ?", jobID, userID).First(&job).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	return &job, nil
+}
@@ -7,13 +7,17 @@ import (
 	"net/http"
 	"os"
 	"strings"
+	"time"
 	"workplace/web_service/assignment"
 	"workplace/web_service/auth"
 	"workplace/web_service/chat"
 	"workplace/web_service/config"
 	"workplace/web_service/favorite"
 	"workplace/web_service/grading"
+	"workplace/web_service/jobs"
+	"workplace/web_service/ocr"
 	"workplace/web_service/questionbank"
+	"workplace/web_service/quota"
 	"workplace/web_service/textbook"
 
 	"github.com/gin-contrib/cors"
@@ -49,30 +53,79 @@ func main() {
 	r.Use(cors.New(corsCfg))
 	authHandler := &auth.AuthHandler{DB: db, Mailer: auth.NewSMTPMailerFromEnv()}
 	classHandler := &auth.ClassHandler{DB: db}
-	gradingHandler := &grading.GradingHandler{DB: db}
-	chatHandler := &chat.ChatHandler{DB: db}
-	assignmentHandler := &assignment.AssignmentHandler{DB: db}
+	// 异步 AI 任务队列：批改 / OCR / 讲解等长耗时调用默认走队列（async=0 时同步），前端轮询 /api/jobs/:id
+	jobQueue := jobs.NewQueue(db)
+	jobHandler := &jobs.JobHandler{Queue: jobQueue}
+	gradingHandler := &grading.GradingHandler{DB: db, Jobs: jobQueue}
+	chatHandler := &chat.ChatHandler{DB: db, Jobs: jobQueue}
+	assignmentHandler := &assignment.AssignmentHandler{DB: db, Jobs: jobQueue}
 	textbookHandler := &textbook.TextbookHandler{DB: db}
-	questionBankHandler := &questionbank.QuestionBankHandler{DB: db}
+	questionBankHandler := &questionbank.QuestionBankHandler{DB: db, Jobs: jobQueue}
 	favoriteHandler := &favorite.FavoriteHandler{DB: db}
+	quotaHandler := &quota.QuotaHandler{DB: db}
+	ocrDocumentHandler := &ocr.DocumentHandler{DB: db, Jobs: jobQueue}
+	// 教材解析：重启后接管卡在 processing 的教材，失败的按次数自动重试
+	textbook.StartIngestReconciler(db, time.Minute)
+	// 教材删除：重启后继续推进未完成的跨服务删除
+	textbook.StartDeletionReconciler(db, time.Minute)
+	gradingHandler.RegisterJobs(jobQueue)
+	assignmentHandler.RegisterJobs(jobQueue)
+	questionBankHandler.RegisterJobs(jobQueue)
+	ocrDocumentHandler.RegisterJobs(jobQueue)
+	chatHandler.RegisterJobs(jobQueue)
+	jobQueue.Start()
+	// 在线测验：服务端兜底自动交卷（学生关掉页面后计时依然生效），补排遗留的 AI 批改（需在注册任务类型之后）
+	assignment.StartQuizAutoSubmitter(db, jobQueue, 30*time.Second)
 	api := r.Group("/api")
 	{
 		api.POST("/auth/register", authHandler.Register)
 		api.POST("/auth/login", authHandler.Login)
 		api.POST("/auth/request-code", authHandler.RequestVerificationCode) // 申请验证码（忘记密码 / 未来注册邮箱验证）
 		api.POST("/auth/reset-password", authHandler.ResetPasswordWithCode) // 基于验证码重置密码
+		// ai_service 回调（凭解析记录的一次性 token 鉴权）
+		api.POST("/internal/textbooks/ingest/callback", textbookHandler.IngestCallbackHandler)
 		authed := api.Group("/")
 		authed.Use(auth.AuthMiddleware())
 		{
 			authed.POST("/chat/send", chatHandler.SendMessageHandler)
+			authed.POST("/chat/send/stream", chatHandler.StreamMessageHandler) // SSE 流式回答
 			authed.GET("/chat/models", chatHandler.GetModelOptionsHandler)
 			authed.GET("/chat/sessions", chatHandler.GetSessionsHandler)
+			authed.PATCH("/chat/sessions/:id", chatHandler.UpdateSessionHandler)  // 重命名 / 置顶 / 归档
+			authed.DELETE("/chat/sessions/:id", chatHandler.DeleteSessionHandler) // 移入回收站
+			authed.GET("/chat/trash", chatHandler.ListTrashHandler)
+			authed.POST("/chat/trash/:id/restore", chatHandler.RestoreSessionHandler)
+			authed.DELETE("/chat/trash/:id", chatHandler.PurgeSessionHandler)
+			authed.GET("/chat/search", chatHandler.SearchHandler)
+			authed.GET("/chat/sessions/:id/export", chatHandler.ExportSessionHandler) // format=md|tex|pdf
+			authed.GET("/chat/export", chatHandler.ExportAllSessionsHandler)          // 全部会话打包为 ZIP
+			authed.POST("/chat/sessions/:id/shares", chatHandler.CreateShareHandler)  // 创建只读分享（快照）
+			authed.GET("/chat/shares", chatHandler.ListMySharesHandler)
+			authed.DELETE("/chat/shares/:id", chatHandler.RevokeShareHandler)
+			authed.GET("/chat/shared/:token", chatHandler.GetSharedSessionHandler)
+			authed.GET("/chat/shared-with-me", chatHandler.ListSharedWithMeHandler)
+			authed.GET("/chat/recommended", chatHandler.ListRecommendedHandler) // 班级推荐讲解
 			authed.GET("/chat/messages/:id", chatHandler.GetMessagesHandler)
-			authed.POST("/chat/messages/:id/feedback", chatHandler.SubmitFeedbackHandler) // 新增点赞路由
+			authed.POST("/chat/messages/:id/feedback", chatHandler.SubmitFeedbackHandler)      // 新增点赞路由
+			authed.POST("/chat/messages/:id/edit", chatHandler.EditMessageHandler)             // 编辑用户消息并在新分支重新回答
+			authed.POST("/chat/messages/:id/regenerate", chatHandler.RegenerateMessageHandler) // 重新生成 AI 回答（可换 model_id）
+			authed.PUT("/chat/sessions/:id/branch", chatHandler.SwitchBranchHandler)           // 切换活动分支
+			authed.GET("/chat/attachments/:id", chatHandler.ServeAttachmentHandler)            // 会话附件（仅本人）
+			authed.GET("/textbooks/:id/pages/:page", textbookHandler.ServePageHandler)         // 引用溯源：教材单页图片 / PDF
 			authed.POST("/grading/upload", gradingHandler.GradeHomeworkHandler)
+			authed.POST("/grading/upload/stream", gradingHandler.StreamGradeHandler) // SSE 流式批改
 			authed.POST("/grading/ocr", gradingHandler.OcrHandler)
+			// 多文件按页识别 → 识别文档（学生校对后供批改/提交按 ID 引用）
+			authed.POST("/ocr/batch", ocrDocumentHandler.BatchHandler)
+			authed.GET("/ocr/documents", ocrDocumentHandler.ListDocumentsHandler)
+			authed.GET("/ocr/documents/:id", ocrDocumentHandler.GetDocumentHandler)
+			authed.PUT("/ocr/documents/:id", ocrDocumentHandler.UpdateDocumentHandler)
 			// **↓↓↓ 新增的答疑路由 ↓↓↓**
 			authed.POST("/grading/followup", gradingHandler.StartFollowUpChatHandler)
+			// AI 批改历史（仅本人）
+			authed.GET("/grading/history", gradingHandler.ListGradeHistoryHandler)
+			authed.GET("/grading/history/:id", gradingHandler.GetGradeResultHandler)
+			authed.DELETE("/grading/history/:id", gradingHandler.DeleteGradeResultHandler)
 			authed.GET("/assignments/:id/problem-file", assignmentHandler.ServeAssignmentProblemFileHandler)
 			// 题库检索（转发 ai_service 混合检索）
 			authed.POST("/questions/search", questionBankHandler.Search)
@@ -84,6 +137,11 @@ func main() {
 			authed.POST("/favorites", favoriteHandler.Add)
 			authed.DELETE("/favorites/:exerciseId", favoriteHandler.Remove)
 			authed.GET("/favorites", favoriteHandler.List)
+			// 异步任务状态 / 取消（仅本人）
+			authed.GET("/jobs/:id", jobHandler.GetJobHandler)
+			authed.POST("/jobs/:id/cancel", jobHandler.CancelJobHandler)
+			// AI 用量与配额（仅本人）
+			authed.GET("/me/usage", quotaHandler.MyUsageHandler)
 		}
 		// ... (下方路由保持不变) ...
 		teacherRoutes := api.Group("/teacher")
@@ -95,11 +153,30 @@ func main() {
 			teacherRoutes.PATCH("/classes/:id/week", classHandler.UpdateClassWeek)               // 更新班级当前教学周
 			teacherRoutes.POST("/classes/:id/weekly_content", classHandler.UploadWeeklyMaterial) // 上传每周课件总结
 			teacherRoutes.PUT("/classes/:id/textbooks", textbookHandler.SetClassTextbooks)       // 设置班级可访问教材
+			teacherRoutes.GET("/classes/:id/usage", quotaHandler.ClassUsageHandler)              // 本班学生 AI 用量
+			teacherRoutes.GET("/classes/:id/quotas", quotaHandler.GetClassRulesHandler)          // 本班 AI 配额
+			teacherRoutes.PUT("/classes/:id/quotas", quotaHandler.SetClassRulesHandler)          // 设置本班 AI 配额
+
+			teacherRoutes.POST("/classes/:id/recommended", chatHandler.RecommendShareHandler)            // 推荐分享的讲解到班级
+			teacherRoutes.DELETE("/classes/:id/recommended/:recId", chatHandler.UnrecommendShareHandler) // 取消推荐
+
+			teacherRoutes.GET("/classes/:id/feedback", chatHandler.FeedbackAnalyticsHandler)                                  // 学生对 AI 回答的评价（按周 / 模型 / 主题）
+			teacherRoutes.GET("/classes/:id/feedback/queue", chatHandler.FeedbackQueueHandler)                                // 被点踩回答的复核队列
+			teacherRoutes.PUT("/classes/:id/feedback/messages/:messageId/correction", chatHandler.SaveCorrectionHandler)      // 写入更正，学生端随消息展示
+			teacherRoutes.DELETE("/classes/:id/feedback/messages/:messageId/correction", chatHandler.DeleteCorrectionHandler) // 撤回更正
+			teacherRoutes.GET("/classes/:id/feedback/export", chatHandler.ExportFeedbackDatasetHandler)                       // JSONL 偏好数据集（学生假名化）
 			teacherRoutes.POST("/assignments", assignmentHandler.CreateAssignmentHandler)
 			teacherRoutes.GET("/assignments", assignmentHandler.ListAssignmentsHandler)
 			teacherRoutes.GET("/assignments/:id", assignmentHandler.GetAssignmentHandler)
+			teacherRoutes.PUT("/assignments/:id/problem-file-text", assignmentHandler.UpdateProblemFileTextHandler) // 修订附件识别文字
+			teacherRoutes.PUT("/assignments/:id/integrity", assignmentHandler.SetIntegrityModeHandler)              // 开启/关闭作业诚信模式
+			teacherRoutes.GET("/assignments/:id/integrity-events", assignmentHandler.ListIntegrityEventsHandler)    // 被切换为只给提示的提问记录
 			teacherRoutes.GET("/submission/file/:id", assignmentHandler.ServeSubmissionFileHandler)
 			teacherRoutes.POST("/submission/:id/comment", assignmentHandler.AddCommentHandler)
+			teacherRoutes.GET("/assignments/:id/ai-usage", gradingHandler.AssignmentAIUsageHandler)          // 本班学生 AI 自主批改使用情况
+			teacherRoutes.GET("/assignments/:id/quiz/attempts", assignmentHandler.ListQuizAttemptsHandler)   // 测验作答与得分
+			teacherRoutes.PUT("/quiz/answers/:id/grade", assignmentHandler.GradeQuizAnswerHandler)           // 主观题评分 / 覆盖自动判分
+			teacherRoutes.POST("/quiz/attempts/:id/ai-grade", assignmentHandler.RequestQuizAIGradingHandler) // 主观题交给 AI 批改
 
 			// 题库：老师录入题目答案/解析
 			teacherRoutes.PUT("/questions/:id/answer", questionBankHandler.SetAnswer)
@@ -108,7 +185,16 @@ func main() {
 			teacherRoutes.GET("/textbooks", textbookHandler.GetTextbooks)
 			teacherRoutes.POST("/textbooks", textbookHandler.UploadTextbook)
 			teacherRoutes.POST("/textbooks/:id/cancel", textbookHandler.CancelTextbook)
-			teacherRoutes.DELETE("/textbooks/:id", textbookHandler.DeleteTextbook)
+			teacherRoutes.POST("/textbooks/:id/retry", textbookHandler.RetryTextbook)                    // 重试解析失败的教材
+			teacherRoutes.GET("/textbooks/:id/versions", textbookHandler.ListTextbookVersions)           // 教材版本历史
+			teacherRoutes.POST("/textbooks/:id/versions", textbookHandler.UploadTextbookVersion)         // 上传新版本，解析完成后自动切换
+			teacherRoutes.PUT("/textbooks/:id/visibility", textbookHandler.SetVisibilityHandler)         // 可见范围：private / shared / institution
+			teacherRoutes.GET("/textbooks/:id/shares", textbookHandler.ListSharesHandler)                // 教材授权给了哪些老师
+			teacherRoutes.POST("/textbooks/:id/shares", textbookHandler.AddShareHandler)                 // 授权给指定老师
+			teacherRoutes.DELETE("/textbooks/:id/shares/:teacherId", textbookHandler.RemoveShareHandler) // 收回授权
+			teacherRoutes.POST("/textbooks/:id/transfer", textbookHandler.TransferOwnershipHandler)      // 转让给其他老师
+			teacherRoutes.GET("/textbooks/:id/dependencies", textbookHandler.DependenciesHandler)        // 删除前查看哪些作业、收藏引用了教材题目
+			teacherRoutes.DELETE("/textbooks/:id", textbookHandler.DeleteTextbook)                       // 删除教材：有作业或收藏引用时需 cascade=1
 		}
 		studentRoutes := api.Group("/student")
 		studentRoutes.Use(auth.AuthMiddleware(), auth.StudentMiddleware())
@@ -118,6 +204,10 @@ func main() {
 			studentRoutes.GET("/assignments", assignmentHandler.ListAssignmentsHandler)
 			studentRoutes.GET("/assignments/:id", assignmentHandler.GetAssignmentHandler)
 			studentRoutes.POST("/assignments/submit", assignmentHandler.SubmitAssignmentHandler)
+			studentRoutes.POST("/assignments/:id/quiz/start", assignmentHandler.StartQuizHandler) // 开始/继续在线测验
+			studentRoutes.GET("/quiz/attempts/:id", assignmentHandler.GetQuizAttemptHandler)
+			studentRoutes.PUT("/quiz/attempts/:id/answers", assignmentHandler.SaveQuizAnswersHandler)
+			studentRoutes.POST("/quiz/attempts/:id/submit", assignmentHandler.SubmitQuizHandler)
 		}
 		api.GET("/health/db", func(c *gin.Context) {
 			sqlDB, err := db.DB()
@@ -0,0 +1,339 @@
+// web_service/ocr/documents.go
+package ocr
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"workplace/web_service/accesscontrol"
+	"workplace/web_service/aiclient"
+	"workplace/web_service/jobs"
+	"workplace/web_service/quota"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const (
+	JobTypeBatch  = "ocr_batch"
+	MaxBatchFiles = 10 // 学生一般拍 3-6 张，封顶防滥用
+)
+
+// ErrDocumentNotFound 识别文档不存在或不属于当前用户
+var ErrDocumentNotFound = errors.New("识别文档不存在")
+
+// Document 一次多文件识别的结果：逐页原文 + 合并后由学生校对的文本，批改/提交作业按 ID 引用，无需重复识别。
+type Document struct {
+	ID        uint           `gorm:"primarykey" json:"id"`
+	UserID    uint           `gorm:"index;not null" json:"-"`
+	Title     string         `gorm:"size:255" json:"title"`
+	UseVision bool           `json:"useVision"`
+	Pages     string         `gorm:"type:text" json:"-"` // JSON []Page，保留识别原文便于对照
+	Text      string         `gorm:"type:text" json:"text"`
+	Edited    bool           `gorm:"default:false" json:"edited"` // 学生是否修改过合并文本
+	CreatedAt time.Time      `json:"createdAt"`
+	UpdatedAt time.Time      `json:"updatedAt"`
+	DeletedAt gorm.DeletedAt `gorm:"index" json:"-"`
+}
+
+func (Document) TableName() string { return "ocr_documents" }
+
+// MarshalJSON 把逐页结果以数组返回
+func (d Document) MarshalJSON() ([]byte, error) {
+	type alias Document
+	out := struct {
+		alias
+		Pages json.RawMessage `json:"pages,omitempty"`
+	}{alias: alias(d)}
+	if d.Pages != "" && json.Valid([]byte(d.Pages)) {
+		out.Pages = json.RawMessage(d.Pages)
+	}
+	return json.Marshal(out)
+}
+
+// LoadDocumentText 取当前用户某份识别文档的（校对后）文本
+func LoadDocumentText(db *gorm.DB, userID, documentID uint) (string, error) {
+	var doc Document
+	err := db.Select("id", "text").Where("user_id = ?", userID).First(&doc, documentID).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return "", ErrDocumentNotFound
+	}
+	if err != nil {
+		return "", err
+	}
+	return doc.Text, nil
+}
+
+type DocumentHandler struct {
+	DB   *gorm.DB
+	Jobs *jobs.Queue
+}
+
+// batchFile 异步批量识别的单个文件：上传时先落盘，任务结束后删除
+type batchFile struct {
+	Path        string `json:"path"`
+	Filename    string `json:"filename"`
+	ContentType string `json:"contentType,omitempty"`
+}
+
+type batchRequest struct {
+	Files     []batchFile `json:"files"`
+	UseVision bool        `json:"useVision,omitempty"`
+	Title     string      `json:"title,omitempty"`
+}
+
+// recognizeBatch 按上传顺序逐个文件按页识别，合并后保存为识别文档
+func (h *DocumentHandler) recognizeBatch(ctx context.Context, userID uint, files []Request, useVision bool, title string) (*Document, error) {
+	var pages []Page
+	for i, file := range files {
+		file.UseVision = useVision
+		filePages, _, err := RecognizePages(ctx, h.DB, file, 180*time.Second)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range filePages {
+			p.FileIndex = i
+			pages = append(pages, p)
+		}
+	}
+	pagesJSON, err := json.Marshal(pages)
+	if err != nil {
+		return nil, err
+	}
+	if title == "" {
+		title = files[0].Filename
+		if len(files) > 1 {
+			title = fmt.Sprintf("%s 等 %d 个文件", files[0].Filename, len(files))
+		}
+	}
+	doc := Document{
+		UserID:    userID,
+		Title:     title,
+		UseVision: useVision,
+		Pages:     string(pagesJSON),
+		Text:      MergePages(pages),
+	}
+	if err := h.DB.Create(&doc).Error; err != nil {
+		return nil, err
+	}
+	return &doc, nil
+}
+
+// respondRecognizeError 把识别错误映射为 HTTP 响应
+func respondRecognizeError(c *gin.Context, err error) {
+	var statusErr *aiclient.StatusError
+	switch {
+	case errors.As(err, &statusErr):
+		c.JSON(statusErr.Status, gin.H{"error": string(statusErr.Body)})
+	case c.Request.Context().Err() != nil:
+	default:
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "AI service is unreachable"})
+	}
+}
+
+// BatchHandler 多文件按页识别：files 的上传顺序即页序，返回逐页文本/置信度并保存为识别文档。
+// 默认文件先落盘，结果（识别文档）通过 GET /api/jobs/:id 轮询；async=0 时同步返回。
+func (h *DocumentHandler) BatchHandler(c *gin.Context) {
+	userID, ok := accesscontrol.CurrentUserID(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "未登录"})
+		return
+	}
+	form, err := c.MultipartForm()
+	if err != nil || len(form.File["files"]) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "No file for OCR"})
+		return
+	}
+	uploads := form.File["files"]
+	if len(uploads) > MaxBatchFiles {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("一次最多识别 %d 个文件", MaxBatchFiles)})
+		return
+	}
+	useVision, _ := strconv.ParseBool(c.PostForm("use_vision"))
+	title := strings.TrimSpace(c.PostForm("title"))
+	if !quota.Check(h.DB, c, quota.BucketOCR) {
+		return
+	}
+
+	if jobs.WantsAsync(c) {
+		uploadDir := "./uploads/jobs"
+		if err := os.MkdirAll(uploadDir, os.ModePerm); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create upload directory"})
+			return
+		}
+		req := batchRequest{UseVision: useVision, Title: title}
+		for i, file := range uploads {
+			path := filepath.Join(uploadDir, fmt.Sprintf("ocr-batch-%d-%d-%d-%s", userID, time.Now().UnixNano(), i, filepath.Base(file.Filename)))
+			if err := c.SaveUploadedFile(file, path); err != nil {
+				removeBatchFiles(req.Files)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save file"})
+				return
+			}
+			req.Files = append(req.Files, batchFile{Path: path, Filename: file.Filename, ContentType: file.Header.Get("Content-Type")})
+		}
+		job, err := h.Jobs.Enqueue(JobTypeBatch, userID, req, 0)
+		if err != nil {
+			removeBatchFiles(req.Files)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "创建识别任务失败"})
+			return
+		}
+		jobs.Accepted(c, job)
+		return
+	}
+
+	files := make([]Request, 0, len(uploads))
+	for _, file := range uploads {
+		src, err := file.Open()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to open OCR file"})
+			return
+		}
+		data, err := io.ReadAll(src)
+		src.Close()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to copy OCR file content"})
+			return
+		}
+		files = append(files, Request{Data: data, Filename: file.Filename, ContentType: file.Header.Get("Content-Type")})
+	}
+	doc, err := h.recognizeBatch(c.Request.Context(), userID, files, useVision, title)
+	if err != nil {
+		respondRecognizeError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, doc)
+}
+
+func removeBatchFiles(files []batchFile) {
+	for _, f := range files {
+		os.Remove(f.Path)
+	}
+}
+
+// RegisterJobs 注册批量识别任务
+func (h *DocumentHandler) RegisterJobs(q *jobs.Queue) {
+	q.Register(JobTypeBatch, func(ctx context.Context, job *jobs.Job) (interface{}, error) {
+		var req batchRequest
+		if err := job.DecodePayload(&req); err != nil {
+			return nil, err
+		}
+		if len(req.Files) == 0 {
+			return nil, jobs.Permanentf("没有待识别的文件")
+		}
+		files := make([]Request, 0, len(req.Files))
+		for _, f := range req.Files {
+			data, err := os.ReadFile(f.Path)
+			if err != nil {
+				return nil, jobs.Permanentf("待识别文件已丢失")
+			}
+			files = append(files, Request{Data: data, Filename: f.Filename, ContentType: f.ContentType})
+		}
+		doc, err := h.recognizeBatch(ctx, job.UserID, files, req.UseVision, req.Title)
+		if err != nil {
+			var statusErr *aiclient.StatusError
+			if errors.As(err, &statusErr) && statusErr.Status < http.StatusInternalServerError {
+				err = jobs.Permanent(err)
+			}
+			return nil, err
+		}
+		return doc, nil
+	})
+	// 临时文件在任务结束后删除（含排队中被取消、孤儿任务被清扫），还会重试时保留
+	q.OnFinished(JobTypeBatch, func(job *jobs.Job) {
+		var req batchRequest
+		if job.DecodePayload(&req) == nil {
+			removeBatchFiles(req.Files)
+		}
+	})
+}
+
+func (h *DocumentHandler) loadDocument(c *gin.Context) (Document, bool) {
+	var doc Document
+	userID, ok := accesscontrol.CurrentUserID(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "未登录"})
+		return doc, false
+	}
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil || id <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "识别文档 ID 不合法"})
+		return doc, false
+	}
+	if err := h.DB.Where("user_id = ?", userID).First(&doc, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": ErrDocumentNotFound.Error()})
+		return doc, false
+	}
+	return doc, true
+}
+
+// ListDocumentsHandler 当前用户最近的识别文档（不含逐页原文）
+func (h *DocumentHandler) ListDocumentsHandler(c *gin.Context) {
+	userID, ok := accesscontrol.CurrentUserID(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "未登录"})
+		return
+	}
+	var docs []Document
+	if err := h.DB.Omit("pages").Where("user_id = ?", userID).
+		Order("updated_at desc, id desc").Limit(50).Find(&docs).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "读取识别文档失败"})
+		return
+	}
+	c.JSON(http.StatusOK, docs)
+}
+
+// GetDocumentHandler 查看识别文档（含逐页原文与置信度）
+func (h *DocumentHandler) GetDocumentHandler(c *gin.Context) {
+	doc, ok := h.loadDocument(c)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, doc)
+}
+
+// UpdateDocumentHandler 保存学生校对后的合并文本 / 标题
+func (h *DocumentHandler) UpdateDocumentHandler(c *gin.Context) {
+	doc, ok := h.loadDocument(c)
+	if !ok {
+		return
+	}
+	var req struct {
+		Text  *string `json:"text"`
+		Title *string `json:"title"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || (req.Text == nil && req.Title == nil) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "请求参数不合法"})
+		return
+	}
+	updates := map[string]interface{}{}
+	if req.Text != nil {
+		if strings.TrimSpace(*req.Text) == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "识别文本不能为空"})
+			return
+		}
+		updates["text"] = *req.Text
+		updates["edited"] = true
+	}
+	if req.Title != nil {
+		title := strings.TrimSpace(*req.Title)
+		if title == "" || len([]rune(title)) > 100 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "标题长度需在 1-100 字之间"})
+			return
+		}
+		updates["title"] = title
+	}
+	if err := h.DB.Model(&doc).Updates(updates).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "保存识别文本失败"})
+		return
+	}
+	h.DB.First(&doc, doc.ID)
+	c.JSON(http.StatusOK, doc)
+}
@@ -0,0 +1,157 @@
+// web_service/ocr/ocr.go
+package ocr
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"workplace/web_service/aiclient"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	ModeText   = "text"   // 默认：PDF 走文字层，图片走 OCR 模型
+	ModeVision = "vision" // 扫描件/手写：PDF 逐页走视觉模型
+)
+
+// CacheEntry OCR 结果缓存，按 文件内容 sha256 + 识别模式 寻址；同一份文件只识别一次。
+type CacheEntry struct {
+	ID          uint      `gorm:"primarykey" json:"id"`
+	ContentHash string    `gorm:"size:64;not null;uniqueIndex:idx_ocr_cache_key" json:"contentHash"`
+	Mode        string    `gorm:"size:20;not null;uniqueIndex:idx_ocr_cache_key" json:"mode"`
+	Text        string    `gorm:"type:text" json:"text"`
+	Response    string    `gorm:"type:text" json:"-"` // ai_service 原始响应 JSON，OcrHandler 原样回给前端
+	HitCount    int       `gorm:"default:0" json:"hitCount"`
+	CreatedAt   time.Time `json:"createdAt"`
+	UpdatedAt   time.Time `json:"updatedAt"`
+}
+
+func (CacheEntry) TableName() string { return "ocr_cache_entries" }
+
+// Request 一次识别请求
+type Request struct {
+	Data        []byte
+	Filename    string
+	ContentType string
+	UseVision   bool
+}
+
+// Result 识别结果；Status/Body 为 ai_service 的原始响应（缓存命中时为 200 + 缓存的响应体）
+type Result struct {
+	Status int
+	Body   []byte
+	Text   string
+	Cached bool
+}
+
+// Mode 请求对应的缓存模式
+func (r Request) Mode() string {
+	if r.UseVision {
+		return ModeVision
+	}
+	return ModeText
+}
+
+// HashBytes 文件内容的 sha256（十六进制）
+func HashBytes(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// Recognize 先查缓存，未命中再调 ai_service /api/v1/ocr；只缓存成功的结果。
+// 网络错误返回 err；ai_service 返回 4xx/5xx 时 err 为 nil，由调用方按 Status 处理。
+func Recognize(ctx context.Context, db *gorm.DB, req Request, timeout time.Duration) (Result, error) {
+	hash := HashBytes(req.Data)
+	mode := req.Mode()
+
+	var entry CacheEntry
+	if err := db.Where("content_hash = ? AND mode = ?", hash, mode).Limit(1).Find(&entry).Error; err == nil && entry.ID != 0 {
+		db.Model(&CacheEntry{}).Where("id = ?", entry.ID).UpdateColumn("hit_count", gorm.Expr("hit_count + 1"))
+		return Result{Status: http.StatusOK, Body: []byte(entry.Response), Text: entry.Text, Cached: true}, nil
+	}
+
+	resp, err := postFile(ctx, "/api/v1/ocr", "file", req, timeout)
+	if err != nil {
+		return Result{}, err
+	}
+	defer resp.Body.Close()
+	responseBody, _ := io.ReadAll(resp.Body)
+	result := Result{Status: resp.StatusCode, Body: responseBody}
+	if resp.StatusCode >= http.StatusBadRequest {
+		return result, nil
+	}
+
+	var parsed struct {
+		Text string `json:"text"`
+	}
+	if err := json.Unmarshal(responseBody, &parsed); err != nil {
+		return result, nil
+	}
+	result.Text = strings.TrimSpace(parsed.Text)
+	if result.Text != "" {
+		entry = CacheEntry{ContentHash: hash, Mode: mode, Text: result.Text, Response: string(responseBody)}
+		if err := db.Clauses(clause.OnConflict{DoNothing: true}).Create(&entry).Error; err != nil {
+			log.Printf("Failed to cache OCR result: %v", err)
+		}
+	}
+	return result, nil
+}
+
+// postFile 以 multipart 表单把单个文件（表单字段 field）发给 ai_service 的 OCR 接口
+func postFile(ctx context.Context, path, field string, req Request, timeout time.Duration) (*http.Response, error) {
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	header := make(textproto.MIMEHeader)
+	header.Set("Content-Disposition", fmt.Sprintf(`form-data; name="%s"; filename="%s"`, field, filepath.Base(req.Filename)))
+	if req.ContentType != "" {
+		header.Set("Content-Type", req.ContentType)
+	}
+	part, err := writer.CreatePart(header)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := part.Write(req.Data); err != nil {
+		return nil, err
+	}
+	// 是否用视觉模型识别 PDF（扫描件/手写选 true，默认走 PyMuPDF 文字层）
+	_ = writer.WriteField("use_vision", fmt.Sprint(req.UseVision))
+	writer.Close()
+
+	httpReq, err := http.NewRequestWithContext(ctx, "POST", aiclient.URL(path), body)
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", writer.FormDataContentType())
+	client := &http.Client{Timeout: timeout}
+	return client.Do(httpReq)
+}
+
+// RecognizeFile 识别磁盘上的文件（作业附件等），失败时返回带 ai_service 响应的错误。
+func RecognizeFile(ctx context.Context, db *gorm.DB, path, name string, useVision bool, timeout time.Duration) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	result, err := Recognize(ctx, db, Request{Data: data, Filename: name, UseVision: useVision}, timeout)
+	if err != nil {
+		return "", err
+	}
+	if result.Status >= http.StatusBadRequest {
+		return "", fmt.Errorf("题目附件识别失败: %s", string(result.Body))
+	}
+	return result.Text, nil
+}
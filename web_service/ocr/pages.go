@@ -0,0 +1,119 @@
+// web_service/ocr/pages.go
+package ocr
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+	"workplace/web_service/aiclient"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	ModePages       = "pages"        // 按页识别（文字层）
+	ModePagesVision = "pages_vision" // 按页识别（视觉模型）
+)
+
+// Page 一页识别结果；FileIndex/Filename 表示来自第几个上传文件
+type Page struct {
+	FileIndex  int     `json:"fileIndex"`
+	Filename   string  `json:"filename"`
+	Page       int     `json:"page"`
+	Text       string  `json:"text"`
+	Confidence float64 `json:"confidence"` // 0-1，ai_service 启发式估计，低分页提示学生重点核对
+	Method     string  `json:"method"`     // text_layer / vision / plain
+	Error      string  `json:"error,omitempty"`
+}
+
+// aiPage ai_service /api/v1/ocr/pages 返回的单页结构
+type aiPage struct {
+	Page       int     `json:"page"`
+	Text       string  `json:"text"`
+	Confidence float64 `json:"confidence"`
+	Method     string  `json:"method"`
+	Error      string  `json:"error,omitempty"`
+}
+
+// RecognizePages 按页识别单个文件，结果按 文件 sha256 + 模式 缓存；有页面识别出错时不写缓存，下次重试。
+func RecognizePages(ctx context.Context, db *gorm.DB, req Request, timeout time.Duration) ([]Page, bool, error) {
+	hash := HashBytes(req.Data)
+	mode := ModePages
+	if req.UseVision {
+		mode = ModePagesVision
+	}
+
+	var entry CacheEntry
+	if err := db.Where("content_hash = ? AND mode = ?", hash, mode).Limit(1).Find(&entry).Error; err == nil && entry.ID != 0 {
+		var cached []aiPage
+		if err := json.Unmarshal([]byte(entry.Response), &cached); err == nil {
+			db.Model(&CacheEntry{}).Where("id = ?", entry.ID).UpdateColumn("hit_count", gorm.Expr("hit_count + 1"))
+			return toPages(cached, req.Filename), true, nil
+		}
+	}
+
+	resp, err := postFile(ctx, "/api/v1/ocr/pages", "files", req, timeout)
+	if err != nil {
+		return nil, false, err
+	}
+	defer resp.Body.Close()
+	responseBody, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode >= http.StatusBadRequest {
+		return nil, false, &aiclient.StatusError{Status: resp.StatusCode, Body: responseBody}
+	}
+	var parsed struct {
+		Pages []aiPage `json:"pages"`
+	}
+	if err := json.Unmarshal(responseBody, &parsed); err != nil {
+		return nil, false, fmt.Errorf("解析识别结果失败: %w", err)
+	}
+
+	complete := len(parsed.Pages) > 0
+	texts := make([]string, 0, len(parsed.Pages))
+	for _, p := range parsed.Pages {
+		if p.Error != "" {
+			complete = false
+		}
+		texts = append(texts, p.Text)
+	}
+	if complete {
+		raw, _ := json.Marshal(parsed.Pages)
+		entry = CacheEntry{ContentHash: hash, Mode: mode, Text: strings.TrimSpace(strings.Join(texts, "\n\n")), Response: string(raw)}
+		if err := db.Clauses(clause.OnConflict{DoNothing: true}).Create(&entry).Error; err != nil {
+			log.Printf("Failed to cache OCR pages: %v", err)
+		}
+	}
+	return toPages(parsed.Pages, req.Filename), false, nil
+}
+
+func toPages(in []aiPage, filename string) []Page {
+	pages := make([]Page, 0, len(in))
+	for _, p := range in {
+		pages = append(pages, Page{
+			Filename:   filename,
+			Page:       p.Page,
+			Text:       strings.TrimSpace(p.Text),
+			Confidence: p.Confidence,
+			Method:     p.Method,
+			Error:      p.Error,
+		})
+	}
+	return pages
+}
+
+// MergePages 按页序合并为一份文本，空白页跳过
+func MergePages(pages []Page) string {
+	parts := make([]string, 0, len(pages))
+	for _, p := range pages {
+		if p.Text != "" {
+			parts = append(parts, p.Text)
+		}
+	}
+	return strings.Join(parts, "\n\n")
+}
@@ -3,6 +3,7 @@ package questionbank
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"io"
 	"mime/multipart"
@@ -12,14 +13,19 @@ import (
 	"time"
 	"workplace/web_service/accesscontrol"
 	"workplace/web_service/aiclient"
+	"workplace/web_service/assignment"
+	"workplace/web_service/auth"
 	"workplace/web_service/chat"
+	"workplace/web_service/jobs"
+	"workplace/web_service/quota"
 
 	"github.com/gin-gonic/gin"
 	"gorm.io/gorm"
 )
 
 type QuestionBankHandler struct {
-	DB *gorm.DB
+	DB   *gorm.DB
+	Jobs *jobs.Queue
 }
 
 // SearchRequest 题库检索入参（透传给 ai_service）
@@ -162,51 +168,51 @@ type exerciseBrief struct {
 	TextbookName   string
 }
 
-// Explain 学生端：把题目作为上下文请 AI 讲解，落成一个新会话，返回 chatSessionId 供前端跳转。
-func (h *QuestionBankHandler) Explain(c *gin.Context) {
-	uid, ok := accesscontrol.CurrentUserID(c)
-	if !ok {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "未登录"})
-		return
-	}
-	id, err := strconv.Atoi(c.Param("id"))
-	if err != nil || id <= 0 {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "无效的题目 ID"})
-		return
-	}
+// explainRequest 题目讲解任务的 payload；TextbookIDs 为发起时的班级教材范围快照
+type explainRequest struct {
+	ExerciseID  int    `json:"exerciseId"`
+	Restricted  bool   `json:"restricted"`
+	TextbookIDs []uint `json:"textbookIds,omitempty"`
+}
 
-	allowedIDs, restricted, _, err := accesscontrol.AllowedTextbookIDsForContext(h.DB, c)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "读取班级教材范围失败"})
-		return
-	}
+// explainExercise 讲解核心逻辑：取题 → 调 AI → 落成新会话。
+func (h *QuestionBankHandler) explainExercise(ctx context.Context, uid uint, req explainRequest) (gin.H, error) {
 	q := h.DB.Table("textbook_exercises").
 		Select("stem, answer, solution, exercise_number, textbook_name").
-		Where("id = ?", id)
-	if restricted {
-		if len(allowedIDs) == 0 {
-			c.JSON(http.StatusForbidden, gin.H{"error": "该题目不在当前班级资料范围内"})
-			return
+		Where("id = ?", req.ExerciseID)
+	if req.Restricted {
+		if len(req.TextbookIDs) == 0 {
+			return nil, jobs.NewStatusError(http.StatusForbidden, "该题目不在当前班级资料范围内")
 		}
-		q = q.Where("textbook_id IN ?", allowedIDs)
+		q = q.Where("textbook_id IN ?", req.TextbookIDs)
 	}
 	var ex exerciseBrief
 	if err := q.Limit(1).Scan(&ex).Error; err != nil || strings.TrimSpace(ex.Stem) == "" {
-		c.JSON(http.StatusNotFound, gin.H{"error": "题目不存在或无权访问"})
-		return
+		return nil, jobs.NewStatusError(http.StatusNotFound, "题目不存在或无权访问")
+	}
+
+	// 题目属于开启诚信模式的在做作业时只给提示，也不把参考答案/解析交给 AI
+	hintOnly := false
+	var user auth.User
+	if err := h.DB.First(&user, uid).Error; err == nil {
+		hintOnly = assignment.HintOnly(h.DB, user, assignment.IntegritySourceExplain, ex.Stem, uint(req.ExerciseID))
 	}
 
 	// 构造讲解 prompt（老师录入的答案/解析作为参考，但要求 AI 讲清思路）
 	var sb strings.Builder
-	sb.WriteString("请作为线性代数老师，详细讲解下面这道题目的解题思路、用到的知识点和完整步骤，并指出常见易错点。\n\n")
+	if hintOnly {
+		sb.WriteString("请作为线性代数老师，针对下面这道题目给出解题提示：点明用到的知识点和思考方向，不要给出完整步骤和最终答案。\n\n")
+	} else {
+		sb.WriteString("请作为线性代数老师，详细讲解下面这道题目的解题思路、用到的知识点和完整步骤，并指出常见易错点。\n\n")
+	}
 	if ex.ExerciseNumber != "" {
 		sb.WriteString("题号：" + ex.ExerciseNumber + "\n")
 	}
 	sb.WriteString("题目：\n" + ex.Stem + "\n")
-	if strings.TrimSpace(ex.Answer) != "" {
+	if !hintOnly && strings.TrimSpace(ex.Answer) != "" {
 		sb.WriteString("\n参考答案：" + ex.Answer + "\n")
 	}
-	if strings.TrimSpace(ex.Solution) != "" {
+	if !hintOnly && strings.TrimSpace(ex.Solution) != "" {
 		sb.WriteString("\n参考解析：" + ex.Solution + "\n")
 	}
 
@@ -216,31 +222,34 @@ func (h *QuestionBankHandler) Explain(c *gin.Context) {
 	_ = writer.WriteField("prompt", sb.String())
 	_ = writer.WriteField("is_first_message", "true")
 	_ = writer.WriteField("user_id", strconv.Itoa(int(uid)))
-	if restricted {
-		if idsJSON, marshalErr := json.Marshal(allowedIDs); marshalErr == nil {
+	if hintOnly {
+		_ = writer.WriteField("hint_only", "true")
+	}
+	if req.Restricted {
+		if idsJSON, marshalErr := json.Marshal(req.TextbookIDs); marshalErr == nil {
 			_ = writer.WriteField("textbook_ids", string(idsJSON))
 		}
 	}
 	writer.Close()
 
-	proxyReq, _ := http.NewRequest("POST", aiclient.URL("/api/v1/chat"), reqBody)
+	proxyReq, _ := http.NewRequestWithContext(ctx, "POST", aiclient.URL("/api/v1/chat"), reqBody)
 	proxyReq.Header.Set("Content-Type", writer.FormDataContentType())
 	client := &http.Client{Timeout: 180 * time.Second}
 	resp, err := client.Do(proxyReq)
 	if err != nil {
-		c.JSON(http.StatusBadGateway, gin.H{"error": "AI 服务不可用"})
-		return
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, jobs.NewStatusError(http.StatusBadGateway, "AI 服务不可用")
 	}
 	defer resp.Body.Close()
 	respBody, _ := io.ReadAll(resp.Body)
 	if resp.StatusCode >= http.StatusBadRequest {
-		c.JSON(resp.StatusCode, gin.H{"error": "AI 讲解失败"})
-		return
+		return nil, jobs.NewStatusError(resp.StatusCode, "AI 讲解失败")
 	}
 	var aiResp chat.AIChatResponse
 	if err := json.Unmarshal(respBody, &aiResp); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "解析 AI 响应失败"})
-		return
+		return nil, jobs.NewStatusError(http.StatusInternalServerError, "解析 AI 响应失败")
 	}
 	explanation := aiResp.TextExplanation
 	if explanation == "" {
@@ -258,19 +267,75 @@ func (h *QuestionBankHandler) Explain(c *gin.Context) {
 	if ex.ExerciseNumber != "" {
 		title = "讲解 · " + ex.ExerciseNumber
 	}
-	session := chat.ChatSession{UserID: uid, Title: title, CreatedAt: time.Now()}
+	exerciseID := uint(req.ExerciseID)
+	session := chat.ChatSession{UserID: uid, Title: title, ContextType: chat.ContextExplain, ExerciseID: &exerciseID, CreatedAt: time.Now()}
 	if err := h.DB.Create(&session).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "创建会话失败"})
-		return
+		return nil, jobs.NewStatusError(http.StatusInternalServerError, "创建会话失败")
 	}
 	now := time.Now()
-	msgs := []chat.ChatMessage{
-		{SessionID: session.ID, Role: "user", Content: "请讲解这道题目：\n\n" + ex.Stem, CreatedAt: now},
-		{SessionID: session.ID, Role: "ai", Content: explanation, Citations: citationsJSON, CreatedAt: now.Add(time.Millisecond)},
+	err = chat.AppendMessages(h.DB, session.ID, nil,
+		&chat.ChatMessage{Role: "user", Content: "请讲解这道题目：\n\n" + ex.Stem, CreatedAt: now},
+		&chat.ChatMessage{Role: "ai", Content: explanation, Citations: citationsJSON, CreatedAt: now.Add(time.Millisecond)},
+	)
+	if err != nil {
+		return nil, jobs.NewStatusError(http.StatusInternalServerError, "保存讲解失败")
+	}
+	return gin.H{"chatSessionId": session.ID, "title": title, "hintOnly": hintOnly}, nil
+}
+
+// Explain 学生端：把题目作为上下文请 AI 讲解，落成一个新会话，返回 chatSessionId 供前端跳转。
+// 默认返回 jobId，讲解完成后在任务结果中拿 chatSessionId；async=0 时同步返回。
+func (h *QuestionBankHandler) Explain(c *gin.Context) {
+	uid, ok := accesscontrol.CurrentUserID(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "未登录"})
+		return
+	}
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil || id <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "无效的题目 ID"})
+		return
+	}
+
+	allowedIDs, restricted, _, err := accesscontrol.AllowedTextbookIDsForContext(h.DB, c)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "读取班级教材范围失败"})
+		return
 	}
-	if err := h.DB.Create(&msgs).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "保存讲解失败"})
+	req := explainRequest{ExerciseID: id, Restricted: restricted, TextbookIDs: allowedIDs}
+	if !quota.Check(h.DB, c, quota.BucketExplain) {
+		return
+	}
+
+	if jobs.WantsAsync(c) {
+		job, err := h.Jobs.Enqueue(JobTypeExplain, uid, req, 0)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "创建讲解任务失败"})
+			return
+		}
+		jobs.Accepted(c, job)
 		return
 	}
-	c.JSON(http.StatusOK, gin.H{"chatSessionId": session.ID, "title": title})
+
+	result, err := h.explainExercise(c.Request.Context(), uid, req)
+	if err != nil {
+		jobs.RespondError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, result)
+}
+
+// JobTypeExplain 题目讲解异步任务
+const JobTypeExplain = "explain"
+
+// RegisterJobs 注册题库相关的异步任务类型
+func (h *QuestionBankHandler) RegisterJobs(q *jobs.Queue) {
+	q.Register(JobTypeExplain, func(ctx context.Context, job *jobs.Job) (interface{}, error) {
+		var req explainRequest
+		if err := job.DecodePayload(&req); err != nil {
+			return nil, err
+		}
+		result, err := h.explainExercise(ctx, job.UserID, req)
+		return result, jobs.TaskError(err)
+	})
 }
@@ -0,0 +1,221 @@
+// web_service/quota/handlers.go
+package quota
+
+import (
+	"net/http"
+	"strings"
+	"time"
+	"workplace/web_service/accesscontrol"
+	"workplace/web_service/auth"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+type QuotaHandler struct {
+	DB *gorm.DB
+}
+
+// LimitStatus 某项配额的当前用量
+type LimitStatus struct {
+	Limit
+	Used      int       `json:"used"`
+	Remaining int       `json:"remaining"`
+	ResetAt   time.Time `json:"resetAt"`
+}
+
+func limitStatuses(limits []Limit, used func(Limit) int, now time.Time) []LimitStatus {
+	out := make([]LimitStatus, 0, len(limits))
+	for _, l := range limits {
+		n := used(l)
+		remaining := l.Max - n
+		if remaining < 0 {
+			remaining = 0
+		}
+		out = append(out, LimitStatus{Limit: l, Used: n, Remaining: remaining, ResetAt: ResetAt(l.Period, now)})
+	}
+	return out
+}
+
+// MyUsageHandler 当前用户今日/本周各桶用量与适用的配额
+func (h *QuotaHandler) MyUsageHandler(c *gin.Context) {
+	user, exists, err := accesscontrol.CurrentUser(h.DB, c)
+	if !exists || err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "未登录"})
+		return
+	}
+	limits, err := LimitsFor(h.DB, user)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "读取配额失败"})
+		return
+	}
+	now := time.Now()
+	daily, err := Used(h.DB, []uint{user.ID}, nil, PeriodStart(PeriodDaily, now))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "读取用量失败"})
+		return
+	}
+	weekly, err := Used(h.DB, []uint{user.ID}, nil, PeriodStart(PeriodWeekly, now))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "读取用量失败"})
+		return
+	}
+	used := func(l Limit) int {
+		if l.Period == PeriodWeekly {
+			return weekly[user.ID][l.Bucket]
+		}
+		return daily[user.ID][l.Bucket]
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"limits": limitStatuses(limits, used, now),
+		"today":  nonNil(daily[user.ID]),
+		"week":   nonNil(weekly[user.ID]),
+	})
+}
+
+func nonNil(m map[string]int) map[string]int {
+	if m == nil {
+		return map[string]int{}
+	}
+	return m
+}
+
+// teacherClass 校验老师是否任教该班级
+func (h *QuotaHandler) teacherClass(c *gin.Context) (auth.Class, uint, bool) {
+	var cls auth.Class
+	teacherID, _ := accesscontrol.CurrentUserID(c)
+	if err := h.DB.Where("id = ? AND teacher_id = ?", c.Param("id"), teacherID).First(&cls).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "班级不存在"})
+		return cls, teacherID, false
+	}
+	return cls, teacherID, true
+}
+
+// studentLimits 班级学生适用的配额（QUOTA_RULES 的 student 配置叠加班级配额）
+func (h *QuotaHandler) studentLimits(classID uint) ([]Limit, error) {
+	return LimitsFor(h.DB, auth.User{Role: "student", ClassID: &classID})
+}
+
+// ClassUsageHandler (老师) 本班每个学生在当前周期（period=daily|weekly，默认 weekly）各桶的用量
+func (h *QuotaHandler) ClassUsageHandler(c *gin.Context) {
+	cls, _, ok := h.teacherClass(c)
+	if !ok {
+		return
+	}
+	period := c.DefaultQuery("period", PeriodWeekly)
+	if !ValidPeriod(period) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "period 只能是 daily 或 weekly"})
+		return
+	}
+	var students []auth.User
+	if err := h.DB.Where("class_id = ? AND role = ?", cls.ID, "student").Order("username asc").Find(&students).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "读取班级学生失败"})
+		return
+	}
+	limits, err := h.studentLimits(cls.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "读取配额失败"})
+		return
+	}
+	now := time.Now()
+	ids := make([]uint, 0, len(students))
+	for _, stu := range students {
+		ids = append(ids, stu.ID)
+	}
+	used := map[uint]map[string]int{}
+	if len(ids) > 0 {
+		if used, err = Used(h.DB, ids, nil, PeriodStart(period, now)); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "读取用量失败"})
+			return
+		}
+	}
+
+	type StudentUsage struct {
+		ID          uint           `json:"id"`
+		Username    string         `json:"username"`
+		DisplayName string         `json:"display_name"`
+		Usage       map[string]int `json:"usage"`
+		Exceeded    []string       `json:"exceeded,omitempty"` // 本周期已用满的桶
+	}
+	items := make([]StudentUsage, 0, len(students))
+	for _, stu := range students {
+		item := StudentUsage{ID: stu.ID, Username: stu.Username, DisplayName: stu.DisplayName, Usage: nonNil(used[stu.ID])}
+		for _, l := range limits {
+			if l.Period == period && item.Usage[l.Bucket] >= l.Max {
+				item.Exceeded = append(item.Exceeded, l.Bucket)
+			}
+		}
+		items = append(items, item)
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"classId":     cls.ID,
+		"period":      period,
+		"periodStart": PeriodStart(period, now),
+		"resetAt":     ResetAt(period, now),
+		"limits":      limits,
+		"students":    items,
+	})
+}
+
+// GetClassRulesHandler (老师) 本班配额：班级自定义的配额与 QUOTA_RULES 中的学生默认值
+func (h *QuotaHandler) GetClassRulesHandler(c *gin.Context) {
+	cls, _, ok := h.teacherClass(c)
+	if !ok {
+		return
+	}
+	var rules []ClassRule
+	if err := h.DB.Where("class_id = ?", cls.ID).Order("bucket asc, period asc").Find(&rules).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "读取配额失败"})
+		return
+	}
+	defaults := roleRules()["student"]
+	if defaults == nil {
+		defaults = []Limit{}
+	}
+	c.JSON(http.StatusOK, gin.H{"rules": rules, "defaults": defaults})
+}
+
+// SetClassRulesHandler (老师) 整体替换本班配额；传空列表即恢复默认
+func (h *QuotaHandler) SetClassRulesHandler(c *gin.Context) {
+	cls, teacherID, ok := h.teacherClass(c)
+	if !ok {
+		return
+	}
+	var req struct {
+		Rules []Limit `json:"rules"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "请求参数不合法"})
+		return
+	}
+	now := time.Now()
+	seen := map[string]bool{}
+	rules := make([]ClassRule, 0, len(req.Rules))
+	for _, r := range req.Rules {
+		bucket := strings.TrimSpace(r.Bucket)
+		if bucket == "" || !ValidPeriod(r.Period) || r.Max < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "配额需包含 bucket、period（daily/weekly）和非负的 limit"})
+			return
+		}
+		if seen[bucket+"|"+r.Period] {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "同一桶同一周期只能设置一次: " + bucket})
+			return
+		}
+		seen[bucket+"|"+r.Period] = true
+		rules = append(rules, ClassRule{ClassID: cls.ID, Bucket: bucket, Period: r.Period, MaxCount: r.Max, UpdatedBy: teacherID, UpdatedAt: now})
+	}
+	err := h.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("class_id = ?", cls.ID).Delete(&ClassRule{}).Error; err != nil {
+			return err
+		}
+		if len(rules) == 0 {
+			return nil
+		}
+		return tx.Create(&rules).Error
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "保存配额失败"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"rules": rules})
+}
@@ -0,0 +1,32 @@
+// web_service/quota/models.go
+package quota
+
+import "time"
+
+// Usage 用户每天在各用量桶上的调用次数，与 ai_service 共用 model_usage_daily 表（ai_service 记 premium_chat 桶）
+type Usage struct {
+	UserID    uint      `gorm:"primaryKey;autoIncrement:false" json:"userId"`
+	UsageDate time.Time `gorm:"primaryKey;type:date" json:"usageDate"`
+	Bucket    string    `gorm:"primaryKey;size:100" json:"bucket"`
+	Count     int       `gorm:"not null;default:0" json:"count"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+func (Usage) TableName() string {
+	return "model_usage_daily"
+}
+
+// ClassRule 老师为班级学生设置的配额，覆盖 QUOTA_RULES 中 student 角色的同桶同周期配置
+type ClassRule struct {
+	ID        uint      `gorm:"primarykey" json:"id"`
+	ClassID   uint      `gorm:"not null;uniqueIndex:idx_quota_class_rule" json:"classId"`
+	Bucket    string    `gorm:"size:100;not null;uniqueIndex:idx_quota_class_rule" json:"bucket"`
+	Period    string    `gorm:"size:10;not null;uniqueIndex:idx_quota_class_rule" json:"period"`
+	MaxCount  int       `gorm:"not null" json:"limit"` // 0 表示该班学生不可使用
+	UpdatedBy uint      `json:"updatedBy"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+func (ClassRule) TableName() string {
+	return "quota_class_rules"
+}
@@ -0,0 +1,275 @@
+// web_service/quota/quota.go
+package quota
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"workplace/web_service/accesscontrol"
+	"workplace/web_service/auth"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// 用量桶：每次转发给 ai_service 的请求计入对应的桶；聊天另计入 "chat:<model_id>"，可单独限制某个模型
+const (
+	BucketChat    = "chat"
+	BucketGrading = "grading"
+	BucketOCR     = "ocr"
+	BucketExplain = "explain"
+
+	PeriodDaily  = "daily"
+	PeriodWeekly = "weekly"
+)
+
+// 同一用户的检查与计数串行执行，避免并发请求同时通过检查
+const advisoryLockNamespace = 7301
+
+// Limit 某个桶在某个周期内的上限
+type Limit struct {
+	Bucket string `json:"bucket"`
+	Period string `json:"period"`
+	Max    int    `json:"limit"`
+}
+
+// ModelBucket 按模型区分的聊天桶
+func ModelBucket(base, modelID string) string {
+	modelID = strings.TrimSpace(modelID)
+	if modelID == "" {
+		return ""
+	}
+	return base + ":" + modelID
+}
+
+// ValidPeriod 周期是否合法
+func ValidPeriod(period string) bool {
+	return period == PeriodDaily || period == PeriodWeekly
+}
+
+// parseRules 解析 QUOTA_RULES，格式 "student:chat:daily=200,student:chat:gpt_5_5:weekly=30"（角色:桶:周期=上限）
+func parseRules(raw string) map[string][]Limit {
+	rules := map[string][]Limit{}
+	for _, item := range strings.Split(raw, ",") {
+		key, value, ok := strings.Cut(strings.TrimSpace(item), "=")
+		if !ok {
+			continue
+		}
+		parts := strings.Split(strings.TrimSpace(key), ":")
+		n, err := strconv.Atoi(strings.TrimSpace(value))
+		if len(parts) < 3 || err != nil || n < 0 {
+			log.Printf("Ignoring invalid QUOTA_RULES entry %q", item)
+			continue
+		}
+		role, period := parts[0], parts[len(parts)-1]
+		bucket := strings.Join(parts[1:len(parts)-1], ":")
+		if !ValidPeriod(period) || bucket == "" {
+			log.Printf("Ignoring invalid QUOTA_RULES entry %q", item)
+			continue
+		}
+		rules[role] = append(rules[role], Limit{Bucket: bucket, Period: period, Max: n})
+	}
+	return rules
+}
+
+// roleRules QUOTA_RULES 只在首次使用时解析一次
+var roleRules = sync.OnceValue(func() map[string][]Limit {
+	return parseRules(os.Getenv("QUOTA_RULES"))
+})
+
+// LimitsFor 用户适用的全部配额：按角色取 QUOTA_RULES，学生再叠加所在班级的配额（同桶同周期以班级为准）
+func LimitsFor(db *gorm.DB, user auth.User) ([]Limit, error) {
+	limits := roleRules()[user.Role]
+	if user.Role != "student" || user.ClassID == nil {
+		return limits, nil
+	}
+	var classRules []ClassRule
+	if err := db.Where("class_id = ?", *user.ClassID).Find(&classRules).Error; err != nil {
+		return nil, err
+	}
+	merged := make([]Limit, 0, len(limits)+len(classRules))
+	overridden := map[string]bool{}
+	for _, r := range classRules {
+		merged = append(merged, Limit{Bucket: r.Bucket, Period: r.Period, Max: r.MaxCount})
+		overridden[r.Bucket+"|"+r.Period] = true
+	}
+	for _, l := range limits {
+		if !overridden[l.Bucket+"|"+l.Period] {
+			merged = append(merged, l)
+		}
+	}
+	return merged, nil
+}
+
+func today(now time.Time) time.Time {
+	y, m, d := now.Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, now.Location())
+}
+
+// PeriodStart 周期开始的日期：当天或本周一
+func PeriodStart(period string, now time.Time) time.Time {
+	day := today(now)
+	if period == PeriodWeekly {
+		return day.AddDate(0, 0, -((int(day.Weekday()) + 6) % 7))
+	}
+	return day
+}
+
+// ResetAt 周期结束、额度恢复的时间
+func ResetAt(period string, now time.Time) time.Time {
+	if period == PeriodWeekly {
+		return PeriodStart(period, now).AddDate(0, 0, 7)
+	}
+	return today(now).AddDate(0, 0, 1)
+}
+
+// Used 用户在 since 之后各桶的调用次数
+func Used(db *gorm.DB, userIDs []uint, buckets []string, since time.Time) (map[uint]map[string]int, error) {
+	type row struct {
+		UserID uint
+		Bucket string
+		Total  int
+	}
+	var rows []row
+	query := db.Model(&Usage{}).
+		Select("user_id, bucket, SUM(count) AS total").
+		Where("user_id IN ? AND usage_date >= ?", userIDs, since)
+	if len(buckets) > 0 {
+		query = query.Where("bucket IN ?", buckets)
+	}
+	if err := query.Group("user_id, bucket").Scan(&rows).Error; err != nil {
+		return nil, err
+	}
+	used := map[uint]map[string]int{}
+	for _, r := range rows {
+		if used[r.UserID] == nil {
+			used[r.UserID] = map[string]int{}
+		}
+		used[r.UserID][r.Bucket] = r.Total
+	}
+	return used, nil
+}
+
+// ExceededError 超出配额
+type ExceededError struct {
+	Limit   Limit
+	Used    int
+	ResetAt time.Time
+}
+
+func (e *ExceededError) Error() string {
+	period := "今日"
+	if e.Limit.Period == PeriodWeekly {
+		period = "本周"
+	}
+	return fmt.Sprintf("%s %s 用量已达上限 %d 次", period, e.Limit.Bucket, e.Limit.Max)
+}
+
+// Consume 检查配额并为每个桶计一次；超出时返回 *ExceededError，不计数
+func Consume(db *gorm.DB, user auth.User, buckets ...string) error {
+	limits, err := LimitsFor(db, user)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec("SELECT pg_advisory_xact_lock(?, ?)", advisoryLockNamespace, int32(user.ID)).Error; err != nil {
+			return err
+		}
+		for _, limit := range limits {
+			if !contains(buckets, limit.Bucket) {
+				continue
+			}
+			used, err := Used(tx, []uint{user.ID}, []string{limit.Bucket}, PeriodStart(limit.Period, now))
+			if err != nil {
+				return err
+			}
+			if n := used[user.ID][limit.Bucket]; n >= limit.Max {
+				return &ExceededError{Limit: limit, Used: n, ResetAt: ResetAt(limit.Period, now)}
+			}
+		}
+		for _, bucket := range buckets {
+			usage := Usage{UserID: user.ID, UsageDate: today(now), Bucket: bucket, Count: 1, UpdatedAt: now}
+			err := tx.Clauses(clause.OnConflict{
+				Columns: []clause.Column{{Name: "user_id"}, {Name: "usage_date"}, {Name: "bucket"}},
+				DoUpdates: clause.Assignments(map[string]interface{}{
+					"count":      gorm.Expr("model_usage_daily.count + 1"),
+					"updated_at": now,
+				}),
+			}).Create(&usage).Error
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Refund 退回一次当天的计数：AI 调用失败、或命中缓存未实际调用 ai_service 时使用。空桶名会被忽略。
+func Refund(db *gorm.DB, userID uint, buckets ...string) {
+	now := time.Now()
+	for _, bucket := range buckets {
+		if bucket == "" {
+			continue
+		}
+		err := db.Model(&Usage{}).
+			Where("user_id = ? AND usage_date = ? AND bucket = ? AND count > 0", userID, today(now), bucket).
+			Updates(map[string]interface{}{"count": gorm.Expr("count - 1"), "updated_at": now}).Error
+		if err != nil {
+			log.Printf("Failed to refund AI usage for user %d: %v", userID, err)
+		}
+	}
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Check 在转发 ai_service 之前调用：通过时计数并返回 true；超出配额时回 429（带 Retry-After 与 resetAt）并返回 false。
+// 空桶名会被忽略（例如未指定 model_id 时的模型桶）。
+func Check(db *gorm.DB, c *gin.Context, buckets ...string) bool {
+	user, exists, err := accesscontrol.CurrentUser(db, c)
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "未登录"})
+		return false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "读取用户信息失败"})
+		return false
+	}
+	nonEmpty := make([]string, 0, len(buckets))
+	for _, b := range buckets {
+		if b != "" {
+			nonEmpty = append(nonEmpty, b)
+		}
+	}
+	err = Consume(db, user, nonEmpty...)
+	if exceeded, ok := err.(*ExceededError); ok {
+		c.Header("Retry-After", strconv.Itoa(int(time.Until(exceeded.ResetAt).Seconds())+1))
+		c.JSON(http.StatusTooManyRequests, gin.H{
+			"error":   exceeded.Error(),
+			"bucket":  exceeded.Limit.Bucket,
+			"period":  exceeded.Limit.Period,
+			"limit":   exceeded.Limit.Max,
+			"used":    exceeded.Used,
+			"resetAt": exceeded.ResetAt,
+		})
+		return false
+	}
+	if err != nil {
+		// 计数失败不阻断学习，只记录日志
+		log.Printf("Failed to record AI usage for user %d: %v", user.ID, err)
+	}
+	return true
+}
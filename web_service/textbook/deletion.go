@@ -0,0 +1,370 @@
+// web_service/textbook/deletion.go
+
+package textbook
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"workplace/web_service/accesscontrol"
+	"workplace/web_service/aiclient"
+	"workplace/web_service/auth"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const (
+	// StatusDeleting 删除进行中的教材状态：已从班级移除，不再接受解析、换版本等操作
+	StatusDeleting = "deleting"
+
+	DeletionPending        = "pending_delete"  // 已受理：停止解析中的任务，删除 ai_service 侧的分块与题目
+	DeletionVectorsDeleted = "vectors_deleted" // 向量数据已删，接着删上传文件
+	DeletionFilesDeleted   = "files_deleted"   // 文件已删，最后删 web 侧的记录
+	DeletionDone           = "done"
+
+	// 失败或进程中断后，至少隔这么久由巡检从当前状态继续
+	deletionRetryDelay = time.Minute
+)
+
+var errTextbookInUse = errors.New("textbook exercises are still referenced")
+
+// TextbookDeletion 教材删除的持久化状态机：pending_delete → vectors_deleted → files_deleted → done。
+// 每一步都可重复执行，失败时停在当前状态记录错误，由巡检（含重启后）继续推进。
+type TextbookDeletion struct {
+	ID           uint       `gorm:"primarykey" json:"id"`
+	TextbookID   uint       `gorm:"uniqueIndex;not null" json:"textbook_id"`
+	TextbookName string     `gorm:"size:255" json:"textbook_name"`
+	FilePaths    string     `gorm:"type:text" json:"-"` // JSON 数组：受理时收集的上传文件及 OCR 中间文件
+	State        string     `gorm:"size:20;not null;default:'pending_delete';index" json:"state"`
+	Cascade      bool       `gorm:"default:false" json:"cascade"` // 受理时一并移除了作业题目与收藏
+	RequestedBy  uint       `json:"requested_by"`
+	Attempts     int        `gorm:"default:0" json:"attempts"`
+	LastError    string     `gorm:"type:text" json:"last_error,omitempty"`
+	CreatedAt    time.Time  `json:"created_at"`
+	UpdatedAt    time.Time  `json:"updated_at"`
+	FinishedAt   *time.Time `json:"finished_at,omitempty"`
+}
+
+// DependentAssignment 引用了该教材题目的作业
+type DependentAssignment struct {
+	ID            uint   `json:"id"`
+	Title         string `json:"title"`
+	ClassID       *uint  `json:"class_id,omitempty"`
+	ExerciseCount int    `json:"exercise_count"`
+}
+
+// DeletionDependencies 删除教材前需要处理的引用；测验作答记录只做提示，不随教材删除
+type DeletionDependencies struct {
+	Assignments     []DependentAssignment `json:"assignments"`
+	FavoriteCount   int64                 `json:"favorite_count"`
+	QuizAnswerCount int64                 `json:"quiz_answer_count"`
+}
+
+func (d DeletionDependencies) blocking() bool {
+	return len(d.Assignments) > 0 || d.FavoriteCount > 0
+}
+
+const textbookExerciseIDs = "SELECT id FROM textbook_exercises WHERE textbook_id = ?"
+
+func loadDeletionDependencies(db *gorm.DB, textbookID uint) (DeletionDependencies, error) {
+	deps := DeletionDependencies{Assignments: []DependentAssignment{}}
+	if err := db.Raw(`SELECT a.id, a.title, a.class_id, COUNT(*) AS exercise_count
+		FROM assignment_exercises ae
+		JOIN assignments a ON a.id = ae.assignment_id AND a.deleted_at IS NULL
+		WHERE ae.exercise_id IN (`+textbookExerciseIDs+`)
+		GROUP BY a.id, a.title, a.class_id
+		ORDER BY a.id`, textbookID).Scan(&deps.Assignments).Error; err != nil {
+		return deps, err
+	}
+	if err := db.Table("favorite_exercises").
+		Where("exercise_id IN ("+textbookExerciseIDs+")", textbookID).Count(&deps.FavoriteCount).Error; err != nil {
+		return deps, err
+	}
+	if err := db.Table("quiz_answers").
+		Where("exercise_id IN ("+textbookExerciseIDs+")", textbookID).Count(&deps.QuizAnswerCount).Error; err != nil {
+		return deps, err
+	}
+	return deps, nil
+}
+
+// textbookFiles 教材及其各版本在磁盘上的文件：原文件、Office 转出的 PDF、OCR 结果及其按内容哈希的缓存
+func textbookFiles(db *gorm.DB, tb Textbook) []string {
+	paths := []string{tb.FilePath}
+	var versions []TextbookVersion
+	db.Where("textbook_id = ?", tb.ID).Find(&versions)
+	for _, v := range versions {
+		if v.FilePath != tb.FilePath {
+			paths = append(paths, v.FilePath)
+		}
+	}
+	var files []string
+	for _, p := range paths {
+		if p == "" {
+			continue
+		}
+		files = append(files, p, p+".ocr.txt")
+		pdf := p
+		switch strings.ToLower(filepath.Ext(p)) {
+		case ".ppt", ".pptx", ".doc", ".docx":
+			pdf = strings.TrimSuffix(p, filepath.Ext(p)) + ".pdf"
+			files = append(files, pdf, pdf+".ocr.txt")
+		}
+		if cache := ocrCachePath(pdf); cache != "" {
+			files = append(files, cache)
+		}
+	}
+	return files
+}
+
+// ocrCachePath ai_service 解析时按 PDF 内容哈希另存的 OCR 结果（与 ingest_pdf.py 的 _ocr_cache_path 一致）。
+// 要在文件还在时计算，所以删除一开始就把它记进待删文件列表；文件不存在时返回空串。
+// 同内容的其他教材也会复用这份缓存，删掉只是让它们下次重新识别。
+func ocrCachePath(pdfPath string) string {
+	f, err := os.Open(pdfPath)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	digest := sha256.New()
+	if _, err := io.Copy(digest, f); err != nil {
+		return ""
+	}
+	abs, err := filepath.Abs(pdfPath)
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(filepath.Dir(abs), ".ocr_cache", hex.EncodeToString(digest.Sum(nil))+".ocr.txt")
+}
+
+// DependenciesHandler 删除前预览：哪些作业、多少收藏引用了这本教材的题目
+func (h *TextbookHandler) DependenciesHandler(c *gin.Context) {
+	tb, _, ok := h.loadOwnedTextbook(c)
+	if !ok {
+		return
+	}
+	deps, err := loadDeletionDependencies(h.DB, tb.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "读取教材引用失败"})
+		return
+	}
+	c.JSON(http.StatusOK, deps)
+}
+
+// DeleteTextbook 老师删除教材。题目仍被作业或收藏引用时返回 409 和引用明细，cascade=1 时一并移除这些引用。
+// 受理后教材立即从班级中移除并标记为 deleting，向量数据、文件与记录由删除状态机在后台依次清理。
+func (h *TextbookHandler) DeleteTextbook(c *gin.Context) {
+	var tb Textbook
+	if err := h.DB.First(&tb, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "找不到该教材"})
+		return
+	}
+	teacherID, _ := accesscontrol.CurrentUserID(c)
+	if !ownsTextbook(tb, teacherID) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "只能删除自己上传的教材"})
+		return
+	}
+
+	var existing TextbookDeletion
+	if err := h.DB.Where("textbook_id = ?", tb.ID).First(&existing).Error; err == nil {
+		c.JSON(http.StatusAccepted, gin.H{"message": "该教材正在删除", "deletion": existing})
+		return
+	}
+
+	cascade := c.Query("cascade") == "1" || c.Query("cascade") == "true"
+	files, _ := json.Marshal(textbookFiles(h.DB, tb))
+	deletion := TextbookDeletion{
+		TextbookID:   tb.ID,
+		TextbookName: tb.Name,
+		FilePaths:    string(files),
+		State:        DeletionPending,
+		Cascade:      cascade,
+		RequestedBy:  teacherID,
+	}
+	var deps DeletionDependencies
+	err := h.DB.Transaction(func(tx *gorm.DB) error {
+		var err error
+		if deps, err = loadDeletionDependencies(tx, tb.ID); err != nil {
+			return err
+		}
+		if deps.blocking() && !cascade {
+			return errTextbookInUse
+		}
+		if cascade {
+			if err := tx.Exec("DELETE FROM assignment_exercises WHERE exercise_id IN ("+textbookExerciseIDs+")", tb.ID).Error; err != nil {
+				return err
+			}
+			if err := tx.Exec("DELETE FROM favorite_exercises WHERE exercise_id IN ("+textbookExerciseIDs+")", tb.ID).Error; err != nil {
+				return err
+			}
+		}
+		if err := tx.Where("textbook_id = ?", tb.ID).Delete(&auth.ClassTextbook{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(&TextbookVersion{}).Where("textbook_id = ? AND status = ?", tb.ID, VersionProcessing).
+			Update("status", VersionCanceled).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(&tb).Update("status", StatusDeleting).Error; err != nil {
+			return err
+		}
+		return tx.Create(&deletion).Error
+	})
+	if errors.Is(err, errTextbookInUse) {
+		c.JSON(http.StatusConflict, gin.H{
+			"error":        "该教材的题目仍被作业或收藏引用，确认后可连同这些引用一起删除",
+			"dependencies": deps,
+		})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "删除教材失败"})
+		return
+	}
+
+	go runDeletion(h.DB, deletion.ID)
+	c.JSON(http.StatusAccepted, gin.H{"message": "教材已移除，后台正在清理向量库数据与文件", "deletion": deletion})
+}
+
+// runDeletion 从当前状态把删除推进到 done；某一步失败时记录错误并停下，等巡检重试
+func runDeletion(db *gorm.DB, deletionID uint) {
+	for {
+		var d TextbookDeletion
+		if err := db.First(&d, deletionID).Error; err != nil {
+			return
+		}
+		var next string
+		var err error
+		switch d.State {
+		case DeletionPending:
+			next, err = DeletionVectorsDeleted, deleteTextbookVectors(db, d)
+		case DeletionVectorsDeleted:
+			next, err = DeletionFilesDeleted, deleteTextbookFiles(d)
+		case DeletionFilesDeleted:
+			next, err = DeletionDone, deleteTextbookRows(db, d)
+		default:
+			return
+		}
+		if err != nil {
+			log.Printf("Textbook %d deletion stuck at %s: %v", d.TextbookID, d.State, err)
+			db.Model(&TextbookDeletion{}).Where("id = ?", d.ID).
+				Updates(map[string]interface{}{"attempts": gorm.Expr("attempts + 1"), "last_error": err.Error()})
+			return
+		}
+		updates := map[string]interface{}{"state": next, "last_error": ""}
+		if next == DeletionDone {
+			updates["finished_at"] = time.Now()
+		}
+		// 按原状态条件更新，巡检与请求协程同时推进时只有一方生效
+		res := db.Model(&TextbookDeletion{}).Where("id = ? AND state = ?", d.ID, d.State).Updates(updates)
+		if res.Error != nil || res.RowsAffected == 0 {
+			return
+		}
+	}
+}
+
+// deleteTextbookVectors 先停掉仍在进行的解析（否则 ai_service 可能在删除后又写回数据），再删分块与题目
+func deleteTextbookVectors(db *gorm.DB, d TextbookDeletion) error {
+	tb := Textbook{ID: d.TextbookID, Name: d.TextbookName}
+	var active []IngestJob
+	if err := db.Where("textbook_id = ? AND status IN ?", d.TextbookID,
+		[]string{IngestQueued, IngestRunning, IngestCanceling}).Find(&active).Error; err != nil {
+		return err
+	}
+	waiting := false
+	for i := range active {
+		if active[i].Status == IngestQueued {
+			db.Model(&IngestJob{}).Where("id = ? AND status = ?", active[i].ID, IngestQueued).
+				Updates(map[string]interface{}{"status": IngestCanceled, "finished_at": time.Now()})
+			continue
+		}
+		if sendIngestCancel(db, tb, &active[i]) != IngestCanceled {
+			waiting = true
+		}
+	}
+	if waiting {
+		return errors.New("等待 AI 服务停止解析")
+	}
+
+	reqBody := &bytes.Buffer{}
+	writer := multipart.NewWriter(reqBody)
+	_ = writer.WriteField("textbook_id", fmt.Sprintf("%d", d.TextbookID))
+	_ = writer.WriteField("textbook_name", d.TextbookName)
+	writer.Close()
+
+	req, _ := http.NewRequest("POST", aiclient.URL("/api/v1/textbook/delete"), reqBody)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	client := &http.Client{Timeout: 60 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("删除向量库数据失败: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("向量库删除返回异常（%d）", resp.StatusCode)
+	}
+	return nil
+}
+
+// deleteTextbookFiles 删除受理时收集的文件，已不存在的视为删除成功
+func deleteTextbookFiles(d TextbookDeletion) error {
+	var files []string
+	if d.FilePaths != "" {
+		if err := json.Unmarshal([]byte(d.FilePaths), &files); err != nil {
+			return err
+		}
+	}
+	for _, f := range files {
+		if err := os.Remove(f); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("删除文件 %s 失败: %w", f, err)
+		}
+	}
+	return nil
+}
+
+// deleteTextbookRows 删除 web 侧与教材相关的记录；删除记录本身保留作为审计
+func deleteTextbookRows(db *gorm.DB, d TextbookDeletion) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		for _, model := range []interface{}{&auth.ClassTextbook{}, &TextbookShare{}, &TextbookVersion{}, &IngestJob{}} {
+			if err := tx.Where("textbook_id = ?", d.TextbookID).Delete(model).Error; err != nil {
+				return err
+			}
+		}
+		return tx.Delete(&Textbook{}, d.TextbookID).Error
+	})
+}
+
+// StartDeletionReconciler 启动时及之后每隔 interval 继续推进未完成的教材删除
+func StartDeletionReconciler(db *gorm.DB, interval time.Duration) {
+	go func() {
+		resumeDeletions(db)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			resumeDeletions(db)
+		}
+	}()
+}
+
+func resumeDeletions(db *gorm.DB) {
+	var deletions []TextbookDeletion
+	if err := db.Where("state <> ? AND updated_at < ?", DeletionDone, time.Now().Add(-deletionRetryDelay)).
+		Find(&deletions).Error; err != nil {
+		log.Printf("Textbook deletion reconcile scan failed: %v", err)
+		return
+	}
+	for _, d := range deletions {
+		go runDeletion(db, d.ID)
+	}
+}
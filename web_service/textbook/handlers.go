@@ -1,15 +1,12 @@
 package textbook
 
 import (
-	"bytes"
 	"fmt"
-	"mime/multipart"
 	"net/http"
 	"os"
 	"path/filepath"
 	"time"
 	"workplace/web_service/accesscontrol"
-	"workplace/web_service/aiclient"
 	"workplace/web_service/auth"
 
 	"github.com/gin-gonic/gin"
@@ -18,31 +15,47 @@ import (
 )
 
 type Textbook struct {
-	ID               uint      `gorm:"primarykey" json:"id"`
-	TeacherID        uint      `gorm:"index" json:"teacher_id"`
-	Name             string    `gorm:"size:255;not null" json:"name"`
-	FilePath         string    `gorm:"size:255" json:"file_path"`
-	Status           string    `gorm:"size:50;default:'processing'" json:"status"` // processing, completed, failed
-	TotalPages       int       `gorm:"default:0" json:"total_pages"`
-	ProcessedPages   int       `gorm:"default:0" json:"processed_pages"`
-	CreatedAt        time.Time `json:"created_at"`
-	SelectedClassIDs []uint    `gorm:"-" json:"selected_class_ids,omitempty"`
+	ID               uint       `gorm:"primarykey" json:"id"`
+	TeacherID        uint       `gorm:"index" json:"teacher_id"`
+	Name             string     `gorm:"size:255;not null" json:"name"`
+	FilePath         string     `gorm:"size:255" json:"file_path"`
+	Status           string     `gorm:"size:50;default:'processing'" json:"status"` // processing, completed, failed
+	TotalPages       int        `gorm:"default:0" json:"total_pages"`
+	ProcessedPages   int        `gorm:"default:0" json:"processed_pages"`
+	CurrentVersion   int        `gorm:"default:1" json:"current_version"`
+	Visibility       string     `gorm:"size:20;not null;default:'institution';index" json:"visibility"` // private / shared / institution；升级前的教材保持全校可见
+	CreatedAt        time.Time  `json:"created_at"`
+	SelectedClassIDs []uint     `gorm:"-" json:"selected_class_ids,omitempty"`
+	IngestJob        *IngestJob `gorm:"-" json:"ingest_job,omitempty"` // 最近一次解析记录（尝试次数、错误、进度时间）
+	// 正在解析的新版本；解析完成前学生仍使用当前版本
+	PendingVersion *TextbookVersion `gorm:"-" json:"pending_version,omitempty"`
 }
 
 type TextbookHandler struct {
 	DB *gorm.DB
 }
 
-// 获取教材列表
+// 获取教材列表（仅当前老师可见的：自己上传的、全校可见的、授权给自己的）
 func (h *TextbookHandler) GetTextbooks(c *gin.Context) {
+	teacherID, _ := accesscontrol.CurrentUserID(c)
 	var textbooks []Textbook
-	if err := h.DB.Order("created_at desc").Find(&textbooks).Error; err != nil {
+	if err := visibleToTeacher(h.DB, teacherID).Order("created_at desc").Find(&textbooks).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch textbooks"})
 		return
 	}
 
 	if len(textbooks) > 0 {
-		teacherID, _ := accesscontrol.CurrentUserID(c)
+		ids := make([]uint, 0, len(textbooks))
+		for _, tb := range textbooks {
+			ids = append(ids, tb.ID)
+		}
+		jobs := latestIngestJobs(h.DB, ids)
+		pending := pendingVersions(h.DB, ids)
+		for i := range textbooks {
+			textbooks[i].IngestJob = jobs[textbooks[i].ID]
+			textbooks[i].PendingVersion = pending[textbooks[i].ID]
+		}
+
 		var links []auth.ClassTextbook
 		if err := h.DB.Table("class_textbooks ct").
 			Select("ct.id, ct.class_id, ct.textbook_id, ct.created_at").
@@ -69,56 +82,40 @@ func (h *TextbookHandler) UploadTextbook(c *gin.Context) {
 		return
 	}
 
-	file, err := c.FormFile("file")
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "未检测到上传的文件"})
+	// 新上传的教材默认仅自己可见
+	visibility := c.DefaultPostForm("visibility", VisibilityPrivate)
+	if !validVisibility(visibility) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "visibility 只能是 private / shared / institution"})
 		return
 	}
 
-	// 将文件保存到本地
-	uploadDir := "uploads/textbooks"
-	os.MkdirAll(uploadDir, os.ModePerm)
-	// filepath.Base 防止文件名带 ../ 造成路径穿越（写到上传目录之外）
-	fileName := fmt.Sprintf("%d_%s", time.Now().Unix(), filepath.Base(file.Filename))
-	filePath := filepath.Join(uploadDir, fileName)
-
-	if err := c.SaveUploadedFile(file, filePath); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "保存文件失败"})
+	filePath, ok := saveUploadedTextbook(c)
+	if !ok {
 		return
 	}
 
 	// 存入数据库状态为处理中
 	teacherID, _ := accesscontrol.CurrentUserID(c)
 	tb := Textbook{
-		TeacherID: teacherID,
-		Name:      name,
-		FilePath:  filePath,
-		Status:    "processing",
+		TeacherID:  teacherID,
+		Name:       name,
+		FilePath:   filePath,
+		Status:     "processing",
+		Visibility: visibility,
 	}
 	if err := h.DB.Create(&tb).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "创建数据库记录失败"})
 		return
 	}
 
-	// 获取绝对路径以传给 Python 服务
-	absPath, _ := filepath.Abs(filePath)
-
-	// 异步调用 Python AI 服务进行 OCR 和 Embedding
-	go func(path string, tbName string, id uint) {
-		reqBody := &bytes.Buffer{}
-		writer := multipart.NewWriter(reqBody)
-		_ = writer.WriteField("file_path", path)
-		_ = writer.WriteField("textbook_name", tbName)
-		_ = writer.WriteField("textbook_id", fmt.Sprintf("%d", id))
-		writer.Close()
-
-		req, err := http.NewRequest("POST", aiclient.URL("/api/v1/textbook/ingest"), reqBody)
-		if err == nil {
-			req.Header.Set("Content-Type", writer.FormDataContentType())
-			client := &http.Client{}
-			client.Do(req) // 发送即忘，Python 那边是后台任务，会自己改数据库
-		}
-	}(absPath, tb.Name, tb.ID)
+	// 异步交给 Python AI 服务进行 OCR 和 Embedding，进度与结果由 ai_service 回调上报
+	job, err := startIngest(h.DB, tb, nil)
+	if err != nil {
+		h.DB.Model(&tb).Update("status", "failed")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "创建解析任务失败"})
+		return
+	}
+	tb.IngestJob = job
 
 	c.JSON(http.StatusOK, gin.H{
 		"message":  "教材已上传，后台正在进行 OCR 和向量化处理...",
@@ -126,6 +123,38 @@ func (h *TextbookHandler) UploadTextbook(c *gin.Context) {
 	})
 }
 
+func uniqueIDs(ids []uint) []uint {
+	out := make([]uint, 0, len(ids))
+	for _, id := range ids {
+		if !containsID(out, id) {
+			out = append(out, id)
+		}
+	}
+	return out
+}
+
+// saveUploadedTextbook 把表单里的 file 存到上传目录，返回保存路径；失败时已写好错误响应
+func saveUploadedTextbook(c *gin.Context) (string, bool) {
+	file, err := c.FormFile("file")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "未检测到上传的文件"})
+		return "", false
+	}
+
+	// 将文件保存到本地
+	uploadDir := "uploads/textbooks"
+	os.MkdirAll(uploadDir, os.ModePerm)
+	// filepath.Base 防止文件名带 ../ 造成路径穿越（写到上传目录之外）
+	fileName := fmt.Sprintf("%d_%s", time.Now().Unix(), filepath.Base(file.Filename))
+	filePath := filepath.Join(uploadDir, fileName)
+
+	if err := c.SaveUploadedFile(file, filePath); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "保存文件失败"})
+		return "", false
+	}
+	return filePath, true
+}
+
 // SetClassTextbooks 将某个班级可见的教材列表替换为 teacher 当前选择。
 func (h *TextbookHandler) SetClassTextbooks(c *gin.Context) {
 	classID := c.Param("id")
@@ -150,15 +179,28 @@ func (h *TextbookHandler) SetClassTextbooks(c *gin.Context) {
 	}
 
 	if len(req.TextbookIDs) > 0 {
-		var count int64
-		if err := h.DB.Model(&Textbook{}).Where("id IN ?", req.TextbookIDs).Count(&count).Error; err != nil {
+		var existing []uint
+		if err := h.DB.Model(&Textbook{}).Where("id IN ?", req.TextbookIDs).Pluck("id", &existing).Error; err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "校验教材失败"})
 			return
 		}
-		if count != int64(len(req.TextbookIDs)) {
+		if len(existing) != len(uniqueIDs(req.TextbookIDs)) {
 			c.JSON(http.StatusBadRequest, gin.H{"error": "包含不存在的教材"})
 			return
 		}
+		// 只能加入自己可见且未在删除的教材；班级里已有的教材即使之后被收回授权也可以保留
+		var visible, linked []uint
+		if err := visibleToTeacher(h.DB.Model(&Textbook{}), teacherID).Where("id IN ? AND status <> ?", req.TextbookIDs, StatusDeleting).Pluck("id", &visible).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "校验教材失败"})
+			return
+		}
+		h.DB.Model(&auth.ClassTextbook{}).Where("class_id = ?", cls.ID).Pluck("textbook_id", &linked)
+		for _, id := range req.TextbookIDs {
+			if !containsID(visible, id) && !containsID(linked, id) {
+				c.JSON(http.StatusForbidden, gin.H{"error": "包含无权使用的教材"})
+				return
+			}
+		}
 	}
 
 	tx := h.DB.Begin()
@@ -213,81 +255,26 @@ func (h *TextbookHandler) CancelTextbook(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "该教材已完成解析，无法取消"})
 		return
 	}
+	if tb.Status == StatusDeleting {
+		c.JSON(http.StatusConflict, gin.H{"error": "该教材正在删除"})
+		return
+	}
 
 	if tb.Status == "canceled" {
 		c.JSON(http.StatusOK, gin.H{"message": "该教材已处于取消状态"})
 		return
 	}
 
-	tb.Status = "canceled"
-	if err := h.DB.Save(&tb).Error; err != nil {
+	if err := h.DB.Model(&tb).Update("status", "canceled").Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "取消失败"})
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"message": "已取消该教材的解析任务"})
-}
-
-// 老师删除教材（级联删除向量库 chunks）
-func (h *TextbookHandler) DeleteTextbook(c *gin.Context) {
-	id := c.Param("id")
-	if id == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "需要提供教材 ID"})
-		return
-	}
-
-	var tb Textbook
-	if err := h.DB.First(&tb, id).Error; err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "找不到该教材"})
-		return
+	// 通知 ai_service 停止解析并清理已写入的分块与题目；已识别的页保留，继续解析时复用
+	ack := cancelIngest(h.DB, tb)
+	message := "已取消该教材的解析任务"
+	if ack != IngestCanceled {
+		message = "已发出取消指令，AI 服务正在停止解析并清理数据"
 	}
-	teacherID, _ := accesscontrol.CurrentUserID(c)
-	if tb.TeacherID != 0 && tb.TeacherID != teacherID {
-		c.JSON(http.StatusForbidden, gin.H{"error": "只能删除自己上传的教材"})
-		return
-	}
-
-	// 调用 Python AI 服务删除向量库中的 chunks
-	reqBody := &bytes.Buffer{}
-	writer := multipart.NewWriter(reqBody)
-	_ = writer.WriteField("textbook_id", fmt.Sprintf("%d", tb.ID))
-	_ = writer.WriteField("textbook_name", tb.Name)
-	writer.Close()
-
-	req, err := http.NewRequest("POST", aiclient.URL("/api/v1/textbook/delete"), reqBody)
-	if err == nil {
-		req.Header.Set("Content-Type", writer.FormDataContentType())
-		client := &http.Client{}
-		resp, err := client.Do(req)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "删除向量库数据失败"})
-			return
-		}
-		defer resp.Body.Close()
-		if resp.StatusCode != http.StatusOK {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "向量库删除返回异常"})
-			return
-		}
-	}
-
-	// 删除本地文件
-	if tb.FilePath != "" {
-		_ = os.Remove(tb.FilePath)
-	}
-
-	// 删除数据库记录
-	tx := h.DB.Begin()
-	if err := tx.Where("textbook_id = ?", tb.ID).Delete(&auth.ClassTextbook{}).Error; err != nil {
-		tx.Rollback()
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "删除教材关联失败"})
-		return
-	}
-	if err := tx.Delete(&tb).Error; err != nil {
-		tx.Rollback()
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "删除数据库记录失败"})
-		return
-	}
-	tx.Commit()
-
-	c.JSON(http.StatusOK, gin.H{"message": "已删除该教材及其向量库数据"})
+	c.JSON(http.StatusOK, gin.H{"message": message, "cancel_status": ack})
 }
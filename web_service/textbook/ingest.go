@@ -0,0 +1,465 @@
+// web_service/textbook/ingest.go
+
+package textbook
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"workplace/web_service/accesscontrol"
+	"workplace/web_service/aiclient"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const (
+	IngestQueued    = "queued"
+	IngestRunning   = "running"
+	IngestSucceeded = "succeeded"
+	IngestFailed    = "failed"
+	IngestCanceled  = "canceled"
+	IngestCanceling = "canceling" // 已向 ai_service 发出取消，等待其停止并清理完的确认
+
+	defaultIngestAttempts = 3
+	// 运行中的解析超过这么久没有进度回调，视为 ai_service 已中断
+	ingestStaleAfter = 30 * time.Minute
+	// 自动重试前至少等待这么久
+	ingestRetryDelay = time.Minute
+)
+
+// IngestJob 一次教材解析（OCR → 分块向量化 → 抽题）的执行记录。上传或手动重试各新建一条；
+// 投递失败、ai_service 回报失败或长时间没有进度时在同一条记录上累加 Attempts 自动重试。
+type IngestJob struct {
+	ID          uint       `gorm:"primarykey" json:"id"`
+	TextbookID  uint       `gorm:"index;not null" json:"textbook_id"`
+	VersionID   *uint      `gorm:"index" json:"version_id,omitempty"`                     // 解析的是教材的新版本（见 TextbookVersion）
+	Status      string     `gorm:"size:20;not null;default:'queued';index" json:"status"` // queued / running / canceling / succeeded / failed / canceled
+	Stage       string     `gorm:"size:30" json:"stage,omitempty"`                        // ai_service 上报的当前阶段：ocr / chunks / exercises
+	Attempts    int        `gorm:"default:0" json:"attempts"`
+	MaxAttempts int        `gorm:"default:3" json:"max_attempts"`
+	LastError   string     `gorm:"type:text" json:"last_error,omitempty"`
+	Token       string     `gorm:"size:64;not null" json:"-"` // 回调鉴权
+	StartedAt   *time.Time `json:"started_at,omitempty"`
+	ProgressAt  *time.Time `json:"progress_at,omitempty"` // 最近一次投递成功或收到回调的时间
+	FinishedAt  *time.Time `json:"finished_at,omitempty"`
+	// 发出取消的时间；超过 ingestRetryDelay 仍未确认时由巡检重发
+	CancelRequestedAt *time.Time `json:"cancel_requested_at,omitempty"`
+	CreatedAt         time.Time  `json:"created_at"`
+	UpdatedAt         time.Time  `json:"updated_at"`
+}
+
+// Finished 解析记录是否已到终态
+func (j IngestJob) Finished() bool {
+	return j.Status == IngestSucceeded || j.Status == IngestFailed || j.Status == IngestCanceled
+}
+
+// callbackBaseURL ai_service 回调 web 服务用的地址
+func callbackBaseURL() string {
+	base := strings.TrimRight(strings.TrimSpace(os.Getenv("WEB_SERVICE_INTERNAL_URL")), "/")
+	if base == "" {
+		return "http://127.0.0.1:8080"
+	}
+	return base
+}
+
+func newIngestToken() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// startIngest 为教材（versionID 非空时为它的新版本）新建一条解析记录并异步投递给 ai_service
+func startIngest(db *gorm.DB, tb Textbook, versionID *uint) (*IngestJob, error) {
+	token, err := newIngestToken()
+	if err != nil {
+		return nil, err
+	}
+	job := IngestJob{TextbookID: tb.ID, VersionID: versionID, Status: IngestQueued, MaxAttempts: defaultIngestAttempts, Token: token}
+	if err := db.Create(&job).Error; err != nil {
+		return nil, err
+	}
+	go dispatchIngest(db, job.ID)
+	return &job, nil
+}
+
+// dispatchIngest 把解析任务交给 ai_service，并核对其响应；失败时按剩余次数排队重试或判定失败
+func dispatchIngest(db *gorm.DB, jobID uint) {
+	var job IngestJob
+	if err := db.First(&job, jobID).Error; err != nil {
+		log.Printf("Ingest job %d not found: %v", jobID, err)
+		return
+	}
+	var tb Textbook
+	if err := db.First(&tb, job.TextbookID).Error; err != nil {
+		db.Model(&job).Updates(map[string]interface{}{"status": IngestFailed, "last_error": "教材已删除", "finished_at": time.Now()})
+		return
+	}
+	filePath := tb.FilePath
+	pending := tb.Status == "processing"
+	if job.VersionID != nil {
+		var v TextbookVersion
+		if err := db.First(&v, *job.VersionID).Error; err == nil {
+			filePath = v.FilePath
+			pending = v.Status == VersionProcessing
+		} else {
+			pending = false
+		}
+	}
+	if !pending {
+		// 排队期间教材（或新版本）已被取消，不再投递
+		db.Model(&IngestJob{}).Where("id = ? AND status = ?", job.ID, IngestQueued).
+			Updates(map[string]interface{}{"status": IngestCanceled, "finished_at": time.Now()})
+		return
+	}
+	now := time.Now()
+	started := map[string]interface{}{
+		"status":      IngestRunning,
+		"attempts":    gorm.Expr("attempts + 1"),
+		"progress_at": now,
+	}
+	if job.StartedAt == nil {
+		started["started_at"] = now
+	}
+	res := db.Model(&IngestJob{}).Where("id = ? AND status = ?", job.ID, IngestQueued).Updates(started)
+	if res.Error != nil || res.RowsAffected == 0 {
+		return // 已被其他实例领取或已取消
+	}
+	job.Attempts++
+
+	absPath, _ := filepath.Abs(filePath)
+	reqBody := &bytes.Buffer{}
+	writer := multipart.NewWriter(reqBody)
+	_ = writer.WriteField("file_path", absPath)
+	_ = writer.WriteField("textbook_name", tb.Name)
+	_ = writer.WriteField("textbook_id", fmt.Sprintf("%d", tb.ID))
+	_ = writer.WriteField("job_id", fmt.Sprintf("%d", job.ID))
+	_ = writer.WriteField("callback_url", callbackBaseURL()+"/api/internal/textbooks/ingest/callback")
+	_ = writer.WriteField("callback_token", job.Token)
+	if job.VersionID != nil {
+		_ = writer.WriteField("version_id", fmt.Sprintf("%d", *job.VersionID))
+	}
+	writer.Close()
+
+	req, _ := http.NewRequest("POST", aiclient.URL("/api/v1/textbook/ingest"), reqBody)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		ingestAttemptFailed(db, job, fmt.Sprintf("投递到 AI 服务失败: %v", err))
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= http.StatusBadRequest {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 2048))
+		ingestAttemptFailed(db, job, fmt.Sprintf("AI 服务拒绝解析任务（%d）: %s", resp.StatusCode, strings.TrimSpace(string(body))))
+	}
+}
+
+// ingestAttemptFailed 记录一次失败：还有次数时回到排队等待重试，否则解析记录与教材（或新版本）都标记为失败
+func ingestAttemptFailed(db *gorm.DB, job IngestJob, reason string) {
+	log.Printf("Textbook %d ingest attempt %d/%d failed: %s", job.TextbookID, job.Attempts, job.MaxAttempts, reason)
+	if job.Attempts < job.MaxAttempts {
+		db.Model(&IngestJob{}).Where("id = ?", job.ID).Updates(map[string]interface{}{"status": IngestQueued, "last_error": reason})
+		return
+	}
+	now := time.Now()
+	db.Model(&IngestJob{}).Where("id = ?", job.ID).Updates(map[string]interface{}{"status": IngestFailed, "last_error": reason, "finished_at": now})
+	if job.VersionID != nil {
+		db.Model(&TextbookVersion{}).Where("id = ? AND status = ?", *job.VersionID, VersionProcessing).
+			Updates(map[string]interface{}{"status": VersionFailed, "last_error": reason})
+		return
+	}
+	db.Model(&Textbook{}).Where("id = ? AND status = ?", job.TextbookID, "processing").Update("status", "failed")
+}
+
+// latestIngestJobs 每本教材最近一条解析记录（不含新版本的解析）
+func latestIngestJobs(db *gorm.DB, textbookIDs []uint) map[uint]*IngestJob {
+	out := map[uint]*IngestJob{}
+	if len(textbookIDs) == 0 {
+		return out
+	}
+	var jobs []IngestJob
+	db.Where("id IN (SELECT MAX(id) FROM ingest_jobs WHERE textbook_id IN ? AND version_id IS NULL GROUP BY textbook_id)", textbookIDs).Find(&jobs)
+	for i := range jobs {
+		out[jobs[i].TextbookID] = &jobs[i]
+	}
+	return out
+}
+
+// ingestCallback ai_service 上报的解析进度或结果
+type ingestCallback struct {
+	JobID          uint   `json:"job_id"`
+	Token          string `json:"token"`
+	Event          string `json:"event"` // progress / completed / failed / canceled
+	Stage          string `json:"stage"`
+	ProcessedPages *int   `json:"processed_pages"`
+	TotalPages     *int   `json:"total_pages"`
+	Error          string `json:"error"`
+}
+
+// IngestCallbackHandler ai_service 回调：更新教材页数进度与解析记录。凭解析记录的 token 鉴权，不走登录态。
+// 响应里带教材当前状态，ai_service 看到 canceled 时停止处理。
+func (h *TextbookHandler) IngestCallbackHandler(c *gin.Context) {
+	var req ingestCallback
+	if err := c.ShouldBindJSON(&req); err != nil || req.JobID == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "回调参数不合法"})
+		return
+	}
+	var job IngestJob
+	if err := h.DB.First(&job, req.JobID).Error; err != nil || subtle.ConstantTimeCompare([]byte(job.Token), []byte(req.Token)) != 1 {
+		c.JSON(http.StatusForbidden, gin.H{"error": "回调凭证无效"})
+		return
+	}
+	var tb Textbook
+	if err := h.DB.First(&tb, job.TextbookID).Error; err != nil {
+		c.JSON(http.StatusOK, gin.H{"status": "deleted"})
+		return
+	}
+	if job.Finished() {
+		c.JSON(http.StatusOK, gin.H{"status": tb.Status, "job_status": job.Status})
+		return
+	}
+	if tb.Status == StatusDeleting && req.Event != "canceled" {
+		// 教材删除中：不再记录进度与结果，让 ai_service 停下并清理
+		c.JSON(http.StatusOK, gin.H{"status": IngestCanceled})
+		return
+	}
+	if job.VersionID != nil {
+		h.versionIngestCallback(c, req, job, tb)
+		return
+	}
+
+	now := time.Now()
+	jobUpdates := map[string]interface{}{"progress_at": now}
+	if req.Stage != "" {
+		jobUpdates["stage"] = req.Stage
+	}
+	tbUpdates := map[string]interface{}{}
+	if req.ProcessedPages != nil {
+		tbUpdates["processed_pages"] = *req.ProcessedPages
+	}
+	if req.TotalPages != nil {
+		tbUpdates["total_pages"] = *req.TotalPages
+	}
+
+	if job.Status == IngestCanceling && req.Event != "progress" && req.Event != "canceled" {
+		// 取消途中解析恰好结束或失败：数据可能未清理，保持 canceling 由巡检重发取消
+		if req.Error != "" {
+			jobUpdates["last_error"] = req.Error
+		}
+		h.DB.Model(&job).Updates(jobUpdates)
+		c.JSON(http.StatusOK, gin.H{"status": tb.Status})
+		return
+	}
+
+	switch req.Event {
+	case "progress":
+	case "canceled":
+		jobUpdates["status"] = IngestCanceled
+		jobUpdates["finished_at"] = now
+		jobUpdates["stage"] = ""
+	case "completed":
+		jobUpdates["status"] = IngestSucceeded
+		jobUpdates["finished_at"] = now
+		if tb.Status == "processing" {
+			tbUpdates["status"] = "completed"
+		}
+	case "failed":
+		h.DB.Model(&job).Updates(jobUpdates)
+		job.ProgressAt = &now
+		ingestAttemptFailed(h.DB, job, req.Error)
+		h.DB.First(&tb, tb.ID)
+		c.JSON(http.StatusOK, gin.H{"status": tb.Status})
+		return
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "event 只能是 progress / completed / failed / canceled"})
+		return
+	}
+	if err := h.DB.Model(&job).Updates(jobUpdates).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "更新解析记录失败"})
+		return
+	}
+	if len(tbUpdates) > 0 {
+		if err := h.DB.Model(&tb).Updates(tbUpdates).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "更新教材进度失败"})
+			return
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"status": tb.Status})
+}
+
+// cancelIngest 通知 ai_service 取消教材解析并清理已写入的分块与题目，返回确认状态：
+// canceled 表示 ai_service 已停止并清理完毕；canceling 表示已发出信号（或暂时联系不上），等待回调确认或巡检重发。
+func cancelIngest(db *gorm.DB, tb Textbook) string {
+	return sendIngestCancel(db, tb, latestIngestJobs(db, []uint{tb.ID})[tb.ID])
+}
+
+// sendIngestCancel 取消指定的解析记录（可为空，此时只清理残留数据）；新版本的解析只清它自己的 staging 数据
+func sendIngestCancel(db *gorm.DB, tb Textbook, job *IngestJob) string {
+	now := time.Now()
+	if job != nil && !job.Finished() {
+		db.Model(job).Updates(map[string]interface{}{"status": IngestCanceling, "cancel_requested_at": now})
+	}
+
+	reqBody := &bytes.Buffer{}
+	writer := multipart.NewWriter(reqBody)
+	_ = writer.WriteField("textbook_id", fmt.Sprintf("%d", tb.ID))
+	_ = writer.WriteField("textbook_name", tb.Name)
+	if job != nil && job.VersionID != nil {
+		_ = writer.WriteField("version_id", fmt.Sprintf("%d", *job.VersionID))
+	}
+	writer.Close()
+
+	req, _ := http.NewRequest("POST", aiclient.URL("/api/v1/textbook/cancel"), reqBody)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		log.Printf("Failed to send cancel for textbook %d: %v", tb.ID, err)
+		return IngestCanceling
+	}
+	defer resp.Body.Close()
+	var ack struct {
+		Status string `json:"status"`
+	}
+	if resp.StatusCode >= http.StatusBadRequest || json.NewDecoder(resp.Body).Decode(&ack) != nil {
+		log.Printf("AI service rejected cancel for textbook %d (%d)", tb.ID, resp.StatusCode)
+		return IngestCanceling
+	}
+	if ack.Status == IngestCanceled && job != nil {
+		db.Model(&IngestJob{}).Where("id = ? AND status = ?", job.ID, IngestCanceling).
+			Updates(map[string]interface{}{"status": IngestCanceled, "finished_at": time.Now()})
+	}
+	return ack.Status
+}
+
+// RetryTextbook 老师手动重试解析失败或继续已取消的教材：新建一条解析记录，已识别的页会被 ai_service 复用
+func (h *TextbookHandler) RetryTextbook(c *gin.Context) {
+	var tb Textbook
+	if err := h.DB.First(&tb, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "找不到该教材"})
+		return
+	}
+	teacherID, _ := accesscontrol.CurrentUserID(c)
+	if tb.TeacherID != 0 && tb.TeacherID != teacherID {
+		c.JSON(http.StatusForbidden, gin.H{"error": "只能重试自己上传的教材"})
+		return
+	}
+	if tb.Status != "failed" && tb.Status != "canceled" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "只有解析失败或已取消的教材可以重试"})
+		return
+	}
+	if job := latestIngestJobs(h.DB, []uint{tb.ID})[tb.ID]; job != nil && job.Status == IngestCanceling {
+		c.JSON(http.StatusConflict, gin.H{"error": "上一次解析仍在停止中，请稍后再试"})
+		return
+	}
+	if err := h.DB.Model(&tb).Update("status", "processing").Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "重试失败"})
+		return
+	}
+	job, err := startIngest(h.DB, tb, nil)
+	if err != nil {
+		h.DB.Model(&tb).Update("status", "failed")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "创建解析任务失败"})
+		return
+	}
+	tb.Status = "processing"
+	tb.IngestJob = job
+	c.JSON(http.StatusOK, gin.H{"message": "已重新开始解析", "textbook": tb})
+}
+
+// StartIngestReconciler 启动时及之后每隔 interval 检查解析中的教材：排队等待重试的记录重新投递，
+// 长时间没有进度的记录按剩余次数重新投递或判定失败；没有解析记录的旧教材补建一条；
+// 取消迟迟没有确认的记录重发取消。
+func StartIngestReconciler(db *gorm.DB, interval time.Duration) {
+	go func() {
+		reconcileIngests(db)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			reconcileIngests(db)
+		}
+	}()
+}
+
+func reconcileIngests(db *gorm.DB) {
+	resendIngestCancels(db)
+
+	var textbooks []Textbook
+	if err := db.Where("status = ?", "processing").Find(&textbooks).Error; err != nil {
+		log.Printf("Textbook ingest reconcile scan failed: %v", err)
+		return
+	}
+	ids := make([]uint, 0, len(textbooks))
+	for _, tb := range textbooks {
+		ids = append(ids, tb.ID)
+	}
+	latest := latestIngestJobs(db, ids)
+	now := time.Now()
+	for _, tb := range textbooks {
+		job := latest[tb.ID]
+		switch {
+		case job == nil || job.Finished():
+			// 升级前上传、或记录已结束但教材仍停在 processing：等过了超时再补建
+			if now.Sub(tb.CreatedAt) < ingestStaleAfter {
+				continue
+			}
+			if _, err := startIngest(db, tb, nil); err != nil {
+				log.Printf("Failed to requeue ingest for textbook %d: %v", tb.ID, err)
+			}
+		default:
+			reconcileJob(db, *job, now)
+		}
+	}
+	reconcileVersionIngests(db, now)
+}
+
+// reconcileJob 排队等待重试的记录重新投递，运行中长时间没有进度的记录按一次失败处理
+func reconcileJob(db *gorm.DB, job IngestJob, now time.Time) {
+	switch job.Status {
+	case IngestQueued:
+		if job.Attempts == 0 || now.Sub(job.UpdatedAt) >= ingestRetryDelay {
+			go dispatchIngest(db, job.ID)
+		}
+	case IngestRunning:
+		last := job.UpdatedAt
+		if job.ProgressAt != nil {
+			last = *job.ProgressAt
+		}
+		if now.Sub(last) >= ingestStaleAfter {
+			ingestAttemptFailed(db, job, fmt.Sprintf("超过 %d 分钟没有收到解析进度", int(ingestStaleAfter.Minutes())))
+		}
+	}
+}
+
+// resendIngestCancels 取消发出后超过 ingestRetryDelay 仍未确认的，重新通知 ai_service；
+// ai_service 若已不在解析（进程重启或解析已结束）会直接清理并确认
+func resendIngestCancels(db *gorm.DB) {
+	var jobs []IngestJob
+	if err := db.Where("status = ? AND cancel_requested_at < ?", IngestCanceling, time.Now().Add(-ingestRetryDelay)).Find(&jobs).Error; err != nil {
+		log.Printf("Textbook ingest cancel scan failed: %v", err)
+		return
+	}
+	for i := range jobs {
+		var tb Textbook
+		if err := db.First(&tb, jobs[i].TextbookID).Error; err != nil {
+			db.Model(&IngestJob{}).Where("id = ?", jobs[i].ID).Updates(map[string]interface{}{"status": IngestCanceled, "finished_at": time.Now()})
+			continue
+		}
+		go sendIngestCancel(db, tb, &jobs[i])
+	}
+}
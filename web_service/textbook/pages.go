@@ -0,0 +1,91 @@
+// web_service/textbook/pages.go
+
+package textbook
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"time"
+	"workplace/web_service/accesscontrol"
+	"workplace/web_service/aiclient"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ServePageHandler 引用溯源：返回教材某一页的图片（format=png，默认）或单页 PDF（format=pdf）。
+// 学生只能查看本班可见的教材，老师只能查看自己可见的教材（见 visibleToTeacher），渲染由 ai_service 完成。
+func (h *TextbookHandler) ServePageHandler(c *gin.Context) {
+	page, err := strconv.Atoi(c.Param("page"))
+	if err != nil || page <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "页码不合法"})
+		return
+	}
+	format := c.DefaultQuery("format", "png")
+	if format != "png" && format != "pdf" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "format 只支持 png / pdf"})
+		return
+	}
+
+	var tb Textbook
+	if err := h.DB.First(&tb, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "找不到该教材"})
+		return
+	}
+	allowedIDs, restricted, _, err := accesscontrol.AllowedTextbookIDsForContext(h.DB, c)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "读取班级教材范围失败"})
+		return
+	}
+	if restricted && !containsID(allowedIDs, tb.ID) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "无权查看该教材"})
+		return
+	}
+	if tb.FilePath == "" || (tb.TotalPages > 0 && page > tb.TotalPages) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "该页不存在"})
+		return
+	}
+
+	absPath, _ := filepath.Abs(tb.FilePath)
+	reqBody := &bytes.Buffer{}
+	writer := multipart.NewWriter(reqBody)
+	_ = writer.WriteField("file_path", absPath)
+	_ = writer.WriteField("page_num", strconv.Itoa(page))
+	_ = writer.WriteField("format", format)
+	writer.Close()
+
+	req, _ := http.NewRequestWithContext(c.Request.Context(), "POST", aiclient.URL("/api/v1/textbook/page"), reqBody)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	client := &http.Client{Timeout: 60 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": "AI 服务不可用"})
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= http.StatusBadRequest {
+		c.JSON(http.StatusNotFound, gin.H{"error": "该页无法显示"})
+		return
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": "读取教材页面失败"})
+		return
+	}
+	c.Header("Cache-Control", "private, max-age=3600")
+	c.Header("Content-Disposition", fmt.Sprintf("inline; filename=\"textbook-%d-p%d.%s\"", tb.ID, page, format))
+	c.Data(http.StatusOK, resp.Header.Get("Content-Type"), data)
+}
+
+func containsID(ids []uint, id uint) bool {
+	for _, v := range ids {
+		if v == id {
+			return true
+		}
+	}
+	return false
+}
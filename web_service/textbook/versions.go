@@ -0,0 +1,466 @@
+// web_service/textbook/versions.go
+
+package textbook
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+	"workplace/web_service/accesscontrol"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const (
+	VersionProcessing = "processing"
+	VersionCompleted  = "completed"
+	VersionFailed     = "failed"
+	VersionCanceled   = "canceled"
+	VersionSuperseded = "superseded" // 曾经生效，已被更新的版本替换
+
+	// 题号相同时题干相似度达到该值即视为同一题；题号不同（或缺失）时要求更高
+	numberedStemMatch = 0.5
+	stemOnlyMatch     = 0.85
+)
+
+// TextbookVersion 教材的一次文件替换（勘误版、新版）。新文件解析进 ai_service 的 staging 表，
+// 完成后按题号与题干相似度把旧题映射到新题，并在一个事务里切换正文、题目及作业、收藏等引用。
+// 教材 ID 不变，班级可见范围无需调整；首次上传的文件是版本 1，不单独建记录。
+type TextbookVersion struct {
+	ID             uint   `gorm:"primarykey" json:"id"`
+	TextbookID     uint   `gorm:"index;not null" json:"textbook_id"`
+	Version        int    `gorm:"not null" json:"version"`
+	FilePath       string `gorm:"size:255" json:"file_path"`
+	Note           string `gorm:"size:500" json:"note,omitempty"` // 老师填写的更新说明
+	Status         string `gorm:"size:20;default:'processing';index" json:"status"`
+	TotalPages     int    `gorm:"default:0" json:"total_pages"`
+	ProcessedPages int    `gorm:"default:0" json:"processed_pages"`
+	UploadedBy     uint   `json:"uploaded_by"`
+	// 切换结果：映射到新题的旧题数；匹配不上但仍被作业、测验或收藏引用而保留下来的旧题数
+	MappedExercises   int        `gorm:"default:0" json:"mapped_exercises"`
+	RetainedExercises int        `gorm:"default:0" json:"retained_exercises"`
+	LastError         string     `gorm:"type:text" json:"last_error,omitempty"`
+	CreatedAt         time.Time  `json:"created_at"`
+	ActivatedAt       *time.Time `json:"activated_at,omitempty"`
+	IngestJob         *IngestJob `gorm:"-" json:"ingest_job,omitempty"`
+}
+
+// exerciseRefTables 以 exercise_id 引用 textbook_exercises.id 的表，切换版本时一起改指向
+var exerciseRefTables = []string{"assignment_exercises", "quiz_answers", "favorite_exercises", "chat_sessions", "integrity_events"}
+
+// pendingVersions 每本教材正在解析的新版本
+func pendingVersions(db *gorm.DB, textbookIDs []uint) map[uint]*TextbookVersion {
+	out := map[uint]*TextbookVersion{}
+	if len(textbookIDs) == 0 {
+		return out
+	}
+	var versions []TextbookVersion
+	db.Where("textbook_id IN ? AND status = ?", textbookIDs, VersionProcessing).Find(&versions)
+	for i := range versions {
+		out[versions[i].TextbookID] = &versions[i]
+	}
+	return out
+}
+
+// UploadTextbookVersion 老师为已有教材上传新版本文件，后台解析完成后自动切换
+func (h *TextbookHandler) UploadTextbookVersion(c *gin.Context) {
+	var tb Textbook
+	if err := h.DB.First(&tb, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "找不到该教材"})
+		return
+	}
+	teacherID, _ := accesscontrol.CurrentUserID(c)
+	if tb.TeacherID != 0 && tb.TeacherID != teacherID {
+		c.JSON(http.StatusForbidden, gin.H{"error": "只能更新自己上传的教材"})
+		return
+	}
+	if tb.Status == "processing" {
+		c.JSON(http.StatusConflict, gin.H{"error": "教材仍在解析中，完成后再上传新版本"})
+		return
+	}
+	if tb.Status == StatusDeleting {
+		c.JSON(http.StatusConflict, gin.H{"error": "该教材正在删除"})
+		return
+	}
+	var pending int64
+	h.DB.Model(&TextbookVersion{}).Where("textbook_id = ? AND status = ?", tb.ID, VersionProcessing).Count(&pending)
+	if pending > 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "已有新版本正在解析"})
+		return
+	}
+
+	filePath, ok := saveUploadedTextbook(c)
+	if !ok {
+		return
+	}
+	var latest int
+	h.DB.Model(&TextbookVersion{}).Where("textbook_id = ?", tb.ID).Select("COALESCE(MAX(version), 0)").Scan(&latest)
+	if latest < tb.CurrentVersion {
+		latest = tb.CurrentVersion
+	}
+	v := TextbookVersion{
+		TextbookID: tb.ID,
+		Version:    latest + 1,
+		FilePath:   filePath,
+		Note:       strings.TrimSpace(c.PostForm("note")),
+		Status:     VersionProcessing,
+		UploadedBy: teacherID,
+	}
+	if err := h.DB.Create(&v).Error; err != nil {
+		_ = os.Remove(filePath)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "创建版本记录失败"})
+		return
+	}
+	job, err := startIngest(h.DB, tb, &v.ID)
+	if err != nil {
+		h.DB.Model(&v).Update("status", VersionFailed)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "创建解析任务失败"})
+		return
+	}
+	v.IngestJob = job
+	c.JSON(http.StatusOK, gin.H{
+		"message": fmt.Sprintf("第 %d 版已上传，解析完成前学生仍使用当前版本", v.Version),
+		"version": v,
+	})
+}
+
+// ListTextbookVersions 教材的版本历史，附每个版本最近一次解析记录
+func (h *TextbookHandler) ListTextbookVersions(c *gin.Context) {
+	teacherID, _ := accesscontrol.CurrentUserID(c)
+	var tb Textbook
+	if err := visibleToTeacher(h.DB, teacherID).First(&tb, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "找不到该教材"})
+		return
+	}
+	var versions []TextbookVersion
+	if err := h.DB.Where("textbook_id = ?", tb.ID).Order("version desc").Find(&versions).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "读取版本记录失败"})
+		return
+	}
+	if len(versions) > 0 {
+		ids := make([]uint, 0, len(versions))
+		for _, v := range versions {
+			ids = append(ids, v.ID)
+		}
+		var jobs []IngestJob
+		h.DB.Where("id IN (SELECT MAX(id) FROM ingest_jobs WHERE version_id IN ? GROUP BY version_id)", ids).Find(&jobs)
+		byVersion := map[uint]*IngestJob{}
+		for i := range jobs {
+			byVersion[*jobs[i].VersionID] = &jobs[i]
+		}
+		for i := range versions {
+			versions[i].IngestJob = byVersion[versions[i].ID]
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"current_version": tb.CurrentVersion, "versions": versions})
+}
+
+// versionIngestCallback 新版本解析的回调：进度记在版本上，完成时切换为当前版本
+func (h *TextbookHandler) versionIngestCallback(c *gin.Context, req ingestCallback, job IngestJob, tb Textbook) {
+	var v TextbookVersion
+	if err := h.DB.First(&v, *job.VersionID).Error; err != nil {
+		c.JSON(http.StatusOK, gin.H{"status": "deleted"})
+		return
+	}
+	now := time.Now()
+	jobUpdates := map[string]interface{}{"progress_at": now}
+	if req.Stage != "" {
+		jobUpdates["stage"] = req.Stage
+	}
+	vUpdates := map[string]interface{}{}
+	if req.ProcessedPages != nil {
+		vUpdates["processed_pages"] = *req.ProcessedPages
+	}
+	if req.TotalPages != nil {
+		vUpdates["total_pages"] = *req.TotalPages
+	}
+
+	switch req.Event {
+	case "progress":
+	case "canceled":
+		jobUpdates["status"] = IngestCanceled
+		jobUpdates["finished_at"] = now
+		if v.Status == VersionProcessing {
+			vUpdates["status"] = VersionCanceled
+		}
+	case "completed":
+		if len(vUpdates) > 0 {
+			h.DB.Model(&v).Updates(vUpdates)
+			vUpdates = map[string]interface{}{}
+		}
+		if err := activateVersion(h.DB, tb, v.ID); err != nil {
+			// 切换失败时旧版本原样保留；按一次失败处理，重试会重新解析到 staging
+			log.Printf("Failed to activate textbook %d version %d: %v", tb.ID, v.Version, err)
+			h.DB.Model(&job).Updates(jobUpdates)
+			ingestAttemptFailed(h.DB, job, "切换到新版本失败: "+err.Error())
+			h.DB.First(&v, v.ID)
+			c.JSON(http.StatusOK, gin.H{"status": v.Status})
+			return
+		}
+		jobUpdates["status"] = IngestSucceeded
+		jobUpdates["finished_at"] = now
+	case "failed":
+		h.DB.Model(&job).Updates(jobUpdates)
+		ingestAttemptFailed(h.DB, job, req.Error)
+		h.DB.First(&v, v.ID)
+		c.JSON(http.StatusOK, gin.H{"status": v.Status})
+		return
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "event 只能是 progress / completed / failed / canceled"})
+		return
+	}
+	if err := h.DB.Model(&job).Updates(jobUpdates).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "更新解析记录失败"})
+		return
+	}
+	if len(vUpdates) > 0 {
+		if err := h.DB.Model(&v).Updates(vUpdates).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "更新版本进度失败"})
+			return
+		}
+	}
+	h.DB.First(&v, v.ID)
+	c.JSON(http.StatusOK, gin.H{"status": v.Status})
+}
+
+// versionExercise 版本切换时用于匹配的题目字段
+type versionExercise struct {
+	ID             uint
+	ExerciseNumber string
+	Stem           string
+}
+
+// activateVersion 把 staging 里解析好的新版本切换为教材当前版本：旧题按题号与题干映射到新题，
+// 作业、测验作答、收藏、讲解会话的引用改指新题；匹配不上但仍被引用的旧题保留，其余旧数据删除。
+// 全部在一个事务里完成，失败时旧版本不受影响。
+func activateVersion(db *gorm.DB, tb Textbook, versionID uint) error {
+	oldFilePath := tb.FilePath
+	var newFilePath string
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var v TextbookVersion
+		if err := tx.First(&v, versionID).Error; err != nil {
+			return err
+		}
+		if v.Status != VersionProcessing {
+			return fmt.Errorf("version status is %s", v.Status)
+		}
+		var oldEx, newEx []versionExercise
+		if err := tx.Table("textbook_exercises").Select("id, exercise_number, stem").
+			Where("textbook_id = ?", tb.ID).Scan(&oldEx).Error; err != nil {
+			return err
+		}
+		if err := tx.Table("textbook_exercises_staging").Select("id, exercise_number, stem").
+			Where("version_id = ?", v.ID).Scan(&newEx).Error; err != nil {
+			return err
+		}
+		mapping := matchExercises(oldEx, newEx)
+
+		if len(mapping) > 0 {
+			values, args := mappingValues(mapping)
+			// 新版本没抽出答案时沿用老师在旧题上补录的答案与解析
+			if err := tx.Exec(`UPDATE textbook_exercises_staging s
+				SET answer = o.answer, solution = o.solution, has_answer = o.has_answer
+				FROM textbook_exercises o, (VALUES `+values+`) AS m(old_id, new_id)
+				WHERE s.id = m.new_id AND o.id = m.old_id AND o.has_answer
+				  AND COALESCE(s.answer, '') = '' AND COALESCE(s.solution, '') = ''`, args...).Error; err != nil {
+				return err
+			}
+			for _, table := range exerciseRefTables {
+				if err := tx.Exec(`UPDATE `+table+` t SET exercise_id = m.new_id
+					FROM (VALUES `+values+`) AS m(old_id, new_id)
+					WHERE t.exercise_id = m.old_id`, args...).Error; err != nil {
+					return err
+				}
+			}
+		}
+
+		res := tx.Exec(`DELETE FROM textbook_exercises e WHERE e.textbook_id = ?
+			AND NOT EXISTS (SELECT 1 FROM assignment_exercises r WHERE r.exercise_id = e.id)
+			AND NOT EXISTS (SELECT 1 FROM quiz_answers r WHERE r.exercise_id = e.id)
+			AND NOT EXISTS (SELECT 1 FROM favorite_exercises r WHERE r.exercise_id = e.id)`, tb.ID)
+		if res.Error != nil {
+			return res.Error
+		}
+		retained := len(oldEx) - int(res.RowsAffected)
+
+		// staging 与正式表共用 id 序列，题目 id 原样保留，映射结果直接可用
+		if err := tx.Exec(`INSERT INTO textbook_exercises
+				(id, textbook_id, textbook_name, page_num, exercise_number, stem, answer, solution, concepts,
+				 concept_tags, exercise_type, question_type, has_answer, source_excerpt, embedding, created_at)
+			SELECT id, ?, ?, page_num, exercise_number, stem, answer, solution, concepts,
+				 concept_tags, exercise_type, question_type, has_answer, source_excerpt, embedding, created_at
+			FROM textbook_exercises_staging WHERE version_id = ?`, tb.ID, tb.Name, v.ID).Error; err != nil {
+			return err
+		}
+		if err := tx.Exec(`DELETE FROM textbook_chunks WHERE textbook_id = ?`, tb.ID).Error; err != nil {
+			return err
+		}
+		if err := tx.Exec(`INSERT INTO textbook_chunks (textbook_id, textbook_name, content, embedding, week_num, created_at)
+			SELECT ?, ?, content, embedding, week_num, created_at
+			FROM textbook_chunks_staging WHERE version_id = ?`, tb.ID, tb.Name, v.ID).Error; err != nil {
+			return err
+		}
+		if err := tx.Exec(`DELETE FROM textbook_exercises_staging WHERE version_id = ?`, v.ID).Error; err != nil {
+			return err
+		}
+		if err := tx.Exec(`DELETE FROM textbook_chunks_staging WHERE version_id = ?`, v.ID).Error; err != nil {
+			return err
+		}
+
+		now := time.Now()
+		if err := tx.Model(&TextbookVersion{}).Where("textbook_id = ? AND status = ?", tb.ID, VersionCompleted).
+			Update("status", VersionSuperseded).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(&v).Updates(map[string]interface{}{
+			"status":             VersionCompleted,
+			"activated_at":       now,
+			"mapped_exercises":   len(mapping),
+			"retained_exercises": retained,
+			"processed_pages":    v.TotalPages,
+		}).Error; err != nil {
+			return err
+		}
+		newFilePath = v.FilePath
+		return tx.Model(&Textbook{}).Where("id = ?", tb.ID).Updates(map[string]interface{}{
+			"file_path":       v.FilePath,
+			"total_pages":     v.TotalPages,
+			"processed_pages": v.TotalPages,
+			"current_version": v.Version,
+			"status":          "completed",
+		}).Error
+	})
+	if err != nil {
+		return err
+	}
+	if oldFilePath != "" && oldFilePath != newFilePath {
+		_ = os.Remove(oldFilePath)
+	}
+	return nil
+}
+
+// mappingValues 把旧题→新题映射拼成 VALUES (?, ?), ... 及对应参数
+func mappingValues(mapping map[uint]uint) (string, []interface{}) {
+	rows := make([]string, 0, len(mapping))
+	args := make([]interface{}, 0, 2*len(mapping))
+	for oldID, newID := range mapping {
+		rows = append(rows, "(?::bigint, ?::bigint)")
+		args = append(args, oldID, newID)
+	}
+	return strings.Join(rows, ", "), args
+}
+
+// matchExercises 旧题 → 新题的一对一映射：题号相同且题干相似度 ≥ numberedStemMatch，
+// 或题干相似度 ≥ stemOnlyMatch；按得分从高到低贪心分配，题号相同的优先。
+func matchExercises(oldEx, newEx []versionExercise) map[uint]uint {
+	type candidate struct {
+		oldID, newID uint
+		score        float64
+	}
+	newGrams := make([]map[string]int, len(newEx))
+	for i, n := range newEx {
+		newGrams[i] = stemBigrams(n.Stem)
+	}
+	var candidates []candidate
+	for _, o := range oldEx {
+		og := stemBigrams(o.Stem)
+		number := strings.TrimSpace(o.ExerciseNumber)
+		for i, n := range newEx {
+			sim := diceSimilarity(og, newGrams[i])
+			switch {
+			case number != "" && number == strings.TrimSpace(n.ExerciseNumber) && sim >= numberedStemMatch:
+				candidates = append(candidates, candidate{o.ID, n.ID, 1 + sim})
+			case sim >= stemOnlyMatch:
+				candidates = append(candidates, candidate{o.ID, n.ID, sim})
+			}
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].score > candidates[j].score })
+	mapping := map[uint]uint{}
+	usedNew := map[uint]bool{}
+	for _, cand := range candidates {
+		if _, ok := mapping[cand.oldID]; ok || usedNew[cand.newID] {
+			continue
+		}
+		mapping[cand.oldID] = cand.newID
+		usedNew[cand.newID] = true
+	}
+	return mapping
+}
+
+// stemBigrams 题干去掉空白与标点后的相邻字符对计数（OCR 两次结果的空格、标点常有出入）
+func stemBigrams(stem string) map[string]int {
+	runes := make([]rune, 0, len(stem))
+	for _, r := range stem {
+		if unicode.IsSpace(r) || unicode.IsPunct(r) {
+			continue
+		}
+		runes = append(runes, unicode.ToLower(r))
+	}
+	grams := map[string]int{}
+	for i := 0; i+1 < len(runes); i++ {
+		grams[string(runes[i:i+2])]++
+	}
+	return grams
+}
+
+// diceSimilarity 两组字符对的 Dice 系数，0~1
+func diceSimilarity(a, b map[string]int) float64 {
+	total := 0
+	for _, n := range a {
+		total += n
+	}
+	for _, n := range b {
+		total += n
+	}
+	if total == 0 {
+		return 0
+	}
+	if len(a) > len(b) {
+		a, b = b, a
+	}
+	shared := 0
+	for g, n := range a {
+		if m := b[g]; m > 0 {
+			if m < n {
+				n = m
+			}
+			shared += n
+		}
+	}
+	return 2 * float64(shared) / float64(total)
+}
+
+// reconcileVersionIngests 与教材解析相同的巡检，作用于正在解析的新版本
+func reconcileVersionIngests(db *gorm.DB, now time.Time) {
+	var versions []TextbookVersion
+	if err := db.Where("status = ?", VersionProcessing).Find(&versions).Error; err != nil {
+		log.Printf("Textbook version reconcile scan failed: %v", err)
+		return
+	}
+	for _, v := range versions {
+		var job IngestJob
+		err := db.Where("version_id = ?", v.ID).Order("id desc").First(&job).Error
+		if err == nil && !job.Finished() {
+			reconcileJob(db, job, now)
+			continue
+		}
+		if now.Sub(v.CreatedAt) < ingestStaleAfter {
+			continue
+		}
+		var tb Textbook
+		if err := db.First(&tb, v.TextbookID).Error; err != nil {
+			db.Model(&v).Update("status", VersionFailed)
+			continue
+		}
+		if _, err := startIngest(db, tb, &v.ID); err != nil {
+			log.Printf("Failed to requeue ingest for textbook %d version %d: %v", tb.ID, v.Version, err)
+		}
+	}
+}
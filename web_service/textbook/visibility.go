@@ -0,0 +1,220 @@
+// web_service/textbook/visibility.go
+
+package textbook
+
+import (
+	"net/http"
+	"strings"
+	"time"
+	"workplace/web_service/accesscontrol"
+	"workplace/web_service/auth"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	VisibilityPrivate     = "private"     // 仅上传者
+	VisibilityShared      = "shared"      // 上传者 + 被授权的老师
+	VisibilityInstitution = "institution" // 全校老师
+)
+
+// TextbookShare 教材授权给某位老师查看并加入其班级（visibility = shared 时生效）
+type TextbookShare struct {
+	ID         uint      `gorm:"primarykey" json:"id"`
+	TextbookID uint      `gorm:"not null;uniqueIndex:idx_textbook_share" json:"textbook_id"`
+	TeacherID  uint      `gorm:"not null;uniqueIndex:idx_textbook_share;index" json:"teacher_id"`
+	GrantedBy  uint      `json:"granted_by"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// TextbookShareItem 授权列表的一行（带老师的用户名与显示名）
+type TextbookShareItem struct {
+	TeacherID   uint      `json:"teacher_id"`
+	Username    string    `json:"username"`
+	DisplayName string    `json:"displayName"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+func validVisibility(v string) bool {
+	return v == VisibilityPrivate || v == VisibilityShared || v == VisibilityInstitution
+}
+
+// visibleToTeacher 限定为该老师能看到的教材：自己上传的、全校可见的、授权给他的，以及没有归属的旧数据
+func visibleToTeacher(db *gorm.DB, teacherID uint) *gorm.DB {
+	return accesscontrol.TeacherVisibleTextbooks(db, teacherID)
+}
+
+// ownsTextbook 上传者（没有归属的旧教材任何老师都可管理）
+func ownsTextbook(tb Textbook, teacherID uint) bool {
+	return tb.TeacherID == 0 || tb.TeacherID == teacherID
+}
+
+// loadOwnedTextbook 读取 :id 教材并校验当前老师是上传者；失败时已写好错误响应
+func (h *TextbookHandler) loadOwnedTextbook(c *gin.Context) (Textbook, uint, bool) {
+	var tb Textbook
+	if err := h.DB.First(&tb, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "找不到该教材"})
+		return tb, 0, false
+	}
+	teacherID, _ := accesscontrol.CurrentUserID(c)
+	if !ownsTextbook(tb, teacherID) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "只有教材上传者可以修改共享设置"})
+		return tb, 0, false
+	}
+	return tb, teacherID, true
+}
+
+// findTeacher 按用户名或学工号找老师
+func (h *TextbookHandler) findTeacher(name string) (auth.User, bool) {
+	var user auth.User
+	name = strings.TrimSpace(name)
+	if name == "" || h.DB.Where("(username = ? OR user_id_no = ?) AND role = ?", name, name, "teacher").First(&user).Error != nil {
+		return user, false
+	}
+	return user, true
+}
+
+// SetVisibilityHandler 上传者修改教材可见范围：private / shared / institution
+func (h *TextbookHandler) SetVisibilityHandler(c *gin.Context) {
+	tb, _, ok := h.loadOwnedTextbook(c)
+	if !ok {
+		return
+	}
+	var req struct {
+		Visibility string `json:"visibility"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || !validVisibility(req.Visibility) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "visibility 只能是 private / shared / institution"})
+		return
+	}
+	if err := h.DB.Model(&tb).Update("visibility", req.Visibility).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "更新可见范围失败"})
+		return
+	}
+	tb.Visibility = req.Visibility
+	c.JSON(http.StatusOK, gin.H{"message": "可见范围已更新", "textbook": tb})
+}
+
+// ListSharesHandler 上传者查看教材授权给了哪些老师
+func (h *TextbookHandler) ListSharesHandler(c *gin.Context) {
+	tb, _, ok := h.loadOwnedTextbook(c)
+	if !ok {
+		return
+	}
+	items := []TextbookShareItem{}
+	if err := h.DB.Table("textbook_shares s").
+		Select("s.teacher_id, u.username, u.display_name, s.created_at").
+		Joins("JOIN users u ON u.id = s.teacher_id").
+		Where("s.textbook_id = ?", tb.ID).
+		Order("s.created_at asc").
+		Scan(&items).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "读取授权列表失败"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"visibility": tb.Visibility, "shares": items})
+}
+
+// AddShareHandler 上传者把教材授权给某位老师（用户名或学工号）；教材为 private 时一并改为 shared
+func (h *TextbookHandler) AddShareHandler(c *gin.Context) {
+	tb, teacherID, ok := h.loadOwnedTextbook(c)
+	if !ok {
+		return
+	}
+	var req struct {
+		Username string `json:"username"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "请求体格式错误"})
+		return
+	}
+	target, found := h.findTeacher(req.Username)
+	if !found {
+		c.JSON(http.StatusNotFound, gin.H{"error": "找不到该老师"})
+		return
+	}
+	if target.ID == tb.TeacherID {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "不能授权给上传者本人"})
+		return
+	}
+	err := h.DB.Transaction(func(tx *gorm.DB) error {
+		share := TextbookShare{TextbookID: tb.ID, TeacherID: target.ID, GrantedBy: teacherID}
+		if err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&share).Error; err != nil {
+			return err
+		}
+		if tb.Visibility == VisibilityPrivate {
+			tb.Visibility = VisibilityShared
+			return tx.Model(&tb).Update("visibility", VisibilityShared).Error
+		}
+		return nil
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "授权失败"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "已授权", "visibility": tb.Visibility})
+}
+
+// RemoveShareHandler 上传者收回某位老师的授权；该老师班级里已加入的这本教材保留，直到他自己移除
+func (h *TextbookHandler) RemoveShareHandler(c *gin.Context) {
+	tb, _, ok := h.loadOwnedTextbook(c)
+	if !ok {
+		return
+	}
+	if err := h.DB.Where("textbook_id = ? AND teacher_id = ?", tb.ID, c.Param("teacherId")).Delete(&TextbookShare{}).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "收回授权失败"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "已收回授权"})
+}
+
+// TransferOwnershipHandler 上传者把教材转给另一位老师。keep_access 默认为 true：
+// 原上传者保留授权（private 的教材随之改为 shared）。
+func (h *TextbookHandler) TransferOwnershipHandler(c *gin.Context) {
+	tb, teacherID, ok := h.loadOwnedTextbook(c)
+	if !ok {
+		return
+	}
+	var req struct {
+		Username   string `json:"username"`
+		KeepAccess *bool  `json:"keep_access"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "请求体格式错误"})
+		return
+	}
+	target, found := h.findTeacher(req.Username)
+	if !found {
+		c.JSON(http.StatusNotFound, gin.H{"error": "找不到该老师"})
+		return
+	}
+	if target.ID == tb.TeacherID {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "该老师已是教材上传者"})
+		return
+	}
+	keepAccess := req.KeepAccess == nil || *req.KeepAccess
+	err := h.DB.Transaction(func(tx *gorm.DB) error {
+		updates := map[string]interface{}{"teacher_id": target.ID}
+		// 新上传者不需要单独授权
+		if err := tx.Where("textbook_id = ? AND teacher_id = ?", tb.ID, target.ID).Delete(&TextbookShare{}).Error; err != nil {
+			return err
+		}
+		if keepAccess && tb.TeacherID != 0 {
+			share := TextbookShare{TextbookID: tb.ID, TeacherID: tb.TeacherID, GrantedBy: teacherID}
+			if err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&share).Error; err != nil {
+				return err
+			}
+			if tb.Visibility == VisibilityPrivate {
+				updates["visibility"] = VisibilityShared
+			}
+		}
+		return tx.Model(&tb).Updates(updates).Error
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "转让失败"})
+		return
+	}
+	h.DB.First(&tb, tb.ID)
+	c.JSON(http.StatusOK, gin.H{"message": "已转让给 " + target.Username, "textbook": tb})
+}